@@ -1,46 +1,843 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"math"
+	"net/http"
+	_ "net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"nfiacco/loadtester/internal/agent"
+	"nfiacco/loadtester/internal/encrypt"
+	"nfiacco/loadtester/internal/openapi"
+	"nfiacco/loadtester/internal/process"
 	"nfiacco/loadtester/internal/runner"
+	"nfiacco/loadtester/internal/server"
+	"nfiacco/loadtester/internal/term"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "server":
+			runServer(os.Args[2:])
+			return
+		case "keygen":
+			runKeygen(os.Args[2:])
+			return
+		case "decrypt":
+			runDecrypt(os.Args[2:])
+			return
+		case "agent":
+			runAgent(os.Args[2:])
+			return
+		case "find-max":
+			runFindMax(os.Args[2:])
+			return
+		case "schema":
+			runSchema(os.Args[2:])
+			return
+		}
+	}
+
 	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
 
 	opts := runner.LoadTestArgs{}
 
 	version := fs.Bool("version", false, "Print version and exit")
+	configFile := fs.String("config", "", "File of \"flag = value\" lines for flags not given on the command line. Reloaded on SIGHUP, applying changes to -qps, -header and -targets")
 	fs.DurationVar(&opts.Duration, "duration", 0, "Duration of the test [0 = forever]")
-	fs.Uint64Var(&opts.Qps, "qps", 100, "Queries per second")
+	fs.DurationVar(&opts.StopAfterIdle, "stop_after_idle", 0, "Stop the test if no results arrive for this long, e.g. because the target is dead [0 = never]")
+	fs.Uint64Var(&opts.MaxRequests, "max_requests", 0, "Stop after sending this many requests [0 = no limit]")
+	fs.Uint64Var(&opts.MaxErrors, "max_errors", 0, "Stop the test after this many failed requests [0 = no limit]")
+	fs.DurationVar(&opts.WaitForTarget, "wait_for_target", 0, "Poll the target until it responds with a status below 500 before starting, for up to this long [0 = don't wait]")
+	fs.Float64Var(&opts.Qps, "qps", 100, "Queries per second")
+	fs.Func("rate", "Request rate, optionally per unit, e.g. \"0.5\", \"30/m\" or \"2/h\". Sets -qps", func(s string) error {
+		v, err := runner.ParseRate(s)
+		opts.Qps = v
+		return err
+	})
+	rateShape := fs.String("rate_shape", "", "CSV file of \"timestamp,rps\" lines, e.g. exported from production monitoring, whose rate shape to replay instead of -qps, over -duration if given")
+	fs.Float64Var(&opts.RateScale, "rate_scale", 1, "Factor to scale the rates of -rate_shape by")
+	rateSchedule := fs.String("rate_schedule", "", "Rates for windows of the time of day, e.g. \"06:00-09:00 -> 2000qps, 09:00-18:00 -> 5000qps\", with -qps outside them")
 	fs.Uint64Var(&opts.Workers, "workers", 100, "Number of initial workers")
 	fs.Uint64Var(&opts.MaxWorkers, "max_workers", 100, "Max number of workers")
+	fs.Uint64Var(&opts.VUs, "vus", 0, "Number of virtual users to run instead of pacing by QPS [0 = use QPS]")
+	fs.Uint64Var(&opts.Iterations, "iterations", 0, "Requests per virtual user [0 = until the duration ends]")
+	fs.DurationVar(&opts.ConnectRamp, "connect_ramp", 0, "Period over which to gradually start workers and their connections")
+	fs.BoolVar(&opts.NewConnections, "new_connections", false, "Establish a new TCP (and TLS) connection for every request instead of reusing them")
+	fs.Uint64Var(&opts.PacerShards, "pacer_shards", 1, "Split the rate between this many independent schedulers, each with its share of the workers, for rates a single one can't keep up with")
+	fs.BoolVar(&opts.PinPacers, "pin_pacers", false, "Lock each scheduler of -pacer_shards to its own OS thread")
+	fs.Func("client_delay", "Delay before sending each request to simulate a distant client, with an optional uniform jitter, e.g. \"20ms±5ms\" or \"20ms+-5ms\"", func(s string) error {
+		d, j, err := runner.ParseDelay(s)
+		opts.ClientDelay, opts.ClientDelayJitter = d, j
+		return err
+	})
+	fs.Func("dns_strategy", "Strategy of picking which of the addresses a host resolves to to send each request to: round-robin, random, first or weighted, for all hosts or one, e.g. \"api.com=first\". Can be repeated", func(s string) error {
+		host, strategy, err := runner.ParseDNSStrategy(s)
+		if opts.DNSStrategies == nil {
+			opts.DNSStrategies = map[string]string{}
+		}
+		opts.DNSStrategies[host] = strategy
+		return err
+	})
+	fs.Func("dns_weight", "Weight of an address for -dns_strategy weighted, in \"address=weight\" form, e.g. \"10.0.0.1=3\" (default 1). Can be repeated", func(s string) error {
+		addr, weight, err := runner.ParseDNSWeight(s)
+		if opts.DNSWeights == nil {
+			opts.DNSWeights = map[string]float64{}
+		}
+		opts.DNSWeights[addr] = weight
+		return err
+	})
+	fs.Float64Var(&opts.PerHostQps, "per_host_qps", 0, "Most requests per second to send to each address the target's host resolves to, spreading requests across them [0 = no limit]")
+	fs.Uint64Var(&opts.Preconnect, "preconnect", 0, "Keep-alive connections to establish to each target before the test starts")
 	fs.BoolVar(&opts.AutoScale, "autoscale", true, "Whether to automatically scale the number of workers")
 	fs.Uint64Var(&opts.Timeout, "timeout", 30, "Timeout to wait for each request in seconds")
+	fs.Uint64Var(&opts.Retries, "retries", 0, "Most times to retry a request that failed with one of -retry_on")
+	opts.RetryOn, _ = runner.ParseRetryOn("error,502,503,504")
+	fs.Func("retry_on", "Comma separated status codes to retry, and \"error\" for requests that got no response, each with an optional weight against -retry_budget, e.g. \"error,503,429=2\" (default \"error,502,503,504\")", func(s string) error {
+		on, err := runner.ParseRetryOn(s)
+		opts.RetryOn = on
+		return err
+	})
+	fs.Func("retry_budget", "Weighted retries allowed as a percentage of the requests, e.g. \"10%\" [empty = unlimited]", func(s string) error {
+		v, err := runner.ParsePercent(s)
+		opts.RetryBudget = v
+		return err
+	})
+	fs.DurationVar(&opts.RetryBackoff, "retry_backoff", 0, "Wait before the first retry of a request, doubled for each next retry")
+	fs.BoolVar(&opts.IdempotencyKey, "idempotency_key", false, "Send a random Idempotency-Key header with each POST, PUT, PATCH or DELETE request, the same for all its retries")
+	fs.StringVar(&opts.RunID, "run_id", "", "ID of the test sent with every request in -run_id_header, to tell its traffic apart in the target's logs [empty = a random UUID]")
+	fs.StringVar(&opts.RunIDHeader, "run_id_header", runner.DefaultRunIDHeader, "Header to send the run ID in [empty = don't send it]")
+	fs.Int64Var(&opts.Seed, "seed", 0, "Seed of the random values, e.g. of placeholders, picks and sampling, to repeat them in another test [0 = a random one]")
 	fs.StringVar(&opts.Method, "method", "GET", "HTTP method to use")
-	fs.StringVar(&opts.OutputFile, "output_file", "stdout", "Output file to write results to. Defaults to \"stdout\"")
+	fs.StringVar(&opts.Mode, "mode", runner.ModeHTTP, "What to do for each request: \"http\" sends a request, \"connect\" only establishes a TCP (and TLS) connection, \"sse\" holds a Server-Sent Events stream, \"longpoll\" sends long polls back to back")
+	fs.BoolVar(&opts.TLSResume, "tls_resume", false, "Resume TLS sessions across connections with session tickets")
+	tlsCert := fs.String("tls_cert", "", "PEM client certificate file for mutual TLS, with -tls_key")
+	tlsKey := fs.String("tls_key", "", "PEM private key file of -tls_cert")
+	tlsKeyLog := fs.String("tls_keylog", "", "File to append TLS secrets to in the SSLKEYLOGFILE format, to decrypt packet captures of the test e.g. in Wireshark")
+	tlsCA := fs.String("tls_ca", "", "PEM file of CA certificates to verify the target's certificate with, instead of the system roots")
+	fs.BoolVar(&opts.TCPInfo, "tcp_info", false, "Report the kernel's TCP statistics of the connections, such as RTT and retransmits (Linux only)")
+	fs.Func("tls_min_version", "Minimum TLS version to negotiate: 1.0, 1.1, 1.2 or 1.3", func(s string) error {
+		v, err := runner.ParseTLSVersion(s)
+		opts.TLSMinVersion = v
+		return err
+	})
+	fs.Func("tls_max_version", "Maximum TLS version to negotiate: 1.0, 1.1, 1.2 or 1.3", func(s string) error {
+		v, err := runner.ParseTLSVersion(s)
+		opts.TLSMaxVersion = v
+		return err
+	})
+	fs.Func("tls_ciphers", "Comma separated cipher suites to offer for TLS 1.2 and below, e.g. \"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256\"", func(s string) error {
+		c, err := runner.ParseCipherSuites(s)
+		opts.TLSCiphers = c
+		return err
+	})
+	fs.Func("group", "Target group with its own rate in \"name=read,qps=5000,workers=50,target=https://...\" form. Can be repeated", func(s string) error {
+		g, err := runner.ParseTargetGroup(s)
+		opts.Groups = append(opts.Groups, g)
+		return err
+	})
+	fs.StringVar(&opts.TargetsFile, "targets", "", "File of weighted targets to send requests to instead of the target argument, reloaded when it changes")
+	openapiSpec := fs.String("openapi", "", "OpenAPI 3 spec (JSON) to generate requests from, sent to the target as the base URL")
+	operation := fs.String("operation", "", "operationId of the -openapi operation to send requests for [empty = all operations]")
+	fs.Func("eject_error_rate", "Stop sending requests to a target of -targets while its error rate is above this percentage, e.g. \"50%\", redistributing its weight", func(s string) error {
+		v, err := runner.ParsePercent(s)
+		opts.EjectErrorRate = v
+		return err
+	})
+	fs.DurationVar(&opts.EjectDuration, "eject_duration", 10*time.Second, "How long to stop sending requests to a target ejected by -eject_error_rate")
+	fs.Func("shadow_target", "Base URL to mirror every request to, e.g. a new backend, reported separately in the summary", func(s string) error {
+		_, err := runner.ParseShadowTarget(s)
+		opts.ShadowTarget = s
+		return err
+	})
+	fs.StringVar(&opts.Tag, "tag", "", "Tag recorded with each result to identify the workload")
+	fs.Func("header", "Header to send in \"Name: value\" form. Can be repeated", func(s string) error {
+		h, err := runner.ParseHeader(s)
+		opts.Headers = append(opts.Headers, h)
+		return err
+	})
+	fs.Func("header_cmd", "Header whose value is the output of a command, in \"Name: command\" form. Can be repeated", func(s string) error {
+		h, err := runner.ParseHeaderCommand(s)
+		opts.HeaderCommands = append(opts.HeaderCommands, h)
+		return err
+	})
+	fs.DurationVar(&opts.HeaderCommandInterval, "header_cmd_interval", time.Minute, "How often to rerun header commands [0 = never]")
+	fs.DurationVar(&opts.HeaderCommandTimeout, "header_cmd_timeout", runner.DefaultHeaderCommandTimeout, "How long a header command can run before it's killed")
+	fs.Func("form", "Multipart form field to send in \"name=value\" form. Can be repeated", func(s string) error {
+		f, err := runner.ParseFormField(s)
+		opts.FormFields = append(opts.FormFields, f)
+		return err
+	})
+	fs.Func("form_file", "Multipart form file to send in \"name=@path\" form. Can be repeated", func(s string) error {
+		f, err := runner.ParseFormFile(s)
+		if err == nil {
+			_, err = os.Stat(f.Path)
+		}
+		opts.FormFiles = append(opts.FormFiles, f)
+		return err
+	})
+	feeder := fs.String("feeder", "", "CSV file whose rows fill \"{{column}}\" placeholders in the target and headers")
+	encryptOutput := fs.String("encrypt_output", "", "Public key file to encrypt the output file to, created with \"loadtest keygen\"")
+	userAgents := fs.String("user_agents", "", "File of User-Agents, one per line, to pick from at random for each request")
+	fs.BoolVar(&opts.UserAgentPerVU, "user_agent_per_vu", false, "Pick a User-Agent from -user_agents once for each virtual user instead of each request")
+	invalid := runner.InvalidRequests{}
+	fs.Func("invalid_rate", "Percentage of requests to send deliberately invalid, e.g. \"5%\", with an invalid bearer token or a body from -invalid_bodies, reported separately in the summary", func(s string) error {
+		v, err := runner.ParsePercent(s)
+		invalid.Rate = v
+		return err
+	})
+	invalidBodies := fs.String("invalid_bodies", "", "File of malformed bodies, one per line, for -invalid_rate to pick from")
+	chaos := runner.Chaos{}
+	fs.Func("abort_rate", "Percentage of requests to cancel once they're sent, e.g. \"1%\", to test how the target handles clients giving up", func(s string) error {
+		v, err := runner.ParsePercent(s)
+		chaos.AbortRate = v
+		return err
+	})
+	fs.Func("drop_connection_rate", "Percentage of requests to reset the connection of once they're sent, e.g. \"0.5%\", to test how the target handles clients vanishing", func(s string) error {
+		v, err := runner.ParsePercent(s)
+		chaos.DropRate = v
+		return err
+	})
+	targetMetrics := runner.TargetMetrics{}
+	fs.StringVar(&targetMetrics.URL, "target_metrics_url", "", "URL of the target's own metrics, e.g. its /metrics, to scrape during the test and report the trend of in the summary, e.g. to spot memory leaks in soak tests")
+	fs.Func("target_metrics", "Comma-separated metrics to scrape from -target_metrics_url: Prometheus metric names, summed across their series, single series, or JSON paths such as \"$.memory.heap_bytes\"", func(s string) error {
+		names, err := runner.ParseMetricNames(s)
+		targetMetrics.Metrics = names
+		return err
+	})
+	fs.DurationVar(&targetMetrics.Interval, "target_metrics_interval", runner.DefaultTargetMetricsInterval, "How often to scrape -target_metrics_url")
+	login := runner.Login{}
+	fs.StringVar(&login.URL, "login_url", "", "URL each virtual user logs in with before its first request, keeping the session cookie for its requests")
+	fs.StringVar(&login.Method, "login_method", "POST", "HTTP method of the login request")
+	fs.StringVar(&login.Body, "login_body", "", "Body of the login request, with \"{{column}}\" placeholders filled in from -credentials, e.g. '{\"user\": \"{{username}}\", \"password\": \"{{password}}\"}'")
+	fs.StringVar(&login.ContentType, "login_content_type", "application/json", "Content-Type of -login_body")
+	fs.StringVar(&login.TokenField, "login_token_field", "", "Dot separated path of a token in the JSON login response, e.g. \"data.access_token\", to send as a bearer token")
+	credentials := fs.String("credentials", "", "CSV file of credentials, with a header line naming the columns, each virtual user logging in with the next row")
+	scenario := fs.String("scenario", "", "JSON file of steps each virtual user sends in turn, extracting values from responses into variables and asserting on them")
+	allowCustomMethod := fs.Bool("allow_custom_method", false, "Allow sending a non-standard HTTP method")
+	var outputs []string
+	fs.Func("output_file", "Output file to write results to, \"stdout\", an http(s) URL to stream them to in a POST request, or a SQLite database ending in .db, .sqlite or .sqlite3. Can be repeated to write to several at once. Defaults to \"stdout\"", func(s string) error {
+		outputs = append(outputs, s)
+		return nil
+	})
+	fs.StringVar(&opts.OutputFormat, "output_format", runner.OutputFormatCSV, "Format of the output file: \"csv\" or \"events\" (NDJSON)")
+	fs.DurationVar(&opts.OutputRotate, "output_rotate", 0, "Shard the output file into a file for each window of this length, e.g. \"15m\" [0 = one file]")
+	fs.DurationVar(&opts.Interval, "interval", time.Second, "Interval of periodic statistics such as interval-summary events")
+	fs.StringVar(&opts.SummaryFile, "summary_file", "", "File to write the summary to as JSON")
+	fs.StringVar(&opts.StatsFile, "stats_file", "", "File to write the QPS, errors, latency percentiles and bytes of each -interval to, as JSON if it ends in .json or CSV otherwise")
+	fs.StringVar(&opts.OutliersFile, "outliers_file", "", "File to write the requests over -outlier_threshold to as NDJSON, with where their time went and their response headers")
+	outlierThreshold := fs.String("outlier_threshold", runner.DefaultOutlierThreshold, "Latency over which requests are written to -outliers_file, e.g. \"500ms\", or a percentile of the last 10000 requests, e.g. \"p99.9\"")
+	fs.StringVar(&opts.AlertWebhook, "alert_webhook", "", "URL to POST a JSON alert to when the error rate or p99 latency of an -interval crosses -alert_error_rate or -alert_p99, and when it's back under")
+	fs.Func("alert_error_rate", "Error rate of an -interval to send an alert to -alert_webhook over, e.g. \"5%\"", func(s string) error {
+		v, err := runner.ParsePercent(s)
+		opts.AlertErrorRate = v
+		return err
+	})
+	fs.DurationVar(&opts.AlertP99, "alert_p99", 0, "p99 latency of an -interval to send an alert to -alert_webhook over, e.g. \"1s\" [0 = none]")
+	fs.StringVar(&opts.StateFile, "state_file", "", "File to save the test's progress to every 10s, to continue it with -resume if it crashes or is killed")
+	resume := fs.String("resume", "", "State file of a test to continue, with the same run ID and what's left of its -duration and -max_requests, appending to its output file")
+	fs.StringVar(&opts.HeatmapFile, "heatmap_file", "", "File to write the latency heatmap to, as JSON if it ends in .json or CSV otherwise")
+	fs.DurationVar(&opts.HeatmapInterval, "heatmap_interval", time.Second, "Width of the heatmap's time buckets")
+	fs.StringVar(&opts.PushgatewayURL, "pushgateway_url", "", "Prometheus Pushgateway to push metrics to, e.g. \"http://localhost:9091\"")
+	fs.StringVar(&opts.InfluxDBURL, "influxdb_url", "", "InfluxDB write endpoint to write metrics to, e.g. \"http://localhost:8086/write?db=loadtest\"")
+	fs.StringVar(&opts.StatsdAddr, "statsd_addr", "", "DogStatsD address to send metrics to, e.g. \"localhost:8125\"")
+	fs.StringVar(&opts.GrafanaAddr, "grafana_addr", "", "Address to serve the metrics of each -export_interval on as a Grafana JSON datasource while the test runs, e.g. \":3003\"")
+	fs.StringVar(&opts.ExportJob, "export_job", "loadtest", "Job name, measurement or prefix of exported metrics")
+	fs.DurationVar(&opts.ExportInterval, "export_interval", 0, "Interval to also export metrics at during the test [0 = only at the end]")
+	fs.StringVar(&opts.RingFile, "ring_file", "", "Memory-mapped file to record results in during the test, written to the output after it, for rates where writing each result can't keep up")
+	fs.Uint64Var(&opts.RingSize, "ring_size", runner.DefaultRingSize, "Most results -ring_file holds, overwriting the oldest once full")
+	fs.Uint64Var(&opts.ResultsBuffer, "results_buffer", runner.DefaultResultsBuffer, "Results that can be waiting to be written before workers block")
+	fs.StringVar(&opts.ResultsOverflow, "results_overflow", runner.ResultsOverflowBlock, "What workers do when the results buffer is full: \"block\" or \"drop\" the result")
+	fs.BoolVar(&opts.RedactURLs, "redact_urls", false, "Hash the query strings and strip the credentials of URLs in the output, summary and events, so they can be shared")
+	fs.BoolVar(&opts.RedactErrors, "redact_errors", false, "Redact URLs, quoted values and anything that looks like a token in the errors written to the output")
+	fs.StringVar(&opts.Record, "record", runner.RecordAll, "Which results to write to the output file: \"all\" or \"errors-only\"")
+	fs.Func("sample", "Percentage of recorded results to write to the output file, e.g. \"1%\" (default 100%)", func(s string) error {
+		v, err := runner.ParsePercent(s)
+		if err == nil && v == 0 {
+			err = fmt.Errorf("sample must be greater than 0%%")
+		}
+		opts.Sample = v
+		return err
+	})
+
+	fs.BoolVar(&opts.Conditional, "conditional", false, "Send conditional requests using ETag/Last-Modified from previous responses")
+	fs.BoolVar(&opts.RecordRedirects, "record_redirects", false, "Record the status, URL and latency of each hop of followed redirects in result-sample events")
+	fs.Func("expect_body_sha256", "Hex encoded SHA-256 that every response body must match", func(s string) error {
+		if b, err := hex.DecodeString(s); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid sha256 %q", s)
+		}
+		opts.ExpectBodySHA256 = s
+		return nil
+	})
+	fs.BoolVar(&opts.LatencyByCode, "latency_by_code", false, "Report latency percentiles for each status code")
+	fs.Func("latency_unit", "Unit of latencies and other durations in the output, summary, stats and heatmap files: \"ns\", \"us\", \"ms\", \"s\" or \"human\", e.g. \"1.5ms\"", func(s string) error {
+		unit, err := runner.ParseLatencyUnit(s)
+		opts.LatencyUnit = unit
+		return err
+	})
+	fs.Func("latency_buckets", "Comma separated latencies to report the percentage of requests within, e.g. \"100ms,250ms,500ms,1s\"", func(s string) error {
+		b, err := runner.ParseLatencyBuckets(s)
+		opts.LatencyBuckets = b
+		return err
+	})
+	fs.Func("annotate", "Expected latency threshold in \"stat=duration\" form, e.g. \"p99=250ms\", or \"ttfb_p99=100ms\" for the time to first byte, flagged in the summary. Can be repeated", func(s string) error {
+		t, err := runner.ParseThreshold(s)
+		opts.Thresholds = append(opts.Thresholds, t)
+		return err
+	})
+	fs.BoolVar(&opts.Verbose, "verbose", false, fmt.Sprintf("Print a line for each request, for debugging at up to %d qps", runner.MaxVerboseQps))
+	interactive := fs.Bool("interactive", false, "Read keyboard controls from stdin, even if it isn't a terminal (default true when stdin is a terminal)")
+	var hosts runner.HostPolicy
+	fs.Func("allow_hosts", "Comma separated patterns of the only hosts that can be targeted, e.g. \"*.staging.example.com\"", func(s string) error {
+		p, err := runner.ParseHostPatterns(s)
+		hosts.Allow = p
+		return err
+	})
+	fs.Func("deny_hosts", "Comma separated patterns of hosts that can't be targeted", func(s string) error {
+		p, err := runner.ParseHostPatterns(s)
+		hosts.Deny = p
+		return err
+	})
+	fs.Func("production_hosts", "Comma separated patterns of production hosts, which can only be targeted once confirmed", func(s string) error {
+		p, err := runner.ParseHostPatterns(s)
+		hosts.Production = p
+		return err
+	})
+	confirmed := fs.Bool("i_know_what_im_doing", false, "Target hosts matching -production_hosts without asking for confirmation")
+	gomaxprocs := fs.Int("gomaxprocs", 0, "Value for GOMAXPROCS [0 = Go default]")
+	nice := fs.Int("nice", 0, "Niceness to run the process with [0 = unchanged]")
+	pprofAddr := fs.String("pprof_addr", "", "Address to serve net/http/pprof on, e.g. \":6060\" [empty = disabled]")
 
 	fs.Usage = func() {
 		fmt.Fprintln(fs.Output(), "Usage: loadtest [flags] target")
+		fmt.Fprintln(fs.Output(), "       loadtest [flags] -group ... [-group ...]")
+		fmt.Fprintln(fs.Output(), "       loadtest [flags] -targets file")
+		fmt.Fprintln(fs.Output(), "       loadtest server [flags]")
+		fmt.Fprintln(fs.Output(), "       loadtest agent [flags]")
+		fmt.Fprintln(fs.Output(), "       loadtest find-max [flags] target")
+		fmt.Fprintln(fs.Output(), "       loadtest schema [flags]")
+		fmt.Fprintln(fs.Output(), "       loadtest keygen [flags]")
+		fmt.Fprintln(fs.Output(), "       loadtest decrypt [flags] <file>")
 		fs.PrintDefaults()
 	}
 
 	fs.Parse(os.Args[1:])
 
+	var config *configFlags
+	if *configFile != "" {
+		var err error
+		if config, err = applyConfig(fs, *configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if *version {
 		fmt.Println("Version: 1.0")
 		return
 	}
 
-	if fs.NArg() != 1 {
+	if opts.Qps <= 0 || math.IsNaN(opts.Qps) || math.IsInf(opts.Qps, 0) {
+		fmt.Fprintln(os.Stderr, "Error: -qps must be a number greater than 0")
+		os.Exit(1)
+	}
+
+	if opts.HeatmapInterval <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: -heatmap_interval must be greater than 0")
+		os.Exit(1)
+	}
+
+	if opts.HeaderCommandTimeout <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: -header_cmd_timeout must be greater than 0")
+		os.Exit(1)
+	}
+
+	if opts.Mode != runner.ModeHTTP && opts.Mode != runner.ModeConnect && opts.Mode != runner.ModeSSE && opts.Mode != runner.ModeLongPoll {
+		fmt.Fprintf(os.Stderr, "Error: invalid -mode value %q\n", opts.Mode)
+		os.Exit(1)
+	}
+	if (opts.Mode == runner.ModeSSE || opts.Mode == runner.ModeLongPoll) && opts.VUs == 0 {
+		fmt.Fprintf(os.Stderr, "Error: -mode %s requires -vus, the number of connections to hold\n", opts.Mode)
+		os.Exit(1)
+	}
+	if opts.Mode == runner.ModeLongPoll && !isSet(fs, "timeout") {
+		opts.Timeout = uint64(runner.DefaultLongPollTimeout / time.Second)
+	}
+	if opts.AlertWebhook != "" && opts.AlertErrorRate == 0 && opts.AlertP99 == 0 {
+		fmt.Fprintln(os.Stderr, "Error: -alert_webhook requires -alert_error_rate or -alert_p99")
+		os.Exit(1)
+	}
+	if opts.AlertWebhook == "" && (opts.AlertErrorRate > 0 || opts.AlertP99 > 0) {
+		fmt.Fprintln(os.Stderr, "Error: -alert_error_rate and -alert_p99 require -alert_webhook")
+		os.Exit(1)
+	}
+	if opts.OutliersFile != "" {
+		t, err := runner.ParseOutlierThreshold(*outlierThreshold)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		opts.OutlierThreshold = &t
+	} else if isSet(fs, "outlier_threshold") {
+		fmt.Fprintln(os.Stderr, "Error: -outlier_threshold requires -outliers_file")
+		os.Exit(1)
+	}
+
+	if err := runner.ValidateMethod(opts.Method, *allowCustomMethod); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	if len(opts.FormFields) > 0 || len(opts.FormFiles) > 0 {
+		if err := runner.ValidateMethodBody(opts.Method); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -form and -form_file: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if opts.OutputFormat != runner.OutputFormatCSV && opts.OutputFormat != runner.OutputFormatEvents {
+		fmt.Fprintf(os.Stderr, "Error: invalid -output_format value %q\n", opts.OutputFormat)
+		os.Exit(1)
+	}
+
+	opts.OutputFile = "stdout"
+	if len(outputs) > 0 {
+		opts.OutputFile, opts.OutputFiles = outputs[0], outputs[1:]
+	}
+	databases := 0
+	for _, name := range outputs {
+		if runner.IsSQLiteOutput(name) {
+			databases++
+		}
+	}
+	if databases > 1 {
+		fmt.Fprintln(os.Stderr, "Error: only one -output_file can be a SQLite database")
+		os.Exit(1)
+	}
+	if databases > 0 && *encryptOutput != "" {
+		fmt.Fprintln(os.Stderr, "Error: -encrypt_output can't encrypt a SQLite -output_file")
+		os.Exit(1)
+	}
+	if opts.OutputRotate > 0 && !slices.ContainsFunc(outputs, isOutputFile) {
+		fmt.Fprintln(os.Stderr, "Error: -output_rotate requires -output_file")
+		os.Exit(1)
+	}
+	if opts.RingFile != "" && opts.OutputRotate > 0 {
+		fmt.Fprintln(os.Stderr, "Error: -ring_file can't be used with -output_rotate")
+		os.Exit(1)
+	}
+	if opts.RingSize == 0 {
+		fmt.Fprintln(os.Stderr, "Error: -ring_size must be at least 1")
+		os.Exit(1)
+	}
+	// Files are named to the second.
+	if opts.OutputRotate > 0 && opts.OutputRotate < time.Second {
+		fmt.Fprintln(os.Stderr, "Error: -output_rotate must be at least 1s")
+		os.Exit(1)
+	}
+
+	if opts.TLSMinVersion != 0 && opts.TLSMaxVersion != 0 && opts.TLSMinVersion > opts.TLSMaxVersion {
+		fmt.Fprintln(os.Stderr, "Error: -tls_min_version can't be greater than -tls_max_version")
+		os.Exit(1)
+	}
+
+	if opts.PacerShards == 0 {
+		fmt.Fprintln(os.Stderr, "Error: -pacer_shards must be at least 1")
+		os.Exit(1)
+	}
+	if opts.PacerShards > 1 && opts.VUs > 0 {
+		fmt.Fprintln(os.Stderr, "Error: -pacer_shards can't be used with -vus")
+		os.Exit(1)
+	}
+
+	if opts.NewConnections && opts.Preconnect > 0 {
+		fmt.Fprintln(os.Stderr, "Error: -new_connections can't be used with -preconnect")
+		os.Exit(1)
+	}
+
+	if opts.TCPInfo && !runner.TCPInfoSupported {
+		fmt.Fprintln(os.Stderr, "Error: -tcp_info is only supported on Linux")
+		os.Exit(1)
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Fprintln(os.Stderr, "Error: -tls_cert and -tls_key must be used together")
+		os.Exit(1)
+	}
+
+	if opts.ResultsOverflow != runner.ResultsOverflowBlock && opts.ResultsOverflow != runner.ResultsOverflowDrop {
+		fmt.Fprintf(os.Stderr, "Error: invalid -results_overflow value %q\n", opts.ResultsOverflow)
+		os.Exit(1)
+	}
+
+	if opts.Record != runner.RecordAll && opts.Record != runner.RecordErrorsOnly {
+		fmt.Fprintf(os.Stderr, "Error: invalid -record value %q\n", opts.Record)
+		os.Exit(1)
+	}
+
+	if opts.Verbose {
+		total := opts.Qps
+		if len(opts.Groups) > 0 {
+			total = 0
+			for _, g := range opts.Groups {
+				total += g.Qps
+			}
+		}
+		if opts.VUs > 0 || total > runner.MaxVerboseQps {
+			fmt.Fprintf(os.Stderr, "Error: -verbose is for debugging at up to %d qps and can't be used with -vus\n", runner.MaxVerboseQps)
+			os.Exit(1)
+		}
+	}
+
+	if *openapiSpec != "" && (opts.Mode != runner.ModeHTTP || len(opts.Groups) > 0 || opts.TargetsFile != "" || len(opts.FormFields) > 0 || len(opts.FormFiles) > 0) {
+		fmt.Fprintln(os.Stderr, "Error: -openapi requires -mode http and can't be used with -group, -targets, -form or -form_file")
+		os.Exit(1)
+	}
+	if *operation != "" && *openapiSpec == "" {
+		fmt.Fprintln(os.Stderr, "Error: -operation requires -openapi")
+		os.Exit(1)
+	}
+
+	// Multipart bodies are streamed from disk and can't be sent twice.
+	if opts.ShadowTarget != "" && (opts.Mode != runner.ModeHTTP || len(opts.FormFields) > 0 || len(opts.FormFiles) > 0) {
+		fmt.Fprintln(os.Stderr, "Error: -shadow_target requires -mode http and can't be used with -form or -form_file")
+		os.Exit(1)
+	}
+
+	if chaos != (runner.Chaos{}) {
+		if opts.Mode != runner.ModeHTTP || *scenario != "" {
+			fmt.Fprintln(os.Stderr, "Error: -abort_rate and -drop_connection_rate require -mode http and can't be used with -scenario")
+			os.Exit(1)
+		}
+		if chaos.AbortRate+chaos.DropRate > 1 {
+			fmt.Fprintln(os.Stderr, "Error: -abort_rate and -drop_connection_rate add up to more than 100%")
+			os.Exit(1)
+		}
+		opts.Chaos = &chaos
+	}
+
+	if targetMetrics.URL != "" || len(targetMetrics.Metrics) > 0 {
+		if targetMetrics.URL == "" || len(targetMetrics.Metrics) == 0 {
+			fmt.Fprintln(os.Stderr, "Error: -target_metrics_url and -target_metrics must be used together")
+			os.Exit(1)
+		}
+		if targetMetrics.Interval <= 0 {
+			fmt.Fprintln(os.Stderr, "Error: -target_metrics_interval must be positive")
+			os.Exit(1)
+		}
+		opts.TargetMetrics = &targetMetrics
+	}
+
+	if opts.EjectErrorRate > 0 && opts.TargetsFile == "" {
+		fmt.Fprintln(os.Stderr, "Error: -eject_error_rate requires -targets")
+		os.Exit(1)
+	}
+
+	if len(opts.Groups) > 0 && opts.TargetsFile != "" {
+		fmt.Fprintln(os.Stderr, "Error: -group can't be used with -targets")
+		os.Exit(1)
+	}
+
+	if len(opts.Groups) > 0 && opts.VUs > 0 {
+		fmt.Fprintln(os.Stderr, "Error: -group can't be used with -vus")
+		os.Exit(1)
+	}
+
+	if login.URL != "" && opts.VUs == 0 {
+		fmt.Fprintln(os.Stderr, "Error: -login_url requires -vus")
+		os.Exit(1)
+	}
+	if login.URL == "" && (login.Body != "" || login.TokenField != "" || *credentials != "") {
+		fmt.Fprintln(os.Stderr, "Error: -login_body, -login_token_field and -credentials require -login_url")
+		os.Exit(1)
+	}
+	for _, v := range []struct{ flag, value string }{{"-login_url", login.URL}, {"-login_body", login.Body}} {
+		if err := runner.ValidateTemplate(v.value); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %s\n", v.flag, err)
+			os.Exit(1)
+		}
+	}
+
+	if *rateShape != "" && (opts.VUs > 0 || len(opts.Groups) > 0) {
+		fmt.Fprintln(os.Stderr, "Error: -rate_shape can't be used with -vus or -group")
+		os.Exit(1)
+	}
+	if *rateSchedule != "" && (*rateShape != "" || opts.VUs > 0 || len(opts.Groups) > 0) {
+		fmt.Fprintln(os.Stderr, "Error: -rate_schedule can't be used with -rate_shape, -vus or -group")
+		os.Exit(1)
+	}
+	if *resume != "" && (*rateShape != "" || *encryptOutput != "") {
+		fmt.Fprintln(os.Stderr, "Error: -resume can't be used with -rate_shape or -encrypt_output")
+		os.Exit(1)
+	}
+	if opts.RateScale <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: -rate_scale must be positive")
+		os.Exit(1)
+	}
+
+	if opts.PerHostQps > 0 && opts.Preconnect > 0 {
+		fmt.Fprintln(os.Stderr, "Error: -per_host_qps can't be used with -preconnect")
+		os.Exit(1)
+	}
+	if len(opts.DNSStrategies) > 0 && opts.Preconnect > 0 {
+		fmt.Fprintln(os.Stderr, "Error: -dns_strategy can't be used with -preconnect")
+		os.Exit(1)
+	}
+	if len(opts.DNSWeights) > 0 {
+		weighted := false
+		for _, strategy := range opts.DNSStrategies {
+			weighted = weighted || strategy == runner.DNSWeighted
+		}
+		if !weighted {
+			fmt.Fprintln(os.Stderr, "Error: -dns_weight requires -dns_strategy weighted")
+			os.Exit(1)
+		}
+	}
+
+	if opts.GrafanaAddr != "" && opts.ExportInterval == 0 {
+		fmt.Fprintln(os.Stderr, "Error: -grafana_addr requires -export_interval")
+		os.Exit(1)
+	}
+
+	if *invalidBodies != "" && invalid.Rate == 0 {
+		fmt.Fprintln(os.Stderr, "Error: -invalid_bodies requires -invalid_rate")
+		os.Exit(1)
+	}
+
+	if *scenario != "" && opts.VUs == 0 {
+		fmt.Fprintln(os.Stderr, "Error: -scenario requires -vus")
+		os.Exit(1)
+	}
+
+	if opts.UserAgentPerVU && (opts.VUs == 0 || *userAgents == "") {
+		fmt.Fprintln(os.Stderr, "Error: -user_agent_per_vu requires -vus and -user_agents")
+		os.Exit(1)
+	}
+
+	// Target groups and targets files replace the single target.
+	if fs.NArg() != 1 && !((len(opts.Groups) > 0 || opts.TargetsFile != "") && fs.NArg() == 0) {
 		fs.Usage()
 		os.Exit(1)
 	}
 
+	if *gomaxprocs > 0 {
+		runtime.GOMAXPROCS(*gomaxprocs)
+	}
+
+	if *nice != 0 {
+		if err := process.SetNiceness(*nice); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: setting niceness: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *pprofAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(*pprofAddr, nil); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: serving pprof: %s\n", err)
+			}
+		}()
+	}
+
+	opts.Keys = keyboardInput(os.Stdin, *interactive, isSet(fs, "interactive"))
+
+	if *feeder != "" {
+		f, err := runner.LoadFeeder(*feeder)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		opts.Feeder = f
+	}
+
+	if login.URL != "" {
+		if *credentials != "" {
+			f, err := runner.LoadFeeder(*credentials)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				os.Exit(1)
+			}
+			login.Credentials = f
+		}
+		opts.Login = &login
+	}
+
+	if invalid.Rate > 0 {
+		if *invalidBodies != "" {
+			bodies, err := runner.LoadInvalidBodies(*invalidBodies)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				os.Exit(1)
+			}
+			invalid.Bodies = bodies
+		}
+		opts.Invalid = &invalid
+	}
+
+	if *rateShape != "" {
+		s, err := runner.LoadRateShape(*rateShape)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		opts.RateShape = s
+	}
+	if *rateSchedule != "" {
+		s, err := runner.ParseRateSchedule(*rateSchedule)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		opts.RateSchedule = s
+	}
+
+	if *resume != "" {
+		s, err := runner.LoadRunState(*resume)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		duration := opts.Duration
+		if duration == 0 && opts.RateShape != nil {
+			// The shape's length, as the runner defaults the duration to.
+			duration = opts.RateShape.Length()
+		}
+		if !s.Remaining(duration, opts.MaxRequests) {
+			fmt.Fprintf(os.Stderr, "Error: the test of %s has no -duration or -max_requests left to run\n", *resume)
+			os.Exit(1)
+		}
+		opts.Resume = s
+		if opts.StateFile == "" {
+			opts.StateFile = *resume
+		}
+	}
+
+	if *scenario != "" {
+		s, err := runner.LoadScenario(*scenario)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		opts.Scenario = s
+	}
+
+	if *encryptOutput != "" {
+		key, err := encrypt.LoadPublicKey(*encryptOutput)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		opts.OutputRecipient = key
+	}
+
+	if opts.TargetsFile != "" {
+		targets, err := runner.LoadTargets(opts.TargetsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		opts.Targets = targets
+	}
+
+	if *userAgents != "" {
+		uas, err := runner.LoadUserAgents(*userAgents)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		opts.UserAgents = uas
+	}
+
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: loading client certificate: %s\n", err)
+			os.Exit(1)
+		}
+		opts.TLSCertificates = []tls.Certificate{cert}
+	}
+
+	if *tlsCA != "" {
+		pool, err := runner.LoadCertPool(*tlsCA)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		opts.TLSRootCAs = pool
+	}
+
+	if *tlsKeyLog != "" {
+		f, err := os.OpenFile(*tlsKeyLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: opening TLS key log: %s\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		fmt.Fprintf(os.Stderr, "Warning: writing TLS secrets to %s, anyone with it can decrypt captures of the test's traffic\n", *tlsKeyLog)
+		opts.TLSKeyLog = f
+	}
+
 	target := fs.Arg(0)
+	if err := runner.ValidateTemplate(target); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: target: %s\n", err)
+		os.Exit(1)
+	}
+
+	if !hosts.Empty() {
+		targets := []string{}
+		if target != "" {
+			targets = append(targets, target)
+		}
+		for _, g := range opts.Groups {
+			targets = append(targets, g.Target)
+		}
+		for _, t := range opts.Targets {
+			targets = append(targets, t.URL)
+		}
+		if err := checkHosts(&hosts, targets, *confirmed); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		// Checked again for every request, whose host can also come from e.g. a redirect.
+		hosts.ConfirmAll = *confirmed
+		opts.HostPolicy = &hosts
+	}
+
+	if *openapiSpec != "" {
+		gen, err := newOpenAPIGenerator(*openapiSpec, *operation, target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		opts.Generator = gen
+	}
+
+	if config != nil {
+		// Headers given on the command line aren't replaced by the config's.
+		headers := opts.Headers
+		opts.Reload = func() (runner.Reloadable, error) {
+			return config.reload(headers)
+		}
+	}
 
 	r := runner.NewRunner(target, opts)
 	err := r.Run()
@@ -49,3 +846,476 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// isOutputFile returns whether an -output_file is a file, rather than stdout, a URL or a SQLite
+// database.
+func isOutputFile(name string) bool {
+	return name != "stdout" && !strings.HasPrefix(name, "http://") && !strings.HasPrefix(name, "https://") && !runner.IsSQLiteOutput(name)
+}
+
+// keyboardInput returns stdin to read keyboard controls from, or nil. They're on by default in a
+// terminal, and opt-in with -interactive otherwise, e.g. when keys are piped in, since reading
+// stdin would take input meant for something else.
+func keyboardInput(stdin *os.File, interactive, explicit bool) io.Reader {
+	if interactive || (!explicit && term.IsTerminal(stdin)) {
+		return stdin
+	}
+	return nil
+}
+
+// checkHosts checks the targets against -allow_hosts, -deny_hosts and -production_hosts. Unless
+// -i_know_what_im_doing is given, a production host has to be confirmed by typing its name.
+func checkHosts(policy *runner.HostPolicy, targets []string, confirmed bool) error {
+	for _, target := range targets {
+		if u, err := url.Parse(target); err == nil && u.Host == "" {
+			// A template like "{{base}}/items" only has a host once it's rendered, and each
+			// request's host is checked then.
+			continue
+		}
+		production, err := policy.Check(context.Background(), target)
+		if err != nil {
+			return err
+		}
+		if !production || confirmed {
+			continue
+		}
+
+		u, _ := url.Parse(target)
+		if !term.IsTerminal(os.Stdin) {
+			return fmt.Errorf("%s is a production host, confirm with -i_know_what_im_doing", u.Hostname())
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %s is a production host. Type its name to load test it anyway: ", u.Hostname())
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(line) != u.Hostname() {
+			return fmt.Errorf("%s wasn't confirmed", u.Hostname())
+		}
+		policy.Confirmed = append(policy.Confirmed, u.Hostname())
+	}
+	return nil
+}
+
+// configFlags are the flags set by a config file.
+type configFlags struct {
+	name     string
+	values   []runner.ConfigValue
+	explicit map[string]bool // Flags given on the command line, which the config doesn't override
+}
+
+// isSet returns whether a flag was given, on the command line or in the config file.
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// applyConfig sets the flags of the config file that weren't given on the command line.
+func applyConfig(fs *flag.FlagSet, name string) (*configFlags, error) {
+	values, err := runner.LoadConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	c := &configFlags{name: name, values: values, explicit: map[string]bool{}}
+	fs.Visit(func(f *flag.Flag) {
+		c.explicit[f.Name] = true
+	})
+
+	for _, v := range values {
+		if v.Name == "config" || fs.Lookup(v.Name) == nil {
+			return nil, fmt.Errorf("config %s: unknown flag %q", name, v.Name)
+		}
+		if c.overridden(v.Name) {
+			continue
+		}
+		if err := fs.Set(v.Name, v.Value); err != nil {
+			return nil, fmt.Errorf("config %s: invalid value %q for -%s: %s", name, v.Value, v.Name, err)
+		}
+	}
+	return c, nil
+}
+
+// overridden returns whether a flag of the config was given on the command line, directly or
+// through -qps and -rate, which set the same value.
+func (c *configFlags) overridden(name string) bool {
+	return c.explicit[name] || (name == "rate" && c.explicit["qps"]) || (name == "qps" && c.explicit["rate"])
+}
+
+// reload rereads the config file, returning the parameters to apply to the running test. Changes to
+// other flags are only applied by restarting the test.
+func (c *configFlags) reload(headers []runner.Header) (runner.Reloadable, error) {
+	values, err := runner.LoadConfig(c.name)
+	if err != nil {
+		return runner.Reloadable{}, err
+	}
+
+	reloaded := runner.Reloadable{}
+	if c.explicit["header"] {
+		reloaded.Headers = headers
+	}
+	for _, v := range values {
+		if c.overridden(v.Name) {
+			continue
+		}
+		switch v.Name {
+		case "qps", "rate":
+			if v.Name == "qps" {
+				reloaded.Qps, err = strconv.ParseFloat(v.Value, 64)
+			} else {
+				reloaded.Qps, err = runner.ParseRate(v.Value)
+			}
+			if err != nil || reloaded.Qps <= 0 || math.IsNaN(reloaded.Qps) || math.IsInf(reloaded.Qps, 0) {
+				return runner.Reloadable{}, fmt.Errorf("config %s: invalid value %q for -%s", c.name, v.Value, v.Name)
+			}
+		case "header":
+			h, err := runner.ParseHeader(v.Value)
+			if err != nil {
+				return runner.Reloadable{}, fmt.Errorf("config %s: %s", c.name, err)
+			}
+			reloaded.Headers = append(reloaded.Headers, h)
+		case "targets":
+			reloaded.TargetsFile = v.Value
+		}
+	}
+
+	for _, name := range changedFlags(c.values, values) {
+		switch name {
+		case "qps", "rate", "header", "targets":
+		default:
+			fmt.Fprintf(os.Stderr, "Warning: -%s changed in the config, restart the test to apply it\n", name)
+		}
+	}
+	c.values = values
+	return reloaded, nil
+}
+
+// changedFlags returns the names of the flags whose values differ between two configs.
+func changedFlags(old, values []runner.ConfigValue) []string {
+	join := func(values []runner.ConfigValue) map[string]string {
+		m := map[string]string{}
+		for _, v := range values {
+			m[v.Name] += v.Value + "\n"
+		}
+		return m
+	}
+	before, after := join(old), join(values)
+
+	var names []string
+	for name, v := range after {
+		if before[name] != v {
+			names = append(names, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newOpenAPIGenerator(name, operation, base string) (*openapi.Generator, error) {
+	spec, err := openapi.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	ops, err := spec.Operations(operation)
+	if err != nil {
+		return nil, err
+	}
+	return openapi.NewGenerator(spec, ops, base)
+}
+
+func runServer(args []string) {
+	fs := flag.NewFlagSet("loadtest server", flag.ExitOnError)
+
+	cfg := server.Config{}
+
+	fs.IntVar(&cfg.Port, "port", 8080, "Port to listen on")
+	fs.DurationVar(&cfg.Latency, "latency", 0, "Mean latency added to each response")
+	fs.DurationVar(&cfg.LatencyJitter, "latency_jitter", 0, "Spread of the latency for the uniform and normal distributions")
+	fs.StringVar(&cfg.Distribution, "latency_distribution", server.DistributionFixed, "Latency distribution: fixed, uniform, normal or exponential")
+	fs.Func("error_rate", "Percentage of requests to fail, e.g. \"1%\"", func(s string) error {
+		v, err := runner.ParsePercent(s)
+		cfg.ErrorRate = v
+		return err
+	})
+	fs.IntVar(&cfg.ErrorCode, "error_code", http.StatusInternalServerError, "Status code of failed requests")
+	fs.IntVar(&cfg.ResponseSize, "response_size", 0, "Size of successful response bodies in bytes")
+
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadtest server [flags]")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	s, err := server.New(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err := s.ListenAndServe(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func runAgent(args []string) {
+	fs := flag.NewFlagSet("loadtest agent", flag.ExitOnError)
+
+	addr := fs.String("addr", "127.0.0.1:8089", "Address to serve the jobs API on")
+	tokenFile := fs.String("token_file", "", "File of the bearer token requests to the API must have [empty = the LOADTEST_AGENT_TOKEN environment variable]")
+	var hosts runner.HostPolicy
+	fs.Func("allow_hosts", "Comma separated patterns of the only hosts jobs can target, e.g. \"*.staging.example.com\"", func(s string) error {
+		p, err := runner.ParseHostPatterns(s)
+		hosts.Allow = p
+		return err
+	})
+	fs.Func("deny_hosts", "Comma separated patterns of hosts jobs can't target", func(s string) error {
+		p, err := runner.ParseHostPatterns(s)
+		hosts.Deny = p
+		return err
+	})
+	fs.Func("production_hosts", "Comma separated patterns of production hosts, which jobs can't target without -i_know_what_im_doing", func(s string) error {
+		p, err := runner.ParseHostPatterns(s)
+		hosts.Production = p
+		return err
+	})
+	fs.BoolVar(&hosts.ConfirmAll, "i_know_what_im_doing", false, "Let jobs target hosts matching -production_hosts")
+
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadtest agent [flags]")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	token := os.Getenv("LOADTEST_AGENT_TOKEN")
+	if *tokenFile != "" {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token == "" {
+		fmt.Fprintln(os.Stderr, "Error: a token is required, in -token_file or LOADTEST_AGENT_TOKEN")
+		os.Exit(1)
+	}
+
+	a := agent.New(token, &hosts)
+	srv := &http.Server{Addr: *addr, Handler: a}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		fmt.Println("Shutting down...")
+		a.Shutdown()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	fmt.Printf("Listening on %s\n", *addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func runFindMax(args []string) {
+	fs := flag.NewFlagSet("loadtest find-max", flag.ExitOnError)
+
+	opts := runner.LoadTestArgs{}
+	f := runner.FindMaxArgs{MaxErrorRate: 0.01, Precision: 0.05}
+
+	fs.Float64Var(&f.MinQps, "min_qps", 10, "QPS of the first trial, which must pass")
+	fs.Float64Var(&f.MaxQps, "max_qps", 100000, "Highest QPS to try")
+	fs.DurationVar(&f.TrialDuration, "trial_duration", 10*time.Second, "Duration of each trial")
+	fs.DurationVar(&f.Cooldown, "cooldown", 5*time.Second, "Pause between trials for the target to recover")
+	fs.Func("max_error_rate", "Highest error rate of a passing trial, e.g. \"1%\" (default 1%)", func(s string) error {
+		v, err := runner.ParsePercent(s)
+		f.MaxErrorRate = v
+		return err
+	})
+	fs.DurationVar(&f.MaxP99, "max_p99", 0, "Highest p99 latency of a passing trial [0 = no bound]")
+	fs.Func("precision", "Stop once the capacity is known within this percentage, e.g. \"5%\" (default 5%)", func(s string) error {
+		v, err := runner.ParsePercent(s)
+		f.Precision = v
+		return err
+	})
+	fs.IntVar(&f.Repeats, "repeats", 3, "Times to repeat the trial at the capacity found, for a 95% confidence interval of its throughput [0 = none]")
+	fs.Uint64Var(&opts.Workers, "workers", 100, "Number of initial workers")
+	fs.Uint64Var(&opts.MaxWorkers, "max_workers", 1000, "Max number of workers")
+	fs.Uint64Var(&opts.Timeout, "timeout", 30, "Timeout to wait for each request in seconds")
+	fs.StringVar(&opts.Method, "method", "GET", "HTTP method to use")
+	fs.Func("header", "Header to send in \"Name: value\" form. Can be repeated", func(s string) error {
+		h, err := runner.ParseHeader(s)
+		opts.Headers = append(opts.Headers, h)
+		return err
+	})
+	summaryFile := fs.String("summary_file", "", "File to write the trials and the capacity found to as JSON")
+
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadtest find-max [flags] target")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if f.MinQps <= 0 || f.MaxQps < f.MinQps || math.IsNaN(f.MinQps) || math.IsNaN(f.MaxQps) || math.IsInf(f.MaxQps, 0) {
+		fmt.Fprintln(os.Stderr, "Error: -min_qps must be greater than 0 and at most -max_qps")
+		os.Exit(1)
+	}
+	if f.TrialDuration <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: -trial_duration must be greater than 0")
+		os.Exit(1)
+	}
+	if f.Precision <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: -precision must be greater than 0%")
+		os.Exit(1)
+	}
+	if f.Repeats < 0 || f.Repeats == 1 {
+		fmt.Fprintln(os.Stderr, "Error: -repeats must be 0, or at least 2 for a confidence interval")
+		os.Exit(1)
+	}
+	opts.AutoScale = true
+
+	res, err := runner.FindMax(fs.Arg(0), opts, f, os.Stdout)
+	if res != nil && *summaryFile != "" {
+		data, _ := json.MarshalIndent(res, "", "  ")
+		if err := os.WriteFile(*summaryFile, append(data, '\n'), 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: writing summary file: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if res.AtMax {
+		fmt.Printf("Max sustainable QPS: at least %.4g, every trial passed up to -max_qps\n", res.Qps)
+	} else {
+		fmt.Printf("Max sustainable QPS: %.4g (capacity between %.4g and %.4g qps)\n", res.Qps, res.Low, res.High)
+	}
+	if t := res.Throughput; t != nil {
+		passed := 0
+		for _, r := range res.Repeats {
+			if r.Passed {
+				passed++
+			}
+		}
+		fmt.Printf("Throughput at %.4g qps: %.2f/s, 95%% confidence interval %.2f-%.2f/s, %d of %d repeats passed\n", res.Qps, t.Mean, t.Low, t.High, passed, len(res.Repeats))
+	}
+}
+
+func runSchema(args []string) {
+	fs := flag.NewFlagSet("loadtest schema", flag.ExitOnError)
+
+	format := fs.String("format", "text", "Format to print the schema in: \"text\" or \"json\"")
+	latencyUnit := fs.String("latency_unit", runner.LatencyUnitNs, "Unit of the durations of the outputs described, as for a load test's -latency_unit")
+
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadtest schema [flags]")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	unit, err := runner.ParseLatencyUnit(*latencyUnit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	schema := runner.OutputSchema(unit)
+	switch *format {
+	case "json":
+		data, _ := json.MarshalIndent(schema, "", "  ")
+		fmt.Println(string(data))
+	case "text":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "Schema version: %d\nLatency unit: %s\n", schema.Version, schema.LatencyUnit)
+		for _, f := range schema.Formats {
+			fmt.Fprintf(w, "\n%s: %s\n", f.Name, f.Description)
+			for _, field := range f.Fields {
+				if field.Description == "" {
+					fmt.Fprintf(w, "  %s\t%s\n", field.Name, field.Type)
+				} else {
+					fmt.Fprintf(w, "  %s\t%s\t%s\n", field.Name, field.Type, field.Description)
+				}
+			}
+		}
+		w.Flush()
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid -format value %q\n", *format)
+		os.Exit(1)
+	}
+}
+
+func runKeygen(args []string) {
+	fs := flag.NewFlagSet("loadtest keygen", flag.ExitOnError)
+
+	out := fs.String("out", "loadtest.key", "File to write the private key to. The public key is written to the same name with .pub appended")
+
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadtest keygen [flags]")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	if err := encrypt.GenerateKey(*out); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func runDecrypt(args []string) {
+	fs := flag.NewFlagSet("loadtest decrypt", flag.ExitOnError)
+
+	keyFile := fs.String("key", "loadtest.key", "Private key file to decrypt with")
+
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: loadtest decrypt [flags] <file>")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	key, err := encrypt.LoadPrivateKey(*keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	r, err := encrypt.NewReader(f, key)
+	if err == nil {
+		_, err = io.Copy(os.Stdout, r)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"nfiacco/loadtester/internal/runner"
+)
+
+// newConfigFlagSet returns a flag set with the reloadable flags and one that isn't, defined like
+// main defines them.
+func newConfigFlagSet(opts *runner.LoadTestArgs) *flag.FlagSet {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	fs.Float64Var(&opts.Qps, "qps", 100, "")
+	fs.Func("rate", "", func(s string) error {
+		v, err := runner.ParseRate(s)
+		opts.Qps = v
+		return err
+	})
+	fs.Func("header", "", func(s string) error {
+		h, err := runner.ParseHeader(s)
+		opts.Headers = append(opts.Headers, h)
+		return err
+	})
+	fs.StringVar(&opts.TargetsFile, "targets", "", "")
+	fs.Uint64Var(&opts.Workers, "workers", 100, "")
+	return fs
+}
+
+func writeConfig(t *testing.T, name, config string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	t.Parallel()
+	name := filepath.Join(t.TempDir(), "loadtest.conf")
+	writeConfig(t, name, "# Raised after the warmup\nqps = 20\nheader = X-Test: 1\nworkers = 5\n")
+
+	opts := runner.LoadTestArgs{}
+	fs := newConfigFlagSet(&opts)
+	if err := fs.Parse([]string{"-workers", "7"}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := applyConfig(fs, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []runner.Header{{Name: "X-Test", Value: "1"}}
+	if opts.Qps != 20 || opts.Workers != 7 || !reflect.DeepEqual(opts.Headers, want) {
+		t.Fatalf("got: qps %g, workers %d, headers %v, want the config's qps and headers and the command line's workers", opts.Qps, opts.Workers, opts.Headers)
+	}
+
+	writeConfig(t, name, "rate = 30/m\n-header = X-Test: 2\nheader = X-New: a\ntargets = targets.txt\nworkers = 9\n")
+	reloaded, err := config.reload(opts.Headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantReloaded := runner.Reloadable{
+		Qps:         0.5,
+		Headers:     []runner.Header{{Name: "X-Test", Value: "2"}, {Name: "X-New", Value: "a"}},
+		TargetsFile: "targets.txt",
+	}
+	if !reflect.DeepEqual(reloaded, wantReloaded) {
+		t.Fatalf("got: %+v, want: %+v", reloaded, wantReloaded)
+	}
+
+	// The reloaded config is applied to the running test.
+	r := runner.NewRunner("http://localhost", opts)
+	changes, err := r.Reload(runner.Reloadable{Qps: reloaded.Qps, Headers: reloaded.Headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantChanges := []string{"qps 20 -> 0.5", "header X-Test changed", "header X-New added"}
+	if !reflect.DeepEqual(changes, wantChanges) {
+		t.Fatalf("got: %v, want: %v", changes, wantChanges)
+	}
+
+	for _, qps := range []string{"-1", "NaN", "Inf"} {
+		writeConfig(t, name, "qps = "+qps+"\n")
+		if _, err := config.reload(opts.Headers); err == nil {
+			t.Fatalf("got: nil, want an error for a qps of %s", qps)
+		}
+	}
+}
+
+func TestReloadConfigExplicitFlags(t *testing.T) {
+	t.Parallel()
+	name := filepath.Join(t.TempDir(), "loadtest.conf")
+	writeConfig(t, name, "qps = 20\nheader = X-Config: 1\n")
+
+	opts := runner.LoadTestArgs{}
+	fs := newConfigFlagSet(&opts)
+	if err := fs.Parse([]string{"-rate", "50", "-header", "X-Cli: 1"}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := applyConfig(fs, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []runner.Header{{Name: "X-Cli", Value: "1"}}
+	if opts.Qps != 50 || !reflect.DeepEqual(opts.Headers, want) {
+		t.Fatalf("got: qps %g, headers %v, want the command line's", opts.Qps, opts.Headers)
+	}
+
+	// Flags given on the command line keep their values, and -rate keeps -qps from changing too.
+	writeConfig(t, name, "qps = 30\nheader = X-Config: 2\n")
+	reloaded, err := config.reload(opts.Headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantReloaded := (runner.Reloadable{Headers: want}); !reflect.DeepEqual(reloaded, wantReloaded) {
+		t.Fatalf("got: %+v, want: %+v", reloaded, wantReloaded)
+	}
+}
+
+func TestApplyConfigUnknownFlag(t *testing.T) {
+	t.Parallel()
+	name := filepath.Join(t.TempDir(), "loadtest.conf")
+	writeConfig(t, name, "qps = 20\nqsp = 30\n")
+
+	fs := newConfigFlagSet(&runner.LoadTestArgs{})
+	if _, err := applyConfig(fs, name); err == nil {
+		t.Fatal("got: nil, want an error for an unknown flag")
+	}
+}
+
+func TestDevNullStdin(t *testing.T) {
+	// Not parallel, as it replaces os.Stdin, e.g. as in CI or docker without -t.
+	if runtime.GOOS != "linux" {
+		t.Skip("/dev/null is only told apart from a terminal on linux")
+	}
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	stdin := os.Stdin
+	os.Stdin = devNull
+	defer func() { os.Stdin = stdin }()
+
+	if keys := keyboardInput(devNull, false, false); keys != nil {
+		t.Fatal("got: keys read from /dev/null, want keyboard controls off by default")
+	}
+	if keys := keyboardInput(devNull, true, true); keys == nil {
+		t.Fatal("got: nil, want keys read with -interactive")
+	}
+
+	policy := &runner.HostPolicy{Production: []string{"127.0.0.1"}}
+	err = checkHosts(policy, []string{"http://127.0.0.1/items"}, false)
+	if err == nil || !strings.Contains(err.Error(), "-i_know_what_im_doing") {
+		t.Fatalf("got: %v, want to be told to confirm with -i_know_what_im_doing", err)
+	}
+}
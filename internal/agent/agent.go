@@ -0,0 +1,389 @@
+// Package agent runs load tests submitted over a local REST API, so pre-installed load testers
+// can be orchestrated remotely instead of running the binary over SSH.
+//
+//	POST   /jobs       submit a test, with a JobSpec body
+//	GET    /jobs       list the jobs
+//	GET    /jobs/{id}  get a job, with its summary once it's finished
+//	DELETE /jobs/{id}  stop a job, waiting for its requests in flight, or cancel them with ?kill=true
+//
+// Every request must have the agent's token as a bearer token.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nfiacco/loadtester/internal/runner"
+)
+
+const (
+	StatusRunning   = "running"
+	StatusDone      = "done"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// JobSpec is a test to run. The config has the fields of JobConfig in the same form as in the
+// summary file, where durations are in nanoseconds, and fields that are left out get the same
+// defaults as the flags. Headers are given separately since they aren't part of the config.
+type JobSpec struct {
+	Target  string          `json:"target"`
+	Headers []string        `json:"headers,omitempty"`
+	Config  json.RawMessage `json:"config"`
+}
+
+// JobConfig is the part of runner.LoadTestArgs a job can set. Anything that runs commands or reads
+// or writes files on the agent's machine, e.g. header commands or output files, is left out, and a
+// config with any other field is rejected.
+type JobConfig struct {
+	Duration        time.Duration        `json:"duration"`
+	MaxRequests     uint64               `json:"max_requests"`
+	StopAfterIdle   time.Duration        `json:"stop_after_idle"`
+	MaxErrors       uint64               `json:"max_errors,omitempty"`
+	Qps             float64              `json:"qps"`
+	Workers         uint64               `json:"workers"`
+	MaxWorkers      uint64               `json:"max_workers"`
+	AutoScale       bool                 `json:"autoscale"`
+	Timeout         uint64               `json:"timeout"`
+	Method          string               `json:"method"`
+	Mode            string               `json:"mode"`
+	TLSResume       bool                 `json:"tls_resume"`
+	Interval        time.Duration        `json:"interval"`
+	ResultsBuffer   uint64               `json:"results_buffer"`
+	ResultsOverflow string               `json:"results_overflow"`
+	LatencyByCode   bool                 `json:"latency_by_code"`
+	Thresholds      []runner.Threshold   `json:"thresholds,omitempty"`
+	LatencyBuckets  []time.Duration      `json:"latency_buckets,omitempty"`
+	VUs             uint64               `json:"vus"`
+	Iterations      uint64               `json:"iterations"`
+	ConnectRamp     time.Duration        `json:"connect_ramp"`
+	NewConnections  bool                 `json:"new_connections"`
+	Groups          []runner.TargetGroup `json:"groups"`
+	Tag             string               `json:"tag"`
+	ShadowTarget    string               `json:"shadow_target,omitempty"`
+	RunID           string               `json:"run_id,omitempty"`
+	Retries         uint64               `json:"retries,omitempty"`
+	RetryOn         map[string]float64   `json:"retry_on,omitempty"`
+	RetryBudget     float64              `json:"retry_budget,omitempty"`
+	RetryBackoff    time.Duration        `json:"retry_backoff,omitempty"`
+}
+
+// apply sets the fields of the config on the arguments.
+func (c JobConfig) apply(args *runner.LoadTestArgs) {
+	args.Duration, args.MaxRequests, args.StopAfterIdle, args.MaxErrors = c.Duration, c.MaxRequests, c.StopAfterIdle, c.MaxErrors
+	args.Qps, args.Workers, args.MaxWorkers, args.AutoScale = c.Qps, c.Workers, c.MaxWorkers, c.AutoScale
+	args.Timeout, args.Method, args.Mode, args.TLSResume = c.Timeout, c.Method, c.Mode, c.TLSResume
+	args.Interval, args.ResultsBuffer, args.ResultsOverflow = c.Interval, c.ResultsBuffer, c.ResultsOverflow
+	args.LatencyByCode, args.Thresholds, args.LatencyBuckets = c.LatencyByCode, c.Thresholds, c.LatencyBuckets
+	args.VUs, args.Iterations, args.ConnectRamp, args.NewConnections = c.VUs, c.Iterations, c.ConnectRamp, c.NewConnections
+	args.Groups, args.Tag, args.ShadowTarget, args.RunID = c.Groups, c.Tag, c.ShadowTarget, c.RunID
+	args.Retries, args.RetryOn, args.RetryBudget, args.RetryBackoff = c.Retries, c.RetryOn, c.RetryBudget, c.RetryBackoff
+}
+
+type Job struct {
+	ID       string          `json:"id"`
+	Target   string          `json:"target"`
+	Status   string          `json:"status"`
+	Error    string          `json:"error,omitempty"`
+	Started  time.Time       `json:"started"`
+	Finished *time.Time      `json:"finished,omitempty"`
+	Summary  *runner.Summary `json:"summary,omitempty"`
+
+	runner    *runner.Runner
+	cancelled bool
+}
+
+// Agent runs one job at a time, since concurrent tests would compete for the machine's resources
+// and skew each other's results.
+type Agent struct {
+	token string             // Bearer token every request must have
+	hosts *runner.HostPolicy // Hosts jobs can send requests to [nil = any]
+
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	order   []string
+	nextID  int
+	running *Job
+}
+
+// New returns an agent that only serves requests with the token as a bearer token. The token
+// can't be empty, since anyone who can submit a job can send requests from the agent's machine.
+// Jobs can only send requests to the hosts the policy lets be targeted, if it's not nil.
+func New(token string, hosts *runner.HostPolicy) *Agent {
+	if token == "" {
+		panic("agent: empty token")
+	}
+	return &Agent{token: token, hosts: hosts, jobs: map[string]*Job{}}
+}
+
+// DefaultArgs returns the arguments a job's config is applied on top of, matching the defaults of
+// the flags.
+func DefaultArgs() runner.LoadTestArgs {
+	return runner.LoadTestArgs{
+		Qps:          100,
+		Workers:      100,
+		MaxWorkers:   100,
+		AutoScale:    true,
+		Timeout:      30,
+		Method:       http.MethodGet,
+		Mode:         runner.ModeHTTP,
+		OutputFile:   os.DevNull,
+		OutputFormat: runner.OutputFormatCSV,
+		Record:       runner.RecordAll,
+	}
+}
+
+// defaultConfig returns the config of DefaultArgs.
+func defaultConfig() JobConfig {
+	args := DefaultArgs()
+	return JobConfig{
+		Qps:        args.Qps,
+		Workers:    args.Workers,
+		MaxWorkers: args.MaxWorkers,
+		AutoScale:  args.AutoScale,
+		Timeout:    args.Timeout,
+		Method:     args.Method,
+		Mode:       args.Mode,
+	}
+}
+
+// authorized returns whether the request has the agent's token.
+func (a *Agent) authorized(req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+func (a *Agent) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !a.authorized(req) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+		return
+	}
+	id, hasID := strings.CutPrefix(req.URL.Path, "/jobs/")
+	switch {
+	case req.URL.Path == "/jobs" && req.Method == http.MethodGet:
+		a.mu.Lock()
+		jobs := make([]*Job, 0, len(a.order))
+		for _, id := range a.order {
+			jobs = append(jobs, a.jobs[id])
+		}
+		writeJSON(w, http.StatusOK, jobs)
+		a.mu.Unlock()
+	case req.URL.Path == "/jobs" && req.Method == http.MethodPost:
+		// Forms a browser can send from another site without a preflight aren't accepted.
+		if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != "application/json" {
+			writeError(w, http.StatusUnsupportedMediaType, errors.New("the job must be sent as application/json"))
+			return
+		}
+		var spec JobSpec
+		if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid job: %s", err))
+			return
+		}
+		job, err := a.Submit(spec)
+		if errors.Is(err, errBusy) {
+			writeError(w, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		a.mu.Lock()
+		writeJSON(w, http.StatusCreated, job)
+		a.mu.Unlock()
+	case hasID && (req.Method == http.MethodGet || req.Method == http.MethodDelete):
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		job, ok := a.jobs[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no job %q", id))
+			return
+		}
+		if req.Method == http.MethodDelete && job.Status == StatusRunning {
+			job.cancelled = true
+			if kill, _ := strconv.ParseBool(req.URL.Query().Get("kill")); kill {
+				job.runner.Kill()
+			} else {
+				job.runner.Stop()
+			}
+		}
+		writeJSON(w, http.StatusOK, job)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+var errBusy = errors.New("a job is already running")
+
+// Submit starts a job, unless one is already running.
+func (a *Agent) Submit(spec JobSpec) (*Job, error) {
+	args := DefaultArgs()
+	config := defaultConfig()
+	if len(spec.Config) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(spec.Config))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&config); err != nil {
+			return nil, fmt.Errorf("invalid config: %s", err)
+		}
+	}
+	config.apply(&args)
+	for _, s := range spec.Headers {
+		h, err := runner.ParseHeader(s)
+		if err != nil {
+			return nil, err
+		}
+		args.Headers = append(args.Headers, h)
+	}
+	if err := validate(spec.Target, args); err != nil {
+		return nil, err
+	}
+	if !a.hosts.Empty() {
+		// Each job checks hosts afresh, since what they resolve to may have changed.
+		args.HostPolicy = &runner.HostPolicy{
+			Allow:      a.hosts.Allow,
+			Deny:       a.hosts.Deny,
+			Production: a.hosts.Production,
+			ConfirmAll: a.hosts.ConfirmAll,
+		}
+		targets := []string{spec.Target}
+		for _, g := range args.Groups {
+			targets = append(targets, g.Target)
+		}
+		for _, target := range targets {
+			if target == "" {
+				continue
+			}
+			if err := args.HostPolicy.Allowed(context.Background(), target); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running != nil {
+		return nil, errBusy
+	}
+
+	a.nextID++
+	job := &Job{
+		ID:      strconv.Itoa(a.nextID),
+		Target:  spec.Target,
+		Status:  StatusRunning,
+		Started: time.Now(),
+		runner:  runner.NewRunner(spec.Target, args),
+	}
+	a.jobs[job.ID] = job
+	a.order = append(a.order, job.ID)
+	a.running = job
+
+	go a.run(job)
+	return job, nil
+}
+
+func (a *Agent) run(job *Job) {
+	err := job.runner.Run()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	job.Finished = &now
+	job.Summary = job.runner.Summary()
+	switch {
+	case err != nil:
+		job.Status, job.Error = StatusFailed, err.Error()
+	case job.cancelled:
+		job.Status = StatusCancelled
+	default:
+		job.Status = StatusDone
+	}
+	a.running = nil
+}
+
+// Shutdown cancels the running job, if any.
+func (a *Agent) Shutdown() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running != nil {
+		a.running.cancelled = true
+		a.running.runner.Kill()
+	}
+}
+
+// validate checks a job's arguments like the flags are checked, and that the job will end on its
+// own since the agent runs one job at a time.
+func validate(target string, args runner.LoadTestArgs) error {
+	if target == "" && len(args.Groups) == 0 {
+		return errors.New("a target is required")
+	}
+	if args.Qps <= 0 && args.VUs == 0 {
+		return errors.New("qps must be greater than 0")
+	}
+	if err := runner.ValidateTemplate(target); err != nil {
+		return fmt.Errorf("target: %s", err)
+	}
+	for _, g := range args.Groups {
+		if g.Name == "" || g.Target == "" {
+			return fmt.Errorf("group %q: name and target are required", g.Name)
+		}
+		if g.Qps <= 0 {
+			return fmt.Errorf("group %s: qps must be greater than 0", g.Name)
+		}
+		if err := runner.ValidateTemplate(g.Target); err != nil {
+			return fmt.Errorf("group %s: target: %s", g.Name, err)
+		}
+	}
+	switch args.Mode {
+	case runner.ModeHTTP, runner.ModeConnect:
+	case runner.ModeSSE, runner.ModeLongPoll:
+		if args.VUs == 0 {
+			return fmt.Errorf("%s mode requires vus", args.Mode)
+		}
+	default:
+		return fmt.Errorf("invalid mode %q", args.Mode)
+	}
+	if args.ResultsOverflow != "" && args.ResultsOverflow != runner.ResultsOverflowBlock && args.ResultsOverflow != runner.ResultsOverflowDrop {
+		return fmt.Errorf("invalid results_overflow %q", args.ResultsOverflow)
+	}
+	if err := runner.ValidateMethod(args.Method, false); err != nil {
+		return err
+	}
+	if args.LatencyUnit != "" {
+		if _, err := runner.ParseLatencyUnit(args.LatencyUnit); err != nil {
+			return err
+		}
+	}
+	if args.ShadowTarget != "" {
+		if _, err := runner.ParseShadowTarget(args.ShadowTarget); err != nil {
+			return err
+		}
+		if args.Mode != runner.ModeHTTP || len(args.FormFields) > 0 || len(args.FormFiles) > 0 {
+			return errors.New("shadow_target requires http mode without form fields")
+		}
+	}
+	if args.Duration == 0 && args.MaxRequests == 0 && (args.VUs == 0 || args.Iterations == 0) {
+		return errors.New("one of duration, max_requests or iterations is required")
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
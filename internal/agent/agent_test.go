@@ -0,0 +1,138 @@
+package agent_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nfiacco/loadtester/internal/agent"
+	"nfiacco/loadtester/internal/runner"
+)
+
+const token = "secret"
+
+func request(t *testing.T, method, url, body string) (int, agent.Job) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var job agent.Job
+	json.NewDecoder(res.Body).Decode(&job)
+	return res.StatusCode, job
+}
+
+func waitForJob(t *testing.T, url string) agent.Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, job := request(t, http.MethodGet, url, ""); job.Status != agent.StatusRunning {
+			return job
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("job didn't finish")
+	return agent.Job{}
+}
+
+func TestAgent(t *testing.T) {
+	t.Parallel()
+	target := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Test") != "1" {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}),
+	)
+	defer target.Close()
+	api := httptest.NewServer(agent.New(token, nil))
+	defer api.Close()
+
+	code, job := request(t, http.MethodPost, api.URL+"/jobs",
+		`{"target": "`+target.URL+`", "headers": ["X-Test: 1"], "config": {"vus": 1, "iterations": 3}}`)
+	if code != http.StatusCreated {
+		t.Fatalf("got: %v, want: %v", code, http.StatusCreated)
+	}
+	job = waitForJob(t, api.URL+"/jobs/"+job.ID)
+	if job.Status != agent.StatusDone || job.Summary == nil || job.Summary.Successful != 3 {
+		t.Fatalf("got: %+v, want 3 successful requests", job)
+	}
+
+	code, job = request(t, http.MethodPost, api.URL+"/jobs",
+		`{"target": "`+target.URL+`", "config": {"qps": 10, "duration": 60000000000}}`)
+	if code != http.StatusCreated {
+		t.Fatalf("got: %v, want: %v", code, http.StatusCreated)
+	}
+	if code, _ := request(t, http.MethodPost, api.URL+"/jobs", `{"target": "`+target.URL+`", "config": {"max_requests": 1}}`); code != http.StatusConflict {
+		t.Fatalf("got: %v, want: %v while a job is running", code, http.StatusConflict)
+	}
+	request(t, http.MethodDelete, api.URL+"/jobs/"+job.ID, "")
+	if job = waitForJob(t, api.URL+"/jobs/"+job.ID); job.Status != agent.StatusCancelled {
+		t.Fatalf("got: %v, want: %v", job.Status, agent.StatusCancelled)
+	}
+
+	if code, _ := request(t, http.MethodPost, api.URL+"/jobs", `{"target": "`+target.URL+`", "config": {"qps": 10}}`); code != http.StatusBadRequest {
+		t.Fatalf("got: %v, want: %v for a job that never ends", code, http.StatusBadRequest)
+	}
+}
+
+func TestAgentRejects(t *testing.T) {
+	t.Parallel()
+	api := httptest.NewServer(agent.New(token, &runner.HostPolicy{Deny: []string{"127.0.0.2"}}))
+	defer api.Close()
+
+	job := `{"target": "http://127.0.0.1:1", "config": {"max_requests": 1}}`
+	tests := []struct {
+		name, auth, contentType, body string
+		want                          int
+	}{
+		{"no token", "", "application/json", job, http.StatusUnauthorized},
+		{"wrong token", "Bearer nope", "application/json", job, http.StatusUnauthorized},
+		{"form", "Bearer " + token, "text/plain", job, http.StatusUnsupportedMediaType},
+		{"header command", "Bearer " + token, "application/json",
+			`{"target": "http://127.0.0.1:1", "config": {"max_requests": 1, "header_commands": [{"name": "X", "command": "id"}]}}`, http.StatusBadRequest},
+		{"output file", "Bearer " + token, "application/json",
+			`{"target": "http://127.0.0.1:1", "config": {"max_requests": 1, "output_file": "/tmp/x"}}`, http.StatusBadRequest},
+		{"denied host", "Bearer " + token, "application/json",
+			`{"target": "http://127.0.0.2:1", "config": {"max_requests": 1}}`, http.StatusBadRequest},
+		{"invalid target", "Bearer " + token, "application/json",
+			`{"target": "http://127.0.0.1:1/{{randint:1}}", "config": {"max_requests": 1}}`, http.StatusBadRequest},
+		{"group without qps", "Bearer " + token, "application/json",
+			`{"config": {"max_requests": 1, "groups": [{"name": "api", "target": "http://127.0.0.1:1"}]}}`, http.StatusBadRequest},
+		{"group without target", "Bearer " + token, "application/json",
+			`{"config": {"max_requests": 1, "groups": [{"name": "api", "qps": 10}]}}`, http.StatusBadRequest},
+		{"invalid group target", "Bearer " + token, "application/json",
+			`{"config": {"max_requests": 1, "groups": [{"name": "api", "target": "http://127.0.0.1:1/{{randip:x}}", "qps": 10}]}}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodPost, api.URL+"/jobs", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", tt.contentType)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.want {
+			t.Errorf("%s: got: %v, want: %v", tt.name, res.StatusCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Package encrypt encrypts output files to a recipient's public key, so results can be written on
+// shared machines and only read by whoever holds the private key.
+//
+// An encrypted file starts with a header line and an ephemeral X25519 public key. The key shared
+// with the recipient's key is stretched with HKDF-SHA256 into an AES-256-GCM key, and the data is
+// sealed in chunks so files of any size can be encrypted and decrypted as a stream. Each chunk's
+// nonce is its index, with the last byte marking the final chunk so truncation is detected.
+package encrypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	header    = "loadtest-encrypted-v1\n"
+	chunkSize = 64 << 10
+)
+
+// GenerateKey creates a key pair, writing the private key to name and the public key to
+// name.pub, each base64 encoded on a single line.
+func GenerateKey(name string) error {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	private := base64.StdEncoding.EncodeToString(key.Bytes()) + "\n"
+	if err := os.WriteFile(name, []byte(private), 0o600); err != nil {
+		return err
+	}
+	public := base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()) + "\n"
+	return os.WriteFile(name+".pub", []byte(public), 0o644)
+}
+
+func readKey(name string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %s: %s", name, err)
+	}
+	return key, nil
+}
+
+func LoadPublicKey(name string) (*ecdh.PublicKey, error) {
+	key, err := readKey(name)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ecdh.X25519().NewPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %s: %s", name, err)
+	}
+	return pub, nil
+}
+
+func LoadPrivateKey(name string) (*ecdh.PrivateKey, error) {
+	key, err := readKey(name)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key %s: %s", name, err)
+	}
+	return priv, nil
+}
+
+// newAEAD derives the file key from the X25519 shared secret, binding it to both public keys.
+func newAEAD(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	// HKDF-SHA256 extract and expand, where a single block covers the 32 byte key.
+	extract := hmac.New(sha256.New, append(append([]byte{}, ephemeral...), recipient...))
+	extract.Write(shared)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte("loadtest output"))
+	expand.Write([]byte{1})
+
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(aead cipher.AEAD, index uint64, last bool) []byte {
+	n := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-9:], index)
+	if last {
+		n[len(n)-1] = 1
+	}
+	return n
+}
+
+// Writer encrypts everything written to it. Close must be called to write the final chunk, but
+// doesn't close the underlying writer.
+type Writer struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+}
+
+func NewWriter(w io.Writer, recipient *ecdh.PublicKey) (*Writer, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.WriteString(w, header); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(ephemeral.PublicKey().Bytes()); err != nil {
+		return nil, err
+	}
+
+	return &Writer{w: w, aead: aead, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// Keep a full chunk buffered until more data arrives, since it may be the last one.
+		if len(w.buf) == chunkSize {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (w *Writer) flush(last bool) error {
+	sealed := w.aead.Seal(nil, nonce(w.aead, w.index, last), w.buf, nil)
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+func (w *Writer) Close() error {
+	return w.flush(true)
+}
+
+// Reader decrypts a stream written by Writer.
+type Reader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	chunk []byte // Sealed chunk being read
+	buf   []byte // Decrypted data not yet returned
+	index uint64
+	done  bool
+}
+
+func NewReader(r io.Reader, key *ecdh.PrivateKey) (*Reader, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	if err != nil || line != header {
+		return nil, errors.New("not an encrypted loadtest file")
+	}
+
+	ephemeralBytes := make([]byte, 32)
+	if _, err := io.ReadFull(br, ephemeralBytes); err != nil {
+		return nil, fmt.Errorf("error reading header: %s", err)
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralBytes)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(shared, ephemeralBytes, key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{r: br, aead: aead, chunk: make([]byte, chunkSize+aead.Overhead())}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *Reader) next() error {
+	n, err := io.ReadFull(r.r, r.chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// A short chunk has to be the last one.
+		if n < r.aead.Overhead() {
+			return errors.New("encrypted file is truncated")
+		}
+		r.done = true
+	} else if err != nil {
+		return err
+	} else if _, err := r.r.Peek(1); err == io.EOF {
+		r.done = true
+	}
+
+	r.buf, err = r.aead.Open(r.chunk[:0:0], nonce(r.aead, r.index, r.done), r.chunk[:n], nil)
+	if err != nil {
+		return errors.New("encrypted file is corrupted, truncated or for another key")
+	}
+	r.index++
+	return nil
+}
@@ -0,0 +1,72 @@
+package encrypt_test
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"nfiacco/loadtester/internal/encrypt"
+)
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+	name := filepath.Join(t.TempDir(), "key")
+	if err := encrypt.GenerateKey(name); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := encrypt.LoadPublicKey(name + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := encrypt.LoadPrivateKey(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cover an empty file, a partial chunk, exactly one chunk and several chunks.
+	for _, size := range []int{0, 100, 64 << 10, 200 << 10} {
+		want := bytes.Repeat([]byte("1700000000,200,1234,,1,\n"), size/24+1)[:size]
+
+		var sealed bytes.Buffer
+		w, err := encrypt.NewWriter(&sealed, pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(want); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if size > 0 && bytes.Contains(sealed.Bytes(), want[:min(size, 24)]) {
+			t.Fatalf("size %d: output contains the plaintext", size)
+		}
+
+		r, err := encrypt.NewReader(bytes.NewReader(sealed.Bytes()), priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("size %d: got %d bytes back, want: %d", size, len(got), len(want))
+		}
+
+		// Dropping the final chunk has to be detected.
+		if size > 64<<10 {
+			headerSize := len("loadtest-encrypted-v1\n") + 32
+			sealedChunkSize := 64<<10 + 16
+			truncated := sealed.Bytes()[:headerSize+size/(64<<10)*sealedChunkSize]
+			r, err := encrypt.NewReader(bytes.NewReader(truncated), priv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(r); err == nil {
+				t.Fatalf("size %d: expected an error for a truncated file", size)
+			}
+		}
+	}
+}
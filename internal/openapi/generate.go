@@ -0,0 +1,374 @@
+package openapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"nfiacco/loadtester/internal/runner"
+)
+
+// Schemas nested deeper than this only get their required properties, and are null past
+// maxDepth, so recursive schemas end.
+const (
+	optionalDepth = 4
+	maxDepth      = 8
+)
+
+const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// Generator generates requests for operations of a spec, with random parameters and bodies that
+// conform to their schemas. Each request is for an operation picked at random.
+type Generator struct {
+	spec *Spec
+	ops  []*Operation
+	base string
+}
+
+// NewGenerator returns a generator of requests for the operations, sent to the base URL the
+// operations' paths are relative to, e.g. "https://api.com/v1".
+func NewGenerator(spec *Spec, ops []*Operation, base string) (*Generator, error) {
+	for _, op := range ops {
+		if err := spec.check(op); err != nil {
+			return nil, fmt.Errorf("operation %s: %s", op.name(), err)
+		}
+	}
+	return &Generator{spec: spec, ops: ops, base: strings.TrimSuffix(base, "/")}, nil
+}
+
+func (op *Operation) name() string {
+	if op.OperationID != "" {
+		return op.OperationID
+	}
+	return op.Method + " " + op.Path
+}
+
+// bodyType returns the content type of the operation's request body to send, and its schema.
+// JSON is preferred over form bodies.
+func (op *Operation) bodyType() (string, *Schema) {
+	if op.RequestBody == nil {
+		return "", nil
+	}
+	form := ""
+	for ct, c := range op.RequestBody.Content {
+		mediaType := strings.TrimSpace(strings.Split(ct, ";")[0])
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			return ct, c.Schema
+		}
+		if mediaType == "application/x-www-form-urlencoded" {
+			form = ct
+		}
+	}
+	if form != "" {
+		return form, op.RequestBody.Content[form].Schema
+	}
+	return "", nil
+}
+
+// check validates that every schema of the operation resolves, so generating its requests can't
+// fail.
+func (s *Spec) check(op *Operation) error {
+	seen := map[*Schema]bool{}
+	for _, p := range op.Parameters {
+		if err := s.checkSchema(p.Schema, seen); err != nil {
+			return err
+		}
+	}
+	if op.RequestBody != nil && op.RequestBody.Required {
+		if ct, _ := op.bodyType(); ct == "" {
+			return fmt.Errorf("unsupported request body, only JSON and form bodies can be generated")
+		}
+	}
+	_, schema := op.bodyType()
+	return s.checkSchema(schema, seen)
+}
+
+func (s *Spec) checkSchema(schema *Schema, seen map[*Schema]bool) error {
+	if schema == nil || seen[schema] {
+		return nil
+	}
+	seen[schema] = true
+
+	resolved, err := s.resolve(schema)
+	if err != nil {
+		return err
+	}
+	children := append(append(append([]*Schema{resolved, resolved.Items}, resolved.AllOf...), resolved.OneOf...), resolved.AnyOf...)
+	for _, p := range resolved.Properties {
+		children = append(children, p)
+	}
+	for _, c := range children {
+		if err := s.checkSchema(c, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Next generates the next request.
+func (g *Generator) Next() runner.GeneratedRequest {
+	op := g.ops[rand.Intn(len(g.ops))]
+	req := runner.GeneratedRequest{Method: op.Method, Header: http.Header{}}
+
+	path := op.Path
+	query := url.Values{}
+	for _, p := range op.Parameters {
+		if !p.Required && rand.Intn(2) == 0 && p.In != "path" {
+			continue
+		}
+		v := g.value(p.Schema, 0)
+		switch p.In {
+		case "path":
+			path = strings.ReplaceAll(path, "{"+p.Name+"}", url.PathEscape(formatParam(v)))
+		case "query":
+			// Arrays are exploded into a value for each item, the default form style.
+			if items, ok := v.([]any); ok {
+				for _, item := range items {
+					query.Add(p.Name, formatParam(item))
+				}
+			} else {
+				query.Add(p.Name, formatParam(v))
+			}
+		case "header":
+			req.Header.Set(p.Name, formatParam(v))
+		}
+	}
+	req.URL = g.base + path
+	if len(query) > 0 {
+		req.URL += "?" + query.Encode()
+	}
+
+	if ct, schema := op.bodyType(); ct != "" {
+		v := g.value(schema, 0)
+		if strings.Contains(ct, "json") {
+			// Generated values are always encodable.
+			req.Body, _ = json.Marshal(v)
+		} else {
+			form := url.Values{}
+			if obj, ok := v.(map[string]any); ok {
+				for k, field := range obj {
+					form.Set(k, formatParam(field))
+				}
+			}
+			req.Body = []byte(form.Encode())
+		}
+		req.Header.Set("Content-Type", ct)
+	}
+
+	return req
+}
+
+// formatParam formats a parameter value in the simple style, with array items separated by
+// commas.
+func formatParam(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, formatParam(item))
+		}
+		return strings.Join(items, ",")
+	case map[string]any:
+		data, _ := json.Marshal(v)
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// value generates a random value conforming to the schema.
+func (g *Generator) value(schema *Schema, depth int) any {
+	// Schemas were checked to resolve when the generator was created.
+	s, _ := g.spec.resolve(schema)
+	if s == nil || depth > maxDepth {
+		return nil
+	}
+
+	switch {
+	case len(s.Enum) > 0:
+		return s.Enum[rand.Intn(len(s.Enum))]
+	case len(s.OneOf) > 0:
+		return g.value(s.OneOf[rand.Intn(len(s.OneOf))], depth)
+	case len(s.AnyOf) > 0:
+		return g.value(s.AnyOf[rand.Intn(len(s.AnyOf))], depth)
+	case len(s.AllOf) > 0:
+		return g.allOf(s, depth)
+	}
+
+	switch s.Type {
+	case "object":
+		return g.object(s, depth)
+	case "array":
+		lo, hi := bounds(s.MinItems, s.MaxItems, 1, 3)
+		items := make([]any, lo+rand.Intn(hi-lo+1))
+		for i := range items {
+			items[i] = g.value(s.Items, depth+1)
+		}
+		return items
+	case "integer":
+		lo, hi := numberBounds(s)
+		return randInt64(clampInt64(math.Ceil(lo)), clampInt64(math.Floor(hi)))
+	case "number":
+		lo, hi := numberBounds(s)
+		return math.Round((lo+rand.Float64()*(hi-lo))*100) / 100
+	case "boolean":
+		return rand.Intn(2) == 1
+	case "":
+		if len(s.Properties) > 0 {
+			return g.object(s, depth)
+		}
+	}
+	return randomString(s)
+}
+
+func (g *Generator) object(s *Schema, depth int) map[string]any {
+	required := map[string]bool{}
+	for _, name := range s.Required {
+		required[name] = true
+	}
+
+	obj := map[string]any{}
+	for name, prop := range s.Properties {
+		if !required[name] && (depth >= optionalDepth || rand.Intn(2) == 0) {
+			continue
+		}
+		obj[name] = g.value(prop, depth+1)
+	}
+	return obj
+}
+
+// allOf generates a value for all of the schemas, by merging the properties of object schemas.
+func (g *Generator) allOf(s *Schema, depth int) any {
+	merged := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	if other := g.merge(merged, s, 0); other != nil {
+		return g.value(other, depth)
+	}
+	return g.object(merged, depth)
+}
+
+// merge merges the properties of an object schema and of its allOf schemas into merged. It
+// returns the first schema that isn't an object, which can't be merged.
+func (g *Generator) merge(merged, s *Schema, level int) *Schema {
+	s, _ = g.spec.resolve(s)
+	if s == nil || level > maxDepth {
+		return nil
+	}
+	if s.Type != "" && s.Type != "object" {
+		return s
+	}
+	for _, sub := range s.AllOf {
+		if other := g.merge(merged, sub, level+1); other != nil {
+			return other
+		}
+	}
+	for k, p := range s.Properties {
+		merged.Properties[k] = p
+	}
+	merged.Required = append(merged.Required, s.Required...)
+	return nil
+}
+
+// bounds returns the range of a length or count, defaulting to defaultSpread values from
+// defaultMin.
+func bounds(minimum, maximum *int, defaultMin, defaultSpread int) (int, int) {
+	lo := defaultMin
+	if minimum != nil {
+		lo = *minimum
+	}
+	hi := lo + defaultSpread - 1
+	if maximum != nil {
+		hi = *maximum
+	}
+	return lo, max(lo, hi)
+}
+
+func numberBounds(s *Schema) (float64, float64) {
+	lo, hi := 0.0, 1000.0
+	if s.Minimum != nil {
+		lo = *s.Minimum
+		hi = lo + 1000
+	}
+	if s.Maximum != nil {
+		hi = *s.Maximum
+		if s.Minimum == nil {
+			lo = math.Min(0, hi)
+		}
+	}
+	return lo, math.Max(lo, hi)
+}
+
+// maxInt64Float is the largest float64 that converts to an int64 without overflowing.
+var maxInt64Float = math.Nextafter(math.MaxInt64, 0)
+
+// clampInt64 converts a bound to an int64, clamping it to the range of int64.
+func clampInt64(f float64) int64 {
+	return int64(math.Max(math.MinInt64, math.Min(f, maxInt64Float)))
+}
+
+// randInt64 returns a random integer between lo and hi inclusive, or lo if the range is empty,
+// e.g. a fractional range without an integer in it.
+func randInt64(lo, hi int64) int64 {
+	if hi <= lo {
+		return lo
+	}
+	// The span of the full range of int64 doesn't fit in one.
+	span := uint64(hi) - uint64(lo)
+	if span < math.MaxInt64 {
+		return lo + rand.Int63n(int64(span)+1)
+	}
+	for {
+		if v := rand.Uint64(); v <= span {
+			return int64(uint64(lo) + v)
+		}
+	}
+}
+
+func randomString(s *Schema) string {
+	switch s.Format {
+	case "date-time":
+		return randomTime().Format(time.RFC3339)
+	case "date":
+		return randomTime().Format("2006-01-02")
+	case "uuid":
+		b := make([]byte, 16)
+		rand.Read(b)
+		b[6], b[8] = b[6]&0x0f|0x40, b[8]&0x3f|0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	case "email":
+		return randomLetters(8) + "@example.com"
+	case "uri", "url":
+		return "https://example.com/" + randomLetters(8)
+	case "ipv4":
+		return fmt.Sprintf("10.%d.%d.%d", rand.Intn(256), rand.Intn(256), rand.Intn(256))
+	case "byte":
+		b := make([]byte, 12)
+		rand.Read(b)
+		return base64.StdEncoding.EncodeToString(b)
+	}
+
+	lo, hi := bounds(s.MinLength, s.MaxLength, 1, 12)
+	// Keep strings with no practical maximum short.
+	hi = min(hi, lo+64)
+	return randomLetters(lo + rand.Intn(hi-lo+1))
+}
+
+func randomLetters(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+// randomTime returns a time in the past year.
+func randomTime() time.Time {
+	return time.Now().UTC().Add(-time.Duration(rand.Int63n(int64(365 * 24 * time.Hour)))).Truncate(time.Second)
+}
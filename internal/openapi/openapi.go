@@ -0,0 +1,160 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Spec is the subset of an OpenAPI 3 document needed to generate requests.
+type Spec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas    map[string]*Schema    `json:"schemas"`
+		Parameters map[string]*Parameter `json:"parameters"`
+	} `json:"components"`
+}
+
+type Operation struct {
+	Method      string       `json:"-"`
+	Path        string       `json:"-"`
+	OperationID string       `json:"operationId"`
+	Parameters  []*Parameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *Schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+type Parameter struct {
+	Ref      string  `json:"$ref"`
+	Name     string  `json:"name"`
+	In       string  `json:"in"` // "path", "query" or "header". Cookie parameters are skipped
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type Schema struct {
+	Ref        string             `json:"$ref"`
+	Type       string             `json:"type"`
+	Format     string             `json:"format"`
+	Enum       []any              `json:"enum"`
+	Properties map[string]*Schema `json:"properties"`
+	Required   []string           `json:"required"`
+	Items      *Schema            `json:"items"`
+	AllOf      []*Schema          `json:"allOf"`
+	OneOf      []*Schema          `json:"oneOf"`
+	AnyOf      []*Schema          `json:"anyOf"`
+	Minimum    *float64           `json:"minimum"`
+	Maximum    *float64           `json:"maximum"`
+	MinLength  *int               `json:"minLength"`
+	MaxLength  *int               `json:"maxLength"`
+	MinItems   *int               `json:"minItems"`
+	MaxItems   *int               `json:"maxItems"`
+}
+
+var methods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// Load loads an OpenAPI 3 spec. Only JSON specs are supported.
+func Load(name string) (*Spec, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		if ext := filepath.Ext(name); ext == ".yaml" || ext == ".yml" {
+			return nil, fmt.Errorf("error reading %s: only JSON specs are supported, convert it to JSON first", name)
+		}
+		return nil, fmt.Errorf("error reading %s: %s", name, err)
+	}
+	return &spec, nil
+}
+
+// Operations returns the operation with the given operationId, or all of the operations if it's
+// empty, sorted by path and method.
+func (s *Spec) Operations(operationID string) ([]*Operation, error) {
+	paths := make([]string, 0, len(s.Paths))
+	for p := range s.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var ops []*Operation
+	for _, path := range paths {
+		item := s.Paths[path]
+
+		var shared []*Parameter
+		if raw, ok := item["parameters"]; ok {
+			if err := json.Unmarshal(raw, &shared); err != nil {
+				return nil, fmt.Errorf("invalid parameters of %s: %s", path, err)
+			}
+		}
+
+		for _, method := range methods {
+			raw, ok := item[method]
+			if !ok {
+				continue
+			}
+			op := &Operation{Method: strings.ToUpper(method), Path: path}
+			if err := json.Unmarshal(raw, op); err != nil {
+				return nil, fmt.Errorf("invalid operation %s %s: %s", op.Method, path, err)
+			}
+			if operationID != "" && op.OperationID != operationID {
+				continue
+			}
+			if err := s.resolveParameters(op, shared); err != nil {
+				return nil, fmt.Errorf("operation %s %s: %s", op.Method, path, err)
+			}
+			ops = append(ops, op)
+		}
+	}
+
+	if len(ops) == 0 {
+		if operationID != "" {
+			return nil, fmt.Errorf("no operation with operationId %q", operationID)
+		}
+		return nil, fmt.Errorf("no operations in the spec")
+	}
+	return ops, nil
+}
+
+// resolveParameters resolves the references of the operation's parameters, and adds the path's
+// parameters the operation doesn't override.
+func (s *Spec) resolveParameters(op *Operation, shared []*Parameter) error {
+	var params []*Parameter
+	seen := map[string]bool{}
+	for _, p := range append(op.Parameters, shared...) {
+		if p.Ref != "" {
+			name, ok := strings.CutPrefix(p.Ref, "#/components/parameters/")
+			if !ok || s.Components.Parameters[name] == nil {
+				return fmt.Errorf("unresolved parameter %q", p.Ref)
+			}
+			p = s.Components.Parameters[name]
+		}
+		if key := p.In + ":" + p.Name; !seen[key] {
+			seen[key] = true
+			params = append(params, p)
+		}
+	}
+	op.Parameters = params
+	return nil
+}
+
+// resolve returns the schema a reference points to.
+func (s *Spec) resolve(schema *Schema) (*Schema, error) {
+	for depth := 0; schema != nil && schema.Ref != ""; depth++ {
+		name, ok := strings.CutPrefix(schema.Ref, "#/components/schemas/")
+		if !ok || s.Components.Schemas[name] == nil || depth > 32 {
+			return nil, fmt.Errorf("unresolved schema %q", schema.Ref)
+		}
+		schema = s.Components.Schemas[name]
+	}
+	return schema, nil
+}
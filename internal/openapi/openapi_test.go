@@ -0,0 +1,163 @@
+package openapi_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"nfiacco/loadtester/internal/openapi"
+)
+
+const spec = `{
+	"openapi": "3.0.0",
+	"paths": {
+		"/pets/{petId}": {
+			"parameters": [{"name": "petId", "in": "path", "required": true, "schema": {"type": "integer", "minimum": 1, "maximum": 9}}],
+			"get": {
+				"operationId": "getPet",
+				"parameters": [{"$ref": "#/components/parameters/Fields"}]
+			},
+			"put": {
+				"operationId": "updatePet",
+				"requestBody": {
+					"required": true,
+					"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Pet"}}}
+				}
+			}
+		}
+	},
+	"components": {
+		"parameters": {
+			"Fields": {"name": "fields", "in": "query", "required": true, "schema": {"type": "string", "enum": ["name", "tag"]}}
+		},
+		"schemas": {
+			"Pet": {
+				"allOf": [
+					{"$ref": "#/components/schemas/Named"},
+					{"type": "object", "required": ["id", "tags"], "properties": {
+						"id": {"type": "string", "format": "uuid"},
+						"tags": {"type": "array", "minItems": 2, "maxItems": 2, "items": {"type": "string", "maxLength": 4}},
+						"parent": {"$ref": "#/components/schemas/Pet"}
+					}}
+				]
+			},
+			"Named": {"type": "object", "required": ["name"], "properties": {"name": {"type": "string", "minLength": 3, "maxLength": 3}}}
+		}
+	}
+}`
+
+func load(t *testing.T, operationID string) *openapi.Generator {
+	t.Helper()
+	return loadSpec(t, spec, operationID)
+}
+
+func loadSpec(t *testing.T, spec, operationID string) *openapi.Generator {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "spec.json")
+	if err := os.WriteFile(name, []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openapi.Load(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := s.Operations(operationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := openapi.NewGenerator(s, ops, "https://api.com/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestGenerateParameters(t *testing.T) {
+	g := load(t, "getPet")
+	url := regexp.MustCompile(`^https://api\.com/v1/pets/[1-9]\?fields=(name|tag)$`)
+	for i := 0; i < 20; i++ {
+		req := g.Next()
+		if req.Method != http.MethodGet || !url.MatchString(req.URL) || req.Body != nil {
+			t.Fatalf("got: %s %s, want a GET request matching %s", req.Method, req.URL, url)
+		}
+	}
+}
+
+func TestGenerateBody(t *testing.T) {
+	g := load(t, "updatePet")
+	for i := 0; i < 20; i++ {
+		req := g.Next()
+		if req.Method != http.MethodPut || req.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("got: %s %v, want a PUT request with a JSON body", req.Method, req.Header)
+		}
+
+		var pet struct {
+			ID   string   `json:"id"`
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		}
+		if err := json.Unmarshal(req.Body, &pet); err != nil {
+			t.Fatal(err)
+		}
+		if len(pet.ID) != 36 || len(pet.Name) != 3 || len(pet.Tags) != 2 {
+			t.Fatalf("got: %s, want a body conforming to the schema", req.Body)
+		}
+	}
+}
+
+func TestUnknownOperation(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "spec.json")
+	os.WriteFile(name, []byte(spec), 0o644)
+	s, err := openapi.Load(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Operations("deletePet"); err == nil || !strings.Contains(err.Error(), "deletePet") {
+		t.Fatalf("got: %v, want an error for the unknown operation", err)
+	}
+	ops, err := s.Operations("")
+	if err != nil || len(ops) != 2 {
+		t.Fatalf("got: %d operations, %v, want: 2", len(ops), err)
+	}
+}
+
+func TestGenerateIntegerBounds(t *testing.T) {
+	g := loadSpec(t, `{
+		"openapi": "3.0.0",
+		"paths": {
+			"/items": {
+				"get": {
+					"operationId": "getItems",
+					"parameters": [
+						{"name": "big", "in": "query", "required": true, "schema": {"type": "integer", "minimum": 0, "maximum": 18446744073709551615}},
+						{"name": "all", "in": "query", "required": true, "schema": {"type": "integer", "minimum": -1e30, "maximum": 1e30}},
+						{"name": "none", "in": "query", "required": true, "schema": {"type": "integer", "minimum": 0.2, "maximum": 0.8}}
+					]
+				}
+			}
+		}
+	}`, "getItems")
+	for i := 0; i < 100; i++ {
+		req := g.Next()
+		u, err := url.Parse(req.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := u.Query()
+		if big, err := strconv.ParseInt(q.Get("big"), 10, 64); err != nil || big < 0 {
+			t.Fatalf("got big=%s, want a non-negative int64", q.Get("big"))
+		}
+		if _, err := strconv.ParseInt(q.Get("all"), 10, 64); err != nil {
+			t.Fatalf("got all=%s, want an int64", q.Get("all"))
+		}
+		if q.Get("none") != "1" {
+			t.Fatalf("got none=%s, want the lowest bound rounded up", q.Get("none"))
+		}
+	}
+}
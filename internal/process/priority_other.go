@@ -0,0 +1,10 @@
+//go:build !unix
+
+package process
+
+import "errors"
+
+// SetNiceness is not supported on this platform.
+func SetNiceness(nice int) error {
+	return errors.New("setting process niceness is not supported on this platform")
+}
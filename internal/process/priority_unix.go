@@ -0,0 +1,11 @@
+//go:build unix
+
+package process
+
+import "syscall"
+
+// SetNiceness sets the scheduling priority of the current process. Lower values are higher
+// priority, and going below 0 usually requires elevated privileges.
+func SetNiceness(nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice)
+}
@@ -0,0 +1,154 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How long to wait for the webhook to accept an alert.
+	alertTimeout = 10 * time.Second
+	// Alerts waiting to be sent, beyond which new ones are dropped rather than hold up the test.
+	alertQueue = 100
+)
+
+// Alert states.
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// Alert is POSTed as JSON to -alert_webhook when the error rate or p99 latency of an interval
+// crosses its threshold, and again when it's back under it.
+type Alert struct {
+	State     string    `json:"state"`  // firing or resolved
+	Metric    string    `json:"metric"` // error_rate or p99
+	Value     float64   `json:"value"`  // Of the interval, the p99 in seconds
+	Threshold float64   `json:"threshold"`
+	RunID     string    `json:"run_id"`
+	Target    string    `json:"target"`
+	Time      time.Time `json:"time"`
+	Requests  int       `json:"requests"` // Of the interval
+	Failed    int       `json:"failed"`
+}
+
+// alerter checks the summary of each interval against the alert thresholds, and sends an alert
+// to the webhook when a threshold is crossed either way, so a test running unattended pages
+// someone rather than failing silently. Alerts are sent from a goroutine of their own, so a slow
+// webhook doesn't hold up the test.
+type alerter struct {
+	url       string
+	errorRate float64
+	p99       time.Duration
+	runID     string
+	target    string
+	console   io.Writer
+	client    http.Client
+
+	firing    map[string]bool // By metric
+	count     atomic.Uint64   // Alerts sent
+	queue     chan Alert
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (r *Runner) newAlerter() *alerter {
+	// Alerts can go to a shared channel, so they don't leak what -redact_urls hides.
+	target, _ := r.outputConfig()
+	a := &alerter{
+		url:       r.args.AlertWebhook,
+		errorRate: r.args.AlertErrorRate,
+		p99:       r.args.AlertP99,
+		runID:     r.args.RunID,
+		target:    target,
+		console:   r.console,
+		client:    http.Client{Timeout: alertTimeout},
+		firing:    map[string]bool{},
+		queue:     make(chan Alert, alertQueue),
+		done:      make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// check compares the summary of an interval to the thresholds. Intervals without requests are
+// skipped, they say nothing about either.
+func (a *alerter) check(s *Summary) {
+	if s.Requests == 0 {
+		return
+	}
+	if a.errorRate > 0 {
+		a.update(s, "error_rate", s.ErrorRate, a.errorRate)
+	}
+	if a.p99 > 0 {
+		a.update(s, "p99", s.Latency.P99.Seconds(), a.p99.Seconds())
+	}
+}
+
+// update sends an alert if the metric crossed its threshold since the last interval.
+func (a *alerter) update(s *Summary, metric string, value, threshold float64) {
+	firing := value > threshold
+	if firing == a.firing[metric] {
+		return
+	}
+	a.firing[metric] = firing
+	alert := Alert{
+		State:     AlertResolved,
+		Metric:    metric,
+		Value:     value,
+		Threshold: threshold,
+		RunID:     a.runID,
+		Target:    a.target,
+		Time:      time.Now(),
+		Requests:  s.Requests,
+		Failed:    s.Failed,
+	}
+	if firing {
+		alert.State = AlertFiring
+	}
+	select {
+	case a.queue <- alert:
+	default:
+		fmt.Fprintf(a.console, "Warning: too many alerts waiting to be sent, dropping %s alert for %s\n", alert.State, metric)
+	}
+}
+
+func (a *alerter) run() {
+	defer close(a.done)
+	for alert := range a.queue {
+		if err := a.send(alert); err != nil {
+			fmt.Fprintf(a.console, "Warning: error sending %s alert for %s: %s\n", alert.State, alert.Metric, err)
+			continue
+		}
+		a.count.Add(1)
+	}
+}
+
+func (a *alerter) send(alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	res, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("status %s", res.Status)
+	}
+	return nil
+}
+
+// close waits for the alerts still waiting to be sent. It can be called more than once.
+func (a *alerter) close() {
+	a.closeOnce.Do(func() { close(a.queue) })
+	<-a.done
+}
@@ -0,0 +1,327 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategies of picking which of the addresses a host resolves to to send each request to.
+const (
+	DNSRoundRobin = "round-robin" // Each address in turn
+	DNSRandom     = "random"      // An address at random
+	DNSFirst      = "first"       // The first address, as most clients do
+	DNSWeighted   = "weighted"    // An address at random in proportion to its weight
+)
+
+var dnsStrategies = []string{DNSRoundRobin, DNSRandom, DNSFirst, DNSWeighted}
+
+// ParseDNSStrategy parses a strategy for all hosts, e.g. "random", or for one host, e.g.
+// "api.com=first". It returns an empty host for all hosts.
+func ParseDNSStrategy(s string) (host, strategy string, err error) {
+	host, strategy, ok := strings.Cut(s, "=")
+	if !ok {
+		host, strategy = "", s
+	}
+	host, strategy = strings.TrimSpace(host), strings.TrimSpace(strategy)
+	if (ok && host == "") || !slices.Contains(dnsStrategies, strategy) {
+		return "", "", fmt.Errorf("invalid DNS strategy %q, expected [host=]strategy, where strategy is one of %s", s, strings.Join(dnsStrategies, ", "))
+	}
+	return host, strategy, nil
+}
+
+// ParseDNSWeight parses the weight of an address for the weighted DNS strategy, e.g.
+// "10.0.0.1=3".
+func ParseDNSWeight(s string) (addr string, weight float64, err error) {
+	addr, w, ok := strings.Cut(s, "=")
+	addr = strings.TrimSpace(addr)
+	if !ok || net.ParseIP(addr) == nil {
+		return "", 0, fmt.Errorf("invalid DNS weight %q, expected \"address=weight\"", s)
+	}
+	weight, err = strconv.ParseFloat(strings.TrimSpace(w), 64)
+	if err != nil || weight <= 0 {
+		return "", 0, fmt.Errorf("invalid DNS weight %q, the weight must be positive", s)
+	}
+	return addr, weight, nil
+}
+
+const (
+	// How long the addresses of a host are used before it's resolved again, so backends added to
+	// or removed from DNS during a long test are followed.
+	backendsRefresh = 30 * time.Second
+	// How long to wait for a host to resolve again before trying later.
+	backendsResolveTimeout = 10 * time.Second
+)
+
+// backends spreads requests across the addresses each target host resolves to, e.g. the hosts
+// behind DNS round-robin, picking them with the host's DNS strategy and optionally limiting the
+// rate sent to each, so one unlucky backend isn't crushed while others idle. Hosts are resolved
+// the first time they're requested, and again in the background every backendsRefresh.
+type backends struct {
+	qps        float64           // Most requests per second to each address [0 = no limit]
+	strategies map[string]string // By host, "" for all hosts
+	weights    map[string]float64
+	rand       *rand.Rand
+
+	hosts sync.Map // *hostBackends by host
+}
+
+type hostBackends struct {
+	addrs      []string
+	strategy   string
+	cumulative []float64 // Running total of the weights, with the weighted strategy
+
+	resolved   atomic.Int64 // Unix nanoseconds of when the host was last resolved, or tried to be
+	refreshing atomic.Bool  // Whether the host is being resolved again
+
+	mu   sync.Mutex
+	next []time.Time // When each address can next be sent a request
+	turn int         // Round-robin position
+}
+
+func newBackends(qps float64, strategies map[string]string, weights map[string]float64, rng *rand.Rand) *backends {
+	return &backends{qps: qps, strategies: strategies, weights: weights, rand: rng}
+}
+
+// lookup returns the addresses of a host, starting to resolve it again if they're stale.
+func (b *backends) lookup(ctx context.Context, host string) (*hostBackends, error) {
+	if v, ok := b.hosts.Load(host); ok {
+		hb := v.(*hostBackends)
+		if time.Since(time.Unix(0, hb.resolved.Load())) > backendsRefresh && hb.refreshing.CompareAndSwap(false, true) {
+			go b.refresh(host, hb)
+		}
+		return hb, nil
+	}
+
+	hb, err := b.resolve(ctx, host, nil)
+	if err != nil {
+		return nil, err
+	}
+	v, _ := b.hosts.LoadOrStore(host, hb)
+	return v.(*hostBackends), nil
+}
+
+// refresh resolves a host again, replacing its addresses. If that fails, the old ones are kept
+// until the next try.
+func (b *backends) refresh(host string, old *hostBackends) {
+	ctx, cancel := context.WithTimeout(context.Background(), backendsResolveTimeout)
+	defer cancel()
+	hb, err := b.resolve(ctx, host, old)
+	if err != nil {
+		old.resolved.Store(time.Now().UnixNano())
+		old.refreshing.Store(false)
+		return
+	}
+	b.hosts.Store(host, hb)
+}
+
+// resolve looks up the addresses of a host. The addresses it had before, if any, keep their
+// rate limits.
+func (b *backends) resolve(ctx context.Context, host string, old *hostBackends) (*hostBackends, error) {
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	hb := &hostBackends{addrs: addrs, strategy: b.strategy(host), next: make([]time.Time, len(addrs))}
+	hb.resolved.Store(time.Now().UnixNano())
+	if old != nil {
+		old.mu.Lock()
+		for i, addr := range addrs {
+			if j := slices.Index(old.addrs, addr); j >= 0 {
+				hb.next[i] = old.next[j]
+			}
+		}
+		hb.turn = old.turn
+		old.mu.Unlock()
+	}
+	if hb.strategy == DNSWeighted {
+		total := 0.0
+		for _, addr := range addrs {
+			w, ok := b.weights[addr]
+			if !ok {
+				w = 1
+			}
+			total += w
+			hb.cumulative = append(hb.cumulative, total)
+		}
+	}
+	return hb, nil
+}
+
+// strategy returns the DNS strategy of a host.
+func (b *backends) strategy(host string) string {
+	if s, ok := b.strategies[host]; ok {
+		return s
+	}
+	if s, ok := b.strategies[""]; ok {
+		return s
+	}
+	return DNSRoundRobin
+}
+
+// pick returns the position of the address the host's strategy picks.
+func (hb *hostBackends) pick(rng *rand.Rand) int {
+	switch hb.strategy {
+	case DNSFirst:
+		return 0
+	case DNSRandom:
+		return rng.Intn(len(hb.addrs))
+	case DNSWeighted:
+		x := rng.Float64() * hb.cumulative[len(hb.cumulative)-1]
+		return min(sort.SearchFloat64s(hb.cumulative, x), len(hb.addrs)-1)
+	}
+	return hb.turn % len(hb.addrs)
+}
+
+// reserve picks the address to send a request to: the one the host's strategy picks if it's free
+// now, otherwise the next one after it that is, or otherwise the one free soonest. It returns the
+// address and when the request can be sent to it.
+func (b *backends) reserve(hb *hostBackends) (string, time.Time) {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+
+	now := time.Now()
+	best := -1
+	start := hb.pick(b.rand)
+	for i := range hb.addrs {
+		j := (start + i) % len(hb.addrs)
+		if !hb.next[j].After(now) {
+			best = j
+			break
+		}
+		if best == -1 || hb.next[j].Before(hb.next[best]) {
+			best = j
+		}
+	}
+
+	at := now
+	if hb.next[best].After(now) {
+		at = hb.next[best]
+	}
+	if b.qps > 0 {
+		hb.next[best] = at.Add(time.Duration(float64(time.Second) / b.qps))
+	}
+	hb.turn = best + 1
+	return hb.addrs[best], at
+}
+
+// roundTripCloser is a transport whose idle connections can be closed.
+type roundTripCloser interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// backendTransport sends each request to the address picked by backends, with a transport for
+// each address so connections are pooled by address.
+type backendTransport struct {
+	backends *backends
+	base     *http.Transport
+	dial     dialFunc
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+// withBackends returns the transport to send requests with: the given one, or with -per_host_qps
+// or -dns_strategy, one spreading requests across the target's addresses.
+func (r *Runner) withBackends(t *http.Transport) roundTripCloser {
+	if r.backends == nil {
+		return t
+	}
+	return &backendTransport{
+		backends:   r.backends,
+		base:       t,
+		dial:       r.dialContext(),
+		transports: map[string]*http.Transport{},
+	}
+}
+
+func (t *backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	hb, err := t.backends.lookup(req.Context(), req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	addr, at := t.backends.reserve(hb)
+
+	info, _ := req.Context().Value(backendKey{}).(*backendInfo)
+	if wait := time.Until(at); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		if info != nil {
+			info.wait += wait
+		}
+	}
+	if info != nil {
+		info.addr = addr
+	}
+
+	return t.transport(addr).RoundTrip(req)
+}
+
+func (t *backendTransport) transport(addr string) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tr, ok := t.transports[addr]; ok {
+		return tr
+	}
+
+	tr := t.base.Clone()
+	// Preconnected connections aren't to a particular address.
+	tr.DialTLSContext = nil
+	tr.DialContext = func(ctx context.Context, network, hostport string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(hostport)
+		if err != nil {
+			return nil, err
+		}
+		return t.dial(ctx, network, net.JoinHostPort(addr, port))
+	}
+	t.transports[addr] = tr
+	return tr
+}
+
+func (t *backendTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tr := range t.transports {
+		tr.CloseIdleConnections()
+	}
+}
+
+type backendKey struct{}
+
+// backendInfo is where a request was sent, and how long it waited for the address's rate limit.
+type backendInfo struct {
+	addr string
+	wait time.Duration
+}
+
+// trackBackend records the address a request is sent to in its result, with -per_host_qps or
+// -dns_strategy. The time the request waited for the address's rate limit is counted as queue
+// delay instead of latency, so the returned function must be called before the latency is
+// measured.
+func (r *Runner) trackBackend(ctx context.Context, result *Result) (context.Context, func()) {
+	if r.backends == nil {
+		return ctx, func() {}
+	}
+	info := &backendInfo{}
+	return context.WithValue(ctx, backendKey{}, info), func() {
+		result.Backend = info.addr
+		result.Timestamp = result.Timestamp.Add(info.wait)
+		result.QueueDelay += info.wait
+	}
+}
@@ -0,0 +1,64 @@
+package runner
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DefaultResultsBuffer is the default size of the results channel, enough to absorb the output
+// writer briefly stalling at high rates.
+const DefaultResultsBuffer = 1024
+
+const (
+	ResultsOverflowBlock = "block"
+	ResultsOverflowDrop  = "drop"
+)
+
+// Backpressure is how often sending a result to the results channel found it full, because
+// whatever reads it, e.g. the output writer, couldn't keep up. Blocked workers send their next
+// requests late, so the test no longer measures what it was meant to.
+type Backpressure struct {
+	Blocked     uint64        `json:"blocked"`      // Results whose worker blocked until there was room
+	BlockedTime time.Duration `json:"blocked_time"` // Total time workers were blocked
+	Dropped     uint64        `json:"dropped"`      // Results dropped instead, with the drop overflow
+}
+
+type backpressure struct {
+	blocked     atomic.Uint64
+	blockedTime atomic.Int64
+	dropped     atomic.Uint64
+}
+
+func (b *backpressure) stats() *Backpressure {
+	s := &Backpressure{
+		Blocked:     b.blocked.Load(),
+		BlockedTime: time.Duration(b.blockedTime.Load()),
+		Dropped:     b.dropped.Load(),
+	}
+	if s.Blocked == 0 && s.Dropped == 0 {
+		return nil
+	}
+	return s
+}
+
+func (r *Runner) newResultsChannel() chan *Result {
+	return make(chan *Result, r.args.ResultsBuffer)
+}
+
+// deliver sends a result to the results channel, counting the sends that found it full.
+func (r *Runner) deliver(results chan<- *Result, result *Result) {
+	select {
+	case results <- result:
+		return
+	default:
+	}
+
+	if r.args.ResultsOverflow == ResultsOverflowDrop {
+		r.backpressure.dropped.Add(1)
+		return
+	}
+	start := time.Now()
+	results <- result
+	r.backpressure.blocked.Add(1)
+	r.backpressure.blockedTime.Add(int64(time.Since(start)))
+}
@@ -0,0 +1,46 @@
+package runner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LatencyBucket is the fraction of requests that completed within a latency.
+type LatencyBucket struct {
+	Le       time.Duration `json:"le"`
+	Fraction float64       `json:"fraction"`
+}
+
+// ParseLatencyBuckets parses a comma separated list of latencies, e.g. "100ms,250ms,1s".
+func ParseLatencyBuckets(s string) ([]time.Duration, error) {
+	var buckets []time.Duration
+	for _, field := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(field))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid latency bucket %q, expected a positive duration", field)
+		}
+		buckets = append(buckets, d)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+
+	return buckets, nil
+}
+
+func computeLatencyBuckets(buckets []time.Duration, latencies []time.Duration) []LatencyBucket {
+	counts := make([]int, len(buckets))
+	for _, l := range latencies {
+		for i, le := range buckets {
+			if l <= le {
+				counts[i]++
+			}
+		}
+	}
+
+	result := make([]LatencyBucket, len(buckets))
+	for i, le := range buckets {
+		result[i] = LatencyBucket{Le: le, Fraction: float64(counts[i]) / float64(len(latencies))}
+	}
+	return result
+}
@@ -0,0 +1,58 @@
+package runner
+
+import (
+	"net/http"
+	"sync"
+)
+
+type validators struct {
+	etag         string
+	lastModified string
+}
+
+// validatorCache stores the ETag and Last-Modified validators from responses, so subsequent
+// requests to the same URL can be made conditional like a browser cache would.
+type validatorCache struct {
+	mu      sync.Mutex
+	entries map[string]validators
+}
+
+func newValidatorCache() *validatorCache {
+	return &validatorCache{entries: map[string]validators{}}
+}
+
+func (c *validatorCache) apply(req *http.Request) {
+	c.mu.Lock()
+	v, ok := c.entries[req.URL.String()]
+	c.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	if v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	}
+	if v.lastModified != "" {
+		req.Header.Set("If-Modified-Since", v.lastModified)
+	}
+}
+
+func (c *validatorCache) store(req *http.Request, res *http.Response) {
+	// A 304 carries no new representation, so keep the validators we already have.
+	if res.StatusCode == http.StatusNotModified {
+		return
+	}
+
+	v := validators{
+		etag:         res.Header.Get("ETag"),
+		lastModified: res.Header.Get("Last-Modified"),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v.etag == "" && v.lastModified == "" {
+		delete(c.entries, req.URL.String())
+	} else {
+		c.entries[req.URL.String()] = v
+	}
+}
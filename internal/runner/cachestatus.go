@@ -0,0 +1,82 @@
+package runner
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Whether a response was served by a cache in front of the target, e.g. a CDN or reverse proxy.
+const (
+	CacheHit    = "hit"
+	CacheMiss   = "miss"
+	CacheStale  = "stale"  // Served stale or revalidated with the origin
+	CacheBypass = "bypass" // Not cacheable, passed through to the origin
+)
+
+// cacheStatus classifies a response by its cache status headers: the standard Cache-Status,
+// Cloudflare's CF-Cache-Status, the X-Cache of most other CDNs and proxies, or otherwise a
+// non-zero Age. It returns "" if the response has none of them.
+func cacheStatus(h http.Header) string {
+	if v := h.Get("Cache-Status"); v != "" {
+		return parseCacheStatus(v)
+	}
+	for _, name := range []string{"CF-Cache-Status", "X-Cache"} {
+		if v := h.Get(name); v != "" {
+			// With layered caches, e.g. "MISS, HIT", the last is the one nearest the client.
+			values := strings.Split(v, ",")
+			return classifyCacheValue(values[len(values)-1])
+		}
+	}
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil && age > 0 {
+		return CacheHit
+	}
+	return ""
+}
+
+// parseCacheStatus classifies an RFC 9211 Cache-Status header, e.g. "CDN; fwd=uri-miss", by its
+// last cache, the one nearest the client.
+func parseCacheStatus(v string) string {
+	caches := strings.Split(v, ",")
+	params := strings.Split(caches[len(caches)-1], ";")
+	for _, p := range params[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(p), "=")
+		switch {
+		case name == "hit":
+			return CacheHit
+		case name == "fwd" && value == "stale":
+			return CacheStale
+		case name == "fwd" && value == "bypass":
+			return CacheBypass
+		case name == "fwd":
+			return CacheMiss
+		}
+	}
+	return ""
+}
+
+// classifyCacheValue classifies a CDN's cache status value, e.g. "HIT", "TCP_MISS", "Hit from
+// cloudfront" or "EXPIRED".
+func classifyCacheValue(v string) string {
+	v = strings.ToUpper(v)
+	has := func(words ...string) bool {
+		for _, w := range words {
+			if strings.Contains(v, w) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case has("STALE", "EXPIRED", "REVALIDATED", "UPDATING", "REFRESH"):
+		return CacheStale
+	case has("HIT"):
+		return CacheHit
+	case has("MISS"):
+		return CacheMiss
+	case has("BYPASS", "DYNAMIC", "PASS"):
+		return CacheBypass
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+package runner
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+)
+
+// Ways a request can be cut short on purpose.
+const (
+	ChaosAbort = "abort" // Cancelled once it's sent
+	ChaosDrop  = "drop"  // Its connection reset once it's sent
+)
+
+// Chaos cuts a share of the requests short once they're sent, like clients that give up or
+// vanish, to load test how the target handles client disconnects. A request cut short succeeds,
+// and is reported separately in the summary.
+type Chaos struct {
+	AbortRate float64 `json:"abort_rate,omitempty"`
+	DropRate  float64 `json:"drop_rate,omitempty"`
+}
+
+// pick returns how to cut a request short, or "" to leave it alone.
+func (c *Chaos) pick(rng *rand.Rand) string {
+	if c == nil {
+		return ""
+	}
+	switch x := rng.Float64(); {
+	case x < c.AbortRate:
+		return ChaosAbort
+	case x < c.AbortRate+c.DropRate:
+		return ChaosDrop
+	}
+	return ""
+}
+
+// chaosCut is how a request picked to be cut short was, once it's done.
+type chaosCut struct {
+	cancel context.CancelFunc
+	how    atomic.Pointer[string] // How it was cut short [nil = it wasn't]
+}
+
+// noChaos is the cut of the requests left alone.
+var noChaos = &chaosCut{cancel: func() {}}
+
+// happened returns how the request was cut short, or "" if it wasn't, e.g. it failed before it
+// was written, so its error is its own.
+func (c *chaosCut) happened() string {
+	if how := c.how.Load(); how != nil {
+		return *how
+	}
+	return ""
+}
+
+// done must be called when the request is done.
+func (c *chaosCut) done() {
+	c.cancel()
+}
+
+// withChaos picks whether to cut a request short, with -abort_rate and -drop_connection_rate,
+// and if so returns a context that does so once the request is written. The result's Chaos is
+// how it was picked to be cut short until it's done, when it's set to cut.happened(). A
+// connection of HTTP/2 is shared by other requests, so a request on one is cancelled instead of
+// its connection being reset.
+func (r *Runner) withChaos(ctx context.Context, result *Result) (context.Context, *chaosCut) {
+	how := r.args.Chaos.pick(r.rand)
+	if result.Chaos = how; how == "" {
+		return ctx, noChaos
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	cut := &chaosCut{cancel: cancel}
+
+	var mu sync.Mutex
+	var conn net.Conn
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			conn = info.Conn
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if how == ChaosDrop && conn != nil && !isHTTP2(conn) {
+				cut.how.Store(&how)
+				resetConn(conn)
+				return
+			}
+			abort := ChaosAbort
+			cut.how.Store(&abort)
+			cancel()
+		},
+	}), cut
+}
+
+func isHTTP2(conn net.Conn) bool {
+	tc, ok := conn.(*tls.Conn)
+	return ok && tc.ConnectionState().NegotiatedProtocol == "h2"
+}
+
+// resetConn closes a connection with a TCP reset rather than a graceful close, as if the client
+// vanished.
+func resetConn(conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
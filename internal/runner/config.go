@@ -0,0 +1,53 @@
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ConfigValue is a flag set by a config file.
+type ConfigValue struct {
+	Name  string
+	Value string
+}
+
+// ParseConfig parses a config file of "flag = value" lines, e.g. "qps = 500" or
+// "header = Authorization: Bearer xyz". Repeatable flags can be given on several lines. Blank
+// lines and lines starting with "#" are skipped.
+func ParseConfig(r io.Reader) ([]ConfigValue, error) {
+	var values []ConfigValue
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimPrefix(strings.TrimSpace(name), "-")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d: expected \"flag = value\"", n)
+		}
+		values = append(values, ConfigValue{Name: name, Value: strings.TrimSpace(value)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func LoadConfig(name string) ([]ConfigValue, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values, err := ParseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config %s: %s", name, err)
+	}
+	return values, nil
+}
@@ -0,0 +1,89 @@
+package runner
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"time"
+)
+
+// connect establishes a TCP connection to the target, and a TLS session on top of it for https
+// targets, without sending a request. It's used to load test connection setup such as TLS
+// terminators.
+func (r *Runner) connect(lt *loadTest, l *lane) *Result {
+	result := r.newResult(lt, l)
+	defer func() {
+		result.Latency = time.Since(result.Timestamp)
+	}()
+
+	var vars map[string]string
+	if r.args.Feeder != nil {
+		vars = r.args.Feeder.Next()
+	}
+
+	target, _ := r.renderTarget(l, vars, result)
+	u, err := url.Parse(target)
+	if err != nil {
+		result.fail(err)
+		return result
+	}
+	if r.args.HostPolicy != nil {
+		if err := r.args.HostPolicy.allow(r.ctx, u.Hostname()); err != nil {
+			result.fail(err)
+			return result
+		}
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, time.Duration(r.args.Timeout)*time.Second)
+	defer cancel()
+
+	if !r.clientDelay() {
+		result.fail(r.ctx.Err())
+		return result
+	}
+	start := time.Now()
+	conn, err := r.dialContext()(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	result.Connect = time.Since(start)
+	if err != nil {
+		result.fail(err)
+		return result
+	}
+	defer conn.Close()
+
+	if u.Scheme != "https" {
+		return result
+	}
+
+	config := &tls.Config{}
+	if c := r.tlsConfig(); c != nil {
+		config = c
+	}
+	config.ServerName = u.Hostname()
+	tlsConn := tls.Client(conn, config)
+	start = time.Now()
+	err = tlsConn.HandshakeContext(ctx)
+	result.TLSHandshake = time.Since(start)
+	if err != nil {
+		result.fail(err)
+		return result
+	}
+	state := tlsConn.ConnectionState()
+	result.TLSVersion, result.Resumed = tls.VersionName(state.Version), state.DidResume
+
+	if r.sessionCache != nil {
+		// TLS 1.3 session tickets are sent after the handshake, and are only processed when
+		// reading from the connection.
+		tlsConn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		tlsConn.Read(make([]byte, 1))
+	}
+
+	return result
+}
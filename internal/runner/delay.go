@@ -0,0 +1,46 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ParseDelay parses a delay with an optional jitter, e.g. "20ms" or "20ms±5ms". "+-" can be used
+// instead of "±".
+func ParseDelay(s string) (time.Duration, time.Duration, error) {
+	base, jitter, ok := strings.Cut(strings.ReplaceAll(s, "+-", "±"), "±")
+	d, err := time.ParseDuration(strings.TrimSpace(base))
+	if err != nil || d < 0 {
+		return 0, 0, fmt.Errorf("invalid delay %q, expected e.g. \"20ms\" or \"20ms±5ms\"", s)
+	}
+	if !ok {
+		return d, 0, nil
+	}
+	j, err := time.ParseDuration(strings.TrimSpace(jitter))
+	if err != nil || j < 0 || j > d {
+		return 0, 0, fmt.Errorf("invalid delay %q, the jitter must be a duration of at most the delay", s)
+	}
+	return d, j, nil
+}
+
+// clientDelay waits for -client_delay before a request is sent, to simulate a distant client. The
+// delay is picked uniformly within the jitter. It returns false if the test is killed meanwhile.
+func (r *Runner) clientDelay() bool {
+	d := r.args.ClientDelay
+	if d == 0 {
+		return true
+	}
+	if j := r.args.ClientDelayJitter; j > 0 {
+		d += time.Duration(r.rand.Int63n(int64(2*j)+1)) - j
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
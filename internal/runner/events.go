@@ -0,0 +1,66 @@
+package runner
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	OutputFormatCSV    = "csv"
+	OutputFormatEvents = "events"
+)
+
+const (
+	EventRunStart        = "run-start"
+	EventIntervalSummary = "interval-summary"
+	EventScaleUp         = "scale-up"
+	EventResultSample    = "result-sample"
+	EventRunEnd          = "run-end"
+)
+
+// Event is a line of the NDJSON event stream written with the "events" output format. Only the
+// fields relevant to the event's type are set.
+type Event struct {
+	Type    string             `json:"type"`
+	Time    time.Time          `json:"time"`
+	Target  string             `json:"target,omitempty"`
+	Config  *LoadTestArgs      `json:"config,omitempty"`
+	Tag     string             `json:"tag,omitempty"`
+	Workers uint64             `json:"workers,omitempty"`
+	Result  *Result            `json:"result,omitempty"`
+	Summary *Summary           `json:"summary,omitempty"`
+	Changes []string           `json:"changes,omitempty"`
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+
+	SchemaVersion int `json:"schema_version,omitempty"`
+}
+
+// eventWriter writes events as NDJSON. It's safe to use from multiple goroutines.
+type eventWriter struct {
+	mu   sync.Mutex
+	enc  *json.Encoder
+	unit string // Of the durations
+}
+
+func newEventWriter(w io.Writer, unit string) *eventWriter {
+	return &eventWriter{enc: json.NewEncoder(w), unit: unit}
+}
+
+func (e *eventWriter) write(event Event) error {
+	event.Time = time.Now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc.Encode(inLatencyUnit(event, e.unit))
+}
+
+// emit publishes an event, and writes it if the events output format is enabled. Failing to write
+// events from the scheduler isn't fatal, the result writer reports errors writing the output.
+func (r *Runner) emit(event Event) {
+	r.publish(event)
+	if r.events != nil {
+		r.events.write(event)
+	}
+}
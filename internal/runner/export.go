@@ -0,0 +1,175 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// exporter pushes summaries to an external metrics system, so results land next to production
+// dashboards. Interval summaries cover the results since the previous interval, the final
+// summary covers the whole test.
+type exporter interface {
+	export(s *Summary, final bool) error
+}
+
+func (r *Runner) newExporters() ([]exporter, error) {
+	var exporters []exporter
+	if r.args.PushgatewayURL != "" {
+		exporters = append(exporters, &pushgatewayExporter{url: r.args.PushgatewayURL, job: r.args.ExportJob})
+	}
+	if r.args.InfluxDBURL != "" {
+		exporters = append(exporters, &influxDBExporter{url: r.args.InfluxDBURL, measurement: r.args.ExportJob})
+	}
+	if r.args.StatsdAddr != "" {
+		exporters = append(exporters, &statsdExporter{addr: r.args.StatsdAddr, prefix: r.args.ExportJob})
+	}
+	if r.args.GrafanaAddr != "" {
+		e, err := newGrafanaExporter(r.args.GrafanaAddr)
+		if err != nil {
+			return nil, fmt.Errorf("error serving the Grafana datasource: %s", err)
+		}
+		exporters = append(exporters, e)
+	}
+
+	return exporters, nil
+}
+
+func exportSummary(exporters []exporter, s *Summary, final bool) error {
+	for _, e := range exporters {
+		if err := e.export(s, final); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func phase(final bool) string {
+	if final {
+		return "final"
+	}
+	return "interval"
+}
+
+type metric struct {
+	name  string
+	value float64
+}
+
+// summaryMetrics returns the metrics exported from a summary, with latencies in seconds.
+func summaryMetrics(s *Summary) []metric {
+	metrics := []metric{
+		{"requests", float64(s.Requests)},
+		{"successful", float64(s.Successful)},
+		{"failed", float64(s.Failed)},
+		{"error_rate", s.ErrorRate},
+		{"throughput", s.Throughput},
+		{"latency_mean_seconds", s.Latency.Mean.Seconds()},
+		{"latency_p50_seconds", s.Latency.P50.Seconds()},
+		{"latency_p90_seconds", s.Latency.P90.Seconds()},
+		{"latency_p95_seconds", s.Latency.P95.Seconds()},
+		{"latency_p99_seconds", s.Latency.P99.Seconds()},
+		{"latency_max_seconds", s.Latency.Max.Seconds()},
+		{"connections_new", float64(s.NewConnections)},
+		{"connections_reused", float64(s.ReusedConnections)},
+		{"connection_reuse_rate", s.ReuseRate},
+		{"cache_hit_rate", s.CacheHitRate},
+	}
+	// Every kind is exported, so each has a series to graph even while there are none.
+	for _, kind := range FailureKinds {
+		metrics = append(metrics, metric{"failed_" + kind, float64(s.Failures[kind])})
+	}
+	return metrics
+}
+
+var exportClient = http.Client{Timeout: 10 * time.Second}
+
+func post(method, url, contentType string, body []byte) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	res, err := exportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s", method, url, res.Status)
+	}
+
+	return nil
+}
+
+// pushgatewayExporter pushes gauges to a Prometheus Pushgateway, replacing the job's previous
+// metrics on every push.
+type pushgatewayExporter struct {
+	url string
+	job string
+}
+
+func (e *pushgatewayExporter) export(s *Summary, final bool) error {
+	var b strings.Builder
+	for _, m := range summaryMetrics(s) {
+		fmt.Fprintf(&b, "# TYPE %s_%s gauge\n", e.job, m.name)
+		fmt.Fprintf(&b, "%s_%s{phase=%q} %g\n", e.job, m.name, phase(final), m.value)
+	}
+
+	u := strings.TrimSuffix(e.url, "/") + "/metrics/job/" + url.PathEscape(e.job)
+	if err := post(http.MethodPut, u, "text/plain; version=0.0.4", []byte(b.String())); err != nil {
+		return fmt.Errorf("pushing to Pushgateway: %s", err)
+	}
+
+	return nil
+}
+
+// influxDBExporter writes a point in InfluxDB line protocol to a write endpoint, e.g.
+// "http://localhost:8086/write?db=loadtest".
+type influxDBExporter struct {
+	url         string
+	measurement string
+}
+
+func (e *influxDBExporter) export(s *Summary, final bool) error {
+	fields := make([]string, 0, len(summaryMetrics(s)))
+	for _, m := range summaryMetrics(s) {
+		fields = append(fields, fmt.Sprintf("%s=%g", m.name, m.value))
+	}
+	line := fmt.Sprintf("%s,phase=%s %s %d\n", e.measurement, phase(final), strings.Join(fields, ","), time.Now().UnixNano())
+
+	if err := post(http.MethodPost, e.url, "text/plain; charset=utf-8", []byte(line)); err != nil {
+		return fmt.Errorf("writing to InfluxDB: %s", err)
+	}
+
+	return nil
+}
+
+// statsdExporter sends gauges to a Datadog agent using the DogStatsD protocol.
+type statsdExporter struct {
+	addr   string
+	prefix string
+}
+
+func (e *statsdExporter) export(s *Summary, final bool) error {
+	conn, err := net.Dial("udp", e.addr)
+	if err != nil {
+		return fmt.Errorf("sending to statsd: %s", err)
+	}
+	defer conn.Close()
+
+	for _, m := range summaryMetrics(s) {
+		if _, err := fmt.Fprintf(conn, "%s.%s:%g|g|#phase:%s", e.prefix, m.name, m.value, phase(final)); err != nil {
+			return fmt.Errorf("sending to statsd: %s", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package runner
+
+import "time"
+
+// Unexported functions tested directly in runner_test.
+var (
+	Percentile          = percentile
+	ComputeLatencyStats = computeLatencyStats
+	PrintSummary        = printResultSummary
+	BuildHeatmap        = buildHeatmap
+	HeatmapBuckets      = heatmapBuckets
+)
+
+// SchedulingErrorStats returns the stats of the scheduling errors, as the summary reports them.
+func SchedulingErrorStats(errors []time.Duration) *LatencyStats {
+	var s schedulingErrors
+	for _, d := range errors {
+		s.add(d)
+	}
+	return s.stats()
+}
+
+// ServeGrafana serves summaries on addr as the interval summaries of a test, followed by a final
+// one, like the Grafana datasource does while a test runs.
+func ServeGrafana(addr string, intervals []*Summary, final *Summary) (func() error, error) {
+	e, err := newGrafanaExporter(addr)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range intervals {
+		e.export(s, false)
+	}
+	e.export(final, true)
+	return e.close, nil
+}
+
+// TraceFallback traces connection attempts to addrs, pausing between them, of which connected
+// succeeded, and returns the fallback the request would record.
+func TraceFallback(addrs []string, pause time.Duration, connected string) (string, time.Duration) {
+	t := &requestTrace{}
+	for i, addr := range addrs {
+		if i > 0 {
+			time.Sleep(pause)
+		}
+		t.connectStart("tcp", addr)
+	}
+	if connected != "" {
+		t.connectDone("tcp", connected, nil)
+	}
+	return t.fallback()
+}
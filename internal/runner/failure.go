@@ -0,0 +1,71 @@
+package runner
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Kinds of failures, so they can be told apart without parsing error messages.
+const (
+	FailureTimeout   = "timeout"   // The request, or establishing its connection, timed out
+	FailureDNS       = "dns"       // The target's host couldn't be resolved
+	FailureRefused   = "refused"   // The connection was refused
+	FailureReset     = "reset"     // The connection was reset or closed by the target
+	FailureTLS       = "tls"       // The TLS handshake failed, e.g. on an invalid certificate
+	FailureHTTP      = "http"      // The target responded with an error status code
+	FailureAssertion = "assertion" // A scenario step's extraction, assertion or script hook failed
+	FailureOther     = "other"
+)
+
+// FailureKinds are all the kinds of failures.
+var FailureKinds = []string{FailureTimeout, FailureDNS, FailureRefused, FailureReset, FailureTLS, FailureHTTP, FailureAssertion, FailureOther}
+
+// classifyError returns the kind of failure an error is.
+func classifyError(err error) string {
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	switch {
+	case isTimeout(err) || errors.Is(err, context.DeadlineExceeded):
+		return FailureTimeout
+	case errors.As(err, &dnsErr):
+		return FailureDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return FailureRefused
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return FailureReset
+	case errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &certErr) ||
+		errors.As(err, &unknownAuthority) || errors.As(err, &hostnameErr) || errors.As(err, &invalidCert):
+		return FailureTLS
+	default:
+		return FailureOther
+	}
+}
+
+// fail records an error as the result's error.
+func (result *Result) fail(err error) {
+	result.Error = err.Error()
+	result.FailureKind = classifyError(err)
+}
+
+// failStatus records an error status code as the result's error.
+func (result *Result) failStatus(status string) {
+	result.Error = status
+	result.FailureKind = FailureHTTP
+}
+
+// failAssertion records a failed check of a scenario step's response as the result's error.
+func (result *Result) failAssertion(msg string) {
+	result.Error = msg
+	result.FailureKind = FailureAssertion
+}
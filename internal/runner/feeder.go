@@ -0,0 +1,50 @@
+package runner
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// Feeder supplies rows of data from a CSV file to request templates. The first line of the file
+// names the columns, and each request consumes the next row, wrapping around once all rows have
+// been used.
+type Feeder struct {
+	rows []map[string]string
+	next atomic.Uint64
+}
+
+func LoadFeeder(name string) (*Feeder, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading feeder %s: %s", name, err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("feeder %s must have a header line and at least one row", name)
+	}
+
+	columns := records[0]
+	feeder := &Feeder{}
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(columns))
+		for i, column := range columns {
+			row[column] = record[i]
+		}
+		feeder.rows = append(feeder.rows, row)
+	}
+
+	return feeder, nil
+}
+
+// Next returns the next row of the feeder. It's safe to call from multiple goroutines.
+func (f *Feeder) Next() map[string]string {
+	i := f.next.Add(1) - 1
+	return f.rows[i%uint64(len(f.rows))]
+}
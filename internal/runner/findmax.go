@@ -0,0 +1,171 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// A trial's throughput must reach this fraction of its QPS, otherwise the target (or the load
+// generator) couldn't keep up with it.
+const minThroughputRatio = 0.9
+
+// FindMaxArgs are the bounds of a search for the highest sustainable QPS.
+type FindMaxArgs struct {
+	MinQps        float64       // QPS of the first trial, which must pass
+	MaxQps        float64       // Highest QPS to try
+	TrialDuration time.Duration // Duration of each trial
+	Cooldown      time.Duration // Pause between trials, for the target to recover
+	MaxErrorRate  float64       // Highest error rate of a passing trial, as a fraction
+	MaxP99        time.Duration // Highest p99 latency of a passing trial [0 = no bound]
+	Precision     float64       // Stop once the capacity is known within this fraction, e.g. 0.05
+	Repeats       int           // Trials repeated at the capacity found, for a confidence interval of its throughput [0 or 1 = none]
+}
+
+// Trial is the outcome of a trial at a fixed QPS.
+type Trial struct {
+	Qps        float64       `json:"qps"`
+	Throughput float64       `json:"throughput"`
+	ErrorRate  float64       `json:"error_rate"`
+	P99        time.Duration `json:"p99"`
+	Passed     bool          `json:"passed"`
+}
+
+// FindMaxResult is the highest sustainable QPS found. The capacity is between Low, the highest QPS
+// that passed, and High, the lowest that failed.
+type FindMaxResult struct {
+	SchemaVersion int `json:"schema_version"`
+
+	Qps        float64   `json:"qps"`
+	Low        float64   `json:"low"`
+	High       float64   `json:"high"`
+	AtMax      bool      `json:"at_max"` // Every trial passed up to MaxQps, so the capacity may be higher
+	Trials     []Trial   `json:"trials"`
+	Repeats    []Trial   `json:"repeats,omitempty"`    // Trials repeated at Qps once the search is over
+	Throughput *Interval `json:"throughput,omitempty"` // 95% confidence interval of the throughput at Qps, from the repeats
+}
+
+// Interval is a confidence interval around the mean of a sample.
+type Interval struct {
+	Mean float64 `json:"mean"`
+	Low  float64 `json:"low"`
+	High float64 `json:"high"`
+}
+
+// tCritical95 are the two-sided 95% critical values of Student's t-distribution by degrees of
+// freedom, from 1 to 30. The normal distribution's 1.96 is close enough above that.
+var tCritical95 = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// confidenceInterval95 returns the 95% confidence interval of the mean of at least 2 values.
+func confidenceInterval95(values []float64) *Interval {
+	n := float64(len(values))
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= n
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	variance /= n - 1
+
+	t := 1.96
+	if df := len(values) - 1; df <= len(tCritical95) {
+		t = tCritical95[df-1]
+	}
+	margin := t * math.Sqrt(variance/n)
+	return &Interval{Mean: mean, Low: mean - margin, High: mean + margin}
+}
+
+// FindMax binary searches the highest QPS at which the target's error rate and p99 latency stay
+// within bounds, running a short test at each candidate QPS with the other args. The QPS is doubled
+// from MinQps until a trial fails, then the range between the last passing and the failing QPS is
+// halved until it's within Precision. The trial at the capacity found is then repeated Repeats
+// times for a confidence interval of its throughput. Each trial is printed to w.
+func FindMax(target string, args LoadTestArgs, f FindMaxArgs, w io.Writer) (*FindMaxResult, error) {
+	res := &FindMaxResult{SchemaVersion: SchemaVersion}
+	run := func(name string, qps float64) Trial {
+		if len(res.Trials) > 0 && f.Cooldown > 0 {
+			time.Sleep(f.Cooldown)
+		}
+		t := runTrial(target, args, f, qps)
+		status := "failed"
+		if t.Passed {
+			status = "passed"
+		}
+		fmt.Fprintf(w, "%s: %.4g qps, throughput %.2f/s, error rate %.2f%%, p99 %s: %s\n",
+			name, qps, t.Throughput, t.ErrorRate*100, t.P99.Round(time.Microsecond), status)
+		return t
+	}
+	trial := func(qps float64) bool {
+		t := run(fmt.Sprintf("Trial %d", len(res.Trials)+1), qps)
+		res.Trials = append(res.Trials, t)
+		return t.Passed
+	}
+	repeat := func() {
+		if f.Repeats < 2 {
+			return
+		}
+		throughputs := make([]float64, 0, f.Repeats)
+		for i := 1; i <= f.Repeats; i++ {
+			t := run(fmt.Sprintf("Repeat %d", i), res.Qps)
+			res.Repeats = append(res.Repeats, t)
+			throughputs = append(throughputs, t.Throughput)
+		}
+		res.Throughput = confidenceInterval95(throughputs)
+	}
+
+	if !trial(f.MinQps) {
+		return res, fmt.Errorf("the trial at the minimum of %g qps failed", f.MinQps)
+	}
+	lo, hi := f.MinQps, 0.0
+	for hi == 0 {
+		next := min(lo*2, f.MaxQps)
+		if next <= lo {
+			res.Qps, res.Low, res.High, res.AtMax = lo, lo, lo, true
+			repeat()
+			return res, nil
+		}
+		if trial(next) {
+			lo = next
+		} else {
+			hi = next
+		}
+	}
+
+	for (hi-lo)/hi > f.Precision {
+		mid := (lo + hi) / 2
+		if trial(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	res.Qps, res.Low, res.High = lo, lo, hi
+	repeat()
+	return res, nil
+}
+
+func runTrial(target string, args LoadTestArgs, f FindMaxArgs, qps float64) Trial {
+	args.Qps, args.Duration, args.MaxRequests = qps, f.TrialDuration, 0
+	r := NewRunner(target, args)
+
+	start := time.Now()
+	var results []*Result
+	for result := range r.StartTest() {
+		results = append(results, result)
+	}
+	s := r.summarize(results, time.Since(start))
+	r.client.CloseIdleConnections()
+
+	t := Trial{Qps: qps, Throughput: s.Throughput, ErrorRate: s.ErrorRate, P99: s.Latency.P99}
+	t.Passed = s.Requests > 0 && t.ErrorRate <= f.MaxErrorRate && (f.MaxP99 == 0 || t.P99 <= f.MaxP99) &&
+		t.Throughput >= qps*minThroughputRatio
+	return t
+}
@@ -0,0 +1,88 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type FormField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type FormFile struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// ParseFormField parses a multipart form field in "name=value" form.
+func ParseFormField(s string) (FormField, error) {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return FormField{}, fmt.Errorf("invalid form field %q, expected \"name=value\"", s)
+	}
+	if err := ValidateTemplate(value); err != nil {
+		return FormField{}, fmt.Errorf("invalid form field %q: %s", s, err)
+	}
+
+	return FormField{Name: name, Value: value}, nil
+}
+
+// ParseFormFile parses a multipart form file in "name=@path" form.
+func ParseFormFile(s string) (FormFile, error) {
+	name, path, ok := strings.Cut(s, "=@")
+	if !ok || name == "" || path == "" {
+		return FormFile{}, fmt.Errorf("invalid form file %q, expected \"name=@path\"", s)
+	}
+
+	return FormFile{Name: name, Path: path}, nil
+}
+
+// multipartBody streams a multipart/form-data body, reading the files as the body is sent
+// rather than holding them in memory. Field values can contain "{{column}}" placeholders.
+func (r *Runner) multipartBody(vars map[string]string) (io.ReadCloser, string) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		pw.CloseWithError(r.writeMultipart(mw, vars))
+	}()
+
+	return pr, mw.FormDataContentType()
+}
+
+func (r *Runner) writeMultipart(mw *multipart.Writer, vars map[string]string) error {
+	for i, f := range r.args.FormFields {
+		if err := mw.WriteField(f.Name, r.formValues[i].render(r.rand, vars)); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range r.args.FormFiles {
+		if err := writeFormFile(mw, f); err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+func writeFormFile(mw *multipart.Writer, f FormFile) error {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	part, err := mw.CreateFormFile(f.Name, filepath.Base(f.Path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, file)
+
+	return err
+}
@@ -0,0 +1,37 @@
+package runner
+
+import (
+	"net/http"
+)
+
+// GeneratedRequest is a request made by a RequestGenerator.
+type GeneratedRequest struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte // Sent as is, even if empty [nil = no body]
+}
+
+// RequestGenerator generates each request of the test, e.g. from an OpenAPI spec, instead of
+// sending the same method to the target every time. It must be safe to call from multiple
+// goroutines.
+type RequestGenerator interface {
+	Next() GeneratedRequest
+}
+
+// generateRequest creates a request from the generator, with the headers given with -header.
+func (r *Runner) generateRequest(result *Result, vars map[string]string) (*http.Request, error) {
+	gen := r.args.Generator.Next()
+	req, err := newBodyRequest(r.ctx, gen.Method, gen.URL, gen.Body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range gen.Header {
+		req.Header[name] = values
+	}
+	r.setHeaders(req, vars)
+	if r.args.Verbose {
+		result.Method, result.URL = gen.Method, gen.URL
+	}
+	return req, nil
+}
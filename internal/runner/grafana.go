@@ -0,0 +1,118 @@
+package runner
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// grafanaExporter serves the interval summaries as a Grafana JSON (SimpleJSON) datasource while
+// the test runs, so dashboards can chart it without a metrics system in between. Each metric of
+// summaryMetrics is a series, e.g. "latency_p99_seconds", with a point for each interval.
+type grafanaExporter struct {
+	server *http.Server
+
+	mu     sync.Mutex
+	points []grafanaPoint
+}
+
+type grafanaPoint struct {
+	time    time.Time
+	metrics []metric
+}
+
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	Targets []struct {
+		Target string `json:"target"`
+	} `json:"targets"`
+}
+
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"` // Value and Unix time in milliseconds
+}
+
+func newGrafanaExporter(addr string) (*grafanaExporter, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &grafanaExporter{}
+	mux := http.NewServeMux()
+	// The datasource's connection test.
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/search", e.search)
+	mux.HandleFunc("/query", e.query)
+	mux.HandleFunc("/annotations", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]\n"))
+	})
+	e.server = &http.Server{Handler: mux}
+	go e.server.Serve(ln)
+
+	return e, nil
+}
+
+func (e *grafanaExporter) export(s *Summary, final bool) error {
+	// The final summary covers the whole test, not an interval.
+	if final {
+		return nil
+	}
+	e.mu.Lock()
+	e.points = append(e.points, grafanaPoint{time: time.Now(), metrics: summaryMetrics(s)})
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *grafanaExporter) close() error {
+	return e.server.Close()
+}
+
+// search lists the series that can be queried.
+func (e *grafanaExporter) search(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	for _, m := range summaryMetrics(&Summary{}) {
+		names = append(names, m.name)
+	}
+	writeGrafanaJSON(w, names)
+}
+
+// query returns the points of the requested series within the time range.
+func (e *grafanaExporter) query(w http.ResponseWriter, r *http.Request) {
+	var q grafanaQuery
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	series := []grafanaSeries{}
+	for _, t := range q.Targets {
+		s := grafanaSeries{Target: t.Target, Datapoints: [][2]float64{}}
+		for _, p := range e.points {
+			if p.time.Before(q.Range.From) || p.time.After(q.Range.To) {
+				continue
+			}
+			for _, m := range p.metrics {
+				if m.name == t.Target {
+					s.Datapoints = append(s.Datapoints, [2]float64{m.value, float64(p.time.UnixMilli())})
+				}
+			}
+		}
+		series = append(series, s)
+	}
+	writeGrafanaJSON(w, series)
+}
+
+func writeGrafanaJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,112 @@
+package runner
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// TargetGroup is a target with its own rate and workers, run alongside other groups in the same
+// test. Results are tagged with the group's name.
+type TargetGroup struct {
+	Name    string  `json:"name"`
+	Target  string  `json:"target"`
+	Qps     float64 `json:"qps"`
+	Workers uint64  `json:"workers"` // [0 = use the test's workers]
+}
+
+// ParseTargetGroup parses a group in "name=read,qps=5000,workers=50,target=https://..." form.
+// The qps can be any rate accepted by ParseRate.
+// The target has to come last, since everything after "target=" is taken as the URL.
+func ParseTargetGroup(s string) (TargetGroup, error) {
+	var g TargetGroup
+	rest := s
+	for rest != "" {
+		var field string
+		if strings.HasPrefix(rest, "target=") {
+			field, rest = rest, ""
+		} else {
+			field, rest, _ = strings.Cut(rest, ",")
+		}
+
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return g, fmt.Errorf("invalid group %q, expected key=value pairs", s)
+		}
+
+		var err error
+		switch key {
+		case "name":
+			g.Name = value
+		case "target":
+			g.Target = value
+		case "qps":
+			g.Qps, err = ParseRate(value)
+		case "workers":
+			g.Workers, err = strconv.ParseUint(value, 10, 64)
+		default:
+			return g, fmt.Errorf("invalid group %q, unknown key %q", s, key)
+		}
+		if err != nil {
+			return g, fmt.Errorf("invalid group %q, bad %s: %s", s, key, err)
+		}
+	}
+
+	if g.Name == "" || g.Target == "" || g.Qps == 0 {
+		return g, fmt.Errorf("invalid group %q, name, target and qps are required", s)
+	}
+	if err := ValidateTemplate(g.Target); err != nil {
+		return g, fmt.Errorf("invalid group %q: %s", s, err)
+	}
+
+	return g, nil
+}
+
+// lane is a target paced at its own rate by the scheduler, with its own pool of workers. A test
+// without groups has a single lane.
+type lane struct {
+	target  *template
+	targets atomic.Pointer[targetSet] // Weighted targets from a targets file, used instead of target
+	tag     string
+	qps     atomicFloat64 // Can be changed during the test
+	workers uint64
+	started atomic.Uint64 // Workers started across the pacer shards
+}
+
+func (r *Runner) newLanes(target string) []*lane {
+	if len(r.args.Groups) == 0 {
+		l := &lane{target: parseValidTemplate(target), tag: r.args.Tag, workers: r.args.Workers}
+		l.qps.Store(r.args.Qps)
+		if len(r.args.Targets) > 0 {
+			l.targets.Store(newTargetSet(r.args.Targets))
+		}
+		return []*lane{l}
+	}
+
+	lanes := make([]*lane, 0, len(r.args.Groups))
+	for _, g := range r.args.Groups {
+		workers := g.Workers
+		if workers == 0 {
+			workers = r.args.Workers
+		}
+		l := &lane{target: parseValidTemplate(g.Target), tag: g.Name, workers: workers}
+		l.qps.Store(g.Qps)
+		lanes = append(lanes, l)
+	}
+
+	return lanes
+}
+
+type atomicFloat64 struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat64) Load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+func (f *atomicFloat64) Store(v float64) {
+	f.bits.Store(math.Float64bits(v))
+}
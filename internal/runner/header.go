@@ -0,0 +1,79 @@
+package runner
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type Header struct {
+	Name  string
+	Value string
+}
+
+// ParseHeader parses a header in "Name: value" form, whose value can be a template.
+func ParseHeader(s string) (Header, error) {
+	h, err := parseHeader(s)
+	if err != nil {
+		return h, err
+	}
+	if err := ValidateTemplate(h.Value); err != nil {
+		return Header{}, fmt.Errorf("invalid header %q: %s", s, err)
+	}
+	return h, nil
+}
+
+func parseHeader(s string) (Header, error) {
+	name, value, ok := strings.Cut(s, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.IndexFunc(name, isNotTokenChar) >= 0 {
+		return Header{}, fmt.Errorf("invalid header %q, expected \"Name: value\"", s)
+	}
+
+	return Header{Name: http.CanonicalHeaderKey(name), Value: strings.TrimSpace(value)}, nil
+}
+
+type headerTemplate struct {
+	name  string
+	value *template
+}
+
+func setHeader(req *http.Request, name, value string) {
+	// The Host header is ignored by the client, the request's Host field has to be set instead.
+	if name == "Host" {
+		req.Host = value
+		return
+	}
+	req.Header.Add(name, value)
+}
+
+// DefaultRunIDHeader is the header -run_id_header sends the run ID in by default.
+const DefaultRunIDHeader = "X-Load-Test-Run-Id"
+
+// setHeaders sets the run ID, the User-Agent and the headers given with -header and -header_cmd on
+// a request.
+func (r *Runner) setHeaders(req *http.Request, vars map[string]string) {
+	if r.args.RunIDHeader != "" {
+		req.Header.Set(r.args.RunIDHeader, r.args.RunID)
+	}
+	if r.args.UserAgents != nil && !r.args.UserAgentPerVU {
+		req.Header.Set("User-Agent", r.args.UserAgents.pick(r.rand))
+	}
+	for _, h := range *r.headers.Load() {
+		setHeader(req, h.name, h.value.render(r.rand, vars))
+	}
+	for _, h := range r.dynamicHeaders {
+		setHeader(req, h.Name, h.value.Load().(string))
+	}
+}
+
+// setHeaderTemplates sets the headers given with -header. It's only called before the test starts
+// and from Reload.
+func (r *Runner) setHeaderTemplates(headers []Header) {
+	r.headerList = headers
+	templates := make([]headerTemplate, 0, len(headers))
+	for _, h := range headers {
+		templates = append(templates, headerTemplate{name: h.Name, value: parseValidTemplate(h.Value)})
+	}
+	r.headers.Store(&templates)
+}
@@ -0,0 +1,107 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHeaderCommandTimeout is how long a header command can run by default, so a hung one,
+// e.g. waiting for a login prompt, doesn't block the test from starting or its refreshes forever.
+const DefaultHeaderCommandTimeout = 30 * time.Second
+
+// HeaderCommand is a header whose value is the output of a command, refreshed periodically so
+// short-lived credentials can be used during long tests.
+type HeaderCommand struct {
+	Name    string `json:"name"`
+	Command string `json:"command"`
+}
+
+// ParseHeaderCommand parses a header command in "Name: command" form.
+func ParseHeaderCommand(s string) (HeaderCommand, error) {
+	h, err := parseHeader(s)
+	if err == nil && h.Value == "" {
+		err = fmt.Errorf("invalid header command %q, expected \"Name: command\"", s)
+	}
+
+	return HeaderCommand{Name: h.Name, Command: h.Value}, err
+}
+
+type dynamicHeader struct {
+	HeaderCommand
+	value atomic.Value // string
+}
+
+func (h *dynamicHeader) refresh(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", h.Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", h.Command)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	// Children of the shell that outlive it would keep the output open after it's killed.
+	cmd.WaitDelay = time.Second
+
+	out, err := cmd.Output()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("running header command %q: timed out after %s", h.Command, timeout)
+	} else if msg := strings.TrimSpace(stderr.String()); err != nil && msg != "" {
+		return fmt.Errorf("running header command %q: %s: %s", h.Command, err, msg)
+	} else if err != nil {
+		return fmt.Errorf("running header command %q: %s", h.Command, err)
+	}
+	h.value.Store(strings.TrimSpace(string(out)))
+
+	return nil
+}
+
+// startHeaderCommands runs the header commands for their initial values, then keeps refreshing
+// them in the background until the test stops. Failed refreshes keep the previous value.
+func (r *Runner) startHeaderCommands() error {
+	var err error
+	r.headerCmdOnce.Do(func() {
+		for _, hc := range r.args.HeaderCommands {
+			h := &dynamicHeader{HeaderCommand: hc}
+			if err = h.refresh(r.args.HeaderCommandTimeout); err != nil {
+				return
+			}
+			r.dynamicHeaders = append(r.dynamicHeaders, h)
+		}
+
+		if len(r.dynamicHeaders) > 0 && r.args.HeaderCommandInterval > 0 {
+			go r.refreshHeaders()
+		}
+	})
+
+	return err
+}
+
+func (r *Runner) refreshHeaders() {
+	ticker := time.NewTicker(r.args.HeaderCommandInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, h := range r.dynamicHeaders {
+				if err := h.refresh(r.args.HeaderCommandTimeout); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+				}
+			}
+		case <-r.stopch:
+			return
+		}
+	}
+}
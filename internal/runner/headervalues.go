@@ -0,0 +1,105 @@
+package runner
+
+import (
+	"math/rand"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// choices are values to pick from at random, each in proportion to its weight.
+type choices struct {
+	values     []string
+	cumulative []int // Running total of the weights
+}
+
+func newChoices(values []string, weights []int) *choices {
+	c := &choices{values: values}
+	total := 0
+	for _, w := range weights {
+		total += w
+		c.cumulative = append(c.cumulative, total)
+	}
+	return c
+}
+
+// equalChoices returns choices of equally likely values. A value can be repeated to make it more
+// likely.
+func equalChoices(values []string) *choices {
+	weights := make([]int, len(values))
+	for i := range weights {
+		weights[i] = 1
+	}
+	return newChoices(values, weights)
+}
+
+func (c *choices) pick(rng *rand.Rand) string {
+	x := rng.Intn(c.cumulative[len(c.cumulative)-1])
+	return c.values[sort.SearchInts(c.cumulative, x+1)]
+}
+
+// acceptLanguages is a realistic mix of browsers' Accept-Language headers, weighted roughly by
+// their share of web traffic.
+var acceptLanguages = newChoices([]string{
+	"en-US,en;q=0.9",
+	"zh-CN,zh;q=0.9",
+	"en-GB,en;q=0.9",
+	"es-ES,es;q=0.9",
+	"es-MX,es;q=0.9,en;q=0.8",
+	"pt-BR,pt;q=0.9,en;q=0.8",
+	"de-DE,de;q=0.9,en;q=0.8",
+	"fr-FR,fr;q=0.9,en;q=0.8",
+	"ja-JP,ja;q=0.9",
+	"ru-RU,ru;q=0.9,en;q=0.8",
+	"hi-IN,hi;q=0.9,en;q=0.8",
+	"en-IN,en;q=0.9",
+	"ko-KR,ko;q=0.9",
+	"it-IT,it;q=0.9,en;q=0.8",
+	"id-ID,id;q=0.9",
+	"tr-TR,tr;q=0.9",
+	"ar-SA,ar;q=0.9,en;q=0.8",
+	"pl-PL,pl;q=0.9",
+	"nl-NL,nl;q=0.9,en;q=0.8",
+	"vi-VN,vi;q=0.9",
+}, []int{26, 8, 6, 5, 3, 6, 6, 5, 5, 4, 3, 3, 3, 3, 2, 2, 2, 2, 2, 2})
+
+// deviceTypes is the mix of web traffic by device type.
+var deviceTypes = newChoices([]string{"mobile", "desktop", "tablet"}, []int{58, 40, 2})
+
+// parseAddrPools parses comma-separated CIDR pools, e.g. "203.0.113.0/24,2001:db8::/32".
+func parseAddrPools(s string) ([]netip.Prefix, bool) {
+	var pools []netip.Prefix
+	for _, cidr := range strings.Split(s, ",") {
+		p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, false
+		}
+		pools = append(pools, p.Masked())
+	}
+	return pools, true
+}
+
+// randomAddr returns a random address of one of the pools. Pools are equally likely whatever
+// their size, and can be repeated to make them more likely.
+func randomAddr(rng *rand.Rand, pools []netip.Prefix) string {
+	p := pools[rng.Intn(len(pools))]
+	a := p.Addr()
+	bits := p.Bits()
+	if a.Is4() {
+		bits += 96
+	}
+	b := a.As16()
+	for i := bits / 8; i < len(b); i++ {
+		var keep byte
+		if i == bits/8 {
+			// The prefix's bits in the byte it ends in.
+			keep = ^byte(0xff >> (bits % 8))
+		}
+		b[i] = b[i]&keep | byte(rng.Intn(256))&^keep
+	}
+	addr := netip.AddrFrom16(b)
+	if a.Is4() {
+		addr = addr.Unmap()
+	}
+	return addr.String()
+}
@@ -0,0 +1,120 @@
+package runner
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How often the error rate of each target is checked, over the requests since the last check.
+	healthCheckInterval = time.Second
+	// Fewest requests a target needs since the last check to be ejected.
+	ejectMinRequests = 5
+)
+
+// targetHealth counts the outcomes of a weighted target's requests, to stop sending requests to
+// it while its error rate is too high, like a client-side load balancer ejecting an outlier.
+type targetHealth struct {
+	requests     atomic.Uint64
+	failed       atomic.Uint64
+	ejected      atomic.Bool
+	ejectedUntil time.Time // Only accessed by the health check
+}
+
+func (h *targetHealth) record(success bool) {
+	h.requests.Add(1)
+	if !success {
+		h.failed.Add(1)
+	}
+}
+
+// pickHealthy picks a target in proportion to the weights of the targets that aren't ejected,
+// so an ejected target's share is redistributed to the rest.
+func (s *targetSet) pickHealthy(rng *rand.Rand) *weightedTarget {
+	total := 0.0
+	for _, t := range s.targets {
+		if !t.health.ejected.Load() {
+			total += t.weight
+		}
+	}
+	x := rng.Float64() * total
+	last := s.targets[0]
+	for _, t := range s.targets {
+		if t.health.ejected.Load() {
+			continue
+		}
+		if x < t.weight {
+			return t
+		}
+		x -= t.weight
+		last = t
+	}
+	return last
+}
+
+// recordHealth counts the result towards the health of the target it was sent to.
+func (r *Runner) recordHealth(result *Result) {
+	if result.health != nil && r.args.EjectErrorRate > 0 {
+		result.health.record(isSuccess(result))
+	}
+}
+
+// checkTargetHealth ejects weighted targets whose error rate is above -eject_error_rate for
+// -eject_duration, then sends them requests again. The last target that isn't ejected is never
+// ejected, so requests keep being sent.
+func (r *Runner) checkTargetHealth(l *lane) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopch:
+			return
+		case <-ticker.C:
+		}
+
+		s := l.targets.Load()
+		now := time.Now()
+		for _, t := range s.targets {
+			h := &t.health
+			requests, failed := h.requests.Swap(0), h.failed.Swap(0)
+			if h.ejected.Load() {
+				if now.After(h.ejectedUntil) {
+					h.ejected.Store(false)
+					s.ejected.Add(-1)
+					fmt.Fprintf(r.console, "%s: returned target %s\n", now.Format(time.RFC3339), t.raw)
+				}
+				continue
+			}
+
+			rate := float64(failed) / float64(max(requests, 1))
+			if requests < ejectMinRequests || rate <= r.args.EjectErrorRate || int(s.ejected.Load()) >= len(s.targets)-1 {
+				continue
+			}
+			h.ejectedUntil = now.Add(r.args.EjectDuration)
+			h.ejected.Store(true)
+			s.ejected.Add(1)
+
+			r.ejectmu.Lock()
+			r.ejections[t.raw]++
+			r.ejectmu.Unlock()
+			fmt.Fprintf(r.console, "%s: ejected target %s for %s, error rate %.2f%%\n", now.Format(time.RFC3339), t.raw, r.args.EjectDuration, rate*100)
+		}
+	}
+}
+
+// ejectionCounts returns how many times each target was ejected.
+func (r *Runner) ejectionCounts() map[string]int {
+	r.ejectmu.Lock()
+	defer r.ejectmu.Unlock()
+
+	if len(r.ejections) == 0 {
+		return nil
+	}
+	counts := make(map[string]int, len(r.ejections))
+	for u, n := range r.ejections {
+		counts[u] = n
+	}
+	return counts
+}
@@ -0,0 +1,105 @@
+package runner
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// heatmapBuckets are the upper bounds of the heatmap's latency buckets, in a 1-2-5 series so
+// they're evenly spaced on a log scale. Latencies above the last bound go in a final overflow
+// bucket.
+var heatmapBuckets = func() []time.Duration {
+	var buckets []time.Duration
+	for d := 100 * time.Microsecond; d <= time.Minute; d *= 10 {
+		buckets = append(buckets, d, 2*d, 5*d)
+	}
+	return buckets
+}()
+
+// Heatmap counts results by when they were sent and their latency.
+type Heatmap struct {
+	SchemaVersion int `json:"schema_version"`
+
+	Interval time.Duration   `json:"interval"`
+	Buckets  []time.Duration `json:"latency_buckets"` // Upper bounds, the last count of each row is the overflow
+	Rows     []HeatmapRow    `json:"rows"`
+}
+
+type HeatmapRow struct {
+	Start  time.Duration `json:"start"` // Offset of the time bucket from the start of the test
+	Counts []uint64      `json:"counts"`
+}
+
+func buildHeatmap(results []*Result, began time.Time, interval time.Duration) *Heatmap {
+	rows := map[int64][]uint64{}
+	for _, r := range results {
+		t := int64(r.Timestamp.Sub(began) / interval)
+		counts, ok := rows[t]
+		if !ok {
+			counts = make([]uint64, len(heatmapBuckets)+1)
+			rows[t] = counts
+		}
+		counts[sort.Search(len(heatmapBuckets), func(i int) bool { return r.Latency <= heatmapBuckets[i] })]++
+	}
+
+	h := &Heatmap{SchemaVersion: SchemaVersion, Interval: interval, Buckets: heatmapBuckets}
+	for t, counts := range rows {
+		h.Rows = append(h.Rows, HeatmapRow{Start: time.Duration(t) * interval, Counts: counts})
+	}
+	sort.Slice(h.Rows, func(i, j int) bool { return h.Rows[i].Start < h.Rows[j].Start })
+
+	return h
+}
+
+// writeHeatmapFile writes the heatmap as JSON if name ends in ".json", and otherwise as CSV with
+// one line per non-empty cell after the preamble: time bucket start, latency bucket upper bound
+// (empty for the overflow bucket), count, with the durations in the unit.
+func writeHeatmapFile(name string, h *Heatmap, unit string) error {
+	if filepath.Ext(name) == ".json" {
+		data, err := json.Marshal(inLatencyUnit(h, unit))
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(name, append(data, '\n'), 0o644)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := writeCSVPreamble(f, heatmapColumns, unit); err != nil {
+		return err
+	}
+	enc := csv.NewWriter(f)
+	for _, row := range h.Rows {
+		for i, count := range row.Counts {
+			if count == 0 {
+				continue
+			}
+			var bound string
+			if i < len(h.Buckets) {
+				bound = formatDuration(h.Buckets[i], unit)
+			}
+			if err := enc.Write([]string{
+				formatDuration(row.Start, unit),
+				bound,
+				strconv.FormatUint(count, 10),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	enc.Flush()
+	if err := enc.Error(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,32 @@
+package runner
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// IdempotencyKeyHeader is the header sent with -idempotency_key.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// setIdempotencyKey gives a request that isn't safe to repeat, such as a POST, PUT or DELETE, a
+// random UUID as its idempotency key, unless it already has one, e.g. from -header. Retries resend
+// the same request, and so the same key, like a real client's would.
+func setIdempotencyKey(req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return
+	}
+	if req.Header.Get(IdempotencyKeyHeader) != "" {
+		return
+	}
+	req.Header.Set(IdempotencyKeyHeader, newUUID())
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6], b[8] = b[6]&0x0f|0x40, b[8]&0x3f|0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,69 @@
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Kinds of deliberately invalid requests.
+const (
+	InvalidAuth = "bad_auth" // Sent with an invalid bearer token instead of its credentials
+	InvalidBody = "bad_body" // Sent with a malformed body
+)
+
+// InvalidRequests makes a share of the requests deliberately invalid, to measure how handling
+// them affects the target's latency. An invalid request succeeds if the target rejects it with a
+// 4xx status code.
+type InvalidRequests struct {
+	Rate   float64  `json:"rate"`
+	Bodies []string `json:"-"` // Malformed bodies to pick from [empty = only send invalid credentials]
+}
+
+// LoadInvalidBodies reads malformed bodies from a file, one per line, skipping blank lines.
+func LoadInvalidBodies(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var bodies []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.TrimSpace(line) != "" {
+			bodies = append(bodies, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading invalid bodies %s: %s", name, err)
+	}
+	if len(bodies) == 0 {
+		return nil, fmt.Errorf("invalid bodies %s has no bodies", name)
+	}
+
+	return bodies, nil
+}
+
+// invalidate makes a share of the requests invalid, returning the kind of invalid request, or ""
+// if the request is left alone. Requests are given an invalid bearer token or, if there are
+// bodies, either that or a malformed body, at random.
+func (r *Runner) invalidate(req *http.Request) string {
+	inv := r.args.Invalid
+	if inv == nil || r.rand.Float64() >= inv.Rate {
+		return ""
+	}
+
+	if len(inv.Bodies) == 0 || r.rand.Intn(2) == 0 {
+		req.Header.Set("Authorization", "Bearer invalid")
+		return InvalidAuth
+	}
+	body := inv.Bodies[r.rand.Intn(len(inv.Bodies))]
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(body)), nil }
+	req.Body, _ = req.GetBody()
+	return InvalidBody
+}
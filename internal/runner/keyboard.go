@@ -0,0 +1,81 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const keyboardHelp = "Keys: + and - change QPS by 10%, w adds a worker, s shows current stats, q quits"
+
+// readKeys reads keypresses from in until stop is called. Stopping interrupts a read in progress
+// if in supports deadlines; otherwise the reader exits once the read returns, e.g. at the next
+// keypress, without taking the key.
+func readKeys(in io.Reader) (<-chan byte, func()) {
+	keys := make(chan byte)
+	done := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			n, err := in.Read(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if n == 1 {
+				select {
+				case keys <- buf[0]:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	stop := func() {
+		close(done)
+		if d, ok := in.(interface{ SetReadDeadline(time.Time) error }); ok {
+			d.SetReadDeadline(time.Now())
+		}
+	}
+	return keys, stop
+}
+
+func (r *Runner) handleKey(key byte, results []*Result, start time.Time) {
+	switch key {
+	case '+', '=':
+		r.scaleQps(1.1)
+		fmt.Fprintf(r.console, "QPS: %s\n", r.currentQps())
+	case '-', '_':
+		r.scaleQps(0.9)
+		fmt.Fprintf(r.console, "QPS: %s\n", r.currentQps())
+	case 'w':
+		r.AddWorker()
+		fmt.Fprintln(r.console, "Adding a worker")
+	case 's':
+		fmt.Fprintf(r.console, "QPS: %s, workers: %d\n", r.currentQps(), r.activeWorkers.Load())
+		printResultSummary(r.console, r.summarize(results, time.Since(start)), false)
+	case 'q':
+		if r.stopFor("stopped from the keyboard") {
+			fmt.Fprintln(r.console, "Shutting down...")
+		}
+	}
+}
+
+func (r *Runner) currentQps() string {
+	if len(r.args.Groups) == 0 {
+		return strconv.FormatFloat(r.lanes[0].qps.Load(), 'f', -1, 64)
+	}
+
+	rates := make([]string, 0, len(r.lanes))
+	for _, l := range r.lanes {
+		rates = append(rates, fmt.Sprintf("%s=%g", l.tag, l.qps.Load()))
+	}
+	return strings.Join(rates, " ")
+}
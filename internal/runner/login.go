@@ -0,0 +1,96 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Login is a request each virtual user sends before the test, to log in with the next credentials
+// of a pool. The session cookie it gets is sent with the user's requests by its cookie jar, and a
+// token from the response, if any, as a bearer token.
+type Login struct {
+	URL         string  `json:"url"`
+	Method      string  `json:"method"`
+	Body        string  `json:"-"` // Template filled in with the credentials, e.g. {"user": "{{username}}"}
+	ContentType string  `json:"content_type"`
+	Credentials *Feeder `json:"-"`                     // Rows of credentials, one for each virtual user in turn
+	TokenField  string  `json:"token_field,omitempty"` // Dot separated path of the token in the JSON response, e.g. "data.access_token" [empty = only use cookies]
+}
+
+// login logs a virtual user in, configuring its client to send the session with every request.
+func (r *Runner) login(client *http.Client) error {
+	l := r.args.Login
+	var vars map[string]string
+	if l.Credentials != nil {
+		vars = l.Credentials.Next()
+	}
+
+	var body io.Reader
+	if l.Body != "" {
+		body = strings.NewReader(parseValidTemplate(l.Body).render(r.rand, vars))
+	}
+	req, err := http.NewRequestWithContext(r.ctx, l.Method, parseValidTemplate(l.URL).render(r.rand, vars), body)
+	if err != nil {
+		return err
+	}
+	if body != nil && l.ContentType != "" {
+		req.Header.Set("Content-Type", l.ContentType)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("login failed: %s", res.Status)
+	}
+	if l.TokenField == "" {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+
+	var data any
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return fmt.Errorf("invalid login response: %s", err)
+	}
+	token, ok := jsonField(data, l.TokenField).(string)
+	if !ok || token == "" {
+		return fmt.Errorf("no %q token in the login response", l.TokenField)
+	}
+	client.Transport = &headerTransport{base: client.Transport, name: "Authorization", value: "Bearer " + token}
+	return nil
+}
+
+// jsonField returns the value at a dot separated path of decoded JSON.
+func jsonField(data any, path string) any {
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := data.(map[string]any)
+		if !ok {
+			return nil
+		}
+		data = obj[key]
+	}
+	return data
+}
+
+// headerTransport sends a header with every request of a virtual user. A header set on the
+// request, e.g. with -header, takes precedence.
+type headerTransport struct {
+	base  http.RoundTripper
+	name  string
+	value string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get(t.name) != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set(t.name, t.value)
+	return t.base.RoundTrip(req)
+}
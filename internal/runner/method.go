@@ -0,0 +1,115 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var standardMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodConnect,
+	http.MethodOptions,
+	http.MethodTrace,
+}
+
+// ValidateMethod checks that method is a standard HTTP method. Non-standard methods are only
+// accepted when allowCustom is set, since they are far more likely to be typos.
+func ValidateMethod(method string, allowCustom bool) error {
+	for _, m := range standardMethods {
+		if method == m {
+			return nil
+		}
+	}
+
+	if method == "" || strings.IndexFunc(method, isNotTokenChar) >= 0 {
+		return fmt.Errorf("invalid method %q", method)
+	}
+
+	if allowCustom {
+		return nil
+	}
+
+	if suggestion := closestMethod(method); suggestion != "" {
+		return fmt.Errorf("unknown method %q, did you mean %q? Use -allow_custom_method to send it anyway", method, suggestion)
+	}
+
+	return fmt.Errorf("unknown method %q. Use -allow_custom_method to send it anyway", method)
+}
+
+// ValidateMethodBody checks that a request with method can have a body. RFC 9110 forbids one in
+// a TRACE request, whose response echoes the request back.
+func ValidateMethodBody(method string) error {
+	if method == http.MethodTrace {
+		return fmt.Errorf("%s requests can't have a body", method)
+	}
+	return nil
+}
+
+// newBodyRequest creates a request that sends body as is whatever the method, or no body if it's
+// nil. net/http only sends the "Content-Length: 0" of an empty body for POST, PUT and PATCH, so
+// e.g. a DELETE with an empty body would look like one without. It never sends it for GET and
+// HEAD, nor over HTTP/2, where the end of the stream marks the end of the body.
+func newBodyRequest(ctx context.Context, method, url string, body []byte) (*http.Request, error) {
+	if body == nil {
+		return http.NewRequestWithContext(ctx, method, url, nil)
+	}
+	if err := ValidateMethodBody(method); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		// An identity transfer encoding makes net/http send the length of an empty body.
+		req.TransferEncoding = []string{"identity"}
+	}
+	return req, nil
+}
+
+// closestMethod returns the standard method within an edit distance of 2 from method, if any.
+func closestMethod(method string) string {
+	best, bestDistance := "", 3
+	for _, m := range standardMethods {
+		if d := editDistance(strings.ToUpper(method), m); d < bestDistance {
+			best, bestDistance = m, d
+		}
+	}
+
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+// isNotTokenChar reports whether c is not allowed in an HTTP token (RFC 7230 section 3.2.6).
+func isNotTokenChar(c rune) bool {
+	return c > 0x7e || c <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c)
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package runner
+
+import "os"
+
+// Memory-mapping files is only supported on unix platforms, elsewhere the data is kept in memory
+// and written to the file when it's unmapped.
+func mapFile(f *os.File, size int) ([]byte, func() error, error) {
+	data := make([]byte, size)
+	return data, func() error {
+		_, err := f.WriteAt(data, 0)
+		return err
+	}, nil
+}
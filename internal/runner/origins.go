@@ -0,0 +1,63 @@
+package runner
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// originTransport sends the requests to each origin (scheme and host) with a transport of its
+// own, when the targets mix them, so each origin is pooled with its own idle connection limits
+// rather than competing for those of a single transport.
+type originTransport struct {
+	newTransport func() roundTripCloser
+
+	mu         sync.Mutex
+	transports map[string]roundTripCloser
+}
+
+func (t *originTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport(req.URL.Scheme + "://" + req.URL.Host).RoundTrip(req)
+}
+
+func (t *originTransport) transport(origin string) roundTripCloser {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr, ok := t.transports[origin]
+	if !ok {
+		tr = t.newTransport()
+		t.transports[origin] = tr
+	}
+	return tr
+}
+
+func (t *originTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tr := range t.transports {
+		tr.CloseIdleConnections()
+	}
+}
+
+// targetOrigins returns the schemes of the targets and their origins, e.g. "https://api.com".
+// Targets with placeholders in their origin are skipped.
+func (r *Runner) targetOrigins() (schemes, origins map[string]bool) {
+	schemes, origins = map[string]bool{}, map[string]bool{}
+	for _, l := range r.lanes {
+		for _, t := range l.allTargets() {
+			s := t.prefix()
+			_, rest, ok := strings.Cut(s, "://")
+			if !ok || (t.parts != nil && !strings.ContainsAny(rest, "/?#")) {
+				continue
+			}
+			u, err := url.Parse(s)
+			if err != nil {
+				continue
+			}
+			schemes[u.Scheme] = true
+			origins[u.Scheme+"://"+u.Host] = true
+		}
+	}
+	return schemes, origins
+}
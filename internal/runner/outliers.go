@@ -0,0 +1,201 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultOutlierThreshold is the threshold requests are outliers over by default, with
+// -outliers_file.
+const DefaultOutlierThreshold = "p99.9"
+
+const (
+	// Latencies of the most recent requests a percentile threshold is of.
+	outlierWindow = 10_000
+	// How many requests the threshold is recomputed after.
+	outlierRecompute = 100
+	// Outliers waiting to be written, beyond which they're dropped rather than hold up the workers.
+	outlierQueue = 1000
+)
+
+// OutlierThreshold is the latency over which a request is an outlier: a fixed latency, or a
+// percentile of the latencies of the most recent requests.
+type OutlierThreshold struct {
+	Latency    time.Duration `json:"latency,omitempty"`
+	Percentile float64       `json:"percentile,omitempty"`
+}
+
+// ParseOutlierThreshold parses a latency, e.g. "500ms", or a percentile of the recent latencies,
+// e.g. "p99.9".
+func ParseOutlierThreshold(s string) (OutlierThreshold, error) {
+	if p, ok := strings.CutPrefix(s, "p"); ok {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v <= 0 || v >= 100 {
+			return OutlierThreshold{}, fmt.Errorf("invalid outlier threshold %q, expected a percentile between p0 and p100, e.g. \"p99.9\"", s)
+		}
+		return OutlierThreshold{Percentile: v}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return OutlierThreshold{}, fmt.Errorf("invalid outlier threshold %q, expected a latency, e.g. \"500ms\", or a percentile, e.g. \"p99.9\"", s)
+	}
+	return OutlierThreshold{Latency: d}, nil
+}
+
+// Outlier is a request slower than the outlier threshold, with where its time went and the
+// headers of its response, written to -outliers_file.
+type Outlier struct {
+	Timestamp time.Time      `json:"timestamp"`
+	Seq       uint64         `json:"seq"`
+	Method    string         `json:"method"`
+	URL       string         `json:"url"`
+	Code      uint16         `json:"code"`
+	Error     string         `json:"error,omitempty"`
+	Latency   time.Duration  `json:"latency"`
+	Threshold time.Duration  `json:"threshold"`
+	Trace     TraceBreakdown `json:"trace"`
+	Headers   http.Header    `json:"headers,omitempty"` // Of the response, if one arrived
+}
+
+// outlierRecorder writes the requests slower than the threshold to the outliers file. It's safe
+// to use from multiple goroutines, and workers don't wait on each other or on the file: latencies
+// go in a lock-free window, the threshold is recomputed in the background, and outliers are
+// written by a goroutine of their own.
+type outlierRecorder struct {
+	args    OutlierThreshold
+	unit    string // Of the durations
+	redact  func(*Outlier)
+	count   atomic.Uint64 // Outliers queued to be written
+	dropped atomic.Uint64 // Outliers dropped as the writer couldn't keep up
+
+	threshold atomic.Int64 // Of the window, for a percentile threshold [0 = not enough requests yet]
+	minCount  int          // Requests needed for the percentile to mean anything
+	window    []atomic.Int64
+	added     atomic.Uint64 // Latencies added to the window, the next one's position modulo its size
+	recompute chan struct{}
+
+	f       *os.File
+	enc     *json.Encoder
+	pending chan Outlier
+	done    chan struct{}
+}
+
+func openOutlierRecorder(name string, threshold OutlierThreshold, unit string) (*outlierRecorder, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	o := &outlierRecorder{
+		args:    threshold,
+		unit:    unit,
+		f:       f,
+		enc:     json.NewEncoder(f),
+		pending: make(chan Outlier, outlierQueue),
+		done:    make(chan struct{}),
+	}
+	if threshold.Percentile > 0 {
+		// e.g. p99.9 is only the slowest request of a thousand.
+		o.minCount = min(outlierWindow, max(100, int(math.Ceil(100/(100-threshold.Percentile)))))
+		o.window = make([]atomic.Int64, outlierWindow)
+		o.recompute = make(chan struct{}, 1)
+		go o.recomputeThreshold()
+	}
+	go o.write()
+	return o, nil
+}
+
+// observe queues the request to be written to the outliers file if it's over the threshold, then
+// counts its latency towards a percentile threshold.
+func (o *outlierRecorder) observe(result *Result, req *http.Request, header http.Header, trace *requestTrace) {
+	threshold := o.args.Latency
+	if o.args.Percentile > 0 {
+		threshold = time.Duration(o.threshold.Load())
+		o.add(result.Latency)
+	}
+	if threshold == 0 || result.Latency <= threshold {
+		return
+	}
+
+	outlier := Outlier{
+		Timestamp: result.Timestamp,
+		Seq:       result.Seq,
+		Code:      result.Code,
+		Error:     result.Error,
+		Latency:   result.Latency,
+		Threshold: threshold,
+		Trace:     trace.breakdown(result.Timestamp, result.Timestamp.Add(result.Latency)),
+		Headers:   header,
+	}
+	if req != nil {
+		outlier.Method, outlier.URL = req.Method, req.URL.String()
+	}
+	select {
+	case o.pending <- outlier:
+		o.count.Add(1)
+	default:
+		o.dropped.Add(1)
+	}
+}
+
+// add counts a latency towards the window, asking for the threshold to be recomputed every so
+// often rather than sorting the window for every request.
+func (o *outlierRecorder) add(latency time.Duration) {
+	n := o.added.Add(1)
+	o.window[(n-1)%outlierWindow].Store(int64(latency))
+	if n%outlierRecompute != 0 || n < uint64(o.minCount) {
+		return
+	}
+	select {
+	case o.recompute <- struct{}{}:
+	default:
+		// Already asked for.
+	}
+}
+
+// recomputeThreshold computes the percentile of the window whenever asked to, until the recorder
+// is closed.
+func (o *outlierRecorder) recomputeThreshold() {
+	sorted := make([]time.Duration, 0, outlierWindow)
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-o.recompute:
+		}
+		sorted = sorted[:0]
+		for i := range o.window[:min(o.added.Load(), outlierWindow)] {
+			sorted = append(sorted, time.Duration(o.window[i].Load()))
+		}
+		slices.Sort(sorted)
+		o.threshold.Store(int64(percentile(sorted, o.args.Percentile)))
+	}
+}
+
+// write writes the queued outliers to the file until the queue is closed.
+func (o *outlierRecorder) write() {
+	defer close(o.done)
+	for outlier := range o.pending {
+		if o.redact != nil {
+			o.redact(&outlier)
+		}
+		o.enc.Encode(inLatencyUnit(outlier, o.unit))
+	}
+}
+
+// close writes the outliers still queued, then closes the file.
+func (o *outlierRecorder) close() error {
+	close(o.pending)
+	<-o.done
+	if n := o.dropped.Load(); n > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %d outliers weren't written to the outliers file as it couldn't keep up\n", n)
+	}
+	return o.f.Close()
+}
@@ -0,0 +1,193 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"nfiacco/loadtester/internal/encrypt"
+)
+
+// encryptedFile is an output encrypted to the -encrypt_output public key.
+type encryptedFile struct {
+	*encrypt.Writer
+	f io.WriteCloser
+}
+
+func (e *encryptedFile) Close() error {
+	if err := e.Writer.Close(); err != nil {
+		e.f.Close()
+		return err
+	}
+	return e.f.Close()
+}
+
+// encryptOutput wraps an output to encrypt it, if -encrypt_output is set.
+func (r *Runner) encryptOutput(f io.WriteCloser) (io.WriteCloser, error) {
+	if r.args.OutputRecipient == nil {
+		return f, nil
+	}
+
+	w, err := encrypt.NewWriter(f, r.args.OutputRecipient)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &encryptedFile{Writer: w, f: f}, nil
+}
+
+// stdoutOutput writes the results to stdout, which is left open when the output is closed, since
+// the summary is printed to it afterwards.
+type stdoutOutput struct{}
+
+func (stdoutOutput) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdoutOutput) Close() error                { return nil }
+
+// multiWriter writes the results to several outputs at once, e.g. a file and a collector. Every
+// output is written to even if another fails.
+type multiWriter []io.WriteCloser
+
+func (m multiWriter) Write(p []byte) (int, error) {
+	var first error
+	for _, w := range m {
+		if _, err := w.Write(p); err != nil && first == nil {
+			first = err
+		}
+	}
+	return len(p), first
+}
+
+func (m multiWriter) Close() error {
+	var first error
+	for _, w := range m {
+		if err := w.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+const (
+	// Results waiting to be sent to a collector, beyond which new ones are dropped rather than
+	// hold up the test.
+	httpOutputQueue = 10000
+	// How long to wait for a collector to take the rest of the results once the test is over.
+	httpOutputCloseTimeout = 30 * time.Second
+)
+
+// httpOutput streams the results to a collector as the body of a single POST request, which
+// ends when the output is closed. Results are queued and sent from a goroutine of their own, so a
+// slow or failing collector doesn't hold up or fail the test: results it can't keep up with are
+// dropped and counted, and failures are only warned about.
+type httpOutput struct {
+	url     string
+	console io.Writer
+	queue   chan []byte
+	dropped int // Writes dropped since the queue was full
+	cancel  context.CancelFunc
+	sent    chan error // Error writing the queued results
+	done    chan error // Error of the request
+}
+
+// newHTTPOutput starts the request to the collector. The results are written to the request body
+// through wrap, e.g. to encrypt them, so dropping some doesn't corrupt the stream.
+func newHTTPOutput(url, contentType string, console io.Writer, wrap func(io.WriteCloser) (io.WriteCloser, error)) (*httpOutput, error) {
+	pr, pw := io.Pipe()
+	w, err := wrap(pw)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	o := &httpOutput{
+		url:     url,
+		console: console,
+		queue:   make(chan []byte, httpOutputQueue),
+		cancel:  cancel,
+		sent:    make(chan error, 1),
+		done:    make(chan error, 1),
+	}
+	go func() {
+		res, err := http.DefaultClient.Do(req)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode >= 300 {
+				err = fmt.Errorf("%s responded %s", url, res.Status)
+			}
+		}
+		// Writes fail from now on, rather than blocking.
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			pr.Close()
+		}
+		o.done <- err
+	}()
+	go func() {
+		var err error
+		for p := range o.queue {
+			if err == nil {
+				_, err = w.Write(p)
+			}
+		}
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		o.sent <- err
+	}()
+	return o, nil
+}
+
+func (o *httpOutput) Write(p []byte) (int, error) {
+	select {
+	case o.queue <- bytes.Clone(p):
+	default:
+		o.dropped++
+	}
+	return len(p), nil
+}
+
+// Close sends the rest of the queued results, waiting for the collector up to a timeout. It never
+// fails, the results still went to the other outputs.
+func (o *httpOutput) Close() error {
+	close(o.queue)
+	timeout := time.NewTimer(httpOutputCloseTimeout)
+	defer timeout.Stop()
+	var err error
+	for sent, done := o.sent, o.done; sent != nil || done != nil; {
+		select {
+		case serr := <-sent:
+			sent = nil
+			if err == nil {
+				err = serr
+			}
+		case derr := <-done:
+			// The request's error explains why writing the results failed.
+			done = nil
+			if derr != nil {
+				err = derr
+			}
+		case <-timeout.C:
+			err = fmt.Errorf("timed out after %s", httpOutputCloseTimeout)
+			sent, done = nil, nil
+		}
+	}
+	o.cancel()
+	if o.dropped > 0 {
+		fmt.Fprintf(o.console, "Warning: %s couldn't keep up, dropped %d writes of results\n", o.url, o.dropped)
+	}
+	if err != nil {
+		fmt.Fprintf(o.console, "Warning: error sending results to %s: %s\n", o.url, err)
+	}
+	return nil
+}
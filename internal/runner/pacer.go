@@ -0,0 +1,142 @@
+package runner
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Waits shorter than this aren't slept, since timers can overshoot by more than that. The
+// request is sent a little early instead, and the pacer makes up for it with the next wait.
+const minSleep = 100 * time.Microsecond
+
+// pace returns how long to wait until the next request is due, after sending requests during
+// elapsed at qps requests per second. Requests are due on a fixed schedule from the start rather
+// than an interval after the previous one, so the pacer catches up after a late wake-up with
+// shorter or negative waits instead of drifting. It returns true if the schedule would overflow.
+func (r *Runner) pace(qps float64, elapsed time.Duration, requests uint64) (time.Duration, bool) {
+	due := float64(requests+1) * float64(time.Second) / qps
+	if due >= math.MaxInt64 {
+		return 0, true
+	}
+
+	return time.Duration(due) - elapsed, false
+}
+
+// pacerTimer puts the pacing loop to sleep, reusing a single timer rather than allocating one for
+// each request.
+type pacerTimer struct {
+	timer  *time.Timer
+	stopch <-chan struct{}
+}
+
+func newPacerTimer(stopch <-chan struct{}) *pacerTimer {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return &pacerTimer{timer: timer, stopch: stopch}
+}
+
+// sleep waits for d, returning false if the runner is stopped in the meantime.
+func (p *pacerTimer) sleep(d time.Duration) bool {
+	if d < minSleep {
+		select {
+		case <-p.stopch:
+			return false
+		default:
+			return true
+		}
+	}
+
+	p.timer.Reset(d)
+	select {
+	case <-p.timer.C:
+		return true
+	case <-p.stopch:
+		if !p.timer.Stop() {
+			<-p.timer.C
+		}
+		return false
+	}
+}
+
+// Scheduling errors are counted in buckets this many to each power of two nanoseconds, so their
+// percentiles are within about 3%.
+const schedulingSubBuckets = 32
+
+// schedulingErrors records how far from when each request was due the pacing loop woke up to send
+// it. Every request adds one, so they're counted in fixed buckets with atomics rather than kept,
+// which would grow with the test and have the pacers contend for a lock.
+type schedulingErrors struct {
+	count   atomic.Int64
+	total   atomic.Int64
+	max     atomic.Int64
+	buckets [60 * schedulingSubBuckets]atomic.Uint64 // Enough for any duration, see schedulingBucket
+}
+
+func (s *schedulingErrors) add(d time.Duration) {
+	if d < 0 {
+		d = -d
+	}
+
+	s.buckets[schedulingBucket(d)].Add(1)
+	s.total.Add(int64(d))
+	for {
+		m := s.max.Load()
+		if int64(d) <= m || s.max.CompareAndSwap(m, int64(d)) {
+			break
+		}
+	}
+	s.count.Add(1)
+}
+
+// schedulingBucket returns the bucket of a scheduling error: the error itself up to twice the
+// sub-buckets, and above that its power of two and the next 5 bits.
+func schedulingBucket(d time.Duration) int {
+	v := uint64(d)
+	if v < 2*schedulingSubBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - 6
+	return shift*schedulingSubBuckets + int(v>>shift)
+}
+
+// schedulingBucketMax returns the largest error of a bucket.
+func schedulingBucketMax(i int) time.Duration {
+	if i < 2*schedulingSubBuckets {
+		return time.Duration(i)
+	}
+	shift := i/schedulingSubBuckets - 1
+	top := uint64(i%schedulingSubBuckets + schedulingSubBuckets)
+	return time.Duration((top+1)<<shift - 1)
+}
+
+func (s *schedulingErrors) stats() *LatencyStats {
+	n := s.count.Load()
+	if n == 0 {
+		return nil
+	}
+	stats := &LatencyStats{
+		Count: int(n),
+		Mean:  time.Duration(s.total.Load() / n),
+		Max:   time.Duration(s.max.Load()),
+	}
+	stats.P50 = s.percentile(50, n, stats.Max)
+	stats.P90 = s.percentile(90, n, stats.Max)
+	stats.P95 = s.percentile(95, n, stats.Max)
+	stats.P99 = s.percentile(99, n, stats.Max)
+	return stats
+}
+
+// percentile returns the nearest-rank percentile p of n errors, like percentile does, to within
+// its bucket: the largest error of the bucket, or the max error if that's less.
+func (s *schedulingErrors) percentile(p float64, n int64, maxError time.Duration) time.Duration {
+	rank := max(1, uint64(math.Ceil(p*float64(n)/100-1e-9)))
+	var seen uint64
+	for i := range s.buckets {
+		if seen += s.buckets[i].Load(); seen >= rank {
+			return min(schedulingBucketMax(i), maxError)
+		}
+	}
+	return maxError
+}
@@ -0,0 +1,157 @@
+package runner
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// preconnectPool holds connections established before the test starts. The transports take them
+// as they dial, so the first requests of the test are sent on warm connections instead of paying
+// for the TCP and TLS handshakes.
+type preconnectPool struct {
+	dial   dialFunc
+	config *tls.Config // Base configuration of TLS connections, or nil for the defaults
+
+	mu    sync.Mutex
+	conns map[poolKey][]net.Conn
+}
+
+type poolKey struct {
+	scheme string // "http" or "https"
+	addr   string // "host:port", as the transport dials it
+}
+
+func newPreconnectPool(config *tls.Config, dial dialFunc) *preconnectPool {
+	return &preconnectPool{
+		dial:   dial,
+		config: config,
+		conns:  map[poolKey][]net.Conn{},
+	}
+}
+
+// install makes the transport take connections from the pool before dialing new ones.
+func (p *preconnectPool) install(t *http.Transport) {
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if conn := p.take("http", addr); conn != nil {
+			return conn, nil
+		}
+		return p.dial(ctx, network, addr)
+	}
+	t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if conn := p.take("https", addr); conn != nil {
+			return conn, nil
+		}
+		return p.dialTLS(ctx, addr)
+	}
+}
+
+func (p *preconnectPool) take(scheme, addr string) net.Conn {
+	key := poolKey{scheme, addr}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.conns[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	p.conns[key] = conns[1:]
+	return conns[0]
+}
+
+func (p *preconnectPool) dialTLS(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := p.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	config := &tls.Config{}
+	if p.config != nil {
+		config = p.config.Clone()
+	}
+	config.ServerName = host
+	config.NextProtos = []string{"h2", "http/1.1"}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// fill establishes n connections to each of the targets' addresses, in parallel.
+func (p *preconnectPool) fill(ctx context.Context, targets []string, n uint64) error {
+	keys := map[poolKey]bool{}
+	for _, target := range targets {
+		u, err := url.Parse(target)
+		if err != nil {
+			return err
+		}
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		keys[poolKey{u.Scheme, net.JoinHostPort(u.Hostname(), port)}] = true
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(keys)*int(n))
+	for key := range keys {
+		for i := uint64(0); i < n; i++ {
+			wg.Add(1)
+			go func(key poolKey) {
+				defer wg.Done()
+
+				var conn net.Conn
+				var err error
+				if key.scheme == "https" {
+					conn, err = p.dialTLS(ctx, key.addr)
+				} else {
+					conn, err = p.dial(ctx, "tcp", key.addr)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				p.mu.Lock()
+				p.conns[key] = append(p.conns[key], conn)
+				p.mu.Unlock()
+			}(key)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+// preconnect establishes the -preconnect connections to the targets before the test starts.
+func (r *Runner) preconnect() error {
+	if r.preconnected == nil || r.args.Mode == ModeConnect {
+		return nil
+	}
+
+	targets := make([]string, 0, len(r.lanes))
+	for _, l := range r.lanes {
+		for _, t := range l.allTargets() {
+			targets = append(targets, t.render(r.rand, nil))
+		}
+	}
+
+	ctx := r.ctx
+	if r.args.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(r.args.Timeout)*time.Second)
+		defer cancel()
+	}
+	return r.preconnected.fill(ctx, targets, r.args.Preconnect)
+}
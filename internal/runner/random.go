@@ -0,0 +1,37 @@
+package runner
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// lockedSource is a source of random numbers safe to use from multiple goroutines, like the
+// global one, but seeded for a single runner so concurrent runners don't affect each other.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+// newRand returns a generator of the random values of a test, seeded with -seed. Only its Read
+// isn't safe to call from multiple goroutines.
+func newRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)})
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
@@ -0,0 +1,30 @@
+package runner
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseRate parses a request rate into requests per second. The rate is a number of requests,
+// optionally fractional, per second by default or per the unit after a slash, e.g. "0.5",
+// "100/s", "30/m" or "2/h".
+func ParseRate(s string) (float64, error) {
+	count, unit, _ := strings.Cut(s, "/")
+	v, err := strconv.ParseFloat(count, 64)
+	if err != nil || v <= 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid rate %q, expected a positive number of requests", s)
+	}
+
+	switch unit {
+	case "", "s":
+		return v, nil
+	case "m":
+		return v / 60, nil
+	case "h":
+		return v / 3600, nil
+	default:
+		return 0, fmt.Errorf("invalid rate %q, unit must be s, m or h", s)
+	}
+}
@@ -0,0 +1,232 @@
+package runner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// redactHash returns a short hash of a redacted value, so results with the same value can still
+// be grouped without revealing it.
+func redactHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+// redactURL strips the credentials and fragment of a URL and replaces its query string with a
+// hash of it, e.g. "https://api.com/items?redacted=1f2e3d4c5b6a".
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "<redacted:" + redactHash(s) + ">"
+	}
+	u.User, u.Fragment, u.RawFragment = nil, "", ""
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted=" + redactHash(u.RawQuery)
+	}
+	return u.String()
+}
+
+// redactSecretURL keeps only the scheme and host of a URL whose path is a secret, e.g. that of a
+// Slack webhook, replacing the rest with a hash of it.
+func redactSecretURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return "<redacted:" + redactHash(s) + ">"
+	}
+	return u.Scheme + "://" + u.Host + "/<redacted:" + redactHash(s) + ">"
+}
+
+// redactValue replaces a value that could be a secret with a hash of it.
+func redactValue(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "<redacted:" + redactHash(s) + ">"
+}
+
+var (
+	// Quoted values, e.g. the URL of a net/http error or the value of a failed assertion, and
+	// unquoted URLs.
+	errorValuePattern = regexp.MustCompile(`"(?:[^"\\]|\\.)*"|https?://[^\s"'<>]+`)
+
+	errorTokenPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`eyJ[\w-]+\.[\w-]+\.[\w-]*`), // JWTs
+		regexp.MustCompile(`(?i)\b(bearer|basic)\s+[\w\-.~+/]+=*`),
+		regexp.MustCompile(`(?i)\b(access_token|token|api_?key|key|secret|password|passwd|session|sig|signature)=[^&\s"]+`),
+	}
+)
+
+// redactError redacts what an error message could leak: the URLs in it as with redactURL, quoted
+// values, which could come from response bodies, and anything that looks like a token.
+func redactError(s string) string {
+	s = errorValuePattern.ReplaceAllStringFunc(s, func(v string) string {
+		if !strings.HasPrefix(v, `"`) {
+			return redactURL(v)
+		}
+		unquoted, err := strconv.Unquote(v)
+		if err != nil {
+			unquoted = v[1 : len(v)-1]
+		}
+		if strings.HasPrefix(unquoted, "http://") || strings.HasPrefix(unquoted, "https://") {
+			return strconv.Quote(redactURL(unquoted))
+		}
+		return `"<redacted:` + redactHash(unquoted) + `>"`
+	})
+	for _, p := range errorTokenPatterns {
+		s = p.ReplaceAllStringFunc(s, func(v string) string {
+			return "<redacted:" + redactHash(v) + ">"
+		})
+	}
+	return s
+}
+
+// redact redacts a result before it's written, with -redact_urls and -redact_errors.
+func (r *Runner) redact(result *Result) {
+	if r.args.RedactErrors && result.Error != "" {
+		result.Error = redactError(result.Error)
+	}
+	if !r.args.RedactURLs {
+		return
+	}
+	if result.URL != "" {
+		result.URL = redactURL(result.URL)
+	}
+	for i := range result.Redirects {
+		result.Redirects[i].URL = redactURL(result.Redirects[i].URL)
+	}
+}
+
+// redactOutlier redacts an outlier before it's written, like a result, along with the headers of
+// its response that could hold credentials or URLs.
+func (r *Runner) redactOutlier(o *Outlier) {
+	if r.args.RedactErrors && o.Error != "" {
+		o.Error = redactError(o.Error)
+	}
+	if r.args.RedactURLs {
+		o.URL = redactURL(o.URL)
+	}
+	if (r.args.RedactURLs || r.args.RedactErrors) && o.Headers != nil {
+		o.Headers = redactHeaders(o.Headers)
+	}
+}
+
+// Parts of the names of headers whose values are likely credentials.
+var secretHeaderNames = []string{"auth", "cookie", "token", "key", "secret", "session", "signature"}
+
+// redactHeaders returns a copy of response headers with the values of those that could hold
+// credentials, e.g. Set-Cookie, replaced with hashes of them, and those with URLs, e.g. Location,
+// redacted as with redactURL.
+func redactHeaders(h http.Header) http.Header {
+	redacted := make(http.Header, len(h))
+	for name, values := range h {
+		values = slices.Clone(values)
+		lower := strings.ToLower(name)
+		for i, v := range values {
+			switch {
+			case lower == "location" || lower == "content-location":
+				values[i] = redactURL(v)
+			case lower == "link" || lower == "refresh":
+				values[i] = redactError(v)
+			case slices.ContainsFunc(secretHeaderNames, func(s string) bool { return strings.Contains(lower, s) }):
+				values[i] = redactValue(v)
+			}
+		}
+		redacted[name] = values
+	}
+	return redacted
+}
+
+// outputConfig returns the target and config to write to the outputs, with the URLs redacted
+// with -redact_urls, along with what else could hold credentials: the header commands and the
+// headers and bodies of the scenario's steps.
+func (r *Runner) outputConfig() (string, *LoadTestArgs) {
+	if !r.args.RedactURLs {
+		return r.target, &r.args
+	}
+
+	args := r.args
+	if r.args.Groups != nil {
+		args.Groups = make([]TargetGroup, len(r.args.Groups))
+		for i, g := range r.args.Groups {
+			g.Target = redactURL(g.Target)
+			args.Groups[i] = g
+		}
+	}
+	if r.args.Targets != nil {
+		args.Targets = make([]Target, len(r.args.Targets))
+		for i, t := range r.args.Targets {
+			t.URL = redactURL(t.URL)
+			args.Targets[i] = t
+		}
+	}
+	if args.ShadowTarget != "" {
+		args.ShadowTarget = redactURL(args.ShadowTarget)
+	}
+	if args.Login != nil {
+		login := *args.Login
+		login.URL = redactURL(login.URL)
+		args.Login = &login
+	}
+	if args.TargetMetrics != nil {
+		tm := *args.TargetMetrics
+		tm.URL = redactURL(tm.URL)
+		args.TargetMetrics = &tm
+	}
+	if args.AlertWebhook != "" {
+		args.AlertWebhook = redactSecretURL(args.AlertWebhook)
+	}
+	if args.HeaderCommands != nil {
+		args.HeaderCommands = make([]HeaderCommand, len(r.args.HeaderCommands))
+		for i, h := range r.args.HeaderCommands {
+			h.Command = redactValue(h.Command)
+			args.HeaderCommands[i] = h
+		}
+	}
+	if args.Scenario != nil {
+		scenario := &Scenario{Steps: make([]*ScenarioStep, len(r.args.Scenario.Steps)), Script: r.args.Scenario.Script}
+		for i, step := range r.args.Scenario.Steps {
+			s := *step
+			s.URL, s.Body = redactURL(s.URL), redactValue(s.Body)
+			if s.Headers != nil {
+				s.Headers = make(map[string]string, len(step.Headers))
+				for name, value := range step.Headers {
+					s.Headers[name] = redactValue(value)
+				}
+			}
+			scenario.Steps[i] = &s
+		}
+		args.Scenario = scenario
+	}
+
+	target := r.target
+	if target != "" {
+		target = redactURL(target)
+	}
+	return target, &args
+}
+
+// redactSummary redacts the URLs of the final summary with -redact_urls.
+func (r *Runner) redactSummary(s *Summary) {
+	if !r.args.RedactURLs {
+		return
+	}
+	if len(s.Ejections) > 0 {
+		ejections := make(map[string]int, len(s.Ejections))
+		for u, n := range s.Ejections {
+			ejections[redactURL(u)] += n
+		}
+		s.Ejections = ejections
+	}
+	if s.Shadow != nil {
+		s.Shadow.Target = redactURL(s.Shadow.Target)
+	}
+	if s.TargetMetrics != nil {
+		s.TargetMetrics.URL = redactURL(s.TargetMetrics.URL)
+	}
+}
@@ -0,0 +1,49 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// maxRedirects matches the limit of http.Client's default redirect policy.
+const maxRedirects = 10
+
+// RedirectHop is a single request of a redirect chain.
+type RedirectHop struct {
+	URL     string        `json:"url"`
+	Code    uint16        `json:"code"`
+	Latency time.Duration `json:"latency"` // Until the hop's response headers were received
+}
+
+// redirectRecorder records the hops of a request's redirect chain. Redirects are followed
+// sequentially, so it doesn't need to be safe for concurrent use.
+type redirectRecorder struct {
+	hops     []RedirectHop
+	hopStart time.Time
+}
+
+type redirectRecorderKey struct{}
+
+func withRedirectRecorder(ctx context.Context, rec *redirectRecorder) context.Context {
+	return context.WithValue(ctx, redirectRecorderKey{}, rec)
+}
+
+func (rec *redirectRecorder) hop(url string, code int) {
+	now := time.Now()
+	rec.hops = append(rec.hops, RedirectHop{URL: url, Code: uint16(code), Latency: now.Sub(rec.hopStart)})
+	rec.hopStart = now
+}
+
+// checkRedirect is the clients' redirect policy. It's called once each hop's response headers are
+// received, before the next hop is sent.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after 10 redirects")
+	}
+	if rec, ok := req.Context().Value(redirectRecorderKey{}).(*redirectRecorder); ok && req.Response != nil {
+		rec.hop(via[len(via)-1].URL.String(), req.Response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const EventConfigReload = "config-reload"
+
+// Reloadable are the parameters of a test that can be changed while it runs, e.g. from a config
+// file reloaded on SIGHUP.
+type Reloadable struct {
+	Qps         float64  // [0 = unchanged]
+	Headers     []Header // Replace the headers given with -header
+	TargetsFile string   // Targets file to load the weighted targets from [empty = unchanged]
+}
+
+// Reload applies the parameters that differ from the running test's, and returns what changed.
+// Changes are printed with the time they were applied and emitted as a config-reload event, to
+// correlate them with the results.
+func (r *Runner) Reload(c Reloadable) ([]string, error) {
+	var changes []string
+	var targets []Target
+	oldTargets := *r.targetsFile.Load()
+	if c.TargetsFile != "" && c.TargetsFile != oldTargets {
+		if len(r.lanes) > 1 {
+			return nil, fmt.Errorf("targets can't be used with target groups")
+		}
+		var err error
+		if targets, err = LoadTargets(c.TargetsFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Qps > 0 && len(r.lanes) == 1 {
+		if old := r.lanes[0].qps.Load(); old != c.Qps {
+			r.SetQps(c.Qps)
+			changes = append(changes, fmt.Sprintf("qps %g -> %g", old, c.Qps))
+		}
+	}
+
+	if diff := diffHeaders(r.headerList, c.Headers); len(diff) > 0 {
+		r.setHeaderTemplates(c.Headers)
+		changes = append(changes, diff...)
+	}
+
+	if targets != nil {
+		r.lanes[0].targets.Store(newTargetSet(targets))
+		r.targetsFile.Store(&c.TargetsFile)
+		if oldTargets == "" {
+			go r.watchTargets(r.lanes[0])
+		}
+		changes = append(changes, fmt.Sprintf("targets %q -> %q (%d targets)", oldTargets, c.TargetsFile, len(targets)))
+	}
+
+	if len(changes) > 0 {
+		fmt.Fprintf(r.console, "%s: reloaded config: %s\n", time.Now().Format(time.RFC3339), strings.Join(changes, ", "))
+		r.emit(Event{Type: EventConfigReload, Changes: changes})
+	}
+	return changes, nil
+}
+
+// diffHeaders describes how the headers changed. Values aren't included since headers often
+// contain credentials.
+func diffHeaders(old, headers []Header) []string {
+	values := func(headers []Header) map[string]string {
+		m := map[string]string{}
+		for _, h := range headers {
+			m[h.Name] += h.Value + "\n"
+		}
+		return m
+	}
+	before, after := values(old), values(headers)
+
+	var diff []string
+	for _, h := range headers {
+		if v, ok := before[h.Name]; !ok {
+			diff = append(diff, "header "+h.Name+" added")
+		} else if v != after[h.Name] {
+			diff = append(diff, "header "+h.Name+" changed")
+		}
+		// Only describe each name once.
+		before[h.Name] = after[h.Name]
+	}
+	for _, h := range old {
+		if _, ok := after[h.Name]; !ok {
+			diff = append(diff, "header "+h.Name+" removed")
+			after[h.Name] = ""
+		}
+	}
+	return diff
+}
+
+// reload reloads the parameters on SIGHUP.
+func (r *Runner) reload() {
+	c, err := r.args.Reload()
+	if err == nil {
+		var changes []string
+		if changes, err = r.Reload(c); err == nil && len(changes) == 0 {
+			fmt.Fprintf(r.console, "%s: reloaded config, nothing changed\n", time.Now().Format(time.RFC3339))
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: not reloading config: %s\n", err)
+	}
+}
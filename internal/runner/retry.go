@@ -0,0 +1,160 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryOnError is the -retry_on key of requests that got no response.
+const RetryOnError = "error"
+
+// Retries always allowed on top of the budget, so failures at the start of the test can be
+// retried.
+const minRetryBudget = 10
+
+// ParseRetryOn parses the comma separated status codes to retry, and "error" for requests that got
+// no response, each optionally with the weight its retries count against the budget, e.g.
+// "error,503,429=2". Weights default to 1.
+func ParseRetryOn(s string) (map[string]float64, error) {
+	on := map[string]float64{}
+	for _, item := range strings.Split(s, ",") {
+		key, weight, hasWeight := strings.Cut(strings.TrimSpace(item), "=")
+		if key != RetryOnError {
+			if code, err := strconv.Atoi(key); err != nil || code < 100 || code > 599 {
+				return nil, fmt.Errorf("invalid retry condition %q, expected a status code or \"error\"", item)
+			}
+		}
+		w := 1.0
+		if hasWeight {
+			var err error
+			if w, err = strconv.ParseFloat(weight, 64); err != nil || w < 0 {
+				return nil, fmt.Errorf("invalid weight in %q", item)
+			}
+		}
+		on[key] = w
+	}
+	return on, nil
+}
+
+// RetrySummary reports how much retrying hid the target's failures.
+type RetrySummary struct {
+	Retried           int     `json:"retried"`             // Requests retried at least once
+	Retries           int     `json:"retries"`             // Attempts after the first
+	Amplification     float64 `json:"amplification"`       // Attempts sent for each request
+	SuccessAfterRetry float64 `json:"success_after_retry"` // Fraction of retried requests that succeeded
+
+	// The weighted retries spent as a fraction of the -retry_budget, and the retries the budget
+	// denied. Only set for the final summary.
+	BudgetConsumed float64 `json:"budget_consumed,omitempty"`
+	Denied         uint64  `json:"denied,omitempty"`
+}
+
+// retryBudget limits the weighted retries to a fraction of the requests.
+type retryBudget struct {
+	mu       sync.Mutex
+	requests uint64
+	spent    float64
+	denied   uint64
+}
+
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	b.requests++
+	b.mu.Unlock()
+}
+
+// allow spends weight from the budget if there's enough of it left. A budget of 0 is unlimited.
+func (b *retryBudget) allow(weight, budget float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if budget > 0 && b.spent+weight > budget*float64(b.requests)+minRetryBudget {
+		b.denied++
+		return false
+	}
+	b.spent += weight
+	return true
+}
+
+// stats returns the fraction of the budget spent and the retries denied.
+func (b *retryBudget) stats(budget float64) (float64, uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if budget == 0 {
+		return 0, b.denied
+	}
+	return b.spent / (budget*float64(b.requests) + minRetryBudget), b.denied
+}
+
+// do sends a request, retrying it as allowed by -retries, -retry_on and -retry_budget. Each
+// attempt after the first waits for the backoff, doubled after every attempt.
+func (r *Runner) do(client *http.Client, req *http.Request, result *Result) (*http.Response, error) {
+	// Requests cut short on purpose would only be retried to be cut short again.
+	if r.args.Retries == 0 || result.Chaos != "" {
+		return client.Do(req)
+	}
+
+	r.retryBudget.request()
+	backoff := r.args.RetryBackoff
+	for attempt := uint64(1); ; attempt++ {
+		result.Attempts = attempt
+		res, err := client.Do(req)
+
+		key := RetryOnError
+		if err == nil {
+			key = strconv.Itoa(res.StatusCode)
+		}
+		weight, retryable := r.args.RetryOn[key]
+		// Bodies that can't be read again, e.g. multipart forms, can't be sent again.
+		resendable := req.Body == nil || req.GetBody != nil
+		if !retryable || !resendable || attempt > r.args.Retries || r.ctx.Err() != nil || !r.retryBudget.allow(weight, r.args.RetryBudget) {
+			return res, err
+		}
+
+		if err == nil {
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		if backoff > 0 {
+			t := time.NewTimer(backoff)
+			select {
+			case <-t.C:
+			case <-r.ctx.Done():
+				t.Stop()
+				return nil, r.ctx.Err()
+			}
+			backoff *= 2
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func summarizeRetries(results []*Result) *RetrySummary {
+	s := &RetrySummary{}
+	attempts, recovered := 0, 0
+	for _, r := range results {
+		attempts += int(max(r.Attempts, 1))
+		if r.Attempts > 1 {
+			s.Retried++
+			s.Retries += int(r.Attempts) - 1
+			if isSuccess(r) {
+				recovered++
+			}
+		}
+	}
+	if len(results) > 0 {
+		s.Amplification = float64(attempts) / float64(len(results))
+	}
+	if s.Retried > 0 {
+		s.SuccessAfterRetry = float64(recovered) / float64(s.Retried)
+	}
+	return s
+}
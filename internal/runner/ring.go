@@ -0,0 +1,195 @@
+package runner
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// DefaultRingSize is the number of results a ring file holds by default, 56 MB of records.
+const DefaultRingSize = 1_000_000
+
+// The layout of a ring file: a header followed by fixed-size result records.
+const (
+	ringMagic      = "LTRING01"
+	ringHeaderSize = 64      // Magic, record size, capacity and the number of results written
+	ringRecordSize = 56      // See resultRing.write
+	ringMaxErrors  = 1 << 16 // Distinct error messages kept, later ones are recorded as their failure kind
+)
+
+// resultRing records the results in a memory-mapped file during the test, instead of encoding
+// each one to the output, for rates where that can't keep up. Writing a result is a fixed-size
+// copy rather than an encoding, though the results are still kept in memory for the summary. Once
+// the ring is full, each result overwrites the oldest. After the test the ring is converted to the
+// output, oldest result first, and the file removed.
+//
+// It only saves encoding the results as they arrive: each result is still allocated and kept in
+// the list the summary is computed from, so the memory used doesn't change.
+//
+// Error messages are recorded by index like the tags. Messages past the first ringMaxErrors
+// distinct ones are recorded as their failure kind.
+type resultRing struct {
+	f        *os.File
+	data     []byte
+	unmap    func() error
+	capacity uint64
+	count    uint64
+
+	tags     []string // Recorded by index
+	tagIndex map[string]uint16
+
+	errors     []string // Recorded by index, 0 for none
+	errorIndex map[string]uint32
+	untracked  uint64 // Errors recorded as their failure kind, as there were too many distinct ones
+}
+
+func openResultRing(name string, capacity uint64) (*resultRing, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	size := ringHeaderSize + int64(capacity)*ringRecordSize
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	data, unmap, err := mapFile(f, int(size))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error mapping %s: %s", name, err)
+	}
+
+	copy(data, ringMagic)
+	binary.LittleEndian.PutUint32(data[8:], ringRecordSize)
+	binary.LittleEndian.PutUint64(data[16:], capacity)
+	return &resultRing{
+		f:        f,
+		data:     data,
+		unmap:    unmap,
+		capacity: capacity,
+		tags:     []string{""},
+		tagIndex: map[string]uint16{"": 0},
+
+		errors:     []string{""},
+		errorIndex: map[string]uint32{"": 0},
+	}, nil
+}
+
+// write records a result. Only Run's goroutine writes results.
+func (g *resultRing) write(r *Result) {
+	rec := g.data[ringHeaderSize+(g.count%g.capacity)*ringRecordSize:][:ringRecordSize]
+	binary.LittleEndian.PutUint64(rec[0:], uint64(r.Timestamp.UnixNano()))
+	binary.LittleEndian.PutUint64(rec[8:], uint64(r.Latency))
+	binary.LittleEndian.PutUint64(rec[16:], uint64(r.QueueDelay))
+	binary.LittleEndian.PutUint64(rec[24:], r.Seq)
+	binary.LittleEndian.PutUint16(rec[32:], r.Code)
+	rec[34] = failureIndex(r)
+	binary.LittleEndian.PutUint16(rec[36:], g.tag(r.Tag))
+	binary.LittleEndian.PutUint64(rec[40:], uint64(r.Bytes))
+	binary.LittleEndian.PutUint32(rec[48:], g.error(r.Error))
+
+	g.count++
+	binary.LittleEndian.PutUint64(g.data[24:], g.count)
+}
+
+func (g *resultRing) tag(name string) uint16 {
+	i, ok := g.tagIndex[name]
+	if !ok {
+		i = uint16(len(g.tags))
+		g.tags = append(g.tags, name)
+		g.tagIndex[name] = i
+	}
+	return i
+}
+
+// error returns the index of an error message, or 0 once there are too many to keep.
+func (g *resultRing) error(msg string) uint32 {
+	i, ok := g.errorIndex[msg]
+	if !ok {
+		if len(g.errors) >= ringMaxErrors {
+			g.untracked++
+			return 0
+		}
+		i = uint32(len(g.errors))
+		g.errors = append(g.errors, msg)
+		g.errorIndex[msg] = i
+	}
+	return i
+}
+
+// failureIndex returns 0 for a successful result, or one more than the index of its failure kind.
+func failureIndex(r *Result) uint8 {
+	if isSuccess(r) {
+		return 0
+	}
+	for i, kind := range FailureKinds {
+		if kind == r.FailureKind {
+			return uint8(i + 1)
+		}
+	}
+	// Failures without a kind are counted as other, the last kind.
+	return uint8(len(FailureKinds))
+}
+
+// overwritten returns the number of results overwritten by newer ones.
+func (g *resultRing) overwritten() uint64 {
+	if g.count <= g.capacity {
+		return 0
+	}
+	return g.count - g.capacity
+}
+
+// each calls f with the results in the ring, oldest first. The result is reused between calls.
+func (g *resultRing) each(f func(*Result) error) error {
+	var r Result
+	for n := g.overwritten(); n < g.count; n++ {
+		rec := g.data[ringHeaderSize+(n%g.capacity)*ringRecordSize:][:ringRecordSize]
+		r = Result{
+			Timestamp:  time.Unix(0, int64(binary.LittleEndian.Uint64(rec[0:]))),
+			Latency:    time.Duration(binary.LittleEndian.Uint64(rec[8:])),
+			QueueDelay: time.Duration(binary.LittleEndian.Uint64(rec[16:])),
+			Seq:        binary.LittleEndian.Uint64(rec[24:]),
+			Code:       binary.LittleEndian.Uint16(rec[32:]),
+			Tag:        g.tags[binary.LittleEndian.Uint16(rec[36:])],
+			Bytes:      int64(binary.LittleEndian.Uint64(rec[40:])),
+		}
+		if i := rec[34]; i > 0 {
+			r.FailureKind = FailureKinds[i-1]
+			r.Error = r.FailureKind
+		}
+		if i := binary.LittleEndian.Uint32(rec[48:]); i > 0 {
+			r.Error = g.errors[i]
+		}
+		if err := f(&r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushRing writes the results recorded in the ring to the output once the test is over.
+func (r *Runner) flushRing(g *resultRing, w io.Writer) error {
+	if n := g.overwritten(); n > 0 {
+		fmt.Fprintf(r.console, "Warning: the oldest %d results were overwritten in %s, only the last %d are written to the output\n", n, r.args.RingFile, g.capacity)
+	}
+	if g.untracked > 0 {
+		fmt.Fprintf(r.console, "Warning: more than %d distinct errors in %s, %d are written as their failure kind\n", ringMaxErrors, r.args.RingFile, g.untracked)
+	}
+	return g.each(func(result *Result) error {
+		return r.writeResult(w, result)
+	})
+}
+
+// close unmaps and removes the ring file, which is of no use once the results are written out.
+func (g *resultRing) close() error {
+	err := g.unmap()
+	if cerr := g.f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(g.f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
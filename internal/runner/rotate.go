@@ -0,0 +1,77 @@
+package runner
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotateTimeFormat names each file of a rotated output after the start of its window, in UTC so
+// the names sort in time order.
+const rotateTimeFormat = "20060102T150405Z"
+
+// rotatingWriter shards the output into a file for each window of time since the test started,
+// e.g. results-20240101T120000Z.csv, results-20240101T121500Z.csv for 15 minute windows. Each
+// write is a whole line, so lines are never split across files.
+type rotatingWriter struct {
+	name     string
+	interval time.Duration
+	open     func(name string) (io.WriteCloser, error)
+
+	mu          sync.Mutex
+	f           io.WriteCloser
+	windowStart time.Time
+	windowEnd   time.Time
+}
+
+func newRotatingWriter(name string, interval time.Duration, start time.Time, open func(string) (io.WriteCloser, error)) (*rotatingWriter, error) {
+	w := &rotatingWriter{name: name, interval: interval, open: open, windowEnd: start}
+	if err := w.rotate(start); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// windowName returns the name of the file for the window starting at t.
+func (w *rotatingWriter) windowName(t time.Time) string {
+	ext := filepath.Ext(w.name)
+	return strings.TrimSuffix(w.name, ext) + "-" + t.UTC().Format(rotateTimeFormat) + ext
+}
+
+// rotate opens the file for the window containing now, skipping windows nothing was written in.
+func (w *rotatingWriter) rotate(now time.Time) error {
+	for !now.Before(w.windowEnd) {
+		w.windowStart = w.windowEnd
+		w.windowEnd = w.windowStart.Add(w.interval)
+	}
+
+	f, err := w.open(w.windowName(w.windowStart))
+	if err != nil {
+		return err
+	}
+	if w.f != nil {
+		w.f.Close()
+	}
+	w.f = f
+	return nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if now := time.Now(); !now.Before(w.windowEnd) {
+		if err := w.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+	return w.f.Write(p)
+}
+
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
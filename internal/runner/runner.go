@@ -1,100 +1,810 @@
 package runner
 
 import (
+	"context"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/csv"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"math"
+	"math/rand"
 	"net/http"
+	"net/http/httptrace"
 	"os"
 	"os/signal"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"nfiacco/loadtester/internal/term"
 )
 
 type LoadTestArgs struct {
-	Duration   time.Duration
-	Qps        uint64
-	Workers    uint64 // Use multiple workers to support high QPS in the event of slow responses
-	MaxWorkers uint64
-	AutoScale  bool
-	Timeout    uint64
-	Method     string
-	OutputFile string
+	Duration         time.Duration     `json:"duration"`
+	MaxRequests      uint64            `json:"max_requests"`              // Stop after sending this many requests [0 = no limit]
+	StopAfterIdle    time.Duration     `json:"stop_after_idle"`           // Stop the test if no results arrive for this long [0 = never]
+	MaxErrors        uint64            `json:"max_errors,omitempty"`      // Stop the test after this many failed requests [0 = no limit]
+	WaitForTarget    time.Duration     `json:"wait_for_target,omitempty"` // Poll the target until it's ready before starting, for up to this long [0 = don't wait]
+	Qps              float64           `json:"qps"`
+	Workers          uint64            `json:"workers"` // Use multiple workers to support high QPS in the event of slow responses
+	MaxWorkers       uint64            `json:"max_workers"`
+	AutoScale        bool              `json:"autoscale"`
+	Timeout          uint64            `json:"timeout"`
+	Method           string            `json:"method"`
+	Mode             string            `json:"mode"`       // What each iteration does: "http" sends a request, "connect" only establishes a connection, "sse" holds an event stream
+	TLSResume        bool              `json:"tls_resume"` // Resume TLS sessions across connections with session tickets
+	OutputFile       string            `json:"output_file"`
+	OutputFiles      []string          `json:"output_files,omitempty"`      // More outputs to write the results to as well as OutputFile
+	OutputFormat     string            `json:"output_format"`               // Format of the output file: "csv" or "events"
+	OutputRotate     time.Duration     `json:"output_rotate"`               // Shard the output file into a file for each window of this length [0 = one file]
+	OutputRecipient  *ecdh.PublicKey   `json:"-"`                           // Encrypt the output file to this public key [nil = not encrypted]
+	RingFile         string            `json:"ring_file,omitempty"`         // Memory-mapped file to record results in during the test, written to the output after it [empty = write them as they arrive]
+	RingSize         uint64            `json:"ring_size,omitempty"`         // Most results the RingFile holds before overwriting the oldest
+	Interval         time.Duration     `json:"interval"`                    // Interval of periodic statistics such as interval-summary events
+	SummaryFile      string            `json:"summary_file"`                // File to write the summary to as JSON [empty = disabled]
+	HeatmapFile      string            `json:"heatmap_file"`                // File to write the latency heatmap to, as JSON if it ends in .json or CSV otherwise
+	HeatmapInterval  time.Duration     `json:"heatmap_interval"`            // Width of the heatmap's time buckets
+	StatsFile        string            `json:"stats_file"`                  // File to write stats of each Interval to, as JSON if it ends in .json or CSV otherwise
+	OutliersFile     string            `json:"outliers_file,omitempty"`     // File to write the requests over the OutlierThreshold to, with their traces, as NDJSON
+	OutlierThreshold *OutlierThreshold `json:"outlier_threshold,omitempty"` // Set with OutliersFile
+	PushgatewayURL   string            `json:"pushgateway_url"`             // Prometheus Pushgateway to push metrics to
+	InfluxDBURL      string            `json:"influxdb_url"`                // InfluxDB write endpoint to write metrics to
+	StatsdAddr       string            `json:"statsd_addr"`                 // DogStatsD address to send metrics to
+	GrafanaAddr      string            `json:"grafana_addr"`                // Address to serve the interval metrics on as a Grafana JSON datasource
+	ExportJob        string            `json:"export_job"`                  // Job name, measurement or prefix of exported metrics
+	ExportInterval   time.Duration     `json:"export_interval"`             // Interval to also export metrics at [0 = only at the end]
+	Record           string            `json:"record"`                      // Which results to write to the output file: "all" or "errors-only"
+	Sample           float64           `json:"sample"`                      // Fraction of recorded results to write, between 0 and 1 [0 = all]
+	ResultsBuffer    uint64            `json:"results_buffer"`              // Results that can be waiting to be read before workers block
+	ResultsOverflow  string            `json:"results_overflow"`            // What workers do when the results buffer is full: "block" or "drop"
+
+	LatencyByCode   bool            `json:"latency_by_code"`           // Report latency percentiles for each status code in the summary
+	LatencyUnit     string          `json:"latency_unit,omitempty"`    // Unit of the durations in the output files, e.g. "ms" [empty = nanoseconds]
+	RedactURLs      bool            `json:"redact_urls,omitempty"`     // Hash the query strings and strip the credentials of URLs in the output files
+	RedactErrors    bool            `json:"redact_errors,omitempty"`   // Redact URLs, quoted values and tokens in the errors in the output files
+	Thresholds      []Threshold     `json:"thresholds,omitempty"`      // Expected latency thresholds to flag in the summary
+	LatencyBuckets  []time.Duration `json:"latency_buckets,omitempty"` // Report the percentage of requests within each latency
+	Conditional     bool            `json:"conditional"`               // Send conditional requests using validators from previous responses
+	RecordRedirects bool            `json:"record_redirects"`          // Record the status, URL and latency of each hop of redirect chains
+
+	ExpectBodySHA256 string `json:"expect_body_sha256"` // Hex encoded SHA-256 every response body must match [empty = not checked]
+
+	TLSMinVersion uint16   `json:"tls_min_version,omitempty"` // e.g. tls.VersionTLS12 [0 = Go default]
+	TLSMaxVersion uint16   `json:"tls_max_version,omitempty"`
+	TLSCiphers    []uint16 `json:"tls_ciphers,omitempty"` // Cipher suites to offer for TLS 1.2 and below [empty = Go default]
+
+	TLSCertificates []tls.Certificate `json:"-"`        // Client certificates for mutual TLS
+	TLSRootCAs      *x509.CertPool    `json:"-"`        // CAs to verify the targets' certificates with [nil = system roots]
+	TLSKeyLog       io.Writer         `json:"-"`        // Where to write TLS secrets in the SSLKEYLOGFILE format, to decrypt packet captures
+	TCPInfo         bool              `json:"tcp_info"` // Collect the kernel's TCP statistics of each connection, on Linux
+
+	VUs        uint64 `json:"vus"`        // Run as virtual users sending requests back to back instead of at a fixed QPS
+	Iterations uint64 `json:"iterations"` // Requests per virtual user [0 = until the duration ends]
+
+	ConnectRamp       time.Duration `json:"connect_ramp"`                  // Period over which to gradually start workers and their connections
+	Preconnect        uint64        `json:"preconnect"`                    // Connections to establish to each target before the test starts
+	NewConnections    bool          `json:"new_connections"`               // Establish a new connection for every request instead of reusing them
+	ClientDelay       time.Duration `json:"client_delay,omitempty"`        // Wait before sending each request, to simulate a distant client
+	ClientDelayJitter time.Duration `json:"client_delay_jitter,omitempty"` // Spread of the client delay, which is picked uniformly within it
+
+	PacerShards uint64 `json:"pacer_shards,omitempty"` // Split the rate between this many independent schedulers, each with its share of the workers [0 = 1]
+	PinPacers   bool   `json:"pin_pacers,omitempty"`   // Lock each scheduler to its own OS thread
+
+	Retries      uint64             `json:"retries,omitempty"`       // Most times to retry a request that failed with one of RetryOn
+	RetryOn      map[string]float64 `json:"retry_on,omitempty"`      // Status codes, or "error" if there was no response, to retry, with the weight each retry counts against the budget
+	RetryBudget  float64            `json:"retry_budget,omitempty"`  // Weighted retries allowed as a fraction of the requests [0 = unlimited]
+	RetryBackoff time.Duration      `json:"retry_backoff,omitempty"` // Wait before the first retry of a request, doubling for each next one
+
+	IdempotencyKey bool               `json:"idempotency_key,omitempty"` // Send a random Idempotency-Key with each request that isn't safe to repeat
+	Invalid        *InvalidRequests   `json:"invalid,omitempty"`         // Share of the requests to send deliberately invalid
+	PerHostQps     float64            `json:"per_host_qps,omitempty"`    // Most requests per second to each address a target's host resolves to [0 = no limit]
+	DNSStrategies  map[string]string  `json:"dns_strategies,omitempty"`  // Strategy of picking the address to send each request to, by host, "" for all hosts [empty = round-robin]
+	DNSWeights     map[string]float64 `json:"dns_weights,omitempty"`     // Weights of addresses for the weighted DNS strategy [default 1]
+	Chaos          *Chaos             `json:"chaos,omitempty"`           // Share of the requests to cut short once they're sent
+	TargetMetrics  *TargetMetrics     `json:"target_metrics,omitempty"`  // Metrics of the target to scrape during the test
+	RunID          string             `json:"run_id,omitempty"`          // Unique ID of the test [empty = a random UUID]
+	RunIDHeader    string             `json:"run_id_header,omitempty"`   // Header to send the RunID in with each request [empty = none]
+	Seed           int64              `json:"seed,omitempty"`            // Seed of the random values, e.g. of placeholders and sampling [0 = a random one]
+
+	RateShape *RateShape `json:"-"`                    // Rate over time to replay instead of Qps, stretched or compressed to the Duration
+	RateScale float64    `json:"rate_scale,omitempty"` // Factor to scale the RateShape's rates by
+
+	RateSchedule *RateSchedule `json:"-"` // Rates for windows of the time of day, with Qps outside them
+
+	AlertWebhook   string        `json:"alert_webhook,omitempty"`    // URL to POST alerts to when an interval crosses a threshold
+	AlertErrorRate float64       `json:"alert_error_rate,omitempty"` // Error rate of an interval to alert over [0 = none]
+	AlertP99       time.Duration `json:"alert_p99,omitempty"`        // p99 latency of an interval to alert over [0 = none]
+
+	StateFile string    `json:"state_file,omitempty"` // File to save the test's progress to, to resume it from
+	Resume    *RunState `json:"resume,omitempty"`     // State of a test to resume, appending to its output
+
+	Groups                []TargetGroup   `json:"groups"`                     // Targets with their own rates, run instead of the single target
+	Targets               []Target        `json:"targets,omitempty"`          // Weighted targets, run instead of the single target
+	TargetsFile           string          `json:"targets_file,omitempty"`     // File the targets were loaded from, reloaded when it changes
+	EjectErrorRate        float64         `json:"eject_error_rate,omitempty"` // Stop sending requests to a weighted target while its error rate is above this [0 = never]
+	EjectDuration         time.Duration   `json:"eject_duration,omitempty"`   // How long to stop sending requests to an unhealthy target for
+	Tag                   string          `json:"tag"`                        // Workload class recorded with each result, to separate mixed workloads in post-processing
+	ShadowTarget          string          `json:"shadow_target,omitempty"`    // Base URL to mirror every request to, reported separately in the summary
+	Headers               []Header        `json:"-"`                          // Not included in the summary since they often contain credentials
+	HeaderCommands        []HeaderCommand `json:"header_commands"`            // Headers whose values are the output of commands
+	HeaderCommandInterval time.Duration   `json:"header_command_interval"`    // How often to rerun header commands [0 = never]
+	HeaderCommandTimeout  time.Duration   `json:"header_command_timeout"`     // How long a header command can run before it's killed [0 = DefaultHeaderCommandTimeout]
+	Feeder                *Feeder         `json:"-"`                          // Supplies variables for "{{column}}" placeholders in the target and headers
+	UserAgents            *UserAgents     `json:"-"`                          // User-Agents to pick from at random for each request
+	UserAgentPerVU        bool            `json:"user_agent_per_vu"`          // Pick a User-Agent once for each virtual user instead
+	Login                 *Login          `json:"login,omitempty"`            // Request each virtual user logs in with before its first request
+	Scenario              *Scenario       `json:"scenario,omitempty"`         // Steps each virtual user sends in turn instead of the target
+
+	FormFields []FormField `json:"form_fields"` // Send a multipart/form-data body with these fields
+	FormFiles  []FormFile  `json:"form_files"`  // and these files, streamed from disk
+
+	Generator RequestGenerator `json:"-"` // Generates each request instead of sending Method to the target
+
+	Verbose bool      `json:"verbose"` // Print a line for each request
+	Keys    io.Reader `json:"-"`       // Read keyboard controls from, e.g. os.Stdin [nil = none]
+
+	Reload func() (Reloadable, error) `json:"-"` // Gets the parameters to apply on SIGHUP [nil = ignore SIGHUP]
+
+	HostPolicy *HostPolicy `json:"-"` // Hosts requests can be sent to, checked for every request [nil = any]
 }
 
+const (
+	// Sleeps in the pacing loop that overshoot by more than this are reported as scheduling delays.
+	schedulingDelayThreshold  = 10 * time.Millisecond
+	schedulingWarningInterval = 5 * time.Second
+)
+
+const (
+	ModeHTTP     = "http"
+	ModeConnect  = "connect"
+	ModeSSE      = "sse"
+	ModeLongPoll = "longpoll"
+)
+
+// DefaultLongPollTimeout is the request timeout in longpoll mode, long enough for a server to
+// hold a poll until it has something to respond with.
+const DefaultLongPollTimeout = 5 * time.Minute
+
+const (
+	RecordAll        = "all"
+	RecordErrorsOnly = "errors-only"
+)
+
 type Runner struct {
-	target   string
-	args     LoadTestArgs
-	stopch   chan struct{}
-	stopOnce sync.Once
-	client   http.Client
+	target     string
+	lanes      []*lane
+	headers    atomic.Pointer[[]headerTemplate] // Can be replaced by a reload
+	headerList []Header                         // The headers the templates were parsed from
+	formValues []*template
+	args       LoadTestArgs
+	rand       *rand.Rand // Seeded with the Seed, for the random values of the test
+	stopch     chan struct{}
+	stopOnce   sync.Once
+	ctx        context.Context // Cancelled by Kill, to cancel the requests in flight
+	kill       context.CancelFunc
+
+	stopReasonOnce sync.Once
+	stopReason     string
+	client         http.Client
+	cache          *validatorCache
+
+	sessionCache tls.ClientSessionCache
+	preconnected *preconnectPool
+	targetsFile  atomic.Pointer[string] // Watched for changes, can be replaced by a reload
+	tcpStats     *tcpStats
+	shadow       *shadow
+	scraper      *metricsScraper
+	outliers     *outlierRecorder
+	alerts       *alerter
+	sqlite       *sqliteOutput // Set with an -output_file ending in .db
+
+	headerCmdOnce  sync.Once
+	dynamicHeaders []*dynamicHeader
+
+	verboseCapOnce sync.Once
+
+	schedulingErrors schedulingErrors
+	backpressure     backpressure
+	loginFailures    atomic.Uint64
+	loginWarning     sync.Once
+	scriptWarning    sync.Once
+	retryBudget      retryBudget
+	backends         *backends // Set with -per_host_qps or -dns_strategy
+	mixedOrigins     bool      // Whether the targets have more than one scheme or host
+	mixedSchemes     bool      // Whether the targets mix http and https
+
+	ejectmu   sync.Mutex
+	ejections map[string]int // Times each weighted target was ejected
+
+	pendingWorkers atomic.Uint64 // Workers to add to each lane
+	activeWorkers  atomic.Int64
+
+	console io.Writer // Where messages for the user are printed
+	events  *eventWriter
+	summary *Summary // Set once Run has finished
+
+	resultSubscribers   []func(*Result)
+	intervalSubscribers []func(*Summary)
+	eventSubscribers    []func(Event)
+	eventmu             sync.Mutex // Serializes the calls to the event subscribers
+
+	pausemu     sync.Mutex
+	resumech    chan struct{} // Non-nil while paused, closed on resume
+	pausedAt    time.Time
+	pausedTotal time.Duration
 }
 
 type Result struct {
-	Success   bool
-	Latency   time.Duration
-	Timestamp time.Time
-	Seq       uint64
-	Error     string
-	Code      uint16
+	Success   bool          `json:"-"`
+	Latency   time.Duration `json:"latency"`
+	Timestamp time.Time     `json:"timestamp"`
+	Seq       uint64        `json:"seq"`
+	Error     string        `json:"error,omitempty"`
+	Code      uint16        `json:"code"`
+	Tag       string        `json:"tag,omitempty"`
+
+	// Name of the scenario step the request was sent by, with -scenario.
+	Step string `json:"step,omitempty"`
+
+	// What kind of failure the error is, e.g. "timeout" or "refused", so failures can be told apart
+	// without parsing the error. Empty for successful requests.
+	FailureKind string `json:"failure_kind,omitempty"`
+
+	// Requests sent, including retries, when retries are enabled.
+	Attempts uint64 `json:"attempts,omitempty"`
+
+	// Response body bytes received.
+	Bytes int64 `json:"bytes,omitempty"`
+
+	// Address the request was sent to, with -per_host_qps or -dns_strategy.
+	Backend string `json:"backend,omitempty"`
+
+	// Scheme of the URL the request was sent to, "http" or "https", when the targets mix them.
+	Scheme string `json:"scheme,omitempty"`
+
+	// Whether the response was a cache "hit", "miss", "stale" or "bypass", by its cache status
+	// headers. Empty if it had none.
+	CacheStatus string `json:"cache_status,omitempty"`
+
+	// How the request was cut short on purpose, "abort" or "drop", if it was chosen to be.
+	Chaos string `json:"chaos,omitempty"`
+
+	// Kind of deliberately invalid request, e.g. "bad_auth", if it was one.
+	Invalid string `json:"invalid,omitempty"`
+
+	// How long the request waited between when it was due and when it was sent, e.g. for a free
+	// worker when the test is overloaded. It isn't included in the latency.
+	QueueDelay time.Duration `json:"queue_delay,omitempty"`
+
+	// Set when a new connection fell back from the first address it tried to another, e.g.
+	// "ipv6->ipv4", along with how long after the first attempt the successful one started. Not
+	// a CSV column, only in the events output and the summary.
+	Fallback      string        `json:"fallback,omitempty"`
+	FallbackDelay time.Duration `json:"fallback_delay,omitempty"`
+
+	// Time from when the request was sent to the first byte of the response, if one arrived. For
+	// streaming responses, it's often what matters rather than the latency.
+	TTFB time.Duration `json:"ttfb,omitempty"`
+
+	// Whether the request was sent on a "new" or "reused" connection. Empty if it got none.
+	Connection string `json:"connection,omitempty"`
+
+	// Connection setup, only measured when a new connection is established.
+	Connect      time.Duration `json:"connect,omitempty"`
+	TLSHandshake time.Duration `json:"tls_handshake,omitempty"`
+	TLSVersion   string        `json:"tls_version,omitempty"` // Negotiated version, e.g. "TLS 1.3"
+	Resumed      bool          `json:"resumed,omitempty"`     // Whether the TLS session was resumed
+
+	// Only recorded with -verbose. The method is only recorded for requests that don't have the
+	// test's method, from a generator or targets with their own.
+	URL    string `json:"url,omitempty"`
+	Method string `json:"method,omitempty"`
+
+	// Events received on a Server-Sent Events connection and the time to the first, in sse mode.
+	// The latency is how long the connection was held.
+	Events     uint64        `json:"events,omitempty"`
+	FirstEvent time.Duration `json:"first_event,omitempty"`
+
+	// Time from when the virtual user's previous poll returned until this one was sent, including
+	// establishing a new connection, in longpoll mode. The latency is how long the poll was held.
+	Reconnect time.Duration `json:"reconnect,omitempty"`
+
+	// Each request of the redirect chain, including the last, when redirects were followed and
+	// recording them is enabled.
+	Redirects []RedirectHop `json:"redirects,omitempty"`
+
+	health *targetHealth // Of the weighted target the request was sent to
 }
 
 type loadTest struct {
 	began time.Time
 	seqmu sync.Mutex
 	seq   uint64
+	sent  atomic.Uint64 // Requests started by virtual users
+}
+
+// ParsePercent parses a percentage such as "1%" or "0.5%" into a fraction between 0 and 1.
+func ParsePercent(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || math.IsNaN(v) {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	if v < 0 || v > 100 {
+		return 0, fmt.Errorf("percentage %q must be between 0%% and 100%%", s)
+	}
+
+	return v / 100, nil
 }
 
 func NewRunner(target string, args LoadTestArgs) *Runner {
-	return &Runner{
-		target:   target,
-		args:     args,
-		stopch:   make(chan struct{}),
-		stopOnce: sync.Once{},
+	if args.Sample == 0 {
+		args.Sample = 1
+	}
+	if args.ExportJob == "" {
+		args.ExportJob = "loadtest"
+	}
+	if args.Interval == 0 {
+		args.Interval = time.Second
+	}
+	if args.HeatmapInterval == 0 {
+		args.HeatmapInterval = time.Second
+	}
+	if args.ResultsBuffer == 0 {
+		args.ResultsBuffer = DefaultResultsBuffer
+	}
+	if args.ResultsOverflow == "" {
+		args.ResultsOverflow = ResultsOverflowBlock
+	}
+	if args.RingSize == 0 {
+		args.RingSize = DefaultRingSize
+	}
+	if args.Login != nil && args.Login.Method == "" {
+		login := *args.Login
+		login.Method = http.MethodPost
+		args.Login = &login
+	}
+	if args.EjectDuration == 0 {
+		args.EjectDuration = 10 * time.Second
+	}
+	if args.HeaderCommandTimeout == 0 {
+		args.HeaderCommandTimeout = DefaultHeaderCommandTimeout
+	}
+	if args.RateShape != nil {
+		if args.RateScale == 0 {
+			args.RateScale = 1
+		}
+		if args.Duration == 0 {
+			args.Duration = args.RateShape.Length()
+		}
+	}
+	// After the shape's default duration, so a resumed test only runs what's left of it.
+	if args.Resume != nil {
+		resumeArgs(&args)
+	}
+	if args.RunID == "" {
+		args.RunID = newUUID()
+	}
+	if args.Seed == 0 {
+		args.Seed = rand.Int63()
+	}
+
+	var cache *validatorCache
+	if args.Conditional {
+		cache = newValidatorCache()
+	}
+
+	formValues := make([]*template, 0, len(args.FormFields))
+	for _, f := range args.FormFields {
+		formValues = append(formValues, parseValidTemplate(f.Value))
+	}
+
+	ctx, kill := context.WithCancel(context.Background())
+	r := &Runner{
+		target:     target,
+		formValues: formValues,
+		args:       args,
+		rand:       newRand(args.Seed),
+		stopch:     make(chan struct{}),
+		ctx:        ctx,
+		kill:       kill,
+		console:    os.Stdout,
+		ejections:  map[string]int{},
+		stopOnce:   sync.Once{},
+		cache:      cache,
 		client: http.Client{
-			Timeout: time.Duration(args.Timeout) * time.Second,
+			Timeout:       time.Duration(args.Timeout) * time.Second,
+			CheckRedirect: checkRedirect,
 		},
 	}
+	r.lanes = r.newLanes(target)
+	r.setHeaderTemplates(args.Headers)
+	r.targetsFile.Store(&args.TargetsFile)
+	if args.TLSResume {
+		r.sessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	if args.TCPInfo && TCPInfoSupported {
+		r.tcpStats = &tcpStats{}
+	}
+	if args.Preconnect > 0 {
+		r.preconnected = newPreconnectPool(r.tlsConfig(), r.dialContext())
+	}
+	if args.PerHostQps > 0 || len(args.DNSStrategies) > 0 {
+		r.backends = newBackends(args.PerHostQps, args.DNSStrategies, args.DNSWeights, r.rand)
+	}
+	schemes, origins := r.targetOrigins()
+	r.mixedSchemes, r.mixedOrigins = len(schemes) > 1, len(origins) > 1
+	if r.preconnected != nil || r.tcpStats != nil || args.NewConnections || r.tlsConfig() != nil || r.backends != nil || r.mixedOrigins {
+		newTransport := func() roundTripCloser {
+			transport := r.newTransport()
+			if args.Preconnect > 0 {
+				// Keep the warm connections once they're idle rather than closing all but the default 2.
+				transport.MaxIdleConnsPerHost = int(args.Preconnect)
+			}
+			return r.withBackends(transport)
+		}
+		if r.mixedOrigins {
+			r.client.Transport = &originTransport{newTransport: newTransport, transports: map[string]roundTripCloser{}}
+		} else {
+			r.client.Transport = newTransport()
+		}
+	}
+	r.client.Transport = r.guardHosts(r.client.Transport)
+	if args.ShadowTarget != "" {
+		// Validated when parsing the arguments.
+		u, _ := ParseShadowTarget(args.ShadowTarget)
+		r.shadow = newShadow(u)
+	}
+	if args.TargetMetrics != nil {
+		r.scraper = newMetricsScraper(args.TargetMetrics)
+	}
+
+	return r
+}
+
+// precheckFailed reports that the test couldn't start. Nothing was sent, but still report that
+// rather than just the error.
+func (r *Runner) precheckFailed(err error) error {
+	summary := r.summarize(nil, 0)
+	summary.StopReason = fmt.Sprintf("precheck failed: %s", err)
+	printResultSummary(r.console, summary, false)
+	return err
 }
 
 func (r *Runner) Run() error {
+	if err := r.startHeaderCommands(); err != nil {
+		return r.precheckFailed(err)
+	}
+	if err := r.waitForTarget(); err != nil {
+		return r.precheckFailed(err)
+	}
+
+	// The test starts once the target is ready.
+	start := time.Now()
+	if err := r.preconnect(); err != nil {
+		return r.precheckFailed(fmt.Errorf("error preconnecting: %s", err))
+	}
+
+	if r.args.OutputFormat == OutputFormatEvents {
+		// Keep stdout clean for the event stream.
+		r.console = os.Stderr
+	}
+	w, err := r.createWriter(start)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	var ring *resultRing
+	if r.args.RingFile != "" {
+		if ring, err = openResultRing(r.args.RingFile, r.args.RingSize); err != nil {
+			return fmt.Errorf("error opening %s: %s", r.args.RingFile, err)
+		}
+		defer ring.close()
+	}
+
+	for _, name := range append([]string{r.args.OutputFile}, r.args.OutputFiles...) {
+		if !IsSQLiteOutput(name) {
+			continue
+		}
+		if r.sqlite, err = openSQLiteOutput(name, r.args.RunID); err != nil {
+			return fmt.Errorf("error opening %s: %s", name, err)
+		}
+		defer r.sqlite.close()
+		break
+	}
+
+	if r.args.OutliersFile != "" {
+		if r.outliers, err = openOutlierRecorder(r.args.OutliersFile, *r.args.OutlierThreshold, r.args.LatencyUnit); err != nil {
+			return fmt.Errorf("error opening %s: %s", r.args.OutliersFile, err)
+		}
+		r.outliers.redact = r.redactOutlier
+		defer r.outliers.close()
+	}
+
+	if r.args.OutputFormat == OutputFormatEvents {
+		r.events = newEventWriter(w, r.args.LatencyUnit)
+	}
+	if r.args.AlertWebhook != "" {
+		r.alerts = r.newAlerter()
+		defer r.alerts.close()
+		r.OnInterval(r.alerts.check)
+	}
+	target, config := r.outputConfig()
+	r.emit(Event{Type: EventRunStart, Target: target, Config: config})
+	if r.sqlite != nil {
+		if err := r.sqlite.start(target, config, start); err != nil {
+			return fmt.Errorf("error writing run to the database: %s", err)
+		}
+	}
+
+	if r.scraper != nil {
+		go r.scraper.run(r.emit)
+		defer r.scraper.stop()
+	}
 	results := r.StartTest()
 	resultList := []*Result{}
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-	w, err := createWriter(r.args.OutputFile)
+	defer signal.Stop(sig)
+	ctl := make(chan os.Signal, 1)
+	if pauseSignal != nil {
+		signal.Notify(ctl, pauseSignal, resumeSignal)
+		defer signal.Stop(ctl)
+	}
+	reload := make(chan os.Signal, 1)
+	if reloadSignal != nil && r.args.Reload != nil {
+		signal.Notify(reload, reloadSignal)
+		defer signal.Stop(reload)
+	}
+
+	var keys <-chan byte
+	if r.args.Keys != nil {
+		if f, ok := r.args.Keys.(*os.File); ok && term.IsTerminal(f) {
+			if restore, err := term.EnableCbreak(int(f.Fd())); err == nil {
+				defer restore()
+			}
+		}
+		var stop func()
+		keys, stop = readKeys(r.args.Keys)
+		defer stop()
+		fmt.Fprintln(r.console, keyboardHelp)
+	}
+
+	exporters, err := r.newExporters()
 	if err != nil {
-		return fmt.Errorf("error opening %s: %s", r.args.OutputFile, err)
+		return err
 	}
-	defer w.Close()
+	for _, e := range exporters {
+		if g, ok := e.(*grafanaExporter); ok {
+			defer g.close()
+		}
+	}
+	var exportTicks <-chan time.Time
+	if r.args.ExportInterval > 0 && len(exporters) > 0 {
+		ticker := time.NewTicker(r.args.ExportInterval)
+		defer ticker.Stop()
+		exportTicks = ticker.C
+	}
+	exported := 0
+
+	var intervalTicks <-chan time.Time
+	if r.events != nil || len(r.intervalSubscribers) > 0 || len(r.eventSubscribers) > 0 {
+		ticker := time.NewTicker(r.args.Interval)
+		defer ticker.Stop()
+		intervalTicks = ticker.C
+	}
+	intervalStart := 0
+
+	var stateTicks <-chan time.Time
+	var progress runProgress
+	saved := 0
+	if r.args.StateFile != "" {
+		ticker := time.NewTicker(stateInterval)
+		defer ticker.Stop()
+		stateTicks = ticker.C
+	}
+
+	var idleTicks <-chan time.Time
+	if r.args.StopAfterIdle > 0 {
+		ticker := time.NewTicker(min(r.args.StopAfterIdle, time.Second))
+		defer ticker.Stop()
+		idleTicks = ticker.C
+	}
+	lastResult := time.Now()
+	var failed uint64
 
 	for {
 		select {
+		case key := <-keys:
+			r.handleKey(key, resultList, start)
+		case <-exportTicks:
+			summary := r.summarize(resultList[exported:], r.args.ExportInterval)
+			exported = len(resultList)
+			if err := exportSummary(exporters, summary, false); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+			}
+		case <-intervalTicks:
+			summary := r.summarize(resultList[intervalStart:], r.args.Interval)
+			intervalStart = len(resultList)
+			for _, f := range r.intervalSubscribers {
+				f(summary)
+			}
+			r.publish(Event{Type: EventIntervalSummary, Summary: summary})
+			if r.events == nil {
+				continue
+			}
+			if err := r.events.write(Event{Type: EventIntervalSummary, Summary: summary}); err != nil {
+				return err
+			}
+		case <-stateTicks:
+			progress.add(resultList[saved:])
+			saved = len(resultList)
+			r.saveState(start, &progress, false)
+		case now := <-idleTicks:
+			if r.paused() {
+				lastResult = now
+			} else if now.Sub(lastResult) >= r.args.StopAfterIdle {
+				r.stopFor(fmt.Sprintf("no results for %s", r.args.StopAfterIdle))
+				// The requests in flight are most likely stuck too.
+				if r.Kill() {
+					fmt.Fprintf(r.console, "No results for %s, stopping\n", r.args.StopAfterIdle)
+				}
+			}
 		case result, ok := <-results:
 			if !ok {
-				printResultSummary(resultList)
-				return nil
+				if ring != nil {
+					if err := r.flushRing(ring, w); err != nil {
+						return err
+					}
+				}
+				err := r.finish(resultList, start, exporters)
+				if r.args.StateFile != "" {
+					progress.add(resultList[saved:])
+					// A test interrupted can still be resumed.
+					r.saveState(start, &progress, r.stopReason != "interrupted")
+				}
+				return err
+			}
+			lastResult = time.Now()
+			if r.args.MaxErrors > 0 && !isSuccess(result) && !r.cancelled(result) {
+				failed++
+				if failed == r.args.MaxErrors && r.stopFor(fmt.Sprintf("reached %d errors", failed)) {
+					fmt.Fprintf(r.console, "Reached %d errors, waiting for requests in flight...\n", failed)
+				}
 			}
+			// The summary always uses every result, only the output file is filtered.
 			resultList = append(resultList, result)
+			for _, f := range r.resultSubscribers {
+				f(result)
+			}
+			if r.args.Verbose {
+				r.printVerbose(r.console, result)
+			}
+			if !r.shouldRecord(result) {
+				continue
+			}
+			r.redact(result)
+			if r.sqlite != nil {
+				if err := r.sqlite.write(result); err != nil {
+					return fmt.Errorf("error writing result to the database: %s", err)
+				}
+			}
+			if ring != nil {
+				ring.write(result)
+				continue
+			}
 			if err := r.writeResult(w, result); err != nil {
 				return err
 			}
 		case <-sig:
-			stopSent := r.Stop()
-			if !stopSent {
-				// Exit immediately on second signal.
+			switch {
+			case r.stopFor("interrupted"):
+				fmt.Fprintln(r.console, "Shutting down, waiting for requests in flight...")
+			case r.Kill():
+				fmt.Fprintln(r.console, "Cancelling requests in flight...")
+			default:
+				// Exit immediately on third signal.
 				return nil
-			} else {
-				fmt.Println("Shutting down...")
 			}
+		case s := <-ctl:
+			if s == pauseSignal && r.Pause() {
+				fmt.Fprintln(r.console, "Paused, send SIGUSR2 to resume")
+			} else if s == resumeSignal && r.Resume() {
+				fmt.Fprintln(r.console, "Resumed")
+			}
+		case <-reload:
+			r.reload()
 		}
 	}
 }
 
+// finish reports the summary of a completed test.
+func (r *Runner) finish(results []*Result, start time.Time, exporters []exporter) error {
+	summary := r.summarize(results, time.Since(start))
+	summary.Target, summary.Config = r.outputConfig()
+	summary.StopReason = r.stopReason
+	summary.SchedulingError = r.schedulingErrors.stats()
+	summary.Ejections = r.ejectionCounts()
+	summary.Backpressure = r.backpressure.stats()
+	summary.LoginFailures = r.loginFailures.Load()
+	summary.Resumed = r.args.Resume
+	if r.outliers != nil {
+		summary.Outliers = r.outliers.count.Load()
+	}
+	if r.alerts != nil {
+		r.alerts.close()
+		summary.Alerts = r.alerts.count.Load()
+	}
+	if summary.Retries != nil {
+		summary.Retries.BudgetConsumed, summary.Retries.Denied = r.retryBudget.stats(r.args.RetryBudget)
+	}
+	if r.tcpStats != nil {
+		// Connections are only read when they're closed.
+		r.client.CloseIdleConnections()
+		summary.TCP = r.tcpStats.summary()
+	}
+	if r.shadow != nil {
+		summary.Shadow = r.shadow.summarize(summary.Elapsed)
+	}
+	if r.scraper != nil {
+		r.scraper.stop()
+		summary.TargetMetrics = r.scraper.summarize(results, start)
+	}
+	r.redactSummary(summary)
+	r.summary = summary
+
+	printResultSummary(r.console, summary, r.args.LatencyByCode)
+	r.publish(Event{Type: EventRunEnd, Summary: summary})
+	if r.events != nil {
+		if err := r.events.write(Event{Type: EventRunEnd, Summary: summary}); err != nil {
+			return err
+		}
+	}
+	if r.sqlite != nil {
+		if err := r.sqlite.finish(summary); err != nil {
+			return fmt.Errorf("error writing summary to the database: %s", err)
+		}
+	}
+	if r.args.SummaryFile != "" {
+		if err := writeSummaryFile(r.args.SummaryFile, summary, r.args.LatencyUnit); err != nil {
+			return fmt.Errorf("error writing summary to %s: %s", r.args.SummaryFile, err)
+		}
+	}
+	if r.args.HeatmapFile != "" {
+		heatmap := buildHeatmap(results, start, r.args.HeatmapInterval)
+		if err := writeHeatmapFile(r.args.HeatmapFile, heatmap, r.args.LatencyUnit); err != nil {
+			return fmt.Errorf("error writing heatmap to %s: %s", r.args.HeatmapFile, err)
+		}
+	}
+	if r.args.StatsFile != "" {
+		if err := writeStatsFile(r.args.StatsFile, buildStats(results, start, r.args.Interval), r.args.LatencyUnit); err != nil {
+			return fmt.Errorf("error writing stats to %s: %s", r.args.StatsFile, err)
+		}
+	}
+
+	return exportSummary(exporters, summary, true)
+}
+
+// Summary returns the summary of the test once Run has returned, or nil if it failed before
+// the test finished.
+func (r *Runner) Summary() *Summary {
+	return r.summary
+}
+
+// Stop stops scheduling requests. The requests in flight complete and are reported before the
+// results channel is closed. It returns false if the test was already stopped.
 func (r *Runner) Stop() bool {
 	select {
 	case <-r.stopch:
@@ -105,150 +815,696 @@ func (r *Runner) Stop() bool {
 	}
 }
 
+// Kill stops the test like Stop, and also cancels the requests in flight, which aren't reported.
+// It returns false if the test was already killed.
+func (r *Runner) Kill() bool {
+	if r.ctx.Err() != nil {
+		return false
+	}
+	r.Stop()
+	r.kill()
+	return true
+}
+
+// cancelled reports whether a result is of a request cancelled by Kill.
+func (r *Runner) cancelled(result *Result) bool {
+	return result.Error != "" && r.ctx.Err() != nil
+}
+
+// stopFor stops the test, recording why it was stopped early for the summary.
+func (r *Runner) stopFor(reason string) bool {
+	r.stopReasonOnce.Do(func() { r.stopReason = reason })
+	return r.Stop()
+}
+
+// SetQps changes the rate of a test without target groups while it's running. With -verbose,
+// the rate is capped at MaxVerboseQps.
+func (r *Runner) SetQps(qps float64) {
+	if qps > 0 {
+		r.lanes[0].qps.Store(r.capVerboseQps(qps))
+	}
+}
+
+// scaleQps multiplies the rate of every lane by factor, keeping the total under MaxVerboseQps
+// with -verbose.
+func (r *Runner) scaleQps(factor float64) {
+	total := 0.0
+	for _, l := range r.lanes {
+		total += l.qps.Load() * factor
+	}
+	if capped := r.capVerboseQps(total); capped < total {
+		factor *= capped / total
+	}
+	for _, l := range r.lanes {
+		l.qps.Store(l.qps.Load() * factor)
+	}
+}
+
+// AddWorker starts one more worker for each target while the test is running.
+func (r *Runner) AddWorker() {
+	r.pendingWorkers.Add(1)
+}
+
+// Pause stops scheduling new requests until Resume is called, while requests already in flight
+// complete. Time spent paused doesn't count towards the test duration. It returns false if the
+// runner was already paused.
+func (r *Runner) Pause() bool {
+	r.pausemu.Lock()
+	defer r.pausemu.Unlock()
+
+	if r.resumech != nil {
+		return false
+	}
+	r.resumech = make(chan struct{})
+	r.pausedAt = time.Now()
+
+	return true
+}
+
+// Resume continues a paused test. It returns false if the runner wasn't paused.
+func (r *Runner) Resume() bool {
+	r.pausemu.Lock()
+	defer r.pausemu.Unlock()
+
+	if r.resumech == nil {
+		return false
+	}
+	close(r.resumech)
+	r.resumech = nil
+	r.pausedTotal += time.Since(r.pausedAt)
+
+	return true
+}
+
+func (r *Runner) paused() bool {
+	r.pausemu.Lock()
+	defer r.pausemu.Unlock()
+	return r.resumech != nil
+}
+
+// waitWhilePaused blocks until the runner is resumed if it's paused, returning false if it's
+// stopped.
+func (r *Runner) waitWhilePaused() bool {
+	select {
+	case <-r.stopch:
+		return false
+	default:
+	}
+
+	r.pausemu.Lock()
+	resumech := r.resumech
+	r.pausemu.Unlock()
+
+	if resumech == nil {
+		return true
+	}
+
+	select {
+	case <-resumech:
+		return true
+	case <-r.stopch:
+		return false
+	}
+}
+
+// newLoadTest starts the state of a test, carrying on from the test it resumes, if any.
+func (r *Runner) newLoadTest() *loadTest {
+	lt := &loadTest{began: time.Now()}
+	if r.args.Resume != nil {
+		// Carry on numbering the requests of the resumed test.
+		lt.seq = r.args.Resume.Seq
+	}
+	return lt
+}
+
+// activeTime returns how long the test has been running, excluding time spent paused.
+func (r *Runner) activeTime(lt *loadTest) time.Duration {
+	r.pausemu.Lock()
+	defer r.pausemu.Unlock()
+
+	return time.Since(lt.began) - r.pausedTotal
+}
+
 func (r *Runner) StartTest() chan *Result {
+	// Run already reports errors from the initial header commands, so this is a no-op then.
+	if err := r.startHeaderCommands(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+	}
+
+	if r.args.TargetsFile != "" {
+		go r.watchTargets(r.lanes[0])
+	}
+	if r.args.EjectErrorRate > 0 && len(r.args.Targets) > 0 {
+		go r.checkTargetHealth(r.lanes[0])
+	}
+
+	if r.args.VUs > 0 {
+		return r.startVirtualUsers()
+	}
+
 	var wg sync.WaitGroup
-	lt := &loadTest{began: time.Now()}
-	workers := r.args.Workers
+	lt := r.newLoadTest()
+	results := r.newResultsChannel()
 
-	results := make(chan *Result)
-	ticks := make(chan struct{})
-	for i := uint64(0); i < workers; i++ {
-		wg.Add(1)
-		go r.runWorker(lt, &wg, ticks, results)
+	if r.args.RateShape != nil {
+		r.SetQps(r.shapeRate(0))
+		go r.followRateShape(lt)
+	}
+	if r.args.RateSchedule != nil {
+		now := time.Now()
+		r.SetQps(r.scheduleRate(now))
+		go r.followRateSchedule(r.args.RateSchedule.windowAt(now))
+	}
+
+	shards := max(r.args.PacerShards, 1)
+	pacers := make([]*pacer, 0, shards)
+	for i := uint64(0); i < shards; i++ {
+		p := &pacer{
+			shard:       i,
+			shards:      shards,
+			maxRequests: shareOf(r.args.MaxRequests, i, shards),
+			maxWorkers:  max(shareOf(r.args.MaxWorkers, i, shards), 1),
+		}
+		for _, l := range r.lanes {
+			st := &laneState{lane: l, ticks: make(chan time.Time), workers: max(shareOf(l.workers, i, shards), 1), rate: l.qps.Load() / float64(shards)}
+			for j := uint64(0); j < st.workers; j++ {
+				wg.Add(1)
+				go r.runWorker(lt, l, &wg, r.rampDelay(j*shards+i, st.workers*shards), st.ticks, results)
+			}
+			l.started.Add(st.workers)
+			p.states = append(p.states, st)
+		}
+		pacers = append(pacers, p)
+	}
+
+	var pacing sync.WaitGroup
+	for _, p := range pacers {
+		pacing.Add(1)
+		go func(p *pacer) {
+			defer pacing.Done()
+			r.runPacer(lt, p, &wg, results)
+		}(p)
 	}
 
 	go func() {
-		// The workers will shut down once the ticks channel is closed, so once this loop ends the
+		// The workers will shut down once the ticks channels are closed, so once the pacers end the
 		// workers will shut down too
-		defer func() {
-			close(ticks)
-			wg.Wait()
-			close(results)
-			r.Stop()
-		}()
-
-		count := uint64(0)
-		for {
-			elapsed := time.Since(lt.began)
-			if r.args.Duration > 0 && elapsed > r.args.Duration {
-				return
+		pacing.Wait()
+		for _, p := range pacers {
+			for _, st := range p.states {
+				close(st.ticks)
 			}
+		}
+		wg.Wait()
+		close(results)
+		r.Stop()
+	}()
+
+	return results
+}
+
+// laneState is the scheduler's state for a lane during a test.
+type laneState struct {
+	*lane
+	ticks        chan time.Time
+	count        uint64
+	workers      uint64
+	blockedUntil time.Duration // Active time before which the lane's workers are assumed busy
+
+	// The rate the lane is currently paced at, and the active time and count when it took effect.
+	rate      float64
+	base      time.Duration
+	baseCount uint64
+}
+
+// pacer is a shard of the scheduler, pacing its share of each lane's rate with its own workers.
+// Very high rates are sharded across several pacers, since a single one can't keep up.
+type pacer struct {
+	shard, shards uint64
+	states        []*laneState
+	maxRequests   uint64 // Share of -max_requests
+	maxWorkers    uint64 // Share of -max_workers for each lane
+}
+
+// shareOf splits n between shards, returning shard i's share.
+func shareOf(n, i, shards uint64) uint64 {
+	share := n / shards
+	if i < n%shards {
+		share++
+	}
+	return share
+}
+
+// offset returns how far ahead of the first shard's schedule the pacer's schedule is, so the
+// shards' requests are interleaved rather than sent at the same moment.
+func (p *pacer) offset(rate float64) time.Duration {
+	return time.Duration(float64(p.shard) * float64(time.Second) / (rate * float64(p.shards)))
+}
+
+func totalCount(states []*laneState) uint64 {
+	var total uint64
+	for _, st := range states {
+		total += st.count
+	}
+	return total
+}
 
-			wait, stop := r.pace(elapsed, count)
+// runPacer sends ticks to the workers of the pacer's lanes when their requests are due, until the
+// test ends.
+func (r *Runner) runPacer(lt *loadTest, p *pacer, wg *sync.WaitGroup, results chan<- *Result) {
+	if r.args.PinPacers {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+
+	states := p.states
+	var lastWarning time.Time
+	timer := newPacerTimer(r.stopch)
+	for {
+		if !r.waitWhilePaused() {
+			return
+		}
+
+		elapsed := r.activeTime(lt)
+		if r.args.Duration > 0 && elapsed > r.args.Duration {
+			return
+		}
+		if r.args.MaxRequests > 0 && totalCount(states) >= p.maxRequests {
+			return
+		}
+
+		for n := r.pendingWorkers.Swap(0); n > 0; n-- {
+			for _, st := range states {
+				r.startWorker(lt, st, wg, results)
+			}
+		}
+
+		// All lanes share this scheduler, so pick the one whose next request is due soonest.
+		var st *laneState
+		var wait, due time.Duration
+		for _, candidate := range states {
+			if qps := candidate.qps.Load() / float64(p.shards); qps != candidate.rate {
+				// Pace the new rate from now on, rather than as if it had applied since the start,
+				// keeping the progress towards the next request so frequent changes, e.g. with
+				// -rate_shape, don't keep holding it back.
+				t := elapsed - candidate.base + p.offset(candidate.rate)
+				progress := t.Seconds()*candidate.rate - float64(candidate.count-candidate.baseCount)
+				progress = max(0, min(progress, 1))
+				candidate.rate, candidate.baseCount = qps, candidate.count
+				candidate.base = elapsed + p.offset(qps) - time.Duration(progress/qps*float64(time.Second))
+			}
+
+			w, stop := r.pace(candidate.rate, elapsed-candidate.base+p.offset(candidate.rate), candidate.count-candidate.baseCount)
 			if stop {
 				return
 			}
-
-			time.Sleep(wait)
-
-			if r.args.AutoScale && workers < r.args.MaxWorkers {
-				select {
-				case ticks <- struct{}{}:
-					count++
-					continue
-				case <-r.stopch:
-					return
-				default:
-					// all workers are blocked. start one more and try again
-					workers++
-					wg.Add(1)
-					go r.runWorker(lt, &wg, ticks, results)
-				}
+			paced := w
+			w = max(w, candidate.blockedUntil-elapsed)
+			if st == nil || w < wait {
+				st, wait, due = candidate, w, paced
 			}
+		}
+
+		if r.args.Duration > 0 && elapsed+due > r.args.Duration {
+			// Not due until after the test ends.
+			return
+		}
+		if !timer.sleep(wait) {
+			return
+		}
+		// When the request was due, so the time it then waits for a worker is measured separately
+		// from its latency.
+		now := r.activeTime(lt)
+		scheduled := time.Now().Add(elapsed + due - now)
+		// How much longer the timer slept than asked. A request already overdue, e.g. after
+		// workers were all busy, isn't slept for at all, and its backlog isn't the timer's.
+		overshoot := now - elapsed - max(wait, 0)
+		if wait == due {
+			// Only when the request isn't held back by its lane's busy workers.
+			r.schedulingErrors.add(overshoot)
+		}
+
+		if overshoot > schedulingDelayThreshold &&
+			time.Since(lastWarning) > schedulingWarningInterval {
+			lastWarning = time.Now()
+			fmt.Fprintf(os.Stderr, "Warning: pacing loop was delayed by %s, the generator may be starved of CPU\n", overshoot)
+		}
 
+		// Don't scale up while the initial workers are still ramping up.
+		if r.args.AutoScale && st.workers < p.maxWorkers && elapsed >= r.args.ConnectRamp {
 			select {
-			case ticks <- struct{}{}:
-				count++
+			case st.ticks <- scheduled:
+				st.count++
+				continue
 			case <-r.stopch:
 				return
+			default:
+				// all workers are blocked. start one more and try again
+				r.startWorker(lt, st, wg, results)
+				r.emit(Event{Type: EventScaleUp, Tag: st.tag, Workers: st.started.Load()})
 			}
 		}
-	}()
-
-	return results
-}
 
-func (r *Runner) pace(elapsed time.Duration, requests uint64) (time.Duration, bool) {
-	expectedRequests := uint64(r.args.Qps) * uint64(elapsed/time.Second)
-	if requests < expectedRequests {
-		// Running behind, send next request immediately.
-		return 0, false
-	}
+		if len(states) > 1 {
+			// Don't let a lane whose workers are all busy hold up the other lanes. It will catch
+			// up once its workers free up.
+			select {
+			case st.ticks <- scheduled:
+				st.count++
+				st.blockedUntil = 0
+			case <-r.stopch:
+				return
+			default:
+				st.blockedUntil = r.activeTime(lt) + time.Millisecond
+			}
+			continue
+		}
 
-	interval := uint64(time.Second.Nanoseconds() / int64(r.args.Qps))
-	if math.MaxInt64/interval < requests {
-		// We would overflow delta if we continued, so stop the run.
-		return 0, true
+		select {
+		case st.ticks <- scheduled:
+			st.count++
+		case <-r.stopch:
+			return
+		}
 	}
+}
 
-	delta := time.Duration((requests + 1) * interval)
+// startWorker starts one more worker for the lane in a pacer.
+func (r *Runner) startWorker(lt *loadTest, st *laneState, wg *sync.WaitGroup, results chan<- *Result) {
+	st.workers++
+	st.started.Add(1)
+	wg.Add(1)
+	go r.runWorker(lt, st.lane, wg, 0, st.ticks, results)
+}
 
-	// Zero or negative durations cause time.Sleep to return immediately.
-	return delta - elapsed, false
+// rampDelay spreads the start of n workers evenly over the connect ramp, so their connections
+// aren't all established at the same moment.
+func (r *Runner) rampDelay(i, n uint64) time.Duration {
+	return r.args.ConnectRamp * time.Duration(i) / time.Duration(n)
 }
 
-func (r *Runner) runWorker(lt *loadTest, wg *sync.WaitGroup, ticks <-chan struct{}, results chan<- *Result) {
+func (r *Runner) runWorker(lt *loadTest, l *lane, wg *sync.WaitGroup, delay time.Duration, ticks <-chan time.Time, results chan<- *Result) {
 	defer wg.Done()
 
-	for range ticks {
-		results <- r.sendRequest(lt)
+	r.activeWorkers.Add(1)
+	defer r.activeWorkers.Add(-1)
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.stopch:
+			return
+		}
+	}
+
+	for scheduled := range ticks {
+		result := r.execute(lt, l, &r.client)
+		if r.cancelled(result) {
+			continue
+		}
+		result.QueueDelay = max(0, result.Timestamp.Sub(scheduled))
+		r.deliver(results, result)
+	}
+}
+
+// execute runs a single iteration of the test, depending on its mode.
+func (r *Runner) execute(lt *loadTest, l *lane, client *http.Client) *Result {
+	var result *Result
+	switch r.args.Mode {
+	case ModeConnect:
+		result = r.connect(lt, l)
+	case ModeSSE:
+		result = r.stream(lt, l, client)
+	default:
+		result = r.sendRequest(lt, l, client)
 	}
+	r.recordHealth(result)
+	return result
 }
 
-func (r *Runner) sendRequest(lt *loadTest) *Result {
+func (r *Runner) newResult(lt *loadTest, l *lane) *Result {
 	var result Result
-	var err error
 
 	lt.seqmu.Lock()
 	result.Timestamp = lt.began.Add(time.Since(lt.began))
 	result.Seq = lt.seq
 	lt.seq++
 	lt.seqmu.Unlock()
+	result.Tag = l.tag
+
+	return &result
+}
+
+func (r *Runner) sendRequest(lt *loadTest, l *lane, client *http.Client) *Result {
+	result := r.newResult(lt, l)
+	var err error
 
+	trace := &requestTrace{}
+	tracked := func() {}
+	var req *http.Request
+	var header http.Header // Of the response, for the outliers file
 	defer func() {
+		tracked()
 		result.Latency = time.Since(result.Timestamp)
-		if err != nil {
-			result.Error = err.Error()
+		result.TTFB = trace.timeToFirstByte(result.Timestamp)
+		result.Fallback, result.FallbackDelay = trace.fallback()
+		result.Connect = trace.connectLatency()
+		result.Connection = trace.connection()
+		result.TLSHandshake, result.TLSVersion, result.Resumed = trace.tlsHandshake()
+		if err != nil && isTimeout(err) {
+			// The client's timeout error doesn't say where the time went. A request that ran into the
+			// client's timeout took that long, give or take the timer firing late.
+			elapsed := result.Latency.Round(time.Millisecond)
+			if client.Timeout > 0 && elapsed >= client.Timeout {
+				elapsed = client.Timeout
+			}
+			result.Error = fmt.Sprintf("timeout after %s while %s: %s", elapsed, trace.currentPhase(), err)
+			result.FailureKind = FailureTimeout
+		} else if err != nil {
+			result.fail(err)
+		}
+		if r.outliers != nil {
+			r.outliers.observe(result, req, header, trace)
 		}
 	}()
 
-	req, err := http.NewRequest(r.args.Method, r.target, nil)
+	var vars map[string]string
+	if r.args.Feeder != nil {
+		vars = r.args.Feeder.Next()
+	}
+
+	var body io.ReadCloser
+	var contentType string
+	if len(r.args.FormFields) > 0 || len(r.args.FormFiles) > 0 {
+		body, contentType = r.multipartBody(vars)
+		// Stops the goroutine writing the body if the request fails before it's fully sent.
+		defer body.Close()
+	}
+
+	if r.args.Generator != nil {
+		req, err = r.generateRequest(result, vars)
+	} else {
+		req, err = r.newTargetRequest(r.ctx, l, vars, result, body)
+	}
 	if err != nil {
-		result.Error = err.Error()
-		return &result
+		result.fail(err)
+		return result
+	}
+	if r.mixedSchemes {
+		result.Scheme = req.URL.Scheme
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
 	}
+	if r.args.IdempotencyKey {
+		setIdempotencyKey(req)
+	}
+	result.Invalid = r.invalidate(req)
+
+	if r.cache != nil {
+		r.cache.apply(req)
+	}
+	if r.shadow != nil {
+		r.shadow.send(client, req, result)
+	}
+	ctx := httptrace.WithClientTrace(req.Context(), trace.clientTrace())
+	ctx, tracked = r.trackBackend(ctx, result)
+	ctx, cut := r.withChaos(ctx, result)
+	defer cut.done()
+	var redirects *redirectRecorder
+	if r.args.RecordRedirects {
+		redirects = &redirectRecorder{hopStart: time.Now()}
+		ctx = withRedirectRecorder(ctx, redirects)
+	}
+	req = req.WithContext(ctx)
 
-	res, err := r.client.Do(req)
+	if !r.clientDelay() {
+		result.fail(r.ctx.Err())
+		return result
+	}
+	res, err := r.do(client, req, result)
+	if result.Chaos = cut.happened(); err != nil && result.Chaos != "" {
+		// Cut short as intended.
+		err = nil
+		return result
+	}
 	if err != nil {
-		result.Error = err.Error()
-		return &result
+		result.fail(err)
+		return result
 	}
 	defer res.Body.Close()
+	header = res.Header
 
-	if result.Code = uint16(res.StatusCode); result.Code < 200 || result.Code >= 400 {
-		result.Error = res.Status
+	if redirects != nil && len(redirects.hops) > 0 {
+		redirects.hop(res.Request.URL.String(), res.StatusCode)
+		result.Redirects = redirects.hops
 	}
 
-	return &result
+	if r.cache != nil {
+		r.cache.store(req, res)
+	}
+	result.CacheStatus = cacheStatus(res.Header)
+
+	trace.setPhase(phaseReadingBody)
+
+	// Drain the body so the connection can be reused. Responses to HEAD requests never have one.
+	var sink io.Writer = io.Discard
+	var h hash.Hash
+	if r.args.ExpectBodySHA256 != "" {
+		h = sha256.New()
+		sink = h
+	}
+	result.Bytes, err = io.Copy(sink, res.Body)
+	if result.Chaos = cut.happened(); err != nil && result.Chaos != "" {
+		err = nil
+		return result
+	} else if err != nil {
+		result.fail(err)
+	}
+
+	if result.Code = uint16(res.StatusCode); result.Invalid != "" {
+		if result.Code < 400 || result.Code >= 500 {
+			result.failStatus(fmt.Sprintf("invalid request got %s", res.Status))
+		}
+	} else if result.Code < 200 || result.Code >= 400 {
+		result.failStatus(res.Status)
+	} else if h != nil && err == nil {
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, r.args.ExpectBodySHA256) {
+			result.Error = fmt.Sprintf("body checksum mismatch: got sha256 %s", sum)
+			result.FailureKind = FailureOther
+		}
+	}
+
+	return result
+}
+
+// createWriter opens the outputs the results are written to, other than a SQLite database.
+func (r *Runner) createWriter(start time.Time) (io.WriteCloser, error) {
+	names := slices.DeleteFunc(append([]string{r.args.OutputFile}, r.args.OutputFiles...), IsSQLiteOutput)
+	if len(names) == 1 {
+		return r.createOutput(names[0], start)
+	}
+
+	var outputs multiWriter
+	for _, name := range names {
+		w, err := r.createOutput(name, start)
+		if err != nil {
+			outputs.Close()
+			return nil, err
+		}
+		outputs = append(outputs, w)
+	}
+	return outputs, nil
 }
 
-func createWriter(name string) (*os.File, error) {
-	switch name {
-	case "stdout":
-		return os.Stdout, nil
+// createOutput opens an output: "stdout", a URL to stream the results to, or a file.
+func (r *Runner) createOutput(name string, start time.Time) (w io.WriteCloser, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("error opening %s: %s", name, err)
+		}
+	}()
+
+	switch {
+	case name == "stdout":
+		if r.args.OutputRecipient != nil && r.args.OutputFormat != OutputFormatEvents {
+			// Only the event stream moves the console output off stdout.
+			return nil, errors.New("encrypted results would be mixed with the console output on stdout, write them to a file or use -output_format events")
+		}
+		w, err := r.encryptOutput(stdoutOutput{})
+		if err != nil {
+			return nil, err
+		}
+		return w, r.writePreamble(w)
+	case strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://"):
+		contentType := "text/csv"
+		if r.args.OutputFormat == OutputFormatEvents {
+			contentType = "application/x-ndjson"
+		}
+		w, err := newHTTPOutput(name, contentType, r.console, r.encryptOutput)
+		if err != nil {
+			return nil, err
+		}
+		return w, r.writePreamble(w)
+	case r.args.OutputRotate > 0:
+		return newRotatingWriter(name, r.args.OutputRotate, start, r.createOutputFile)
 	default:
-		return os.Create(name)
+		return r.createOutputFile(name)
 	}
 }
 
+func (r *Runner) createOutputFile(name string) (io.WriteCloser, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if r.args.Resume != nil {
+		// The results of the resumed test carry on after those of the test it resumed.
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(name, flag, 0o666)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w, err := r.encryptOutput(f)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > 0 {
+		return w, nil
+	}
+	if err := r.writePreamble(w); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (r *Runner) shouldRecord(result *Result) bool {
+	if r.args.Record == RecordErrorsOnly && result.Error == "" {
+		return false
+	}
+
+	return r.args.Sample >= 1 || r.rand.Float64() < r.args.Sample
+}
+
 func (r *Runner) writeResult(w io.Writer, result *Result) error {
+	if r.events != nil {
+		return r.events.write(Event{Type: EventResultSample, Result: result})
+	}
+
 	enc := csv.NewWriter(w)
 	err := enc.Write([]string{
 		strconv.FormatInt(result.Timestamp.UnixNano(), 10),
 		strconv.FormatUint(uint64(result.Code), 10),
-		strconv.FormatInt(result.Latency.Nanoseconds(), 10),
+		formatDuration(result.Latency, r.args.LatencyUnit),
 		result.Error,
 		strconv.FormatUint(result.Seq, 10),
+		result.Tag,
+		formatDuration(result.QueueDelay, r.args.LatencyUnit),
+		result.FailureKind,
 	})
 	if err != nil {
 		return err
@@ -258,21 +1514,3 @@ func (r *Runner) writeResult(w io.Writer, result *Result) error {
 
 	return enc.Error()
 }
-
-func printResultSummary(results []*Result) {
-	var success, failure int
-	var totalLatency time.Duration
-
-	for _, r := range results {
-		if r.Code >= 200 && r.Code < 400 {
-			success++
-		} else {
-			failure++
-		}
-		totalLatency += r.Latency
-	}
-
-	fmt.Printf("Successful Requests: %d, Failed Requests: %d\n", success, failure)
-	fmt.Printf("Average latency: %s\n", totalLatency/time.Duration(len(results)))
-	fmt.Printf("Error rate: %.2f%%\n", float64(failure)/float64(len(results))*100)
-}
@@ -1,11 +1,36 @@
 package runner_test
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	_ "modernc.org/sqlite"
+
+	"nfiacco/loadtester/internal/encrypt"
 	"nfiacco/loadtester/internal/runner"
 )
 
@@ -51,3 +76,4606 @@ func TestDuration(t *testing.T) {
 		t.Fatalf("got: %v, want: %v", elapsed.Round(time.Second), time.Second)
 	}
 }
+
+func TestRecordErrorsOnly(t *testing.T) {
+	t.Parallel()
+	var count int64
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt64(&count, 1)%2 == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}),
+	)
+	defer server.Close()
+
+	out := filepath.Join(t.TempDir(), "results.csv")
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:   1 * time.Second,
+		Workers:    1,
+		Qps:        10,
+		OutputFile: out,
+		Record:     runner.RecordErrorsOnly,
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The results follow the schema version comment and the header line.
+	if got, want := strings.Count(string(data), "\n"), 2+5; got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
+
+func TestSuccess(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			code, _ := strconv.Atoi(r.URL.Query().Get("code"))
+			w.WriteHeader(code)
+		}),
+	)
+	defer server.Close()
+
+	for _, tt := range []struct {
+		name string
+		code int
+		args runner.LoadTestArgs
+		want int
+	}{
+		{"2xx", 200, runner.LoadTestArgs{}, 1},
+		{"3xx", 304, runner.LoadTestArgs{}, 1},
+		{"4xx", 404, runner.LoadTestArgs{}, 0},
+		{"5xx", 503, runner.LoadTestArgs{}, 0},
+		{"failed check", 200, runner.LoadTestArgs{ExpectBodySHA256: "00"}, 0},
+		{"connect", 0, runner.LoadTestArgs{Mode: runner.ModeConnect, Timeout: 5}, 1},
+	} {
+		tt.args.VUs, tt.args.Iterations = 1, 1
+		tt.args.OutputFile = filepath.Join(t.TempDir(), "results.csv")
+		r := runner.NewRunner(server.URL+"/?code="+strconv.Itoa(tt.code), tt.args)
+		if err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if s := r.Summary(); s.Successful != tt.want || s.Requests != 1 {
+			t.Errorf("%s: got: %d successful of %d, want: %d", tt.name, s.Successful, s.Requests, tt.want)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	t.Parallel()
+	ms := func(n int) []time.Duration {
+		sorted := make([]time.Duration, n)
+		for i := range sorted {
+			sorted[i] = time.Duration(i+1) * time.Millisecond
+		}
+		return sorted
+	}
+	tests := []struct {
+		n    int
+		p    float64
+		want time.Duration
+	}{
+		{n: 1, p: 50, want: 1 * time.Millisecond},
+		{n: 1, p: 99, want: 1 * time.Millisecond},
+		{n: 3, p: 34, want: 2 * time.Millisecond},
+		{n: 3, p: 50, want: 2 * time.Millisecond},
+		{n: 3, p: 67, want: 3 * time.Millisecond},
+		{n: 10, p: 0, want: 1 * time.Millisecond},
+		{n: 10, p: 50, want: 5 * time.Millisecond},
+		{n: 10, p: 90, want: 9 * time.Millisecond},
+		{n: 10, p: 91, want: 10 * time.Millisecond},
+		{n: 10, p: 100, want: 10 * time.Millisecond},
+		{n: 100, p: 7, want: 7 * time.Millisecond},
+		{n: 100, p: 99, want: 99 * time.Millisecond},
+		{n: 1000, p: 99.9, want: 999 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := runner.Percentile(ms(tt.n), tt.p); got != tt.want {
+			t.Errorf("p%g of %d latencies = %s, want: %s", tt.p, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestSchedulingErrorStats(t *testing.T) {
+	t.Parallel()
+	if stats := runner.SchedulingErrorStats(nil); stats != nil {
+		t.Fatalf("got: %s, want nil without requests", stats)
+	}
+
+	// Errors from 0 to about 10s, both early and late, spread across the buckets.
+	var errors []time.Duration
+	for i := 0; i < 10000; i++ {
+		d := time.Duration(i*i) * 97
+		if i%2 == 1 {
+			d = -d
+		}
+		errors = append(errors, d)
+	}
+	got := runner.SchedulingErrorStats(errors)
+	for i, d := range errors {
+		errors[i] = d.Abs()
+	}
+	want := runner.ComputeLatencyStats(errors)
+	if got.Count != want.Count || got.Mean != want.Mean || got.Max != want.Max {
+		t.Fatalf("got: %+v, want: %+v", got, want)
+	}
+	for _, p := range []struct {
+		name      string
+		got, want time.Duration
+	}{{"p50", got.P50, want.P50}, {"p90", got.P90, want.P90}, {"p95", got.P95, want.P95}, {"p99", got.P99, want.P99}} {
+		if p.got < p.want || float64(p.got-p.want) > 0.035*float64(p.want) {
+			t.Errorf("got: %s %s, want within 3%% above %s", p.name, p.got, p.want)
+		}
+	}
+
+	// Small errors are counted exactly.
+	small := runner.SchedulingErrorStats([]time.Duration{1, 2, 3, 40, 63})
+	if small.P50 != 3 || small.P90 != 63 || small.Max != 63 {
+		t.Fatalf("got: %+v, want exact percentiles", small)
+	}
+}
+
+func TestLatencyByCode(t *testing.T) {
+	t.Parallel()
+	var n atomic.Int32
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch n.Add(1) % 3 {
+			case 1:
+			case 2:
+				time.Sleep(20 * time.Millisecond)
+				w.WriteHeader(http.StatusNotFound)
+			case 0:
+				time.Sleep(60 * time.Millisecond)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:           1,
+		Iterations:    9,
+		LatencyByCode: true,
+		OutputFile:    filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	codes := r.Summary().Codes
+	if len(codes) != 3 {
+		t.Fatalf("got: %v, want the stats of 200, 404 and 503", codes)
+	}
+	for code, stats := range codes {
+		if stats.Count != 3 {
+			t.Errorf("got: %d requests with code %s, want: 3", stats.Count, code)
+		}
+	}
+	// Each code has the latency of its own responses.
+	ok, notFound, unavailable := codes["200"], codes["404"], codes["503"]
+	if ok.P50 >= 20*time.Millisecond || notFound.P50 < 20*time.Millisecond || unavailable.P50 < 60*time.Millisecond || notFound.P50 >= unavailable.P50 {
+		t.Errorf("got: 200 %s, 404 %s, 503 %s, want medians under 20ms, from 20ms and from 60ms", ok, notFound, unavailable)
+	}
+
+	var printed strings.Builder
+	runner.PrintSummary(&printed, r.Summary(), true)
+	for _, want := range []string{"  200: count=3 ", "  404: count=3 ", "  503: count=3 "} {
+		if !strings.Contains(printed.String(), want) {
+			t.Fatalf("got: %s, want a line starting with %q", printed.String(), want)
+		}
+	}
+}
+
+func TestHeatmap(t *testing.T) {
+	t.Parallel()
+	began := time.Now()
+	result := func(at, latency time.Duration) *runner.Result {
+		return &runner.Result{Timestamp: began.Add(at), Latency: latency}
+	}
+	results := []*runner.Result{
+		result(0, 50*time.Microsecond),
+		result(100*time.Millisecond, 100*time.Microsecond), // On a bound, in its bucket
+		result(900*time.Millisecond, 101*time.Microsecond),
+		result(time.Second, 3*time.Millisecond),
+		result(3500*time.Millisecond, time.Hour), // Overflow
+	}
+	h := runner.BuildHeatmap(results, began, time.Second)
+
+	buckets := runner.HeatmapBuckets
+	if h.Interval != time.Second || !reflect.DeepEqual(h.Buckets, buckets) {
+		t.Fatalf("got: interval %s, buckets %v", h.Interval, h.Buckets)
+	}
+	bucket := func(bound time.Duration) int {
+		return slices.Index(buckets, bound)
+	}
+	counts := func(cells map[int]uint64) []uint64 {
+		c := make([]uint64, len(buckets)+1)
+		for i, n := range cells {
+			c[i] = n
+		}
+		return c
+	}
+	want := []runner.HeatmapRow{
+		{Start: 0, Counts: counts(map[int]uint64{bucket(100 * time.Microsecond): 2, bucket(200 * time.Microsecond): 1})},
+		{Start: time.Second, Counts: counts(map[int]uint64{bucket(5 * time.Millisecond): 1})},
+		{Start: 3 * time.Second, Counts: counts(map[int]uint64{len(buckets): 1})},
+	}
+	if !reflect.DeepEqual(h.Rows, want) {
+		t.Fatalf("got: %+v, want: %+v", h.Rows, want)
+	}
+
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+	dir := t.TempDir()
+	name := filepath.Join(dir, "heatmap.json")
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:         1,
+		Iterations:  5,
+		HeatmapFile: name,
+		OutputFile:  filepath.Join(dir, "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written runner.Heatmap
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	total := uint64(0)
+	for _, row := range written.Rows {
+		for _, n := range row.Counts {
+			total += n
+		}
+	}
+	if total != 5 {
+		t.Fatalf("got: %d results in the heatmap file, want: 5", total)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		addrs     []string
+		connected string
+		want      string
+	}{
+		{name: "reused connection"},
+		{name: "first address", addrs: []string{"127.0.0.1:443"}, connected: "127.0.0.1:443"},
+		{name: "ipv6 to ipv4", addrs: []string{"[::1]:443", "127.0.0.1:443"}, connected: "127.0.0.1:443", want: "ipv6->ipv4"},
+		{name: "between A records", addrs: []string{"10.0.0.1:80", "10.0.0.2:80"}, connected: "10.0.0.2:80", want: "ipv4->ipv4"},
+		{name: "all failed", addrs: []string{"[::1]:443", "127.0.0.1:443"}},
+	}
+	for _, tt := range tests {
+		kind, delay := runner.TraceFallback(tt.addrs, 10*time.Millisecond, tt.connected)
+		if kind != tt.want {
+			t.Errorf("%s: got: %q, want: %q", tt.name, kind, tt.want)
+		}
+		if (tt.want != "" && delay < 10*time.Millisecond) || (tt.want == "" && delay != 0) {
+			t.Errorf("%s: got a delay of %s, want the time between the attempts", tt.name, delay)
+		}
+	}
+}
+
+func TestValidateMethod(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		method      string
+		allowCustom bool
+		wantErr     bool
+	}{
+		{"HEAD", false, false},
+		{"OPTIONS", false, false},
+		{"PTACH", false, true},
+		{"PURGE", false, true},
+		{"PURGE", true, false},
+		{"BAD METHOD", true, true},
+	}
+	for _, tt := range tests {
+		err := runner.ValidateMethod(tt.method, tt.allowCustom)
+		if got := err != nil; got != tt.wantErr {
+			t.Errorf("ValidateMethod(%q, %v) = %v, wantErr: %v", tt.method, tt.allowCustom, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPause(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration: 1 * time.Second,
+		Workers:  1,
+		Qps:      100,
+	})
+	r.Pause()
+	time.AfterFunc(500*time.Millisecond, func() { r.Resume() })
+
+	start := time.Now()
+	var hits uint64
+	for range r.StartTest() {
+		hits++
+	}
+	elapsed := time.Since(start)
+
+	if got, want := hits, uint64(100); got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+	if elapsed < 1500*time.Millisecond {
+		t.Fatalf("got: %v, want at least 1.5s", elapsed)
+	}
+}
+
+func TestConditional(t *testing.T) {
+	t.Parallel()
+	var notModified int64
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt64(&notModified, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:    1 * time.Second,
+		Workers:     1,
+		Qps:         10,
+		Conditional: true,
+	})
+	for range r.StartTest() {
+	}
+
+	if got, want := atomic.LoadInt64(&notModified), int64(9); got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
+
+func TestFeeder(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	seen := map[string]int{}
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			seen[r.URL.Path+" "+r.Header.Get("X-Password")]++
+			mu.Unlock()
+		}),
+	)
+	defer server.Close()
+
+	name := filepath.Join(t.TempDir(), "users.csv")
+	if err := os.WriteFile(name, []byte("username,password\nalice,a1\nbob,b2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	feeder, err := runner.LoadFeeder(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := runner.NewRunner(server.URL+"/users/{{username}}", runner.LoadTestArgs{
+		Duration: 1 * time.Second,
+		Workers:  1,
+		Qps:      10,
+		Headers:  []runner.Header{{Name: "X-Password", Value: "{{password}}"}},
+		Feeder:   feeder,
+	})
+	for range r.StartTest() {
+	}
+
+	want := map[string]int{"/users/alice a1": 5, "/users/bob b2": 5}
+	if !reflect.DeepEqual(seen, want) {
+		t.Fatalf("got: %v, want: %v", seen, want)
+	}
+}
+
+func TestVirtualUsers(t *testing.T) {
+	t.Parallel()
+	var withCookie int64
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := r.Cookie("session"); err == nil {
+				atomic.AddInt64(&withCookie, 1)
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        3,
+		Iterations: 4,
+	})
+	var hits int64
+	for range r.StartTest() {
+		hits++
+	}
+
+	if got, want := hits, int64(12); got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+	// Every request after each virtual user's first should carry its cookie.
+	if got, want := atomic.LoadInt64(&withCookie), int64(9); got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
+
+func TestSummaryFile(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("fail") != "" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL+"?fail=1", runner.LoadTestArgs{
+		Duration:    500 * time.Millisecond,
+		Workers:     1,
+		Qps:         10,
+		OutputFile:  filepath.Join(dir, "results.csv"),
+		SummaryFile: filepath.Join(dir, "summary.json"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary runner.Summary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := summary.Failed, 5; got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+	if got, want := summary.Codes["503"].Count, 5; got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
+
+func TestLatencyUnit(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:    300 * time.Millisecond,
+		Workers:     1,
+		Qps:         10,
+		LatencyUnit: runner.LatencyUnitMs,
+		OutputFile:  filepath.Join(dir, "results.csv"),
+		SummaryFile: filepath.Join(dir, "summary.json"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	output, err := os.ReadFile(filepath.Join(dir, "results.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msSummary, err := os.ReadFile(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := r.Summary()
+
+	lines := strings.Split(string(output), "\n")
+	if lines[1] != "# latency_unit: ms" {
+		t.Fatalf("got: %q, want the latency unit after the schema version", lines[1])
+	}
+	latency, err := strconv.ParseFloat(strings.Split(lines[3], ",")[2], 64)
+	if err != nil || latency <= 0 || latency > 1000 {
+		t.Fatalf("got: %q, want a latency in milliseconds", lines[3])
+	}
+
+	var got struct {
+		Latency struct {
+			P99 float64 `json:"p99"`
+		} `json:"latency"`
+	}
+	if err := json.Unmarshal(msSummary, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := float64(s.Latency.P99) / float64(time.Millisecond); got.Latency.P99 != want {
+		t.Fatalf("got: p99 %v, want: %v", got.Latency.P99, want)
+	}
+	// The fields are the same, in the same order, just in another unit.
+	if !strings.HasPrefix(string(msSummary), "{\n  \"schema_version\": ") {
+		t.Fatalf("got: %.40q, want the schema version first", msSummary)
+	}
+	nsSummary, _ := json.Marshal(s)
+	var ns, ms map[string]any
+	json.Unmarshal(nsSummary, &ns)
+	json.Unmarshal(msSummary, &ms)
+	if got, want := jsonKeys(ms, ""), jsonKeys(ns, ""); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
+
+// jsonKeys returns the paths of every member of decoded JSON objects.
+func jsonKeys(v any, prefix string) []string {
+	var keys []string
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			keys = append(keys, prefix+k)
+			keys = append(keys, jsonKeys(child, prefix+k+".")...)
+		}
+	case []any:
+		for _, child := range v {
+			keys = append(keys, jsonKeys(child, prefix+"[].")...)
+		}
+	}
+	sort.Strings(keys)
+	return slices.Compact(keys)
+}
+
+func TestRedact(t *testing.T) {
+	t.Parallel()
+	// Nothing listens on the address once the listener is closed.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner("http://user:hunter2@"+ln.Addr().String()+"/items?token=s3cret", runner.LoadTestArgs{
+		Duration:     300 * time.Millisecond,
+		Workers:      1,
+		Qps:          10,
+		OutputFormat: runner.OutputFormatEvents,
+		OutputFile:   filepath.Join(dir, "events.ndjson"),
+		SummaryFile:  filepath.Join(dir, "summary.json"),
+		RedactURLs:   true,
+		RedactErrors: true,
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"events.ndjson", "summary.json"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(data); strings.Contains(s, "s3cret") || strings.Contains(s, "hunter2") || !strings.Contains(s, "/items?redacted=") {
+			t.Fatalf("got: %s, want the URLs redacted", s)
+		}
+		if name == "events.ndjson" && !strings.Contains(string(data), "connection refused") {
+			t.Fatalf("got: %s, want errors with what isn't sensitive kept", data)
+		}
+	}
+}
+
+func TestRedactConfig(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	scenario, err := runner.ParseScenario([]byte(`{"steps": [{
+		"name": "login",
+		"method": "POST",
+		"url": "/login?api_key=k3y",
+		"headers": {"Authorization": "Bearer t0ken"},
+		"body": "{\"password\": \"hunter2\"}"
+	}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:            1,
+		Iterations:     1,
+		Method:         http.MethodGet,
+		Scenario:       scenario,
+		HeaderCommands: []runner.HeaderCommand{{Name: "X-Token", Command: "echo s3cret-cmd"}},
+		AlertWebhook:   server.URL + "/services/T0/B0/w3bhook",
+		AlertErrorRate: 0.5,
+		OutputFormat:   runner.OutputFormatEvents,
+		OutputFile:     filepath.Join(dir, "events.ndjson"),
+		SummaryFile:    filepath.Join(dir, "summary.json"),
+		RedactURLs:     true,
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"events.ndjson", "summary.json"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, secret := range []string{"k3y", "t0ken", "hunter2", "s3cret-cmd", "w3bhook"} {
+			if strings.Contains(string(data), secret) {
+				t.Fatalf("got %q in %s: %s", secret, name, data)
+			}
+		}
+		if !regexp.MustCompile(`"Authorization": ?"\\u003credacted:`).Match(data) {
+			t.Fatalf("got: %s, want the scenario's headers redacted", data)
+		}
+	}
+}
+
+func TestTargetGroups(t *testing.T) {
+	t.Parallel()
+	var reads, writes atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/read", func(w http.ResponseWriter, r *http.Request) {
+		reads.Add(1)
+	})
+	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
+		writes.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	r := runner.NewRunner("", runner.LoadTestArgs{
+		Duration: time.Second,
+		Workers:  2,
+		Groups: []runner.TargetGroup{
+			{Name: "read", Target: server.URL + "/read", Qps: 40},
+			{Name: "write", Target: server.URL + "/write", Qps: 10, Workers: 1},
+		},
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each group is paced at its own rate by the shared scheduler, and summarized on its own.
+	summary := r.Summary()
+	read, write := summary.Groups["read"], summary.Groups["write"]
+	if len(summary.Groups) != 2 || read.Requests != int(reads.Load()) || write.Requests != int(writes.Load()) {
+		t.Fatalf("got: %+v, want the %d reads and %d writes the server got", summary.Groups, reads.Load(), writes.Load())
+	}
+	if read.Requests < 35 || read.Requests > 45 || read.Failed != 0 {
+		t.Fatalf("got: %+v, want about 40 successful reads", read)
+	}
+	if write.Requests < 8 || write.Requests > 12 || write.Failed != write.Requests || write.ErrorRate != 1 {
+		t.Fatalf("got: %+v, want about 10 failed writes", write)
+	}
+	if summary.Requests != read.Requests+write.Requests {
+		t.Fatalf("got: %d requests, want: %d", summary.Requests, read.Requests+write.Requests)
+	}
+
+	var printed strings.Builder
+	runner.PrintSummary(&printed, summary, false)
+	for _, want := range []string{"Groups:\n", "  read: error rate=0.00%", "  write: error rate=100.00%"} {
+		if !strings.Contains(printed.String(), want) {
+			t.Fatalf("got: %s, want a line with %q", printed.String(), want)
+		}
+	}
+}
+
+func TestParseTargetGroup(t *testing.T) {
+	t.Parallel()
+	got, err := runner.ParseTargetGroup("name=read,qps=5000,workers=50,target=https://api.com/items?ids=1,2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := runner.TargetGroup{Name: "read", Target: "https://api.com/items?ids=1,2", Qps: 5000, Workers: 50}
+	if got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+
+	if _, err := runner.ParseTargetGroup("name=read,target=https://api.com"); err == nil {
+		t.Fatal("expected an error for a group without qps")
+	}
+}
+
+func TestPushgatewayExport(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	var mu sync.Mutex
+	var pushes []string
+	pushgateway := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			pushes = append(pushes, r.Method+" "+r.URL.Path+"\n"+string(body))
+			mu.Unlock()
+		}),
+	)
+	defer pushgateway.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:       300 * time.Millisecond,
+		Workers:        1,
+		Qps:            10,
+		OutputFile:     filepath.Join(t.TempDir(), "results.csv"),
+		PushgatewayURL: pushgateway.URL,
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pushes) != 1 {
+		t.Fatalf("got %d pushes, want 1", len(pushes))
+	}
+	if !strings.HasPrefix(pushes[0], "PUT /metrics/job/loadtest\n") || !strings.Contains(pushes[0], `loadtest_requests{phase="final"} 3`) {
+		t.Fatalf("unexpected push: %s", pushes[0])
+	}
+}
+
+func TestInfluxDBExport(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	var mu sync.Mutex
+	var writes []string
+	influxdb := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			writes = append(writes, r.Method+" "+r.URL.RequestURI()+"\n"+string(body))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	)
+	defer influxdb.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:         1,
+		Iterations:  3,
+		OutputFile:  filepath.Join(t.TempDir(), "results.csv"),
+		InfluxDBURL: influxdb.URL + "/write?db=loadtest",
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(writes) != 1 {
+		t.Fatalf("got %d writes, want 1", len(writes))
+	}
+	// One point in line protocol: measurement and tags, fields, timestamp in nanoseconds.
+	line := regexp.MustCompile(`^POST /write\?db=loadtest\nloadtest,phase=final requests=3,successful=3,failed=0,error_rate=0,[a-z0-9_=.,+-]*failed_timeout=0[a-z0-9_=.,+-]* \d{19}\n$`)
+	if !line.MatchString(writes[0]) {
+		t.Fatalf("unexpected write: %s", writes[0])
+	}
+}
+
+func TestStatsdExport(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+	statsd, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statsd.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 3,
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+		StatsdAddr: statsd.LocalAddr().String(),
+		ExportJob:  "checkout",
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A datagram for each metric, in the DogStatsD format.
+	got := map[string]bool{}
+	buf := make([]byte, 1024)
+	statsd.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := statsd.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		got[string(buf[:n])] = true
+	}
+	for _, want := range []string{
+		"checkout.requests:3|g|#phase:final",
+		"checkout.failed:0|g|#phase:final",
+		"checkout.error_rate:0|g|#phase:final",
+		"checkout.failed_timeout:0|g|#phase:final",
+	} {
+		if !got[want] {
+			t.Errorf("got: %v, want %q", got, want)
+		}
+	}
+	if want := 15 + len(runner.FailureKinds); len(got) != want {
+		t.Fatalf("got %d metrics, want: %d", len(got), want)
+	}
+}
+
+func TestGrafanaExport(t *testing.T) {
+	t.Parallel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	start := time.Now()
+	closeGrafana, err := runner.ServeGrafana(addr, []*runner.Summary{{Requests: 10}, {Requests: 12}}, &runner.Summary{Requests: 22})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeGrafana()
+	base := "http://" + addr
+
+	res, err := http.Get(base + "/search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	json.NewDecoder(res.Body).Decode(&names)
+	res.Body.Close()
+	if !slices.Contains(names, "requests") || !slices.Contains(names, "latency_p99_seconds") {
+		t.Fatalf("got: %v, want the exported metrics", names)
+	}
+
+	query := fmt.Sprintf(`{"range":{"from":%q,"to":%q},"targets":[{"target":"requests"},{"target":"unknown"}]}`,
+		start.Add(-time.Minute).Format(time.RFC3339Nano), time.Now().Add(time.Minute).Format(time.RFC3339Nano))
+	res, err = http.Post(base+"/query", "application/json", strings.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []struct {
+		Target     string       `json:"target"`
+		Datapoints [][2]float64 `json:"datapoints"`
+	}
+	json.NewDecoder(res.Body).Decode(&series)
+	res.Body.Close()
+
+	// The final summary covers the whole test, so only the intervals are points.
+	if len(series) != 2 || series[0].Target != "requests" || len(series[0].Datapoints) != 2 || len(series[1].Datapoints) != 0 {
+		t.Fatalf("got: %+v, want 2 points of requests and none of an unknown series", series)
+	}
+	for i, want := range []float64{10, 12} {
+		p := series[0].Datapoints[i]
+		if at := time.UnixMilli(int64(p[1])); p[0] != want || at.Before(start.Truncate(time.Millisecond)) || at.After(time.Now()) {
+			t.Fatalf("got: point %v, want %g at the time it was exported", p, want)
+		}
+	}
+
+	query = fmt.Sprintf(`{"range":{"from":%q,"to":%q},"targets":[{"target":"requests"}]}`,
+		start.Add(-time.Hour).Format(time.RFC3339Nano), start.Add(-time.Minute).Format(time.RFC3339Nano))
+	res, err = http.Post(base+"/query", "application/json", strings.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(res.Body).Decode(&series)
+	res.Body.Close()
+	if len(series) != 1 || len(series[0].Datapoints) != 0 {
+		t.Fatalf("got: %+v, want no points outside the range", series)
+	}
+}
+
+func TestSetQps(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration: 1 * time.Second,
+		Workers:  1,
+		Qps:      10,
+	})
+	time.AfterFunc(500*time.Millisecond, func() { r.SetQps(100) })
+
+	var hits uint64
+	for range r.StartTest() {
+		hits++
+	}
+
+	// 5 requests in the first half, then up to 50 in the second once the pacer wakes up.
+	if hits < 45 || hits > 56 {
+		t.Fatalf("got: %v, want about 55", hits)
+	}
+}
+
+func TestTimeoutPhase(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(2 * time.Second):
+			case <-r.Context().Done():
+			}
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 1,
+		Timeout:    1,
+	})
+	result := <-r.StartTest()
+
+	if !strings.Contains(result.Error, "timeout after 1s while waiting for headers") {
+		t.Fatalf("unexpected error: %s", result.Error)
+	}
+}
+
+func TestMultipartForm(t *testing.T) {
+	t.Parallel()
+	type upload struct{ title, file string }
+	uploads := make(chan upload, 1)
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f, _, err := r.FormFile("upload")
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data, _ := io.ReadAll(f)
+			uploads <- upload{r.FormValue("title"), string(data)}
+		}),
+	)
+	defer server.Close()
+
+	name := filepath.Join(t.TempDir(), "photo.jpg")
+	if err := os.WriteFile(name, []byte("not really a photo"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 1,
+		Method:     http.MethodPost,
+		FormFields: []runner.FormField{{Name: "title", Value: "cat"}},
+		FormFiles:  []runner.FormFile{{Name: "upload", Path: name}},
+	})
+	if result := <-r.StartTest(); result.Error != "" {
+		t.Fatal(result.Error)
+	}
+
+	if got, want := <-uploads, (upload{"cat", "not really a photo"}); got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
+
+func TestTargetRanges(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var paths []string
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			paths = append(paths, r.URL.Path)
+			mu.Unlock()
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL+"/items/{1..3}/{{randint:5:5}}", runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 4,
+	})
+	for range r.StartTest() {
+	}
+
+	want := []string{"/items/1/5", "/items/2/5", "/items/3/5", "/items/1/5"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got: %v, want: %v", paths, want)
+	}
+}
+
+func TestRandomHeaderValues(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	var requests []http.Header
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requests = append(requests, r.Header)
+			mu.Unlock()
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 200,
+		Headers: []runner.Header{
+			{Name: "X-Forwarded-For", Value: "{{randip:10.1.2.128/25,2001:db8::/120}}"},
+			{Name: "Accept-Language", Value: "{{randlang}}"},
+			{Name: "X-Device-Type", Value: "{{randdevice}}"},
+			{Name: "X-Plan", Value: "{{randpick:free|pro}}"},
+			{Name: "X-Widest", Value: "{{randint:-1:9223372036854775805}}"},
+		},
+	})
+	for range r.StartTest() {
+	}
+
+	pools := []netip.Prefix{netip.MustParsePrefix("10.1.2.128/25"), netip.MustParsePrefix("2001:db8::/120")}
+	for _, h := range requests {
+		addr, err := netip.ParseAddr(h.Get("X-Forwarded-For"))
+		if err != nil || !(pools[0].Contains(addr) || pools[1].Contains(addr)) {
+			t.Fatalf("got: X-Forwarded-For %q, want an address of the pools", h.Get("X-Forwarded-For"))
+		}
+		seen[pools[0].String()] = seen[pools[0].String()] || pools[0].Contains(addr)
+		seen[pools[1].String()] = seen[pools[1].String()] || pools[1].Contains(addr)
+		if lang := h.Get("Accept-Language"); !strings.Contains(lang, ";q=") {
+			t.Fatalf("got: Accept-Language %q", lang)
+		}
+		switch device := h.Get("X-Device-Type"); device {
+		case "mobile", "desktop", "tablet":
+			seen[device] = true
+		default:
+			t.Fatalf("got: X-Device-Type %q", device)
+		}
+		seen[h.Get("X-Plan")] = true
+		if n, err := strconv.ParseInt(h.Get("X-Widest"), 10, 64); err != nil || n < -1 {
+			t.Fatalf("got: X-Widest %q, want an integer of the range", h.Get("X-Widest"))
+		}
+	}
+	for _, want := range []string{"10.1.2.128/25", "2001:db8::/120", "mobile", "desktop", "free", "pro"} {
+		if !seen[want] {
+			t.Errorf("got: no %s in 200 requests", want)
+		}
+	}
+}
+
+func TestSeed(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	paths := map[string][]string{}
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			paths[r.Header.Get("X-Runner")] = append(paths[r.Header.Get("X-Runner")], r.URL.Path)
+			mu.Unlock()
+		}),
+	)
+	defer server.Close()
+
+	// Runners running at the same time, like the jobs of an agent, each repeat their seed's values.
+	var wg sync.WaitGroup
+	for _, name := range []string{"a", "b", "c"} {
+		seed := int64(42)
+		if name == "c" {
+			seed = 43
+		}
+		r := runner.NewRunner(server.URL+"/items/{{randint:1:1000000}}", runner.LoadTestArgs{
+			VUs:        1,
+			Iterations: 50,
+			Seed:       seed,
+			Headers:    []runner.Header{{Name: "X-Runner", Value: name}},
+		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range r.StartTest() {
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(paths["a"]) != 50 || !reflect.DeepEqual(paths["a"], paths["b"]) {
+		t.Fatalf("got: %v and %v, want the same paths for the same seed", paths["a"], paths["b"])
+	}
+	if reflect.DeepEqual(paths["a"], paths["c"]) {
+		t.Fatalf("got: %v for both, want different paths for another seed", paths["a"])
+	}
+}
+
+func TestInvalidTemplates(t *testing.T) {
+	t.Parallel()
+	for _, s := range []string{
+		"{{randip:10.1.2.0/33}}",
+		"{{randip:}}",
+		"{{randint:5}}",
+		"{{randint:9:1}}",
+		"{{randint:a:b}}",
+		"{{randint:-1:9223372036854775806}}",
+	} {
+		if err := runner.ValidateTemplate(s); err == nil {
+			t.Errorf("got: nil, want an error for %s", s)
+		}
+		if _, err := runner.ParseHeader("X-Test: " + s); err == nil {
+			t.Errorf("got: nil, want an error for a header of %s", s)
+		}
+		if _, err := runner.ParseFormField("id=" + s); err == nil {
+			t.Errorf("got: nil, want an error for a form field of %s", s)
+		}
+		if _, err := runner.ParseTargetGroup("name=api,qps=10,target=http://localhost/" + s); err == nil {
+			t.Errorf("got: nil, want an error for a group target of %s", s)
+		}
+		if _, err := runner.ParseScenario([]byte(`{"steps": [{"url": "/items/` + s + `"}]}`)); err == nil {
+			t.Errorf("got: nil, want an error for a scenario step of %s", s)
+		}
+	}
+	if err := runner.ValidateTemplate("http://localhost/{{id}}/{1..3}/{{randint:1:9}}"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The targets file is rejected on load, rather than sending the placeholder as it is.
+	_, err := runner.ParseTargets(strings.NewReader("http://localhost/items/{{randint:1}}\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatalf("got: %v, want an error on line 1", err)
+	}
+	_, err = runner.ParseTargets(strings.NewReader("POST {{randint:x:y}}/items\nX-Test: 1\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatalf("got: %v, want an error on line 1", err)
+	}
+	_, err = runner.ParseTargets(strings.NewReader("POST http://localhost/items\nX-Forwarded-For: {{randip:nope}}\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("got: %v, want an error on line 2", err)
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	t.Parallel()
+	var polls atomic.Int64
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+			if polls.Add(1)%2 == 0 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			fmt.Fprint(w, `{"event":"update"}`)
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Mode:       runner.ModeLongPoll,
+		VUs:        2,
+		Duration:   time.Second,
+		Timeout:    5,
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := r.Summary()
+	lp := s.LongPoll
+	if lp == nil || lp.WithData == 0 || lp.Empty == 0 || lp.WithData+lp.Empty != s.Requests {
+		t.Fatalf("got: %+v for %d requests, want polls with data and empty ones", lp, s.Requests)
+	}
+	if lp.Held.P50 < 100*time.Millisecond {
+		t.Errorf("got: median hold of %s, want at least 100ms", lp.Held.P50)
+	}
+	// The first poll of each virtual user has no previous one to reconnect after.
+	if got, want := lp.Reconnect.Count, s.Requests-2; got != want || lp.Reconnect.Max > 100*time.Millisecond {
+		t.Errorf("got: %d reconnects, max %s, want: %d quick ones", got, lp.Reconnect.Max, want)
+	}
+}
+
+func TestMaxRequests(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	for _, args := range []runner.LoadTestArgs{
+		{Workers: 2, Qps: 1000, MaxRequests: 25},
+		{VUs: 4, MaxRequests: 25},
+	} {
+		r := runner.NewRunner(server.URL, args)
+		var hits uint64
+		for range r.StartTest() {
+			hits++
+		}
+		if got, want := hits, uint64(25); got != want {
+			t.Fatalf("got: %v, want: %v", got, want)
+		}
+	}
+}
+
+func TestConnectMode(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewUnstartedServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("connect mode shouldn't send requests")
+		}),
+	)
+	var conns int64
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 3,
+		Mode:       runner.ModeConnect,
+		Timeout:    1,
+	})
+	for result := range r.StartTest() {
+		if result.Error != "" || result.Connect == 0 {
+			t.Fatalf("unexpected result: %+v", result)
+		}
+	}
+
+	// The server tracks connections asynchronously.
+	time.Sleep(50 * time.Millisecond)
+	if got, want := atomic.LoadInt64(&conns), int64(3); got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
+
+func TestHeaderCommand(t *testing.T) {
+	t.Parallel()
+	tokens := make(chan string, 1)
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokens <- r.Header.Get("Authorization")
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:            1,
+		Iterations:     1,
+		HeaderCommands: []runner.HeaderCommand{{Name: "Authorization", Command: "echo Bearer abc"}},
+	})
+	for range r.StartTest() {
+	}
+
+	if got, want := <-tokens, "Bearer abc"; got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+
+	r = runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:                  1,
+		Iterations:           1,
+		HeaderCommands:       []runner.HeaderCommand{{Name: "Authorization", Command: "sleep 10"}},
+		HeaderCommandTimeout: 100 * time.Millisecond,
+		OutputFile:           filepath.Join(t.TempDir(), "results.csv"),
+	})
+	start := time.Now()
+	if err := r.Run(); err == nil || !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Fatalf("got: %v, want the header command to time out", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("got: %s, want the header command killed after its timeout", elapsed)
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	t.Parallel()
+	tests := map[string]float64{
+		"1%":   0.01,
+		"0.5%": 0.005,
+		"100":  1,
+		"0%":   0,
+	}
+	for s, want := range tests {
+		if got, err := runner.ParsePercent(s); err != nil || got != want {
+			t.Errorf("ParsePercent(%q) = %v, %v, want: %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "x%", "-1%", "101%", "NaN%", "Inf%", "-Inf"} {
+		if got, err := runner.ParsePercent(s); err == nil {
+			t.Errorf("ParsePercent(%q) = %v, want an error", s, got)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	t.Parallel()
+	tests := map[string]float64{
+		"100":    100,
+		"0.5":    0.5,
+		"10/s":   10,
+		"30/m":   0.5,
+		"36/h":   0.01,
+		"0":      0,
+		"1/day":  0,
+		"NaN":    0,
+		"Inf":    0,
+		"+Inf/m": 0,
+	}
+	for s, want := range tests {
+		got, err := runner.ParseRate(s)
+		if want == 0 && err == nil {
+			t.Errorf("ParseRate(%q) = %v, want an error", s, got)
+		} else if want != 0 && (err != nil || got != want) {
+			t.Errorf("ParseRate(%q) = %v, %v, want: %v", s, got, err, want)
+		}
+	}
+}
+
+func TestNoResults(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Workers:     1,
+		Qps:         0.1,
+		OutputFile:  filepath.Join(dir, "results.csv"),
+		SummaryFile: filepath.Join(dir, "summary.json"),
+	})
+	time.AfterFunc(100*time.Millisecond, func() { r.Stop() })
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary runner.Summary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Requests != 0 {
+		t.Fatalf("got: %v, want: 0", summary.Requests)
+	}
+}
+
+func TestThresholds(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(20 * time.Millisecond)
+		}),
+	)
+	defer server.Close()
+
+	var thresholds []runner.Threshold
+	for _, s := range []string{"p99=1ms", "max=10s"} {
+		th, err := runner.ParseThreshold(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		thresholds = append(thresholds, th)
+	}
+	if _, err := runner.ParseThreshold("p42=1ms"); err == nil {
+		t.Fatal("expected an error for an unknown stat")
+	}
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:         1,
+		Iterations:  3,
+		Thresholds:  thresholds,
+		OutputFile:  filepath.Join(dir, "results.csv"),
+		SummaryFile: filepath.Join(dir, "summary.json"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary runner.Summary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Thresholds) != 2 {
+		t.Fatalf("got: %v thresholds, want: 2", len(summary.Thresholds))
+	}
+	if summary.Thresholds[0].Passed || !summary.Thresholds[1].Passed {
+		t.Fatalf("got: %+v, want the first to fail and the second to pass", summary.Thresholds)
+	}
+}
+
+func TestTTFBThresholds(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Streams the rest of the body slowly.
+			w.Write([]byte("first"))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+			w.Write([]byte("rest"))
+		}),
+	)
+	defer server.Close()
+
+	var thresholds []runner.Threshold
+	for _, s := range []string{"ttfb_p99=50ms", "p99=50ms"} {
+		th, err := runner.ParseThreshold(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		thresholds = append(thresholds, th)
+	}
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 2,
+		Thresholds: thresholds,
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := r.Summary()
+	if s.TTFB == nil || s.TTFB.Max >= 50*time.Millisecond || s.Latency.P50 < 100*time.Millisecond {
+		t.Fatalf("got: ttfb %v, latency %v, want the first byte well before the end", s.TTFB, s.Latency)
+	}
+	if !s.Thresholds[0].Passed || s.Thresholds[0].Name() != "ttfb_p99" || s.Thresholds[1].Passed {
+		t.Fatalf("got: %+v, want the ttfb threshold to pass and the latency one to fail", s.Thresholds)
+	}
+}
+
+func TestUserAgents(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	seen := map[string]int{}
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			seen[r.UserAgent()]++
+			mu.Unlock()
+		}),
+	)
+	defer server.Close()
+
+	name := filepath.Join(t.TempDir(), "agents.txt")
+	if err := os.WriteFile(name, []byte("# browsers\nbrowser/1\n\nbrowser/2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	uas, err := runner.LoadUserAgents(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, perVU := range []bool{false, true} {
+		r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+			VUs:            2,
+			Iterations:     5,
+			UserAgents:     uas,
+			UserAgentPerVU: perVU,
+		})
+		for range r.StartTest() {
+		}
+	}
+
+	if got, want := seen["browser/1"]+seen["browser/2"], 20; got != want {
+		t.Fatalf("got: %v, want: %v (%v)", got, want, seen)
+	}
+}
+
+func TestOutputRotate(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:     1500 * time.Millisecond,
+		Workers:      1,
+		Qps:          4,
+		OutputFile:   filepath.Join(dir, "results.csv"),
+		OutputRotate: 1 * time.Second,
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "results-*.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(files), 2; got != want {
+		t.Fatalf("got: %v files, want: %v", got, want)
+	}
+	lines := 0
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines += strings.Count(string(data), "\n")
+	}
+	// Each file starts with the schema version comment and the header line.
+	if got, want := lines, 2*2+6; got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
+
+func TestMultipleOutputs(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+	var collected []byte
+	var contentType string
+	collector := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentType = r.Header.Get("Content-Type")
+			collected, _ = io.ReadAll(r.Body)
+		}),
+	)
+	defer collector.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:          1,
+		Iterations:   3,
+		OutputFormat: runner.OutputFormatEvents,
+		OutputFile:   filepath.Join(dir, "results.ndjson"),
+		OutputFiles:  []string{collector.URL},
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "results.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each output starts with its own schema event.
+	_, got, _ := strings.Cut(string(collected), "\n")
+	_, want, _ := strings.Cut(string(data), "\n")
+	if got != want || contentType != "application/x-ndjson" {
+		t.Fatalf("got: %q (%s), want the same as the file: %q", got, contentType, want)
+	}
+	if got := strings.Count(string(data), `"type":"result-sample"`); got != 3 {
+		t.Fatalf("got: %d results, want: 3", got)
+	}
+
+	// A failing collector doesn't fail the test.
+	failing := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+	)
+	defer failing.Close()
+	r = runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:         1,
+		Iterations:  3,
+		OutputFile:  filepath.Join(dir, "results.csv"),
+		OutputFiles: []string{failing.URL},
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if s := r.Summary(); s.Successful != 3 {
+		t.Fatalf("got: %d successful, want: 3", s.Successful)
+	}
+}
+
+func TestRingFile(t *testing.T) {
+	t.Parallel()
+	var n atomic.Int32
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if n.Add(1)%2 == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 5,
+		Tag:        "ring",
+		RingFile:   filepath.Join(dir, "results.ring"),
+		RingSize:   3,
+		OutputFile: filepath.Join(dir, "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "results.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the last 3 results fit in the ring.
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")[2:]
+	if len(lines) != 3 {
+		t.Fatalf("got: %q, want 3 results", lines)
+	}
+	for i, line := range lines {
+		fields := strings.Split(line, ",")
+		code, errorMsg, errorKind := "200", "", ""
+		if i%2 == 1 {
+			code, errorMsg, errorKind = "500", "500 Internal Server Error", "http"
+		}
+		if fields[1] != code || fields[3] != errorMsg || fields[4] != strconv.Itoa(i+2) || fields[5] != "ring" || fields[7] != errorKind {
+			t.Fatalf("got: %q, want result %d with status %s", line, i+2, code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "results.ring")); !os.IsNotExist(err) {
+		t.Fatalf("got: %v, want the ring file removed", err)
+	}
+}
+
+func TestConnectRamp(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var inFlight int
+	var reached []time.Time // When 1, 2, ... requests were first in flight at once
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			if inFlight++; inFlight > len(reached) {
+				reached = append(reached, time.Now())
+			}
+			mu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}),
+	)
+	defer server.Close()
+
+	for _, tt := range []struct {
+		name string
+		args runner.LoadTestArgs
+	}{
+		{"workers", runner.LoadTestArgs{Qps: 100, Workers: 4, MaxWorkers: 4}},
+		{"vus", runner.LoadTestArgs{VUs: 4}},
+	} {
+		mu.Lock()
+		reached = nil
+		mu.Unlock()
+		args := tt.args
+		args.Duration = time.Second
+		args.ConnectRamp = 800 * time.Millisecond
+		args.OutputFile = filepath.Join(t.TempDir(), "results.csv")
+		if err := runner.NewRunner(server.URL, args).Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The 4 start 200ms apart, so each one more in flight at once waits for the next to start.
+		mu.Lock()
+		times := reached
+		mu.Unlock()
+		if len(times) != 4 {
+			t.Fatalf("%s: got: at most %d requests in flight, want 4", tt.name, len(times))
+		}
+		for i := 1; i < len(times); i++ {
+			got, want := times[i].Sub(times[0]), time.Duration(i)*200*time.Millisecond
+			if got < want-20*time.Millisecond || got > want+150*time.Millisecond {
+				t.Errorf("%s: got: %d in flight after %s, want about %s", tt.name, i+1, got, want)
+			}
+		}
+	}
+}
+
+func TestQueueDelay(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+		}),
+	)
+	defer server.Close()
+
+	// A single worker can only keep up with half the rate, so requests queue up behind it.
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:    500 * time.Millisecond,
+		Workers:     1,
+		Qps:         20,
+		OutputFile:  filepath.Join(dir, "results.csv"),
+		SummaryFile: filepath.Join(dir, "summary.json"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary runner.Summary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.QueueDelay == nil || summary.QueueDelay.Max < 100*time.Millisecond {
+		t.Fatalf("got: %v, want a queue delay of at least 100ms", summary.QueueDelay)
+	}
+	if summary.Latency.Max >= 200*time.Millisecond {
+		t.Fatalf("got: %v, want the latency to exclude the queue delay", summary.Latency.Max)
+	}
+}
+
+func TestRecordRedirects(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/old" {
+				http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			}
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL+"/old", runner.LoadTestArgs{
+		VUs:             1,
+		Iterations:      1,
+		RecordRedirects: true,
+	})
+	var results []*runner.Result
+	for result := range r.StartTest() {
+		results = append(results, result)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("got: %v results, want: 1", len(results))
+	}
+	hops := results[0].Redirects
+	if len(hops) != 2 {
+		t.Fatalf("got: %v hops, want: 2", len(hops))
+	}
+	if hops[0].URL != server.URL+"/old" || hops[0].Code != http.StatusMovedPermanently {
+		t.Fatalf("got: %+v, want the redirect from /old", hops[0])
+	}
+	if hops[1].URL != server.URL+"/new" || hops[1].Code != http.StatusOK {
+		t.Fatalf("got: %+v, want the response from /new", hops[1])
+	}
+}
+
+func TestPreconnect(t *testing.T) {
+	t.Parallel()
+	var conns int64
+	server := httptest.NewUnstartedServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:   500 * time.Millisecond,
+		Workers:    3,
+		Qps:        10,
+		Preconnect: 3,
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A single connection would do at this rate, so all three were preconnected and then used
+	// instead of dialing new ones.
+	if got, want := atomic.LoadInt64(&conns), int64(3); got != want {
+		t.Fatalf("got: %v connections, want: %v", got, want)
+	}
+}
+
+func TestEncryptOutput(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	key := filepath.Join(dir, "key")
+	if err := encrypt.GenerateKey(key); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := encrypt.LoadPublicKey(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := encrypt.LoadPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "results.csv.enc")
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:             1,
+		Iterations:      3,
+		OutputFile:      out,
+		OutputRecipient: pub,
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dec, err := encrypt.NewReader(f, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(string(data), "\n"), 2+3; got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+
+	r = runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:             1,
+		Iterations:      1,
+		OutputFile:      "stdout",
+		OutputRecipient: pub,
+	})
+	if err := r.Run(); err == nil {
+		t.Fatal("got no error encrypting the results to stdout along with the console output")
+	}
+}
+
+func TestSSE(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := 0; i < 5; i++ {
+				io.WriteString(w, ": heartbeat\n\ndata: tick\n\n")
+				w.(http.Flusher).Flush()
+				time.Sleep(10 * time.Millisecond)
+			}
+			<-r.Context().Done()
+		}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:    300 * time.Millisecond,
+		VUs:         2,
+		Mode:        runner.ModeSSE,
+		OutputFile:  filepath.Join(dir, "results.csv"),
+		SummaryFile: filepath.Join(dir, "summary.json"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary runner.Summary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.SSE == nil || summary.SSE.Events != 10 || summary.SSE.FirstEvent.Count != 2 {
+		t.Fatalf("got: %+v, want 10 events on 2 connections", summary.SSE)
+	}
+	if summary.Failed != 0 {
+		t.Fatalf("got: %v failed, want: 0", summary.Failed)
+	}
+}
+
+func TestStopAndKill(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(300 * time.Millisecond):
+			case <-r.Context().Done():
+			}
+		}),
+	)
+	defer server.Close()
+
+	// Stop waits for the requests in flight, Kill cancels them.
+	for _, kill := range []bool{false, true} {
+		r := runner.NewRunner(server.URL, runner.LoadTestArgs{VUs: 2})
+		time.AfterFunc(100*time.Millisecond, func() {
+			if kill {
+				r.Kill()
+			} else {
+				r.Stop()
+			}
+		})
+
+		start := time.Now()
+		var hits int
+		for range r.StartTest() {
+			hits++
+		}
+		elapsed := time.Since(start)
+
+		want, wantElapsed := 2, 300*time.Millisecond
+		if kill {
+			want, wantElapsed = 0, 100*time.Millisecond
+		}
+		if hits != want {
+			t.Fatalf("kill=%v: got: %v results, want: %v", kill, hits, want)
+		}
+		if elapsed < wantElapsed || elapsed > wantElapsed+100*time.Millisecond {
+			t.Fatalf("kill=%v: got: %v, want about %v", kill, elapsed, wantElapsed)
+		}
+	}
+}
+
+func TestSchedulingError(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:    300 * time.Millisecond,
+		Workers:     1,
+		Qps:         100,
+		OutputFile:  filepath.Join(dir, "results.csv"),
+		SummaryFile: filepath.Join(dir, "summary.json"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary runner.Summary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.SchedulingError == nil || summary.SchedulingError.Count != summary.Requests {
+		t.Fatalf("got: %v, want an error for each of the %v requests", summary.SchedulingError, summary.Requests)
+	}
+
+	// Requests overdue as the only worker is busy are sent straight away, without a scheduling
+	// error for their backlog.
+	slow := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(50 * time.Millisecond)
+		}),
+	)
+	defer slow.Close()
+	r = runner.NewRunner(slow.URL, runner.LoadTestArgs{
+		Duration:   500 * time.Millisecond,
+		Workers:    1,
+		MaxWorkers: 1,
+		Qps:        100,
+		OutputFile: filepath.Join(dir, "slow.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if s := r.Summary(); s.SchedulingError == nil || s.SchedulingError.Max > 20*time.Millisecond {
+		t.Fatalf("got: %v, want no error for the backlog", s.SchedulingError)
+	}
+}
+
+func TestTargetsReload(t *testing.T) {
+	t.Parallel()
+	var a, b int64
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/a" {
+				atomic.AddInt64(&a, 1)
+			} else {
+				atomic.AddInt64(&b, 1)
+			}
+		}),
+	)
+	defer server.Close()
+
+	name := filepath.Join(t.TempDir(), "targets.txt")
+	if err := os.WriteFile(name, []byte("# only a\n"+server.URL+"/a\n"+server.URL+"/b 0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	targets, err := runner.LoadTargets(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := runner.NewRunner("", runner.LoadTestArgs{
+		Duration:    2 * time.Second,
+		Workers:     1,
+		Qps:         20,
+		Targets:     targets,
+		TargetsFile: name,
+	})
+	// Move all the traffic to b, which is picked up on the next check a second in.
+	time.AfterFunc(300*time.Millisecond, func() {
+		os.WriteFile(name, []byte(server.URL+"/a 0\n"+server.URL+"/b\n"), 0o644)
+	})
+	for range r.StartTest() {
+	}
+
+	gotA, gotB := atomic.LoadInt64(&a), atomic.LoadInt64(&b)
+	if gotA < 15 || gotB < 15 || gotA+gotB != 40 {
+		t.Fatalf("got: a=%v b=%v, want about 20 each", gotA, gotB)
+	}
+}
+
+func TestMixedSchemes(t *testing.T) {
+	t.Parallel()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(secure.Certificate())
+
+	targets, err := runner.ParseTargets(strings.NewReader(plain.URL + "/a\n" + secure.URL + "/b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := runner.NewRunner("", runner.LoadTestArgs{
+		Duration:   time.Second,
+		Workers:    1,
+		Qps:        40,
+		Targets:    targets,
+		TLSRootCAs: roots,
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := r.Summary()
+	overHTTP, overHTTPS := summary.Schemes["http"], summary.Schemes["https"]
+	if summary.Failed > 0 || overHTTP.Requests < 5 || overHTTPS.Requests < 5 || overHTTP.Requests+overHTTPS.Requests != summary.Requests {
+		t.Fatalf("got: %d failed, schemes %+v", summary.Failed, summary.Schemes)
+	}
+	// Each origin keeps its connections.
+	if summary.ReuseRate < 0.8 {
+		t.Fatalf("got: reuse rate %.2f, want connections kept for each origin", summary.ReuseRate)
+	}
+}
+
+func TestOutliers(t *testing.T) {
+	t.Parallel()
+	var hits atomic.Int64
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hits.Add(1)%10 == 0 {
+				w.Header().Set("X-Slow", "1")
+				w.Header().Set("Set-Cookie", "session=s3cret")
+				w.Header().Set("Location", "/next?token=s3cret")
+				time.Sleep(100 * time.Millisecond)
+			}
+		}),
+	)
+	defer server.Close()
+
+	threshold, err := runner.ParseOutlierThreshold("50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"p99.9", "p50"} {
+		if _, err := runner.ParseOutlierThreshold(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range []string{"p100", "p0", "fast", "-1s"} {
+		if _, err := runner.ParseOutlierThreshold(s); err == nil {
+			t.Fatalf("%s: got no error", s)
+		}
+	}
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL+"/items", runner.LoadTestArgs{
+		Duration:         time.Second,
+		Workers:          2,
+		Qps:              40,
+		OutputFile:       filepath.Join(dir, "results.csv"),
+		OutliersFile:     filepath.Join(dir, "outliers.ndjson"),
+		OutlierThreshold: &threshold,
+		RedactURLs:       true,
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "outliers.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "s3cret") {
+		t.Fatalf("got: %s, want the cookie and the Location's query redacted", data)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if summary := r.Summary(); summary.Outliers < 3 || int(summary.Outliers) != len(lines) {
+		t.Fatalf("got: %d outliers, %d lines", summary.Outliers, len(lines))
+	}
+	for _, line := range lines {
+		var o runner.Outlier
+		if err := json.Unmarshal([]byte(line), &o); err != nil {
+			t.Fatal(err)
+		}
+		if o.URL != server.URL+"/items" || o.Method != http.MethodGet || o.Threshold != 50*time.Millisecond ||
+			o.Headers.Get("X-Slow") != "1" || o.Trace.WaitForHeaders < 90*time.Millisecond {
+			t.Fatalf("got: %s", line)
+		}
+	}
+
+	// A percentile threshold applies once there are enough requests for it. The slow requests are
+	// the slowest tenth, so over p80.
+	threshold, err = runner.ParseOutlierThreshold("p80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = runner.NewRunner(server.URL+"/items", runner.LoadTestArgs{
+		Duration:         time.Second,
+		Workers:          10,
+		Qps:              300,
+		OutputFile:       filepath.Join(dir, "results.csv"),
+		OutliersFile:     filepath.Join(dir, "percentile.ndjson"),
+		OutlierThreshold: &threshold,
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(filepath.Join(dir, "percentile.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	if summary := r.Summary(); summary.Outliers < 5 || int(summary.Outliers) != len(lines) {
+		t.Fatalf("got: %d outliers, %d lines", summary.Outliers, len(lines))
+	}
+}
+
+func TestRateSchedule(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	for _, s := range []string{"", "06:00-09:00", "06:00 -> 10", "06:00-06:00 -> 10", "25:00-01:00 -> 10", "06:00-09:00 -> 0", "06:00-09:00 -> fast"} {
+		if _, err := runner.ParseRateSchedule(s); err == nil {
+			t.Fatalf("%q: got no error", s)
+		}
+	}
+
+	// A window around now, wrapping past midnight if need be, and another that's hours away.
+	now := time.Now()
+	at := func(d time.Duration) string { return now.Add(d).Format("15:04") }
+	schedule, err := runner.ParseRateSchedule(at(-time.Hour) + "-" + at(time.Hour) + " -> 40qps, " + at(2*time.Hour) + "-" + at(3*time.Hour) + " -> 1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:     time.Second,
+		Workers:      1,
+		Qps:          5,
+		RateSchedule: schedule,
+		OutputFile:   filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if requests := r.Summary().Requests; requests < 35 || requests > 45 {
+		t.Fatalf("got: %d requests, want about 40 at the rate of the current window", requests)
+	}
+
+	// A rate set during a window lasts until the window ends.
+	r = runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:     2500 * time.Millisecond,
+		Workers:      1,
+		Qps:          5,
+		RateSchedule: schedule,
+		OutputFile:   filepath.Join(t.TempDir(), "results.csv"),
+	})
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		r.SetQps(4)
+	}()
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if requests := r.Summary().Requests; requests > 40 {
+		t.Fatalf("got: %d requests, want about 28 with the rate set during the window kept", requests)
+	}
+}
+
+func TestLatencyBuckets(t *testing.T) {
+	t.Parallel()
+	var count int64
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt64(&count, 1)%2 == 0 {
+				time.Sleep(50 * time.Millisecond)
+			}
+		}),
+	)
+	defer server.Close()
+
+	buckets, err := runner.ParseLatencyBuckets("1s,25ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:            1,
+		Iterations:     4,
+		LatencyBuckets: buckets,
+		OutputFile:     filepath.Join(dir, "results.csv"),
+		SummaryFile:    filepath.Join(dir, "summary.json"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary runner.Summary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	want := []runner.LatencyBucket{{Le: 25 * time.Millisecond, Fraction: 0.5}, {Le: time.Second, Fraction: 1}}
+	if !reflect.DeepEqual(summary.LatencyBuckets, want) {
+		t.Fatalf("got: %v, want: %v", summary.LatencyBuckets, want)
+	}
+}
+
+func TestVerboseURL(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL+"/items/{1..3}", runner.LoadTestArgs{
+		Duration: 300 * time.Millisecond,
+		Workers:  1,
+		Qps:      10,
+		Verbose:  true,
+	})
+	var urls []string
+	for result := range r.StartTest() {
+		urls = append(urls, result.URL)
+	}
+
+	want := []string{server.URL + "/items/1", server.URL + "/items/2", server.URL + "/items/3"}
+	if !reflect.DeepEqual(urls, want) {
+		t.Fatalf("got: %v, want: %v", urls, want)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	keys, w := io.Pipe()
+	defer keys.Close()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:   time.Minute,
+		Workers:    1,
+		Qps:        10,
+		Keys:       keys,
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+	})
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("q"))
+	}()
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Summary().StopReason, "stopped from the keyboard"; got != want {
+		t.Fatalf("got: %q, want: %q", got, want)
+	}
+
+	// The reader stops once it returns from the read in progress, rather than waiting for
+	// another key forever.
+	if _, err := w.Write([]byte("s")); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan struct{})
+	go func() {
+		w.Write([]byte("s"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("got: a key read after the test ended, want the reader stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestVerboseQpsCap(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration: time.Second,
+		Workers:  2,
+		Qps:      10,
+		Verbose:  true,
+	})
+	results := r.StartTest()
+	r.SetQps(1000)
+	n := 0
+	for range results {
+		n++
+	}
+
+	// 20 qps for a second, rather than 1000.
+	if n > 30 {
+		t.Fatalf("got: %d requests, want the rate capped at %d qps", n, runner.MaxVerboseQps)
+	}
+}
+
+func TestShadowTarget(t *testing.T) {
+	t.Parallel()
+	primary := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer primary.Close()
+	var mu sync.Mutex
+	var paths []string
+	var shadow *httptest.Server
+	shadow = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			if r.Host != shadow.Listener.Addr().String() {
+				t.Errorf("got host: %s, want the shadow target's", r.Host)
+			}
+			paths = append(paths, r.URL.RequestURI()+" "+r.Header.Get("X-Test"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusInternalServerError)
+		}),
+	)
+	defer shadow.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(primary.URL+"/items?id=1", runner.LoadTestArgs{
+		VUs:          1,
+		Iterations:   3,
+		Headers:      []runner.Header{{Name: "X-Test", Value: "1"}, {Name: "Host", Value: "primary.example"}},
+		ShadowTarget: shadow.URL,
+		OutputFile:   filepath.Join(dir, "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := r.Summary()
+	if summary.Failed != 0 || summary.Successful != 3 {
+		t.Fatalf("got: %d failed, want shadow requests excluded", summary.Failed)
+	}
+	if s := summary.Shadow; s == nil || s.Requests != 3 || s.Failed != 3 || s.Mismatched != 3 {
+		t.Fatalf("got: %+v, want 3 failed and mismatched shadow requests", s)
+	}
+	want := []string{"/items?id=1 1", "/items?id=1 1", "/items?id=1 1"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got: %v, want: %v", paths, want)
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Make each request establish a new connection.
+			w.Header().Set("Connection", "close")
+		}),
+	)
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:           1,
+		Iterations:    3,
+		TLSMaxVersion: tls.VersionTLS12,
+		TLSResume:     true,
+		TLSRootCAs:    roots,
+		OutputFile:    filepath.Join(dir, "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := r.Summary()
+	if summary.Failed != 0 {
+		t.Fatalf("got: %d failed requests, want: 0", summary.Failed)
+	}
+	if want := map[string]int{"TLS 1.2": 3}; !reflect.DeepEqual(summary.TLSVersions, want) {
+		t.Fatalf("got: %v, want: %v", summary.TLSVersions, want)
+	}
+	if want := 2.0 / 3; summary.ResumedRate != want {
+		t.Fatalf("got: %v, want: %v of sessions resumed", summary.ResumedRate, want)
+	}
+}
+
+func TestEjectUnhealthyTarget(t *testing.T) {
+	t.Parallel()
+	var badHits atomic.Int64
+	bad := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			badHits.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+	)
+	defer bad.Close()
+	good := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer good.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner("", runner.LoadTestArgs{
+		Duration:       2500 * time.Millisecond,
+		Workers:        4,
+		Qps:            40,
+		Targets:        []runner.Target{{URL: bad.URL, Weight: 1}, {URL: good.URL, Weight: 1}},
+		EjectErrorRate: 0.5,
+		EjectDuration:  time.Minute,
+		OutputFile:     filepath.Join(dir, "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := r.Summary()
+	if want := map[string]int{bad.URL: 1}; !reflect.DeepEqual(summary.Ejections, want) {
+		t.Fatalf("got: %v, want: %v", summary.Ejections, want)
+	}
+	// Only the requests in the first second before the target is ejected.
+	if n := badHits.Load(); n == 0 || n > int64(summary.Requests)/3 {
+		t.Fatalf("got: %d of %d requests to the ejected target", n, summary.Requests)
+	}
+}
+
+func TestTCPInfo(t *testing.T) {
+	t.Parallel()
+	if !runner.TCPInfoSupported {
+		t.Skip("TCP_INFO is not supported on this platform")
+	}
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Connection", "close")
+		}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 3,
+		TCPInfo:    true,
+		OutputFile: filepath.Join(dir, "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if tcp := r.Summary().TCP; tcp == nil || tcp.Connections != 3 || tcp.RTT.Max == 0 {
+		t.Fatalf("got: %+v, want the statistics of 3 connections", tcp)
+	}
+}
+
+type fakeGenerator struct {
+	base string
+	n    atomic.Int64
+}
+
+func (g *fakeGenerator) Next() runner.GeneratedRequest {
+	return runner.GeneratedRequest{
+		Method: http.MethodPost,
+		URL:    g.base + "/items/" + strconv.FormatInt(g.n.Add(1), 10),
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   []byte(`{"ok":true}`),
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var got []string
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			got = append(got, r.Method+" "+r.URL.Path+" "+r.Header.Get("Content-Type")+" "+string(body))
+			mu.Unlock()
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 2,
+		Generator:  &fakeGenerator{base: server.URL},
+	})
+	for range r.StartTest() {
+	}
+
+	want := []string{
+		`POST /items/1 application/json {"ok":true}`,
+		`POST /items/2 application/json {"ok":true}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
+
+type listGenerator struct {
+	requests []runner.GeneratedRequest
+	n        atomic.Int64
+}
+
+func (g *listGenerator) Next() runner.GeneratedRequest {
+	return g.requests[g.n.Add(1)-1]
+}
+
+func TestMethodBodies(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var got []string
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			got = append(got, fmt.Sprintf("%s %q %q", r.Method, r.Header["Content-Length"], body))
+			mu.Unlock()
+		}),
+	)
+	defer server.Close()
+
+	gen := &listGenerator{}
+	for _, req := range []struct {
+		method string
+		body   []byte
+	}{
+		{http.MethodDelete, []byte("id=1")},
+		{http.MethodDelete, []byte{}},
+		{http.MethodDelete, nil},
+		{http.MethodGet, []byte("q=1")},
+		{http.MethodOptions, []byte{}},
+		{"PURGE", []byte("key")},
+		{http.MethodTrace, nil},
+		{http.MethodTrace, []byte("x")},
+	} {
+		gen.requests = append(gen.requests, runner.GeneratedRequest{Method: req.method, URL: server.URL, Body: req.body})
+	}
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: uint64(len(gen.requests)),
+		Generator:  gen,
+	})
+	var errs []string
+	for result := range r.StartTest() {
+		if result.Error != "" {
+			errs = append(errs, result.Error)
+		}
+	}
+
+	want := []string{
+		`DELETE ["4"] "id=1"`,
+		`DELETE ["0"] ""`,
+		`DELETE [] ""`,
+		`GET ["3"] "q=1"`,
+		`OPTIONS ["0"] ""`,
+		`PURGE ["3"] "key"`,
+		`TRACE [] ""`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0], "TRACE requests can't have a body") {
+		t.Fatalf("got: %v, want an error for the TRACE request with a body", errs)
+	}
+
+	if _, err := runner.ParseTargets(strings.NewReader("TRACE " + server.URL + "\n@" + os.DevNull + "\n")); err == nil {
+		t.Errorf("got: no error for a TRACE target with a body")
+	}
+	if _, err := runner.ParseScenario([]byte(`{"steps": [{"method": "TRACE", "url": "/", "body": "x"}]}`)); err == nil {
+		t.Errorf("got: no error for a TRACE step with a body")
+	}
+}
+
+func TestResultsOverflow(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	for _, overflow := range []string{runner.ResultsOverflowBlock, runner.ResultsOverflowDrop} {
+		r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+			VUs:             2,
+			Iterations:      20,
+			ResultsBuffer:   1,
+			ResultsOverflow: overflow,
+		})
+		received := 0
+		for range r.StartTest() {
+			// Read slower than the results are produced.
+			time.Sleep(5 * time.Millisecond)
+			received++
+		}
+
+		if overflow == runner.ResultsOverflowBlock && received != 40 {
+			t.Fatalf("got: %d results, want: 40 when blocking", received)
+		}
+		if overflow == runner.ResultsOverflowDrop && (received == 0 || received >= 40) {
+			t.Fatalf("got: %d results, want some of 40 dropped", received)
+		}
+	}
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:             4,
+		Iterations:      100,
+		ResultsBuffer:   1,
+		ResultsOverflow: runner.ResultsOverflowDrop,
+		OutputFile:      filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	summary := r.Summary()
+	if summary.Requests+summary.Dropped != 400 {
+		t.Fatalf("got: %d requests and %d dropped, want 400 in total", summary.Requests, summary.Dropped)
+	}
+	if b := summary.Backpressure; summary.Dropped > 0 && (b == nil || b.Dropped != uint64(summary.Dropped)) {
+		t.Fatalf("got: %+v, want %d dropped", b, summary.Dropped)
+	}
+}
+
+func TestVegetaTargets(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			seen[r.Method+" "+r.URL.Path+" "+r.Header.Get("X-Test")+" "+string(body)] = true
+			mu.Unlock()
+		}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	body := filepath.Join(dir, "item.json")
+	if err := os.WriteFile(body, []byte(`{"id":1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	targets, err := runner.ParseTargets(strings.NewReader(`
+# Plain targets and vegeta targets can be mixed.
+` + server.URL + `/a
+
+POST ` + server.URL + `/b 1
+X-Test: 1
+@` + body + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := runner.NewRunner("", runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 30,
+		Method:     http.MethodGet,
+		Headers:    []runner.Header{{Name: "X-Test", Value: "0"}},
+		Targets:    targets,
+	})
+	for range r.StartTest() {
+	}
+
+	want := map[string]bool{"GET /a 0 ": true, `POST /b 1 {"id":1}`: true}
+	if !reflect.DeepEqual(seen, want) {
+		t.Fatalf("got: %v, want: %v", seen, want)
+	}
+
+	if _, err := runner.ParseTargets(strings.NewReader(server.URL + "\nX-Test: 1\n")); err == nil {
+		t.Fatal("got: nil, want an error for a header after a target without a method")
+	}
+}
+
+func TestTemplatedTargets(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			seen[r.Method+" "+r.URL.Path] = true
+			mu.Unlock()
+		}),
+	)
+	defer server.Close()
+
+	name := filepath.Join(t.TempDir(), "bases.csv")
+	if err := os.WriteFile(name, []byte("base\n"+server.URL+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	feeder, err := runner.LoadFeeder(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := runner.ParseTargets(strings.NewReader("{{base}}/a\nPOST {{base}}/b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := runner.NewRunner("", runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 30,
+		Method:     http.MethodGet,
+		Targets:    targets,
+		Feeder:     feeder,
+	})
+	for range r.StartTest() {
+	}
+
+	want := map[string]bool{"GET /a": true, "POST /b": true}
+	if !reflect.DeepEqual(seen, want) {
+		t.Fatalf("got: %v, want: %v", seen, want)
+	}
+
+	for _, s := range []string{"api.com/a\n", "ftp://api.com/a\n", "/a/{{id}}\n"} {
+		if _, err := runner.ParseTargets(strings.NewReader(s)); err == nil {
+			t.Fatalf("got: nil, want an error for %q without a scheme or a leading placeholder", s)
+		}
+	}
+}
+
+func TestNewConnections(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	addrs := map[string]bool{}
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			addrs[r.RemoteAddr] = true
+			mu.Unlock()
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:            1,
+		Iterations:     3,
+		NewConnections: true,
+	})
+	for result := range r.StartTest() {
+		if result.Connect == 0 {
+			t.Fatalf("got: no connect latency, want one for the new connection of each request")
+		}
+	}
+
+	if len(addrs) != 3 {
+		t.Fatalf("got: %d connections, want: 3", len(addrs))
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Breaks keep-alive for requests to /close.
+			if r.URL.Path == "/close" {
+				w.Header().Set("Connection", "close")
+			}
+		}),
+	)
+	defer server.Close()
+
+	for _, tt := range []struct {
+		path        string
+		new, reused int
+	}{
+		{"/", 1, 3},
+		{"/close", 4, 0},
+	} {
+		r := runner.NewRunner(server.URL+tt.path, runner.LoadTestArgs{
+			VUs:        1,
+			Iterations: 4,
+			OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+		})
+		if err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+		s := r.Summary()
+		if s.NewConnections != tt.new || s.ReusedConnections != tt.reused || s.ReuseRate != float64(tt.reused)/4 {
+			t.Errorf("%s: got %d new, %d reused (%v), want %d new, %d reused", tt.path, s.NewConnections, s.ReusedConnections, s.ReuseRate, tt.new, tt.reused)
+		}
+	}
+}
+
+func TestCacheStatus(t *testing.T) {
+	t.Parallel()
+	headers := [][2]string{
+		{"X-Cache", "MISS, HIT"},
+		{"CF-Cache-Status", "MISS"},
+		{"Cache-Status", "Origin; fwd=miss, Edge; fwd=stale"},
+		{"Age", "30"},
+		{"X-Other", ""},
+	}
+	var mu sync.Mutex
+	n := 0
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Header().Set(headers[n][0], headers[n][1])
+			n++
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 5,
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := r.Summary()
+	got := map[string]int{}
+	for status, g := range s.Cache {
+		got[status] = g.Requests
+	}
+	if want := map[string]int{"hit": 2, "miss": 1, "stale": 1, "none": 1}; !reflect.DeepEqual(got, want) || s.CacheHitRate != 0.4 {
+		t.Fatalf("got: %v (hit rate %v), want: %v", got, s.CacheHitRate, want)
+	}
+}
+
+func TestChaos(t *testing.T) {
+	t.Parallel()
+	var disconnects atomic.Int32
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+				disconnects.Add(1)
+			case <-time.After(time.Second):
+			}
+		}),
+	)
+	defer server.Close()
+
+	for _, chaos := range []*runner.Chaos{{AbortRate: 1}, {DropRate: 1}} {
+		disconnects.Store(0)
+		r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+			VUs:        1,
+			Iterations: 3,
+			Chaos:      chaos,
+			Retries:    1,
+			RetryOn:    map[string]float64{runner.RetryOnError: 1},
+			OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+		})
+		start := time.Now()
+		if err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		s := r.Summary()
+		if s.Failed != 0 || len(s.Chaos) != 1 || time.Since(start) > 500*time.Millisecond {
+			t.Fatalf("%+v: got: %d failed, %v, want 3 requests cut short straight away", chaos, s.Failed, s.Chaos)
+		}
+		if chaos.AbortRate == 0 {
+			// A reset can reach the server before it reads the request, which it then never handles.
+			continue
+		}
+		// The server notices the disconnect asynchronously.
+		for i := 0; i < 100 && disconnects.Load() < 3; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := disconnects.Load(); got != 3 {
+			t.Fatalf("%+v: got: %d disconnects, want: 3", chaos, got)
+		}
+	}
+
+	// Requests that fail before they're sent weren't cut short.
+	r := runner.NewRunner("http://127.0.0.1:1", runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 3,
+		Chaos:      &runner.Chaos{AbortRate: 1},
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if s := r.Summary(); s.Failed != 3 || s.Chaos[runner.ChaosAbort].Requests != 0 {
+		t.Fatalf("got: %d failed, %v, want 3 refused requests", s.Failed, s.Chaos)
+	}
+}
+
+func TestSubscribers(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:   1100 * time.Millisecond,
+		Qps:        10,
+		Workers:    1,
+		Interval:   500 * time.Millisecond,
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+	})
+	var first, second, intervals int
+	r.OnResult(func(*runner.Result) { first++ })
+	r.OnResult(func(*runner.Result) { second++ })
+	r.OnInterval(func(s *runner.Summary) {
+		intervals++
+		if s.Requests < 4 || s.Requests > 6 {
+			t.Errorf("got: %d requests in an interval, want about 5", s.Requests)
+		}
+	})
+	var events []string
+	var end *runner.Summary
+	r.OnEvent(func(e runner.Event) {
+		events = append(events, e.Type)
+		if e.Type == runner.EventRunEnd {
+			end = e.Summary
+		}
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests := r.Summary().Requests; first != requests || second != requests || intervals != 2 {
+		t.Fatalf("got: %d and %d results, %d intervals, want: %d results, 2 intervals", first, second, intervals, requests)
+	}
+	// Events are published whatever the output format.
+	want := []string{runner.EventRunStart, runner.EventIntervalSummary, runner.EventIntervalSummary, runner.EventRunEnd}
+	if !reflect.DeepEqual(events, want) || end != r.Summary() {
+		t.Fatalf("got: events %v, want: %v with the final summary", events, want)
+	}
+}
+
+func TestTargetMetrics(t *testing.T) {
+	t.Parallel()
+	var scrapes atomic.Int64
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/metrics" {
+				return
+			}
+			n := scrapes.Add(1)
+			fmt.Fprintf(w, "# TYPE process_resident_memory_bytes gauge\nprocess_resident_memory_bytes %d\n", 1000*n)
+			fmt.Fprint(w, "cache_bytes{cache=\"a b\"} 5\ncache_bytes{cache=\"c\"} 7 1700000000000\n")
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:   time.Second,
+		Qps:        20,
+		Workers:    1,
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+		TargetMetrics: &runner.TargetMetrics{
+			URL:      server.URL + "/metrics",
+			Metrics:  []string{"process_resident_memory_bytes", "cache_bytes", `cache_bytes{cache="c"}`, "missing"},
+			Interval: 200 * time.Millisecond,
+		},
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := r.Summary()
+	m := s.TargetMetrics
+	if m == nil || len(m.Samples) < 3 || len(m.Trends) != 4 {
+		t.Fatalf("got: %+v, want samples and 4 trends", m)
+	}
+	if last := m.Samples[len(m.Samples)-1]; last.Requests != s.Requests {
+		t.Errorf("got: %d requests before the last sample, want: %d", last.Requests, s.Requests)
+	}
+	mem := m.Trends[0]
+	if mem.Samples != len(m.Samples) || mem.First != 1000 || mem.Last != mem.Max || mem.GrowthPerHour <= 0 {
+		t.Errorf("got: %+v, want growth from 1000", mem)
+	}
+	if sum, series := m.Trends[1], m.Trends[2]; sum.Last != 12 || series.Last != 7 {
+		t.Errorf("got: %v and %v, want: 12 and 7", sum.Last, series.Last)
+	}
+	if m.Trends[3].Samples != 0 {
+		t.Errorf("got: %d samples of a missing metric, want: 0", m.Trends[3].Samples)
+	}
+}
+
+func TestReload(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var headers []string
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			headers = append(headers, r.Header.Get("X-Test")+r.Header.Get("X-New"))
+			mu.Unlock()
+		}),
+	)
+	defer server.Close()
+
+	// Config files are parsed into these by the command, see cmd/main_test.go.
+	reloaded := runner.Reloadable{
+		Qps:     20,
+		Headers: []runner.Header{{Name: "X-Test", Value: "2"}, {Name: "X-New", Value: "a"}},
+	}
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 1,
+		Qps:        10,
+		Headers:    []runner.Header{{Name: "X-Test", Value: "1"}},
+	})
+	changes, err := r.Reload(reloaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"qps 10 -> 20", "header X-Test changed", "header X-New added"}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("got: %v, want: %v", changes, want)
+	}
+	if changes, _ := r.Reload(reloaded); len(changes) != 0 {
+		t.Fatalf("got: %v, want no changes", changes)
+	}
+
+	for range r.StartTest() {
+	}
+	if !reflect.DeepEqual(headers, []string{"2a"}) {
+		t.Fatalf("got: %v, want the reloaded headers", headers)
+	}
+}
+
+func TestFindMax(t *testing.T) {
+	t.Parallel()
+	// Allow 6 requests per 100ms window, i.e. about 60 qps.
+	var mu sync.Mutex
+	var window time.Time
+	count := 0
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if now := time.Now().Truncate(100 * time.Millisecond); now != window {
+				window, count = now, 0
+			}
+			if count++; count > 6 {
+				w.WriteHeader(http.StatusTooManyRequests)
+			}
+		}),
+	)
+	defer server.Close()
+
+	res, err := runner.FindMax(server.URL, runner.LoadTestArgs{Workers: 4, MaxWorkers: 4}, runner.FindMaxArgs{
+		MinQps:        20,
+		MaxQps:        320,
+		TrialDuration: 500 * time.Millisecond,
+		MaxErrorRate:  0.05,
+		Precision:     0.25,
+		Repeats:       3,
+	}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.AtMax || res.Low < 40 || res.High > 80 || res.Low >= res.High || res.Qps != res.Low {
+		t.Fatalf("got: %+v, want a capacity between 40 and 80 qps", res)
+	}
+	if len(res.Repeats) != 3 || res.Repeats[0].Qps != res.Qps {
+		t.Fatalf("got: %+v, want 3 repeats at %g qps", res.Repeats, res.Qps)
+	}
+	if tp := res.Throughput; tp == nil || tp.Low > tp.Mean || tp.Mean > tp.High || tp.Mean <= 0 {
+		t.Fatalf("got: %+v, want a confidence interval around the mean throughput", tp)
+	}
+}
+
+func TestOutputSchema(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	for _, format := range []string{runner.OutputFormatCSV, runner.OutputFormatEvents} {
+		out := filepath.Join(dir, "results."+format)
+		r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+			VUs:          1,
+			Iterations:   1,
+			OutputFile:   out,
+			OutputFormat: format,
+		})
+		if err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(data), "\n")
+
+		if format == runner.OutputFormatCSV {
+			want := []string{"# schema_version: 4", "timestamp,code,latency,error,seq,tag,queue_delay,failure_kind"}
+			if !reflect.DeepEqual(lines[:2], want) {
+				t.Fatalf("got: %q, want: %q", lines[:2], want)
+			}
+			if got := len(strings.Split(lines[2], ",")); got != len(runner.OutputSchema("").Formats[0].Fields) {
+				t.Fatalf("got: %d columns, want the schema's", got)
+			}
+			continue
+		}
+		var event runner.Event
+		if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != runner.EventSchema || event.SchemaVersion != runner.SchemaVersion {
+			t.Fatalf("got: %+v, want a schema event first", event)
+		}
+	}
+
+	fields := map[string]string{}
+	for _, f := range runner.OutputSchema("").Formats[2].Fields {
+		fields[f.Name] = f.Type
+	}
+	if fields["schema_version"] != "integer" || fields["latency.p99"] != "integer (nanoseconds)" || fields["codes"] != "object of object" {
+		t.Fatalf("got: %v, want the summary's fields", fields)
+	}
+
+	// Durations are described in the unit they're written in.
+	schema := runner.OutputSchema(runner.LatencyUnitMs)
+	if got := schema.Formats[0].Fields[2]; got.Name != "latency" || got.Type != "number (milliseconds)" {
+		t.Fatalf("got: %+v, want the latency in milliseconds", got)
+	}
+	if got := schema.Formats[0].Fields[0]; got.Type != "integer" {
+		t.Fatalf("got: %+v, want the timestamp as it is", got)
+	}
+	if got := runner.OutputSchema(runner.LatencyUnitHuman).Formats[2].Fields; !slices.ContainsFunc(got, func(f runner.SchemaField) bool {
+		return f.Name == "latency.p99" && strings.HasPrefix(f.Type, "string")
+	}) {
+		t.Fatalf("got: %v, want the summary's latencies as Go durations", got)
+	}
+	if runner.OutputSchema("").Formats[0].Fields[2].Type != "integer (nanoseconds)" {
+		t.Fatal("got: the default schema changed by another unit's")
+	}
+}
+
+func TestPacerShards(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	for _, args := range []runner.LoadTestArgs{
+		{Duration: 1 * time.Second, Workers: 4, Qps: 100, PacerShards: 4, PinPacers: true},
+		{Workers: 4, Qps: 1000, MaxRequests: 25, PacerShards: 4},
+	} {
+		r := runner.NewRunner(server.URL, args)
+		var hits uint64
+		for range r.StartTest() {
+			hits++
+		}
+		want := uint64(100)
+		if args.MaxRequests > 0 {
+			want = args.MaxRequests
+		}
+		if hits != want {
+			t.Fatalf("got: %v, want: %v", hits, want)
+		}
+	}
+}
+
+func TestFailureKinds(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/error":
+				w.WriteHeader(http.StatusServiceUnavailable)
+			case "/reset":
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+			case "/slow":
+				time.Sleep(1500 * time.Millisecond)
+			}
+		}),
+	)
+	defer server.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + listener.Addr().String()
+	listener.Close()
+
+	for _, tt := range []struct {
+		target string
+		want   string
+	}{
+		{server.URL + "/ok", ""},
+		{server.URL + "/error", runner.FailureHTTP},
+		{server.URL + "/reset", runner.FailureReset},
+		{server.URL + "/slow", runner.FailureTimeout},
+		{refused, runner.FailureRefused},
+	} {
+		r := runner.NewRunner(tt.target, runner.LoadTestArgs{VUs: 1, Iterations: 1, Timeout: 1})
+		for result := range r.StartTest() {
+			if result.FailureKind != tt.want {
+				t.Errorf("%s: got: %q (%s), want: %q", tt.target, result.FailureKind, result.Error, tt.want)
+			}
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	seen := map[string]int{}
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/login" {
+				var creds struct{ User, Password string }
+				json.NewDecoder(r.Body).Decode(&creds)
+				if creds.Password != "secret-"+creds.User {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: creds.User})
+				w.Write([]byte(`{"data": {"token": "token-` + creds.User + `"}}`))
+				return
+			}
+			cookie, _ := r.Cookie("session")
+			mu.Lock()
+			seen[cookie.String()+" "+r.Header.Get("Authorization")]++
+			mu.Unlock()
+		}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "credentials.csv")
+	if err := os.WriteFile(name, []byte("username,password\nalice,secret-alice\nbob,secret-bob\neve,guess\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := runner.LoadFeeder(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := runner.NewRunner(server.URL+"/items", runner.LoadTestArgs{
+		VUs:        3,
+		Iterations: 2,
+		OutputFile: filepath.Join(dir, "results.csv"),
+		Login: &runner.Login{
+			URL:         server.URL + "/login",
+			Body:        `{"user": "{{username}}", "password": "{{password}}"}`,
+			ContentType: "application/json",
+			Credentials: credentials,
+			TokenField:  "data.token",
+		},
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"session=alice Bearer token-alice": 2, "session=bob Bearer token-bob": 2}
+	if !reflect.DeepEqual(seen, want) {
+		t.Fatalf("got: %v, want: %v", seen, want)
+	}
+	if got := r.Summary().LoginFailures; got != 1 {
+		t.Fatalf("got: %d login failures, want: 1", got)
+	}
+}
+
+func TestTLSKeyLog(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	name := filepath.Join(t.TempDir(), "keys.log")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 1,
+		TLSRootCAs: roots,
+		TLSKeyLog:  f,
+	})
+	for result := range r.StartTest() {
+		if result.Error != "" {
+			t.Fatal(result.Error)
+		}
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "CLIENT_TRAFFIC_SECRET_0 ") {
+		t.Fatalf("got: %q, want the TLS 1.3 secrets", data)
+	}
+}
+
+func TestClientDelay(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		s             string
+		delay, jitter time.Duration
+		wantErr       bool
+	}{
+		{"20ms", 20 * time.Millisecond, 0, false},
+		{"20ms±5ms", 20 * time.Millisecond, 5 * time.Millisecond, false},
+		{"20ms +- 5ms", 20 * time.Millisecond, 5 * time.Millisecond, false},
+		{"5ms±20ms", 0, 0, true},
+		{"fast", 0, 0, true},
+	} {
+		delay, jitter, err := runner.ParseDelay(tt.s)
+		if (err != nil) != tt.wantErr || delay != tt.delay || jitter != tt.jitter {
+			t.Fatalf("%s: got: %s±%s, %v", tt.s, delay, jitter, err)
+		}
+	}
+
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:               1,
+		Iterations:        3,
+		ClientDelay:       50 * time.Millisecond,
+		ClientDelayJitter: 10 * time.Millisecond,
+	})
+	for result := range r.StartTest() {
+		if result.Latency < 40*time.Millisecond {
+			t.Fatalf("got: %s, want the client delay included", result.Latency)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	t.Parallel()
+	if on, err := runner.ParseRetryOn("error,503,429=2"); err != nil || !reflect.DeepEqual(on, map[string]float64{"error": 1, "503": 1, "429": 2}) {
+		t.Fatalf("got: %v, %v", on, err)
+	}
+	for _, s := range []string{"", "timeout", "600", "503=-1"} {
+		if _, err := runner.ParseRetryOn(s); err == nil {
+			t.Fatalf("%q: want an error", s)
+		}
+	}
+
+	// Every first attempt fails.
+	var hits atomic.Int64
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hits.Add(1)%2 == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:          1,
+		Iterations:   4,
+		Retries:      2,
+		RetryOn:      map[string]float64{"503": 1},
+		RetryBackoff: time.Millisecond,
+		OutputFile:   filepath.Join(dir, "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := r.Summary()
+	if summary.Failed != 0 || hits.Load() != 8 {
+		t.Fatalf("got: %d failed after %d attempts", summary.Failed, hits.Load())
+	}
+	want := &runner.RetrySummary{Retried: 4, Retries: 4, Amplification: 2, SuccessAfterRetry: 1}
+	if !reflect.DeepEqual(summary.Retries, want) {
+		t.Fatalf("got: %+v, want: %+v", summary.Retries, want)
+	}
+}
+
+func TestScenario(t *testing.T) {
+	t.Parallel()
+	for _, s := range []string{
+		`{"steps": []}`,
+		`{"steps": [{"name": "a"}]}`,
+		`{"steps": [{"url": "/", "extract": [{"var": "id", "json": "$.id", "header": "X-Id"}]}]}`,
+		`{"steps": [{"url": "/", "assert": [{"var": "id"}]}]}`,
+		`{"steps": [{"url": "/", "unknown": 1}]}`,
+		`{"steps": [{"name": "a", "url": "/"}, {"name": "a", "url": "/b"}]}`,
+	} {
+		if _, err := runner.ParseScenario([]byte(s)); err == nil {
+			t.Fatalf("%s: want an error", s)
+		}
+	}
+
+	var next atomic.Int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		id := next.Add(1)
+		w.Header().Set("X-Owner", string(body))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"order": {"items": [{"id": %d}]}}`, id)
+	})
+	mux.HandleFunc("/orders/", func(w http.ResponseWriter, r *http.Request) {
+		// Every third order is lost.
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/orders/"))
+		if id%3 == 0 {
+			id = 0
+		}
+		fmt.Fprintf(w, "<p>order %d</p>", id)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	scenario, err := runner.ParseScenario([]byte(`{"steps": [
+		{"name": "create", "method": "POST", "url": "/orders", "body": "alice", "status": 201,
+		 "extract": [{"var": "id", "json": "$.order.items[0].id"}, {"var": "owner", "header": "X-Owner"}],
+		 "assert": [{"var": "owner", "equals": "alice"}]},
+		{"name": "fetch", "url": "/orders/{{id}}",
+		 "extract": [{"var": "fetched", "regex": "order (\\d+)"}],
+		 "assert": [{"var": "fetched", "equals": "{{id}}"}]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:          1,
+		Iterations:   6,
+		Scenario:     scenario,
+		Tag:          "checkout",
+		OutputFormat: runner.OutputFormatEvents,
+		OutputFile:   filepath.Join(dir, "results.ndjson"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := r.Summary()
+	if summary.Requests != 12 || summary.Failures[runner.FailureAssertion] != 2 {
+		t.Fatalf("got: %d requests, failures %v", summary.Requests, summary.Failures)
+	}
+	if create, fetch := summary.Steps["create"], summary.Steps["fetch"]; create.Failed != 0 || fetch.Requests != 6 || fetch.Failed != 2 {
+		t.Fatalf("got: %+v", summary.Steps)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "results.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(data), `"tag":"checkout","step":"fetch"`); got != 6 {
+		t.Fatalf("got: %d fetch results tagged checkout, want: 6", got)
+	}
+}
+
+func TestScenarioLargeNumbers(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var paths []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
+		// Beyond 2^53, which a float64 can't hold exactly.
+		fmt.Fprint(w, `{"id": 9007199254740993, "total": 10.50, "meta": {"shard": 18446744073709551615}}`)
+	})
+	mux.HandleFunc("/orders/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	scenario, err := runner.ParseScenario([]byte(`{"steps": [
+		{"name": "create", "method": "POST", "url": "/orders",
+		 "extract": [{"var": "id", "json": "$.id"}, {"var": "total", "json": "$.total"}, {"var": "meta", "json": "$.meta"}],
+		 "assert": [{"var": "total", "equals": "10.50"}, {"var": "meta", "equals": "{\"shard\":18446744073709551615}"}]},
+		{"name": "fetch", "url": "/orders/{{id}}"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 1,
+		Scenario:   scenario,
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if failures := r.Summary().Failures; len(failures) != 0 {
+		t.Fatalf("got: failures %v, want the numbers extracted as they are", failures)
+	}
+	if want := []string{"/orders/9007199254740993"}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got: %v, want: %v", paths, want)
+	}
+}
+
+func TestScenarioBranches(t *testing.T) {
+	t.Parallel()
+	for _, s := range []string{
+		`{"steps": [{"url": "/", "on": [{"status": [404]}]}]}`,
+		`{"steps": [{"url": "/", "on": [{"status": [404], "end": true, "goto": "step1"}]}]}`,
+		`{"steps": [{"url": "/", "on": [{"status": [404], "goto": "missing"}]}]}`,
+		`{"steps": [{"url": "/", "on": [{"status": [429], "retry": "soon"}]}]}`,
+		`{"steps": [{"url": "/", "on": [{"goto": "step1"}]}]}`,
+	} {
+		if _, err := runner.ParseScenario([]byte(s)); err == nil {
+			t.Fatalf("%s: want an error", s)
+		}
+	}
+
+	var creates atomic.Int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lookup", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	mux.HandleFunc("/create", func(w http.ResponseWriter, r *http.Request) {
+		// Rate limited every other time.
+		if creates.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	scenario, err := runner.ParseScenario([]byte(`{"steps": [
+		{"name": "lookup", "url": "/lookup", "on": [{"status": [404], "goto": "create"}]},
+		{"name": "update", "url": "/update"},
+		{"name": "create", "url": "/create", "on": [{"status": [429, 503], "retry": "10ms", "max_retries": 2}]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 4,
+		Scenario:   scenario,
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each lookup skips the update, and each create is retried once.
+	steps := r.Summary().Steps
+	if lookup, update, create := steps["lookup"], steps["update"], steps["create"]; lookup.Requests != 4 || lookup.Failed != 0 || update.Requests != 0 || create.Requests != 8 || create.Failed != 4 {
+		t.Fatalf("got: %+v", steps)
+	}
+}
+
+func TestSQLiteOutput(t *testing.T) {
+	t.Parallel()
+	for name, want := range map[string]bool{"results.db": true, "a/results.SQLite3": true, "results.csv": false, "stdout": false, "https://collector/results.db": false} {
+		if got := runner.IsSQLiteOutput(name); got != want {
+			t.Fatalf("%s got: %v, want: %v", name, got, want)
+		}
+	}
+
+	var requests atomic.Int64
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1)%4 == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}),
+	)
+	defer server.Close()
+
+	// Both tests are added to the database, and the CSV output is still written.
+	dir := t.TempDir()
+	name := filepath.Join(dir, "results.db")
+	for _, runID := range []string{"first", "second"} {
+		r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+			VUs:         1,
+			Iterations:  20,
+			RunID:       runID,
+			OutputFile:  name,
+			OutputFiles: []string{filepath.Join(dir, runID+".csv")},
+		})
+		if err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, runID+".csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The schema comment and header line, then a line per result.
+		if lines := strings.Count(string(data), "\n"); lines != 22 {
+			t.Fatalf("%s got: %d CSV lines, want: 22", runID, lines)
+		}
+	}
+
+	db, err := sql.Open("sqlite", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT run_id, target, ended_at IS NOT NULL, requests, failed, json_extract(summary, '$.requests'), json_extract(config, '$.iterations') FROM runs ORDER BY started_at")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var runs []string
+	for rows.Next() {
+		var runID, target string
+		var ended bool
+		var requests, failed, summaryRequests, iterations int
+		if err := rows.Scan(&runID, &target, &ended, &requests, &failed, &summaryRequests, &iterations); err != nil {
+			t.Fatal(err)
+		}
+		if target != server.URL || !ended || requests != 20 || failed != 5 || summaryRequests != 20 || iterations != 20 {
+			t.Fatalf("%s got: target=%s ended=%v requests=%d failed=%d summary requests=%d iterations=%d", runID, target, ended, requests, failed, summaryRequests, iterations)
+		}
+		runs = append(runs, runID)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"first", "second"}; !reflect.DeepEqual(runs, want) {
+		t.Fatalf("got: %v, want: %v", runs, want)
+	}
+
+	for _, runID := range runs {
+		var results, unavailable, failures, seqs int
+		var latency int64
+		err := db.QueryRow(`SELECT count(*), count(CASE code WHEN 503 THEN 1 END), count(CASE failure_kind WHEN 'http' THEN 1 END),
+			count(DISTINCT seq), min(latency_ns) FROM results WHERE run_id = ?`, runID).Scan(&results, &unavailable, &failures, &seqs, &latency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results != 20 || unavailable != 5 || failures != 5 || seqs != 20 || latency <= 0 {
+			t.Fatalf("%s got: %d results, %d 503s, %d http failures, %d seqs, min latency %d", runID, results, unavailable, failures, seqs, latency)
+		}
+	}
+
+	// The schema lists the tables' columns in order.
+	schema := map[string][]string{}
+	for _, f := range runner.OutputSchema("").Formats {
+		for _, field := range f.Fields {
+			schema[f.Name] = append(schema[f.Name], field.Name)
+		}
+	}
+	for table, format := range map[string]string{"runs": "sqlite-runs", "results": "sqlite-results"} {
+		var columns []string
+		rows, err := db.Query("SELECT name FROM pragma_table_info(?) ORDER BY cid", table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				t.Fatal(err)
+			}
+			columns = append(columns, column)
+		}
+		rows.Close()
+		if !reflect.DeepEqual(columns, schema[format]) {
+			t.Fatalf("%s got: %v, want: %v", table, columns, schema[format])
+		}
+	}
+
+	var indexes int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = 'results'").Scan(&indexes); err != nil {
+		t.Fatal(err)
+	}
+	if indexes != 2 {
+		t.Fatalf("got: %d indexes on results, want: 2", indexes)
+	}
+}
+
+func TestScenarioScript(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	script := func(name, source string) string {
+		name = filepath.Join(dir, name)
+		if err := os.WriteFile(name, []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	for _, name := range []string{
+		filepath.Join(dir, "missing.lua"),
+		script("syntax.lua", "function beforeRequest(req"),
+		script("nohooks.lua", "x = 1"),
+		script("sandbox.lua", "io.open('/etc/passwd')\nfunction beforeRequest(req) end"),
+	} {
+		if _, err := runner.ParseScenario([]byte(fmt.Sprintf(`{"script": %q, "steps": [{"url": "/"}]}`, name))); err == nil {
+			t.Fatalf("%s: want an error", name)
+		}
+	}
+
+	var unsigned atomic.Int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		body, _ := io.ReadAll(r.Body)
+		mac.Write([]byte(r.Method + " " + r.URL.Path + " " + string(body)))
+		if r.Header.Get("X-Signature") != hex.EncodeToString(mac.Sum(nil)) {
+			unsigned.Add(1)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/lookup":
+			w.WriteHeader(http.StatusNotFound)
+		case "/create":
+			if string(body) != `{"name":"gadget"}` {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id": 12345678901234567890}`))
+		case "/items/12345678901234567890":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// Requests are signed, the lookup's 404 goes to create, skipping update, and the created ID
+	// is fetched.
+	scenario, err := runner.ParseScenario([]byte(fmt.Sprintf(`{"script": %q, "steps": [
+		{"name": "lookup", "url": "/lookup"},
+		{"name": "update", "url": "/update"},
+		{"name": "create", "method": "POST", "url": "/create"},
+		{"name": "fetch", "url": "/items/{{id}}"}
+	]}`, script("hooks.lua", `
+function beforeRequest(req)
+  if req.step == "create" then
+    req.body = json_encode({name = "gadget"})
+  end
+  local path = string.match(req.url, "^https?://[^/]+(/[^?]*)")
+  req.headers["X-Signature"] = hmac_sha256("secret", req.method .. " " .. path .. " " .. req.body)
+end
+
+function afterResponse(res)
+  if res.step == "lookup" and res.status == 404 then
+    return "create"
+  end
+  if res.step == "create" then
+    res.vars.id = json_decode(res.body).id
+  end
+end
+`))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        2,
+		Iterations: 3,
+		Scenario:   scenario,
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if n := unsigned.Load(); n != 0 {
+		t.Fatalf("got: %d unsigned requests, want: 0", n)
+	}
+	steps := r.Summary().Steps
+	for name, want := range map[string]int{"lookup": 6, "update": 0, "create": 6, "fetch": 6} {
+		if got := steps[name]; got.Requests != want || got.Failed != 0 {
+			t.Fatalf("%s got: %+v, want: %d requests and no failures", name, got, want)
+		}
+	}
+
+	// A hook's error fails the step, as does going to a step that doesn't exist.
+	for _, source := range []string{
+		`function afterResponse(res) error("boom") end`,
+		`function afterResponse(res) return "missing" end`,
+	} {
+		scenario, err := runner.ParseScenario([]byte(fmt.Sprintf(`{"script": %q, "steps": [{"name": "a", "url": "/items/12345678901234567890"}, {"name": "b", "url": "/"}]}`, script("failing.lua", source))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+			VUs:        1,
+			Iterations: 2,
+			Scenario:   scenario,
+			OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+		})
+		if err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+		summary := r.Summary()
+		if a, b := summary.Steps["a"], summary.Steps["b"]; a.Requests != 2 || a.Failed != 2 || b.Requests != 0 {
+			t.Fatalf("%s got: %+v", source, summary.Steps)
+		}
+		if n := summary.Failures[runner.FailureAssertion]; n != 2 {
+			t.Fatalf("%s got: %d assertion failures, want: 2", source, n)
+		}
+	}
+}
+
+func TestScenarioMaxConcurrency(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var inFlight, most int
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/report" {
+				return
+			}
+			mu.Lock()
+			inFlight++
+			most = max(most, inFlight)
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}),
+	)
+	defer server.Close()
+
+	scenario, err := runner.ParseScenario([]byte(`{"steps": [{"url": "/list"}, {"url": "/report", "max_concurrency": 2}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        8,
+		Iterations: 3,
+		Scenario:   scenario,
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := r.Summary()
+	if got := most; got != 2 || s.Failed != 0 || s.QueueDelay == nil || s.QueueDelay.Max < 20*time.Millisecond {
+		t.Fatalf("got: %d concurrent reports, %d failed, queue delay %v, want 2 and waiting for them", got, s.Failed, s.QueueDelay)
+	}
+}
+
+func TestStatsFile(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello")
+		}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:   time.Second,
+		Qps:        20,
+		Workers:    2,
+		MaxWorkers: 2,
+		Interval:   250 * time.Millisecond,
+		OutputFile: filepath.Join(dir, "results.csv"),
+		StatsFile:  filepath.Join(dir, "stats.json"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "stats.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats runner.IntervalStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		t.Fatal(err)
+	}
+	// The results of the last interval may be sent just after the test's first second.
+	if len(stats.Rows) < 4 || len(stats.Rows) > 5 {
+		t.Fatalf("got: %d rows, want 4", len(stats.Rows))
+	}
+	requests := 0
+	for i, row := range stats.Rows {
+		if row.Start != time.Duration(i)*250*time.Millisecond || row.Qps != float64(row.Requests)*4 || row.Bytes != int64(row.Requests)*5 || row.P50 == 0 {
+			t.Fatalf("got: %+v", row)
+		}
+		requests += row.Requests
+	}
+	if requests != r.Summary().Requests {
+		t.Fatalf("got: %d requests, want: %d", requests, r.Summary().Requests)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var keys []string
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			keys = append(keys, r.Header.Get(runner.IdempotencyKeyHeader))
+			// Every first attempt fails.
+			if len(keys)%2 == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:            1,
+		Iterations:     2,
+		Method:         http.MethodPut,
+		Retries:        1,
+		RetryOn:        map[string]float64{"503": 1},
+		IdempotencyKey: true,
+		OutputFile:     filepath.Join(dir, "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 4 || len(keys[0]) != 36 || keys[0] != keys[1] || keys[2] != keys[3] || keys[0] == keys[2] {
+		t.Fatalf("got: %q, want the same key for the retries of each request", keys)
+	}
+}
+
+func TestRunIDHeader(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var ids []string
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			ids = append(ids, r.Header.Get(runner.DefaultRunIDHeader))
+		}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:         1,
+		Iterations:  3,
+		RunIDHeader: runner.DefaultRunIDHeader,
+		OutputFile:  filepath.Join(dir, "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	runID := r.Summary().Config.RunID
+	if len(runID) != 36 || len(ids) != 3 || ids[0] != runID || ids[1] != runID || ids[2] != runID {
+		t.Fatalf("got: %q, want run ID %q with every request", ids, runID)
+	}
+}
+
+func TestInvalidRequests(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			switch {
+			case r.Header.Get("Authorization") == "Bearer invalid":
+				w.WriteHeader(http.StatusUnauthorized)
+			case string(body) == "{bad":
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        1,
+		Iterations: 60,
+		Method:     http.MethodPost,
+		Invalid:    &runner.InvalidRequests{Rate: 0.5, Bodies: []string{"{bad"}},
+		OutputFile: filepath.Join(dir, "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := r.Summary()
+	if summary.Failed != 0 {
+		t.Fatalf("got: %d failed, want invalid requests rejected with 4xx to succeed", summary.Failed)
+	}
+	requests := 0
+	for _, class := range []string{"valid", runner.InvalidAuth, runner.InvalidBody} {
+		if summary.Classes[class].Requests == 0 {
+			t.Fatalf("got: %+v, want %s requests", summary.Classes, class)
+		}
+		requests += summary.Classes[class].Requests
+	}
+	if requests != 60 {
+		t.Fatalf("got: %d requests in classes, want 60", requests)
+	}
+}
+
+func TestStopAfterIdle(t *testing.T) {
+	t.Parallel()
+	var hits atomic.Int64
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The target hangs after its first requests.
+			if hits.Add(1) > 3 {
+				<-r.Context().Done()
+			}
+		}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Qps:           20,
+		Workers:       2,
+		MaxWorkers:    2,
+		StopAfterIdle: 300 * time.Millisecond,
+		OutputFile:    filepath.Join(dir, "results.csv"),
+	})
+	start := time.Now()
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("got: stopped after %s", elapsed)
+	}
+	if summary := r.Summary(); summary.Requests != 3 || summary.StopReason != "no results for 300ms" {
+		t.Fatalf("got: %d requests, stop reason %q", summary.Requests, summary.StopReason)
+	}
+}
+
+func TestMaxErrors(t *testing.T) {
+	t.Parallel()
+	var hits atomic.Int64
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Every other request fails.
+			if hits.Add(1)%2 == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:   10 * time.Second,
+		Qps:        100,
+		Workers:    1,
+		MaxErrors:  5,
+		OutputFile: filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := r.Summary()
+	if summary.Elapsed > 3*time.Second || summary.Failed < 5 || summary.Failed > 6 || summary.StopReason != "reached 5 errors" {
+		t.Fatalf("got: %d failed in %s, stop reason %q", summary.Failed, summary.Elapsed, summary.StopReason)
+	}
+}
+
+func TestResume(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	out, state := filepath.Join(dir, "results.csv"), filepath.Join(dir, "state.json")
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Qps:         100,
+		Workers:     1,
+		MaxRequests: 10,
+		RunID:       "run-1",
+		OutputFile:  out,
+		StateFile:   state,
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// A test that finished can't be resumed.
+	if _, err := runner.LoadRunState(state); err == nil {
+		t.Fatal("want an error resuming a finished test")
+	}
+
+	// Resume as if the test had crashed after its first 10 requests of 20.
+	r = runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Qps:         100,
+		Workers:     1,
+		MaxRequests: 20,
+		OutputFile:  out,
+		StateFile:   state,
+		Resume:      &runner.RunState{RunID: "run-1", Seed: 42, Seq: 10, Requests: 10, Elapsed: time.Second},
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if summary := r.Summary(); summary.Requests != 10 || summary.Resumed == nil || summary.Config.RunID != "run-1" || summary.Config.Seed != 42 {
+		t.Fatalf("got: %d requests, resumed %v, run ID %q, seed %d", summary.Requests, summary.Resumed, summary.Config.RunID, summary.Config.Seed)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The resumed results follow those of the first test, without another preamble.
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if got, want := len(lines), 2+20; got != want {
+		t.Fatalf("got: %d lines, want: %d", got, want)
+	}
+	seqs := map[string]bool{}
+	for _, line := range lines[2:] {
+		seqs[strings.Split(line, ",")[4]] = true
+	}
+	if len(seqs) != 20 || !seqs["19"] {
+		t.Fatalf("got sequence numbers: %v", seqs)
+	}
+
+	data, err = os.ReadFile(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s runner.RunState
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.RunID != "run-1" || s.Seed != 42 || s.Requests != 20 || s.Seq != 20 || !s.Finished || s.Elapsed < time.Second {
+		t.Fatalf("got state: %+v", s)
+	}
+}
+
+func TestAlertWebhook(t *testing.T) {
+	t.Parallel()
+	healthy := time.Now().Add(600 * time.Millisecond).UnixNano()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if time.Now().UnixNano() < healthy {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}),
+	)
+	defer server.Close()
+
+	var mu sync.Mutex
+	var alerts []runner.Alert
+	webhook := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var alert runner.Alert
+			if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			alerts = append(alerts, alert)
+			mu.Unlock()
+		}),
+	)
+	defer webhook.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:       1500 * time.Millisecond,
+		Qps:            50,
+		Workers:        1,
+		Interval:       200 * time.Millisecond,
+		AlertWebhook:   webhook.URL,
+		AlertErrorRate: 0.5,
+		AlertP99:       time.Second,
+		RunID:          "run-1",
+		OutputFile:     filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The error rate alert fires once, then resolves once the target recovers. The latency never
+	// crosses its threshold.
+	mu.Lock()
+	defer mu.Unlock()
+	if len(alerts) != 2 || alerts[0].State != runner.AlertFiring || alerts[1].State != runner.AlertResolved {
+		t.Fatalf("got alerts: %+v", alerts)
+	}
+	for _, alert := range alerts {
+		if alert.Metric != "error_rate" || alert.Threshold != 0.5 || alert.RunID != "run-1" {
+			t.Fatalf("got alert: %+v", alert)
+		}
+	}
+	if got := r.Summary().Alerts; got != 2 {
+		t.Fatalf("got: %d alerts, want: 2", got)
+	}
+}
+
+func TestWaitForTarget(t *testing.T) {
+	t.Parallel()
+	var ready atomic.Int64
+	ready.Store(time.Now().Add(500 * time.Millisecond).UnixNano())
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if time.Now().UnixNano() < ready.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:      300 * time.Millisecond,
+		Workers:       1,
+		Qps:           20,
+		WaitForTarget: 5 * time.Second,
+		OutputFile:    filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if summary := r.Summary(); summary.Requests == 0 || summary.Failed > 0 {
+		t.Fatalf("got: %d requests, %d failed, want the startup errors not counted", summary.Requests, summary.Failed)
+	}
+
+	// A target that never gets ready fails the test.
+	ready.Store(time.Now().Add(time.Hour).UnixNano())
+	r = runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:      300 * time.Millisecond,
+		Workers:       1,
+		Qps:           20,
+		WaitForTarget: time.Second,
+		OutputFile:    filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err == nil || !strings.Contains(err.Error(), "not ready after 1s") {
+		t.Fatalf("got: %v, want the target not ready", err)
+	}
+}
+
+func TestGrafanaDatasource(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:       2 * time.Second,
+		Qps:            20,
+		Workers:        2,
+		MaxWorkers:     2,
+		ExportInterval: 100 * time.Millisecond,
+		GrafanaAddr:    addr,
+		OutputFile:     filepath.Join(dir, "results.csv"),
+	})
+	done := make(chan error)
+	go func() { done <- r.Run() }()
+	defer func() {
+		r.Stop()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	query := fmt.Sprintf(`{"range": {"from": %q, "to": %q}, "targets": [{"target": "requests"}]}`,
+		time.Now().Add(-time.Minute).Format(time.RFC3339), time.Now().Add(time.Minute).Format(time.RFC3339))
+	for i := 0; ; i++ {
+		time.Sleep(100 * time.Millisecond)
+		res, err := http.Post("http://"+addr+"/query", "application/json", strings.NewReader(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var series []struct {
+			Target     string       `json:"target"`
+			Datapoints [][2]float64 `json:"datapoints"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&series)
+		res.Body.Close()
+		if err != nil || len(series) != 1 || series[0].Target != "requests" {
+			t.Fatalf("got: %+v, %v", series, err)
+		}
+		if len(series[0].Datapoints) > 1 {
+			break
+		}
+		if i == 15 {
+			t.Fatalf("got: %v, want a point for each interval", series[0].Datapoints)
+		}
+	}
+}
+
+func TestDNSStrategy(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		s, host, strategy string
+		wantErr           bool
+	}{
+		{"random", "", runner.DNSRandom, false},
+		{"api.com=first", "api.com", runner.DNSFirst, false},
+		{" api.com = weighted ", "api.com", runner.DNSWeighted, false},
+		{"=random", "", "", true},
+		{"api.com=least-conn", "", "", true},
+	}
+	for _, tt := range tests {
+		host, strategy, err := runner.ParseDNSStrategy(tt.s)
+		if (err != nil) != tt.wantErr || host != tt.host || strategy != tt.strategy {
+			t.Errorf("ParseDNSStrategy(%q) = %q, %q, %v", tt.s, host, strategy, err)
+		}
+	}
+	if _, _, err := runner.ParseDNSWeight("api.com=2"); err == nil {
+		t.Error("want an error for a weight of a host name")
+	}
+
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:      500 * time.Millisecond,
+		Qps:           40,
+		Workers:       1,
+		DNSStrategies: map[string]string{"": runner.DNSWeighted},
+		DNSWeights:    map[string]float64{"127.0.0.1": 3},
+		OutputFile:    filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	summary := r.Summary()
+	if backend := summary.Backends["127.0.0.1"]; len(summary.Backends) != 1 || backend.Requests != summary.Requests || backend.Failed != 0 {
+		t.Fatalf("got: %+v, want all %d requests to 127.0.0.1", summary.Backends, summary.Requests)
+	}
+}
+
+func TestPerHostQps(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+
+	dir := t.TempDir()
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:        4,
+		Duration:   time.Second,
+		PerHostQps: 20,
+		OutputFile: filepath.Join(dir, "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := r.Summary()
+	backend := summary.Backends["127.0.0.1"]
+	if len(summary.Backends) != 1 || backend.Requests < 15 || backend.Requests > 25 || backend.Failed != 0 {
+		t.Fatalf("got: %+v, want about 20 requests to 127.0.0.1", summary.Backends)
+	}
+	if summary.QueueDelay == nil || summary.QueueDelay.Max < 10*time.Millisecond || summary.Latency.P50 > 10*time.Millisecond {
+		t.Fatalf("got: queue delay %v, latency %s, want the wait for the limit in the queue delay", summary.QueueDelay, summary.Latency)
+	}
+}
+
+func TestRateShape(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	name := filepath.Join(dir, "shape.csv")
+	// 10 rps for 100s, then rising to 50 rps over the next 100s.
+	if err := os.WriteFile(name, []byte("time,rps\n1700000000,10\n1700000100,10\n1700000200,50\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	shape, err := runner.LoadRateShape(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shape.Length() != 200*time.Second {
+		t.Fatalf("got: %s, want 200s", shape.Length())
+	}
+
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+	// Compressed to 2s, so about 10 requests in the first second and 30 in the next.
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		Duration:   2 * time.Second,
+		RateShape:  shape,
+		Workers:    4,
+		MaxWorkers: 4,
+		OutputFile: filepath.Join(dir, "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.Summary().Requests; n < 32 || n > 48 {
+		t.Fatalf("got: %d requests, want about 40", n)
+	}
+}
+
+func TestResumeRateShape(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	name := filepath.Join(dir, "shape.csv")
+	// 40 rps for the first second, then 2 rps for the next.
+	if err := os.WriteFile(name, []byte("0,40\n1,40\n1,2\n2,2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	shape, err := runner.LoadRateShape(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+	defer server.Close()
+	// Resumed after the first second, so only the second's 2 rps are left to run.
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		RateShape:  shape,
+		Workers:    4,
+		MaxWorkers: 4,
+		OutputFile: filepath.Join(dir, "results.csv"),
+		Resume:     &runner.RunState{RunID: "run-1", Seed: 42, Seq: 40, Requests: 40, Elapsed: time.Second},
+	})
+	start := time.Now()
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Fatalf("got: %s, want the remaining second of the shape", elapsed)
+	}
+	if n := r.Summary().Requests; n < 1 || n > 5 {
+		t.Fatalf("got: %d requests, want about 2", n)
+	}
+}
+
+func TestHostPolicy(t *testing.T) {
+	t.Parallel()
+	parse := func(s string) []string {
+		p, err := runner.ParseHostPatterns(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	policy := &runner.HostPolicy{
+		Allow:      parse("*.example.com"),
+		Deny:       parse("admin.example.com"),
+		Production: parse("*.prod.example.com, API.example.com."),
+	}
+
+	for _, tt := range []struct {
+		target     string
+		production bool
+		ok         bool
+	}{
+		{"http://app.staging.example.com/", false, true},
+		{"https://api.example.com:8443/users", true, true},
+		{"https://web.prod.example.com/", true, true},
+		{"https://admin.example.com/", false, false},
+		{"https://example.org/", false, false},
+	} {
+		production, err := policy.Check(context.Background(), tt.target)
+		if production != tt.production || (err == nil) != tt.ok {
+			t.Errorf("%s: got production %t, error %v", tt.target, production, err)
+		}
+	}
+
+	if _, err := runner.ParseHostPatterns("[a-"); err == nil {
+		t.Error("got no error for an invalid pattern")
+	}
+}
+
+func TestHostPolicyRequests(t *testing.T) {
+	t.Parallel()
+	var denied atomic.Int64
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.Host, "localhost") {
+				denied.Add(1)
+				return
+			}
+			http.Redirect(w, r, "http://"+strings.Replace(r.Host, "127.0.0.1", "localhost", 1)+"/", http.StatusFound)
+		}),
+	)
+	defer server.Close()
+	elsewhere := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	scenario, err := runner.ParseScenario([]byte(`{"steps": [{"name": "other", "url": "` + elsewhere + `/"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range []runner.LoadTestArgs{
+		{Workers: 1, Qps: 100, MaxRequests: 3},
+		{VUs: 1, Iterations: 3},
+		{VUs: 1, Iterations: 3, Scenario: scenario},
+	} {
+		args.HostPolicy = &runner.HostPolicy{Deny: []string{"localhost"}}
+		args.OutputFile = filepath.Join(t.TempDir(), "results.csv")
+		r := runner.NewRunner(server.URL, args)
+		if err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if s := r.Summary(); s.Failed != 3 {
+			t.Errorf("got: %d failed, want requests to a denied host refused", s.Failed)
+		}
+	}
+
+	r := runner.NewRunner(server.URL, runner.LoadTestArgs{
+		VUs:          1,
+		Iterations:   3,
+		ShadowTarget: elsewhere,
+		HostPolicy:   &runner.HostPolicy{Deny: []string{"localhost"}},
+		OutputFile:   filepath.Join(t.TempDir(), "results.csv"),
+	})
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if s := r.Summary().Shadow; s == nil || s.Failed != 3 {
+		t.Errorf("got: %+v, want shadow requests to a denied host refused", s)
+	}
+	if n := denied.Load(); n != 0 {
+		t.Fatalf("got: %d requests to the denied host, want none", n)
+	}
+}
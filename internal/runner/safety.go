@@ -0,0 +1,153 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// HostPolicy guards against load testing the wrong host, e.g. production by accident. Patterns
+// match host names case-insensitively, with "*" matching any characters, e.g. "*.prod.example.com".
+// The runner checks the host of every request against it, wherever its URL came from, e.g. a
+// redirect or a scenario step.
+type HostPolicy struct {
+	Allow      []string // Hosts that can be targeted [empty = any]
+	Deny       []string // Hosts that can't be targeted
+	Production []string // Hosts that can only be targeted once confirmed
+
+	ConfirmAll bool     // Whether all production hosts are confirmed
+	Confirmed  []string // Production hosts confirmed to be load tested
+
+	checked sync.Map // Errors of the hosts already checked by host, nil if they can be targeted
+}
+
+// Empty returns whether the policy allows any host.
+func (p *HostPolicy) Empty() bool {
+	return p == nil || (len(p.Allow) == 0 && len(p.Deny) == 0 && len(p.Production) == 0)
+}
+
+// ParseHostPatterns parses a comma-separated list of host patterns.
+func ParseHostPatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(p), "."))
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q", p)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// Check checks a target URL against the policy. The target's host and the canonical name it
+// resolves to are both checked, so an alias of a production host is one too. It returns whether
+// the target is a production host, and an error if it can't be targeted at all.
+func (p *HostPolicy) Check(ctx context.Context, target string) (bool, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false, err
+	}
+	return p.checkHost(ctx, u.Hostname())
+}
+
+func (p *HostPolicy) checkHost(ctx context.Context, host string) (bool, error) {
+	hosts := []string{normalizeHost(host)}
+	if net.ParseIP(host) != nil {
+		// IP addresses have no canonical name to look up.
+	} else if cname, err := net.DefaultResolver.LookupCNAME(ctx, host); err == nil {
+		if cname = normalizeHost(cname); cname != hosts[0] {
+			hosts = append(hosts, cname)
+		}
+	}
+
+	production := false
+	for _, host := range hosts {
+		if matchHost(p.Deny, host) {
+			return false, fmt.Errorf("target host %s is denied", host)
+		}
+		production = production || matchHost(p.Production, host)
+	}
+	if len(p.Allow) > 0 && !matchHost(p.Allow, hosts[0]) {
+		return false, fmt.Errorf("target host %s isn't allowed", hosts[0])
+	}
+	return production, nil
+}
+
+// Allowed returns an error if requests can't be sent to a target URL's host, see allow.
+func (p *HostPolicy) Allowed(ctx context.Context, target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	return p.allow(ctx, u.Hostname())
+}
+
+// allow returns an error if a request can't be sent to a host: it's denied, not allowed, or a
+// production host that wasn't confirmed. Hosts are only checked once.
+func (p *HostPolicy) allow(ctx context.Context, host string) error {
+	if err, ok := p.checked.Load(host); ok {
+		if err == nil {
+			return nil
+		}
+		return err.(error)
+	}
+	production, err := p.checkHost(ctx, host)
+	if err == nil && production && !p.ConfirmAll && !slices.ContainsFunc(p.Confirmed, func(c string) bool { return normalizeHost(c) == normalizeHost(host) }) {
+		err = fmt.Errorf("target host %s is a production host that wasn't confirmed", host)
+	}
+	p.checked.Store(host, err)
+	return err
+}
+
+// hostGuard refuses to send requests to the hosts its policy doesn't let be targeted.
+type hostGuard struct {
+	policy *HostPolicy
+	base   http.RoundTripper
+}
+
+// guardHosts returns the transport to send requests with, checking their hosts against the
+// -allow_hosts, -deny_hosts and -production_hosts policy if there is one.
+func (r *Runner) guardHosts(base http.RoundTripper) http.RoundTripper {
+	if r.args.HostPolicy.Empty() {
+		return base
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &hostGuard{policy: r.args.HostPolicy, base: base}
+}
+
+func (g *hostGuard) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := g.policy.allow(req.Context(), req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+	return g.base.RoundTrip(req)
+}
+
+func (g *hostGuard) CloseIdleConnections() {
+	if c, ok := g.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
+	return false
+}
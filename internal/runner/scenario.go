@@ -0,0 +1,566 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Scenario is a sequence of steps each virtual user sends in turn, e.g. to create an order and
+// then fetch it, instead of the same request every time. Values extracted from a step's response
+// are variables of the next steps' templates, and can be asserted on, to check the target responds
+// correctly under load. Create one with LoadScenario or ParseScenario.
+type Scenario struct {
+	Steps []*ScenarioStep `json:"steps"`
+
+	// Lua file defining beforeRequest and afterResponse hooks, called with each step's request
+	// before it's sent and with its response, e.g. to sign requests or decide the next step.
+	Script string `json:"script,omitempty"`
+
+	script *lua.FunctionProto
+	names  map[string]int // Index of each step by name
+}
+
+// ScenarioStep is a request of a scenario. The URL, headers and body are templates filled in with
+// the feeder row of the iteration and the values extracted by the previous steps.
+type ScenarioStep struct {
+	Name    string            `json:"name"` // Recorded as the step of its results, unique within the scenario
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url"` // Absolute, or a path appended to the target
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Status  int               `json:"status,omitempty"` // Expected status code [0 = any 2xx or 3xx]
+
+	// Most of the step's requests in flight at once across all virtual users, e.g. for an
+	// expensive endpoint. Virtual users wait their turn, which is counted as queue delay.
+	// [0 = no limit]
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+
+	Extract []Extraction `json:"extract,omitempty"`
+	Assert  []Assertion  `json:"assert,omitempty"`
+	On      []Branch     `json:"on,omitempty"`
+
+	url, body *template
+	headers   map[string]*template
+	slots     chan struct{} // With MaxConcurrency, holds a value for each request in flight
+}
+
+// Extraction extracts a value from a response into a variable, from exactly one of a JSON path,
+// e.g. "$.items[0].id", the first group (or the whole match) of a regular expression on the body,
+// or a header.
+type Extraction struct {
+	Var    string `json:"var"`
+	JSON   string `json:"json,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+	Header string `json:"header,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Assertion checks the value of a variable after a step's extractions. The step fails if it
+// doesn't hold.
+type Assertion struct {
+	Var     string `json:"var"`
+	Equals  string `json:"equals,omitempty"`  // Template the value must equal, e.g. "{{user_id}}"
+	Matches string `json:"matches,omitempty"` // Regular expression the value must match
+
+	equals  *template
+	pattern *regexp.Regexp
+}
+
+// Branch decides what a virtual user does when a step gets one of the given status codes, like a
+// real client reacting to the response, e.g. skipping steps after a 404 or backing off after a
+// 429, instead of going on to the next step. It has exactly one of goto, end or retry. Responses
+// a goto or end branch handles aren't failures, and aren't extracted from or asserted on.
+type Branch struct {
+	Status     []int  `json:"status"`
+	Goto       string `json:"goto,omitempty"`        // Name of the step to go to
+	End        bool   `json:"end,omitempty"`         // End the iteration
+	Retry      string `json:"retry,omitempty"`       // Back off for this long, e.g. "1s", then send the step again
+	MaxRetries int    `json:"max_retries,omitempty"` // Times to retry before the step fails [0 = 3]
+
+	next    int // Index of the goto step
+	backoff time.Duration
+}
+
+// Most steps an iteration runs, so goto branches going back to earlier steps can't loop forever.
+const maxIterationSteps = 1000
+
+// Most of a step's response body kept in memory to extract values from and assert on.
+const maxStepBody = 10 << 20
+
+// LoadScenario loads a scenario from a JSON file.
+func LoadScenario(name string) (*Scenario, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ParseScenario(data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading scenario %s: %s", name, err)
+	}
+	return s, nil
+}
+
+// ParseScenario parses and validates a scenario in JSON.
+func ParseScenario(data []byte) (*Scenario, error) {
+	var s Scenario
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return nil, err
+	}
+	if len(s.Steps) == 0 {
+		return nil, fmt.Errorf("no steps")
+	}
+
+	names := map[string]int{}
+	for i, step := range s.Steps {
+		if step.Name == "" {
+			step.Name = "step" + strconv.Itoa(i+1)
+		}
+		if _, ok := names[step.Name]; ok {
+			return nil, fmt.Errorf("more than one step named %s", step.Name)
+		}
+		names[step.Name] = i
+	}
+	s.names = names
+
+	if s.Script != "" {
+		var err error
+		if s.script, err = compileScript(s.Script); err != nil {
+			return nil, fmt.Errorf("script: %s", err)
+		}
+	}
+
+	for _, step := range s.Steps {
+		if step.URL == "" {
+			return nil, fmt.Errorf("step %s has no url", step.Name)
+		}
+		if step.Method == "" {
+			step.Method = http.MethodGet
+		}
+		if step.Body != "" {
+			if err := ValidateMethodBody(step.Method); err != nil {
+				return nil, fmt.Errorf("step %s: %s", step.Name, err)
+			}
+		}
+		if step.MaxConcurrency < 0 {
+			return nil, fmt.Errorf("step %s: max_concurrency can't be negative", step.Name)
+		}
+		if step.MaxConcurrency > 0 {
+			step.slots = make(chan struct{}, step.MaxConcurrency)
+		}
+		var err error
+		if step.url, err = parseTemplate(step.URL); err != nil {
+			return nil, fmt.Errorf("step %s: url: %s", step.Name, err)
+		}
+		if step.body, err = parseTemplate(step.Body); err != nil {
+			return nil, fmt.Errorf("step %s: body: %s", step.Name, err)
+		}
+		step.headers = make(map[string]*template, len(step.Headers))
+		for name, value := range step.Headers {
+			if step.headers[name], err = parseTemplate(value); err != nil {
+				return nil, fmt.Errorf("step %s: header %s: %s", step.Name, name, err)
+			}
+		}
+
+		for j := range step.Extract {
+			e := &step.Extract[j]
+			sources := 0
+			for _, source := range []string{e.JSON, e.Regex, e.Header} {
+				if source != "" {
+					sources++
+				}
+			}
+			if e.Var == "" || sources != 1 {
+				return nil, fmt.Errorf("step %s: an extraction needs a var and one of json, regex or header", step.Name)
+			}
+			if e.Regex != "" {
+				var err error
+				if e.pattern, err = regexp.Compile(e.Regex); err != nil {
+					return nil, fmt.Errorf("step %s: invalid regex: %s", step.Name, err)
+				}
+			}
+		}
+
+		for j := range step.Assert {
+			a := &step.Assert[j]
+			if a.Var == "" || (a.Equals == "") == (a.Matches == "") {
+				return nil, fmt.Errorf("step %s: an assertion needs a var and one of equals or matches", step.Name)
+			}
+			if a.Equals != "" {
+				var err error
+				if a.equals, err = parseTemplate(a.Equals); err != nil {
+					return nil, fmt.Errorf("step %s: invalid equals: %s", step.Name, err)
+				}
+			} else {
+				var err error
+				if a.pattern, err = regexp.Compile(a.Matches); err != nil {
+					return nil, fmt.Errorf("step %s: invalid matches: %s", step.Name, err)
+				}
+			}
+		}
+
+		for j := range step.On {
+			b := &step.On[j]
+			actions := 0
+			for _, set := range []bool{b.Goto != "", b.End, b.Retry != ""} {
+				if set {
+					actions++
+				}
+			}
+			if len(b.Status) == 0 || actions != 1 {
+				return nil, fmt.Errorf("step %s: a branch needs a status and one of goto, end or retry", step.Name)
+			}
+			if b.Goto != "" {
+				next, ok := names[b.Goto]
+				if !ok {
+					return nil, fmt.Errorf("step %s: no step %s to go to", step.Name, b.Goto)
+				}
+				b.next = next
+			}
+			if b.Retry != "" {
+				var err error
+				if b.backoff, err = time.ParseDuration(b.Retry); err != nil || b.backoff < 0 {
+					return nil, fmt.Errorf("step %s: invalid retry %q, expected a duration to back off for", step.Name, b.Retry)
+				}
+				if b.MaxRetries < 0 {
+					return nil, fmt.Errorf("step %s: max_retries can't be negative", step.Name)
+				}
+				if b.MaxRetries == 0 {
+					b.MaxRetries = 3
+				}
+			}
+		}
+	}
+
+	return &s, nil
+}
+
+// limitsConcurrency returns whether any step of the scenario has a MaxConcurrency.
+func (s *Scenario) limitsConcurrency() bool {
+	if s == nil {
+		return false
+	}
+	for _, step := range s.Steps {
+		if step.slots != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// branch returns the branch of the step for a status code, if any.
+func (step *ScenarioStep) branch(code uint16) *Branch {
+	for i := range step.On {
+		if slices.Contains(step.On[i].Status, int(code)) {
+			return &step.On[i]
+		}
+	}
+	return nil
+}
+
+// runScenario runs an iteration of the scenario for a virtual user, delivering a result for each
+// step. The iteration ends at the first step that fails, since the next ones may depend on it, or
+// as the steps' branches or script decide. It returns false if the test was killed.
+func (r *Runner) runScenario(lt *loadTest, client *http.Client, hooks *scriptHooks, results chan<- *Result) bool {
+	vars := map[string]string{}
+	if r.args.Feeder != nil {
+		for k, v := range r.args.Feeder.Next() {
+			vars[k] = v
+		}
+	}
+
+	steps := r.args.Scenario.Steps
+	retries := 0
+	for i, n := 0, 0; i < len(steps) && n < maxIterationSteps; n++ {
+		result, branch := r.runStep(lt, steps[i], client, hooks, vars)
+		r.recordHealth(result)
+		if r.cancelled(result) {
+			return false
+		}
+		r.deliver(results, result)
+		switch {
+		case branch == nil:
+			if !isSuccess(result) {
+				return true
+			}
+			i, retries = i+1, 0
+		case branch.End:
+			return true
+		case branch.Retry != "":
+			if retries == branch.MaxRetries {
+				return true
+			}
+			retries++
+			t := time.NewTimer(branch.backoff)
+			select {
+			case <-t.C:
+			case <-r.ctx.Done():
+				t.Stop()
+				return false
+			}
+		default:
+			i, retries = branch.next, 0
+		}
+	}
+	return true
+}
+
+// runStep sends a step's request, returning its result and the branch its status code or the
+// script's afterResponse hook takes, if any. hooks is nil without a script.
+func (r *Runner) runStep(lt *loadTest, step *ScenarioStep, client *http.Client, hooks *scriptHooks, vars map[string]string) (*Result, *Branch) {
+	result := r.newResult(lt, r.lanes[0])
+	result.Step = step.Name
+
+	trace := &requestTrace{}
+	tracked := func() {}
+	var end time.Time // When the response was read, so the afterResponse hook isn't timed
+	defer func() {
+		tracked()
+		if end.IsZero() {
+			end = time.Now()
+		}
+		result.Latency = end.Sub(result.Timestamp)
+		result.TTFB = trace.timeToFirstByte(result.Timestamp)
+		result.Connect = trace.connectLatency()
+		result.Connection = trace.connection()
+		result.TLSHandshake, result.TLSVersion, result.Resumed = trace.tlsHandshake()
+	}()
+
+	if step.slots != nil {
+		select {
+		case step.slots <- struct{}{}:
+		case <-r.ctx.Done():
+			result.fail(r.ctx.Err())
+			return result, nil
+		}
+		defer func() { <-step.slots }()
+		wait := time.Since(result.Timestamp)
+		result.Timestamp = result.Timestamp.Add(wait)
+		result.QueueDelay += wait
+	}
+
+	target := step.url.render(r.rand, vars)
+	if strings.HasPrefix(target, "/") {
+		target = strings.TrimSuffix(r.target, "/") + target
+	}
+	var body io.Reader
+	var bodyText string
+	if step.Body != "" {
+		bodyText = step.body.render(r.rand, vars)
+		body = strings.NewReader(bodyText)
+	}
+	req, err := http.NewRequestWithContext(r.ctx, step.Method, target, body)
+	if err != nil {
+		result.fail(err)
+		return result, nil
+	}
+	if r.mixedSchemes {
+		result.Scheme = req.URL.Scheme
+	}
+	r.setHeaders(req, vars)
+	for name, value := range step.headers {
+		setHeader(req, name, value.render(r.rand, vars))
+	}
+	if r.args.IdempotencyKey {
+		setIdempotencyKey(req)
+	}
+	if hooks != nil && hooks.before != nil {
+		start := time.Now()
+		err := hooks.beforeRequest(step.Name, req, bodyText, vars)
+		// As with waiting for a slot, the hook's time isn't the request's.
+		result.Timestamp = result.Timestamp.Add(time.Since(start))
+		if err != nil {
+			result.failAssertion(err.Error())
+			return result, nil
+		}
+	}
+	if r.args.Verbose {
+		result.Method, result.URL = req.Method, req.URL.String()
+	}
+	ctx, tracked := r.trackBackend(httptrace.WithClientTrace(req.Context(), trace.clientTrace()), result)
+	req = req.WithContext(ctx)
+
+	if !r.clientDelay() {
+		result.fail(r.ctx.Err())
+		return result, nil
+	}
+	res, err := r.do(client, req, result)
+	if err != nil {
+		result.fail(err)
+		return result, nil
+	}
+	defer res.Body.Close()
+	result.CacheStatus = cacheStatus(res.Header)
+
+	trace.setPhase(phaseReadingBody)
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxStepBody))
+	result.Bytes = int64(len(data))
+	if err == nil {
+		// Only the start of a larger body is extracted from, the rest is read to time it.
+		var n int64
+		n, err = io.Copy(io.Discard, res.Body)
+		result.Bytes += n
+	}
+	if err != nil {
+		result.fail(err)
+		return result, nil
+	}
+
+	result.Code = uint16(res.StatusCode)
+	if hooks != nil && hooks.after != nil {
+		end = time.Now()
+		ret, err := hooks.afterResponse(step.Name, res, data, vars)
+		if err == nil {
+			var branch *Branch
+			if branch, err = r.args.Scenario.scriptBranch(ret); branch != nil {
+				return result, branch
+			}
+		}
+		if err != nil {
+			result.failAssertion(err.Error())
+			return result, nil
+		}
+	}
+	if branch := step.branch(result.Code); branch != nil {
+		if branch.Retry != "" {
+			// Rejected, e.g. rate limited, until the retry succeeds.
+			result.failStatus(res.Status)
+		}
+		return result, branch
+	}
+	if ok := res.StatusCode == step.Status || step.Status == 0 && result.Code >= 200 && result.Code < 400; !ok {
+		result.failStatus(res.Status)
+		return result, nil
+	}
+
+	for _, e := range step.Extract {
+		value, ok := e.extract(res, data)
+		if !ok {
+			result.failAssertion(fmt.Sprintf("extract %s: no match", e.Var))
+			return result, nil
+		}
+		vars[e.Var] = value
+	}
+	for _, a := range step.Assert {
+		if err := a.check(r.rand, vars); err != nil {
+			result.failAssertion(err.Error())
+			return result, nil
+		}
+	}
+
+	return result, nil
+}
+
+func (e *Extraction) extract(res *http.Response, body []byte) (string, bool) {
+	switch {
+	case e.Header != "":
+		v := res.Header.Get(e.Header)
+		return v, v != ""
+	case e.pattern != nil:
+		m := e.pattern.FindSubmatch(body)
+		if m == nil {
+			return "", false
+		}
+		if len(m) > 1 {
+			return string(m[1]), true
+		}
+		return string(m[0]), true
+	default:
+		data, err := decodeJSON(body)
+		if err != nil {
+			return "", false
+		}
+		return jsonValue(jsonPath(data, e.JSON))
+	}
+}
+
+func (a *Assertion) check(rng *rand.Rand, vars map[string]string) error {
+	value, ok := vars[a.Var]
+	if !ok {
+		return fmt.Errorf("assert %s: not set", a.Var)
+	}
+	if a.equals != nil {
+		if want := a.equals.render(rng, vars); value != want {
+			return fmt.Errorf("assert %s: got %q, want %q", a.Var, value, want)
+		}
+		return nil
+	}
+	if !a.pattern.MatchString(value) {
+		return fmt.Errorf("assert %s: %q doesn't match %q", a.Var, value, a.Matches)
+	}
+	return nil
+}
+
+// jsonPath returns the value at a JSON path of decoded JSON, e.g. "$.items[0].id". The leading
+// "$." is optional.
+// decodeJSON decodes a JSON document with its numbers as json.Number, so IDs beyond 2^53 aren't
+// rounded to the nearest float64.
+func decodeJSON(body []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var data any
+	if err := dec.Decode(&data); err != nil {
+		return nil, err
+	}
+	// Like json.Unmarshal, anything after the document is an error.
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid character after top-level value")
+	}
+	return data, nil
+}
+
+func jsonPath(data any, path string) any {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	for _, key := range strings.Split(path, ".") {
+		name, indexes, _ := strings.Cut(key, "[")
+		if name != "" {
+			data = jsonField(data, name)
+		}
+		for indexes != "" {
+			var index string
+			index, indexes, _ = strings.Cut(indexes, "]")
+			indexes = strings.TrimPrefix(indexes, "[")
+			arr, ok := data.([]any)
+			i, err := strconv.Atoi(index)
+			if !ok || err != nil || i < 0 || i >= len(arr) {
+				return nil
+			}
+			data = arr[i]
+		}
+	}
+	return data
+}
+
+// jsonValue formats a decoded JSON value as a variable. Objects and arrays are formatted as JSON.
+func jsonValue(v any) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case json.Number:
+		// As it is in the document, e.g. a 64-bit ID.
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		data, err := json.Marshal(v)
+		return string(data), err == nil
+	}
+}
@@ -0,0 +1,123 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// How often the rate follows the schedule.
+const scheduleInterval = time.Second
+
+// RateSchedule is a rate for windows of the time of day, e.g. a higher rate during business
+// hours, for soak tests running for days to follow a daily traffic pattern.
+type RateSchedule struct {
+	windows []scheduleWindow
+}
+
+type scheduleWindow struct {
+	start, end time.Duration // Since midnight, the end before the start if it wraps past midnight
+	rate       float64
+}
+
+// ParseRateSchedule parses comma-separated windows of the time of day in the local time zone and
+// their rates, e.g. "06:00-09:00 -> 2000qps, 09:00-18:00 -> 5000qps". Rates are as for -rate, and
+// a window can wrap past midnight, e.g. "22:00-06:00 -> 100".
+func ParseRateSchedule(s string) (*RateSchedule, error) {
+	schedule := &RateSchedule{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		window, rate, ok := strings.Cut(entry, "->")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule entry %q, expected \"HH:MM-HH:MM -> rate\"", entry)
+		}
+		from, to, ok := strings.Cut(strings.TrimSpace(window), "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule entry %q, expected \"HH:MM-HH:MM -> rate\"", entry)
+		}
+		start, err := parseTimeOfDay(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule entry %q: %s", entry, err)
+		}
+		end, err := parseTimeOfDay(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule entry %q: %s", entry, err)
+		}
+		if start == end {
+			return nil, fmt.Errorf("invalid schedule entry %q, the window is empty", entry)
+		}
+		qps, err := ParseRate(strings.TrimSuffix(strings.TrimSpace(rate), "qps"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule entry %q: %s", entry, err)
+		}
+		schedule.windows = append(schedule.windows, scheduleWindow{start: start, end: end, rate: qps})
+	}
+	if len(schedule.windows) == 0 {
+		return nil, fmt.Errorf("empty schedule")
+	}
+	return schedule, nil
+}
+
+// parseTimeOfDay parses a time of day, e.g. "06:00", "6:00" or "24:00", into the time since
+// midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 || len(s) > 5 {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// windowAt returns the index of the first window a time is in, or -1 if it's in none.
+func (s *RateSchedule) windowAt(t time.Time) int {
+	year, month, day := t.Date()
+	since := t.Sub(time.Date(year, month, day, 0, 0, 0, 0, t.Location()))
+	for i, w := range s.windows {
+		if w.start < w.end && since >= w.start && since < w.end {
+			return i
+		}
+		if w.start > w.end && (since >= w.start || since < w.end) {
+			return i
+		}
+	}
+	return -1
+}
+
+// rateAt returns the rate of the first window a time is in, or false if it's in none.
+func (s *RateSchedule) rateAt(t time.Time) (float64, bool) {
+	if i := s.windowAt(t); i >= 0 {
+		return s.windows[i].rate, true
+	}
+	return 0, false
+}
+
+// scheduleRate returns the rate of -rate_schedule now, or -qps outside its windows.
+func (r *Runner) scheduleRate(now time.Time) float64 {
+	if rate, ok := r.args.RateSchedule.rateAt(now); ok {
+		return rate
+	}
+	return r.args.Qps
+}
+
+// followRateSchedule changes the rate to follow -rate_schedule until the test stops, starting in
+// the given window. The rate only changes when the window does, so a rate set in between, e.g.
+// with the keyboard or a reload, lasts until the next window starts or ends.
+func (r *Runner) followRateSchedule(window int) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopch:
+			return
+		case now := <-ticker.C:
+			if w := r.args.RateSchedule.windowAt(now); w != window {
+				window = w
+				r.SetQps(r.scheduleRate(now))
+			}
+		}
+	}
+}
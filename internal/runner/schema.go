@@ -0,0 +1,282 @@
+package runner
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// SchemaVersion is the version of the output formats, written at the start of every output. It's
+// incremented whenever a field is added, removed or changes meaning, so parsers can detect
+// outputs they weren't written for.
+//
+// Version 4 added, among others, the connection, TLS and cache details of results, their scheme,
+// step and chaos, reconnects, outliers, alerts, the resumed test and the seed, and durations in
+// the -latency_unit.
+const SchemaVersion = 4
+
+const EventSchema = "schema"
+
+// SchemaField is a field of an output format.
+type SchemaField struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+// SchemaFormat is the definition of an output format.
+type SchemaFormat struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Fields      []SchemaField `json:"fields"`
+}
+
+// Schema is the definition of every output format.
+type Schema struct {
+	Version     int            `json:"schema_version"`
+	LatencyUnit string         `json:"latency_unit"` // Of the durations
+	Formats     []SchemaFormat `json:"formats"`
+}
+
+// The type of durations in nanoseconds, replaced by that of the -latency_unit.
+const durationField = "integer (nanoseconds)"
+
+// resultColumns are the columns of the CSV output, in order.
+var resultColumns = []SchemaField{
+	{"timestamp", "integer", "When the request was sent, in nanoseconds since the Unix epoch"},
+	{"code", "integer", "HTTP status code, 0 if there was no response"},
+	{"latency", durationField, "Latency"},
+	{"error", "string", "Error, empty if the request succeeded"},
+	{"seq", "integer", "Sequence number of the request"},
+	{"tag", "string", "Value of -tag"},
+	{"queue_delay", durationField, "Time the request waited to be sent after it was due"},
+	{"failure_kind", "string", "Kind of failure: timeout, dns, refused, reset, tls, http, assertion or other. Empty if the request succeeded"},
+}
+
+// sqliteRunColumns are the columns of the runs table of a SQLite output. Its durations are always in
+// nanoseconds, whatever the -latency_unit.
+var sqliteRunColumns = []SchemaField{
+	{"run_id", "string", "ID of the test, the primary key"},
+	{"schema_version", "integer", "Schema version of the test's output"},
+	{"target", "string", "Target of the test"},
+	{"started_at", "integer", "When the test started, in nanoseconds since the Unix epoch"},
+	{"ended_at", "integer", "When the test ended, in nanoseconds since the Unix epoch. Null if it didn't finish"},
+	{"stop_reason", "string", "Why the test stopped early, empty if it didn't"},
+	{"requests", "integer", "Number of requests"},
+	{"failed", "integer", "Number of failed requests"},
+	{"error_rate", "number", "Fraction of the requests that failed"},
+	{"throughput", "number", "Completed requests per second"},
+	{"p50_ns", "integer", "Median latency in nanoseconds"},
+	{"p99_ns", "integer", "99th percentile latency in nanoseconds"},
+	{"config", "string", "Config of the test as JSON"},
+	{"summary", "string", "Summary of the test as JSON, with durations in nanoseconds. Null if it didn't finish"},
+}
+
+// sqliteResultColumns are the columns of the results table of a SQLite output.
+var sqliteResultColumns = []SchemaField{
+	{"run_id", "string", "ID of the test the result is from, in the runs table"},
+	{"timestamp", "integer", "When the request was sent, in nanoseconds since the Unix epoch"},
+	{"code", "integer", "HTTP status code, 0 if there was no response"},
+	{"latency_ns", "integer", "Latency in nanoseconds"},
+	{"error", "string", "Error, empty if the request succeeded"},
+	{"seq", "integer", "Sequence number of the request"},
+	{"tag", "string", "Value of -tag"},
+	{"queue_delay_ns", "integer", "Time the request waited to be sent after it was due, in nanoseconds"},
+	{"failure_kind", "string", "Kind of failure: timeout, dns, refused, reset, tls, http, assertion or other. Empty if the request succeeded"},
+	{"step", "string", "Name of the scenario step that sent the request, empty without -scenario"},
+}
+
+// heatmapColumns are the columns of a CSV heatmap file, in order.
+var heatmapColumns = []SchemaField{
+	{"start", durationField, "Start of the time bucket since the start of the test"},
+	{"latency_bound", durationField, "Upper bound of the latency bucket, empty for the overflow bucket"},
+	{"count", "integer", "Number of results in the cell"},
+}
+
+// OutputSchema returns the definition of every output format, with durations in a -latency_unit
+// [empty = nanoseconds]. The fields of JSON formats are listed with their paths, e.g.
+// "summary.latency.p99".
+func OutputSchema(unit string) Schema {
+	if unit == "" {
+		unit = LatencyUnitNs
+	}
+	schema := Schema{
+		Version:     SchemaVersion,
+		LatencyUnit: unit,
+		Formats: []SchemaFormat{
+			{
+				Name:        "csv",
+				Description: "Results output with -output_format csv, one line per result after a \"# schema_version\" comment and a header line",
+				Fields:      resultColumns,
+			},
+			{
+				Name:        "events",
+				Description: "NDJSON results output with -output_format events, starting with a schema event",
+				Fields:      jsonFields(reflect.TypeOf(Event{}), ""),
+			},
+			{
+				Name:        "summary",
+				Description: "JSON file written with -summary_file",
+				Fields:      jsonFields(reflect.TypeOf(Summary{}), ""),
+			},
+			{
+				Name:        "heatmap-csv",
+				Description: "Heatmap file written with -heatmap_file, one line per non-empty cell after a \"# schema_version\" comment and a header line",
+				Fields:      heatmapColumns,
+			},
+			{
+				Name:        "heatmap-json",
+				Description: "Heatmap file written with -heatmap_file ending in .json",
+				Fields:      jsonFields(reflect.TypeOf(Heatmap{}), ""),
+			},
+			{
+				Name:        "stats-csv",
+				Description: "Stats file written with -stats_file, one line per interval after a \"# schema_version\" comment and a header line",
+				Fields:      statsColumns,
+			},
+			{
+				Name:        "stats-json",
+				Description: "Stats file written with -stats_file ending in .json",
+				Fields:      jsonFields(reflect.TypeOf(IntervalStats{}), ""),
+			},
+			{
+				Name:        "find-max",
+				Description: "JSON file written with find-max -summary_file",
+				Fields:      jsonFields(reflect.TypeOf(FindMaxResult{}), ""),
+			},
+			{
+				Name:        "sqlite-runs",
+				Description: "Table of the tests written to an -output_file ending in .db, .sqlite or .sqlite3, one row per test",
+				Fields:      sqliteRunColumns,
+			},
+			{
+				Name:        "sqlite-results",
+				Description: "Table of the results written to an -output_file ending in .db, .sqlite or .sqlite3, one row per result, indexed by run_id and timestamp and by run_id and code",
+				Fields:      sqliteResultColumns,
+			},
+		},
+	}
+	if unit == LatencyUnitNs {
+		return schema
+	}
+
+	inUnit := "string (Go duration, e.g. \"1.5ms\")"
+	if unit != LatencyUnitHuman {
+		inUnit = "number (" + map[string]string{LatencyUnitUs: "microseconds", LatencyUnitMs: "milliseconds", LatencyUnitS: "seconds"}[unit] + ")"
+	}
+	for i, f := range schema.Formats {
+		fields := make([]SchemaField, len(f.Fields))
+		for j, field := range f.Fields {
+			field.Type = strings.ReplaceAll(field.Type, durationField, inUnit)
+			fields[j] = field
+		}
+		schema.Formats[i].Fields = fields
+	}
+	return schema
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// jsonFields lists the fields a value of type t is encoded to as JSON, recursing into objects and
+// arrays of objects.
+func jsonFields(t reflect.Type, prefix string) []SchemaField {
+	var fields []SchemaField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		name, _, _ := strings.Cut(tag, ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			fields = append(fields, jsonFields(f.Type, prefix)...)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		name = prefix + name
+
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		fields = append(fields, SchemaField{Name: name, Type: jsonType(ft)})
+
+		switch {
+		case ft.Kind() == reflect.Struct && ft != timeType:
+			fields = append(fields, jsonFields(ft, name+".")...)
+		case (ft.Kind() == reflect.Slice || ft.Kind() == reflect.Map) && ft.Elem().Kind() == reflect.Struct && ft.Elem() != timeType:
+			fields = append(fields, jsonFields(ft.Elem(), name+"[].")...)
+		}
+	}
+	return fields
+}
+
+func jsonType(t reflect.Type) string {
+	switch {
+	case t == durationType:
+		return durationField
+	case t == timeType:
+		return "string (RFC 3339 time)"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "string (base64)"
+		}
+		return "array of " + jsonType(t.Elem())
+	case reflect.Map:
+		return "object of " + jsonType(t.Elem())
+	case reflect.Struct:
+		return "object"
+	default:
+		return "any"
+	}
+}
+
+// writeCSVPreamble writes the schema version comment and the header line of a CSV output, with a
+// comment of the unit of its durations if they're not in nanoseconds.
+func writeCSVPreamble(w io.Writer, columns []SchemaField, unit string) error {
+	if _, err := fmt.Fprintf(w, "# schema_version: %d\n", SchemaVersion); err != nil {
+		return err
+	}
+	if unit != "" && unit != LatencyUnitNs {
+		if _, err := fmt.Fprintf(w, "# latency_unit: %s\n", unit); err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(columns))
+	for _, c := range columns {
+		names = append(names, c.Name)
+	}
+	enc := csv.NewWriter(w)
+	enc.Write(names)
+	enc.Flush()
+	return enc.Error()
+}
+
+// writePreamble writes what a results output starts with, so it describes its schema: a CSV
+// preamble, or a schema event.
+func (r *Runner) writePreamble(w io.Writer) error {
+	if r.args.OutputFormat == OutputFormatEvents {
+		return json.NewEncoder(w).Encode(Event{Type: EventSchema, Time: time.Now(), SchemaVersion: SchemaVersion})
+	}
+	return writeCSVPreamble(w, resultColumns, r.args.LatencyUnit)
+}
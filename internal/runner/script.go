@@ -0,0 +1,330 @@
+package runner
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Hooks a scenario's script defines, called with each step's request and response.
+const (
+	beforeRequestHook = "beforeRequest"
+	afterResponseHook = "afterResponse"
+)
+
+// scriptLibs are the Lua libraries scripts can use. io, os and the like aren't opened, so a script
+// can't touch files or run commands.
+var scriptLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+// scriptFunctions are the functions scripts can call besides the libraries', e.g. to sign
+// requests.
+var scriptFunctions = map[string]lua.LGFunction{
+	// hmac_sha256(key, data) returns the hex HMAC-SHA256 of data.
+	"hmac_sha256": func(L *lua.LState) int {
+		mac := hmac.New(sha256.New, []byte(L.CheckString(1)))
+		mac.Write([]byte(L.CheckString(2)))
+		L.Push(lua.LString(hex.EncodeToString(mac.Sum(nil))))
+		return 1
+	},
+	// sha256(data) returns the hex SHA-256 of data.
+	"sha256": func(L *lua.LState) int {
+		sum := sha256.Sum256([]byte(L.CheckString(1)))
+		L.Push(lua.LString(hex.EncodeToString(sum[:])))
+		return 1
+	},
+	// base64(data) returns data in standard base64.
+	"base64": func(L *lua.LState) int {
+		L.Push(lua.LString(base64.StdEncoding.EncodeToString([]byte(L.CheckString(1)))))
+		return 1
+	},
+	// now() returns the Unix time in seconds, with a fraction.
+	"now": func(L *lua.LState) int {
+		L.Push(lua.LNumber(float64(time.Now().UnixNano()) / 1e9))
+		return 1
+	},
+	// json_encode(value) returns a value as JSON.
+	"json_encode": func(L *lua.LState) int {
+		data, err := json.Marshal(fromLua(L.CheckAny(1)))
+		if err != nil {
+			L.RaiseError("json_encode: %s", err)
+		}
+		L.Push(lua.LString(data))
+		return 1
+	},
+	// json_decode(data) returns decoded JSON.
+	"json_decode": func(L *lua.LState) int {
+		data, err := decodeJSON([]byte(L.CheckString(1)))
+		if err != nil {
+			L.RaiseError("json_decode: %s", err)
+		}
+		L.Push(toLua(L, data))
+		return 1
+	},
+}
+
+// compileScript compiles a scenario's Lua script, checking it runs and defines a hook.
+func compileScript(name string) (*lua.FunctionProto, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunk, err := parse.Parse(f, name)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := newScriptHooks(proto)
+	if err != nil {
+		return nil, err
+	}
+	defer h.close()
+	if h.before == nil && h.after == nil {
+		return nil, fmt.Errorf("%s defines neither %s nor %s", name, beforeRequestHook, afterResponseHook)
+	}
+	return proto, nil
+}
+
+// scriptHooks are the hooks of a virtual user's own Lua state, since a state can't be shared
+// between goroutines. Globals a script sets persist across the virtual user's iterations.
+type scriptHooks struct {
+	L             *lua.LState
+	before, after *lua.LFunction // nil if the script doesn't define the hook
+}
+
+// newScriptHooks runs a compiled script in a new Lua state.
+func newScriptHooks(proto *lua.FunctionProto) (*scriptHooks, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range scriptLibs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	for name, fn := range scriptFunctions {
+		L.SetGlobal(name, L.NewFunction(fn))
+	}
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	h := &scriptHooks{L: L}
+	h.before, _ = L.GetGlobal(beforeRequestHook).(*lua.LFunction)
+	h.after, _ = L.GetGlobal(afterResponseHook).(*lua.LFunction)
+	return h, nil
+}
+
+func (h *scriptHooks) close() {
+	h.L.Close()
+}
+
+// beforeRequest calls the script's beforeRequest with a table of the step's name, request and the
+// iteration's variables, and applies the changes it makes to them.
+func (h *scriptHooks) beforeRequest(step string, req *http.Request, body string, vars map[string]string) error {
+	L := h.L
+	t := L.NewTable()
+	t.RawSetString("step", lua.LString(step))
+	t.RawSetString("method", lua.LString(req.Method))
+	t.RawSetString("url", lua.LString(req.URL.String()))
+	t.RawSetString("headers", headerTable(L, req.Header))
+	t.RawSetString("body", lua.LString(body))
+	t.RawSetString("vars", varsTable(L, vars))
+	if err := L.CallByParam(lua.P{Fn: h.before, Protect: true}, t); err != nil {
+		return err
+	}
+	setVars(t.RawGetString("vars"), vars)
+
+	req.Method = lua.LVAsString(t.RawGetString("method"))
+	if target := lua.LVAsString(t.RawGetString("url")); target != req.URL.String() {
+		u, err := url.Parse(target)
+		if err != nil {
+			return fmt.Errorf("%s: invalid url: %s", beforeRequestHook, err)
+		}
+		if req.Host == req.URL.Host {
+			req.Host = u.Host
+		}
+		req.URL = u
+	}
+	headers, ok := t.RawGetString("headers").(*lua.LTable)
+	if !ok {
+		return fmt.Errorf("%s: headers isn't a table", beforeRequestHook)
+	}
+	req.Header = http.Header{}
+	headers.ForEach(func(k, v lua.LValue) {
+		setHeader(req, lua.LVAsString(k), lua.LVAsString(v))
+	})
+	if b := lua.LVAsString(t.RawGetString("body")); b != body {
+		req.Body = io.NopCloser(strings.NewReader(b))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(b)), nil }
+		req.ContentLength = int64(len(b))
+		if b == "" {
+			req.Body, req.GetBody = http.NoBody, nil
+		}
+	}
+	return nil
+}
+
+// afterResponse calls the script's afterResponse with a table of the step's name, response and
+// the iteration's variables, applying the changes it makes to the variables. The hook returns
+// nothing to go on as usual, the name of a step to go to, or false to end the iteration.
+func (h *scriptHooks) afterResponse(step string, res *http.Response, body []byte, vars map[string]string) (lua.LValue, error) {
+	L := h.L
+	t := L.NewTable()
+	t.RawSetString("step", lua.LString(step))
+	t.RawSetString("status", lua.LNumber(res.StatusCode))
+	t.RawSetString("headers", headerTable(L, res.Header))
+	t.RawSetString("body", lua.LString(body))
+	t.RawSetString("vars", varsTable(L, vars))
+	if err := L.CallByParam(lua.P{Fn: h.after, NRet: 1, Protect: true}, t); err != nil {
+		return nil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	setVars(t.RawGetString("vars"), vars)
+	return ret, nil
+}
+
+// headerTable returns headers as a table of their canonical names, with the values of a header
+// set more than once joined by commas.
+func headerTable(L *lua.LState, header http.Header) *lua.LTable {
+	t := L.CreateTable(0, len(header))
+	for name, values := range header {
+		t.RawSetString(name, lua.LString(strings.Join(values, ", ")))
+	}
+	return t
+}
+
+func varsTable(L *lua.LState, vars map[string]string) *lua.LTable {
+	t := L.CreateTable(0, len(vars))
+	for k, v := range vars {
+		t.RawSetString(k, lua.LString(v))
+	}
+	return t
+}
+
+// setVars replaces the variables with those of a hook's table, so a hook can unset them too.
+func setVars(v lua.LValue, vars map[string]string) {
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		return
+	}
+	clear(vars)
+	t.ForEach(func(k, v lua.LValue) {
+		vars[lua.LVAsString(k)] = lua.LVAsString(v)
+	})
+}
+
+// toLua converts decoded JSON to a Lua value. Integers beyond 2^53 are strings, since Lua's
+// numbers are float64s.
+func toLua(L *lua.LState, v any) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case json.Number:
+		f, _ := v.Float64()
+		if math.Abs(f) > 1<<53 && !strings.ContainsAny(string(v), ".eE") {
+			return lua.LString(v)
+		}
+		return lua.LNumber(f)
+	case []any:
+		t := L.CreateTable(len(v), 0)
+		for _, e := range v {
+			t.Append(toLua(L, e))
+		}
+		return t
+	case map[string]any:
+		t := L.CreateTable(0, len(v))
+		for k, e := range v {
+			t.RawSetString(k, toLua(L, e))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+// fromLua converts a Lua value to one to encode as JSON. Tables with only the keys 1 to n are
+// arrays, others are objects.
+func fromLua(v lua.LValue) any {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		f := float64(v)
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil
+		}
+		return f
+	case *lua.LTable:
+		n := v.MaxN()
+		keys := 0
+		v.ForEach(func(lua.LValue, lua.LValue) { keys++ })
+		if n > 0 && n == keys {
+			a := make([]any, n)
+			for i := range a {
+				a[i] = fromLua(v.RawGetInt(i + 1))
+			}
+			return a
+		}
+		m := map[string]any{}
+		v.ForEach(func(k, e lua.LValue) {
+			m[lua.LVAsString(k)] = fromLua(e)
+		})
+		return m
+	}
+	return nil
+}
+
+// scriptBranch returns the branch an afterResponse hook's return value takes, if any.
+func (s *Scenario) scriptBranch(ret lua.LValue) (*Branch, error) {
+	switch ret := ret.(type) {
+	case lua.LString:
+		next, ok := s.names[string(ret)]
+		if !ok {
+			return nil, fmt.Errorf("%s: no step %s to go to", afterResponseHook, ret)
+		}
+		return &Branch{Goto: string(ret), next: next}, nil
+	case lua.LBool:
+		if !ret {
+			return &Branch{End: true}, nil
+		}
+		return nil, nil
+	case *lua.LNilType:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%s returned a %s, expected the name of a step or false", afterResponseHook, ret.Type())
+}
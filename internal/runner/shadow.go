@@ -0,0 +1,133 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ShadowSummary aggregates the requests mirrored to the shadow target. They're not included in
+// the rest of the summary or checked against the thresholds.
+type ShadowSummary struct {
+	Target     string       `json:"target"`
+	Requests   int          `json:"requests"`
+	Failed     int          `json:"failed"`
+	ErrorRate  float64      `json:"error_rate"`
+	Throughput float64      `json:"throughput"`
+	Latency    LatencyStats `json:"latency"`
+	Mismatched int          `json:"mismatched"`        // Responses whose status code differs from the primary target's
+	Dropped    int          `json:"dropped,omitempty"` // Requests not mirrored because too many were already in flight
+}
+
+// shadowMaxInFlight bounds the mirrored requests waiting for a response, so a slow shadow target
+// can't pile up goroutines and connections for the whole test.
+const shadowMaxInFlight = 256
+
+// ParseShadowTarget parses the base URL of a shadow target, e.g. "https://canary.api.com".
+func ParseShadowTarget(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid shadow target %q, expected an http or https URL", s)
+	}
+	return u, nil
+}
+
+type shadowResult struct {
+	primary *Result
+	shadow  *Result
+}
+
+// shadow mirrors requests to a second target, keeping their path and query.
+type shadow struct {
+	target   *url.URL
+	wg       sync.WaitGroup
+	inFlight chan struct{}
+
+	mu      sync.Mutex
+	results []shadowResult
+	dropped int
+}
+
+func newShadow(target *url.URL) *shadow {
+	return &shadow{target: target, inFlight: make(chan struct{}, shadowMaxInFlight)}
+}
+
+// send mirrors a request without waiting for the response, so the shadow target's latency
+// doesn't slow down the primary one. The request is dropped if too many are already in flight.
+func (s *shadow) send(client *http.Client, req *http.Request, primary *Result) {
+	select {
+	case s.inFlight <- struct{}{}:
+	default:
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+		return
+	}
+
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = s.target.Scheme, s.target.Host
+	// A Host header set for the primary target would send the request back to it.
+	req.Host = ""
+	if req.GetBody != nil {
+		// The clone shares the body with the primary request.
+		req.Body, _ = req.GetBody()
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() { <-s.inFlight }()
+
+		result := &Result{Timestamp: time.Now(), Seq: primary.Seq, Tag: primary.Tag}
+		res, err := client.Do(req)
+		if err == nil {
+			_, err = io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			if result.Code = uint16(res.StatusCode); err == nil && (result.Code < 200 || result.Code >= 400) {
+				result.failStatus(res.Status)
+			}
+		}
+		if err != nil {
+			result.fail(err)
+		}
+		result.Latency = time.Since(result.Timestamp)
+
+		s.mu.Lock()
+		s.results = append(s.results, shadowResult{primary: primary, shadow: result})
+		s.mu.Unlock()
+	}()
+}
+
+// summarize waits for the mirrored requests in flight and aggregates all of them.
+func (s *shadow) summarize(elapsed time.Duration) *ShadowSummary {
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := &ShadowSummary{Target: s.target.String(), Requests: len(s.results), Dropped: s.dropped}
+	latencies := make([]time.Duration, 0, len(s.results))
+	for _, r := range s.results {
+		if !isSuccess(r.shadow) {
+			summary.Failed++
+		}
+		if r.shadow.Code != r.primary.Code {
+			summary.Mismatched++
+		}
+		latencies = append(latencies, r.shadow.Latency)
+	}
+	if summary.Requests > 0 {
+		summary.ErrorRate = float64(summary.Failed) / float64(summary.Requests)
+	}
+	if elapsed > 0 {
+		summary.Throughput = float64(summary.Requests) / elapsed.Seconds()
+	}
+	summary.Latency = computeLatencyStats(latencies)
+	return summary
+}
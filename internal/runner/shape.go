@@ -0,0 +1,128 @@
+package runner
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The lowest rate a rate shape is replayed at, since the pacer can't pace a rate of 0.
+const minShapeRate = 0.01
+
+// How often the rate follows the shape.
+const shapeInterval = 100 * time.Millisecond
+
+// RateShape is a request rate over time, e.g. exported from production monitoring, to replay
+// instead of a constant rate. The rate between two points is interpolated linearly.
+type RateShape struct {
+	offsets []time.Duration // Since the first point
+	rates   []float64
+}
+
+// LoadRateShape reads a rate shape from a CSV file of "timestamp,rps" lines, with an optional
+// header line. Timestamps are Unix times in seconds or RFC 3339 times.
+func LoadRateShape(name string) (*RateShape, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading rate shape %s: %s", name, err)
+	}
+
+	type point struct {
+		time time.Time
+		rate float64
+	}
+	var points []point
+	for i, record := range records {
+		if len(record) != 2 {
+			return nil, fmt.Errorf("rate shape %s line %d: expected timestamp,rps", name, i+1)
+		}
+		t, terr := parseShapeTime(strings.TrimSpace(record[0]))
+		rate, rerr := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if terr != nil || rerr != nil || rate < 0 {
+			if i == 0 {
+				// A header line.
+				continue
+			}
+			return nil, fmt.Errorf("rate shape %s line %d: invalid timestamp or rps", name, i+1)
+		}
+		points = append(points, point{t, rate})
+	}
+	if len(points) < 2 {
+		return nil, fmt.Errorf("rate shape %s must have at least two points", name)
+	}
+
+	sort.SliceStable(points, func(i, j int) bool { return points[i].time.Before(points[j].time) })
+	s := &RateShape{}
+	for _, p := range points {
+		s.offsets = append(s.offsets, p.time.Sub(points[0].time))
+		s.rates = append(s.rates, p.rate)
+	}
+	if s.Length() == 0 {
+		return nil, fmt.Errorf("rate shape %s must span some time", name)
+	}
+	return s, nil
+}
+
+func parseShapeTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Length returns the time from the first point of the shape to the last.
+func (s *RateShape) Length() time.Duration {
+	return s.offsets[len(s.offsets)-1]
+}
+
+// rateAt returns the rate at offset t of the shape.
+func (s *RateShape) rateAt(t time.Duration) float64 {
+	i := sort.Search(len(s.offsets), func(i int) bool { return s.offsets[i] > t })
+	switch {
+	case i == 0:
+		return s.rates[0]
+	case i == len(s.offsets):
+		return s.rates[len(s.rates)-1]
+	}
+	from, to := s.offsets[i-1], s.offsets[i]
+	frac := float64(t-from) / float64(to-from)
+	return s.rates[i-1] + frac*(s.rates[i]-s.rates[i-1])
+}
+
+// shapeRate returns the rate of -rate_shape at a point of the test. The shape is stretched or
+// compressed to the test's duration, and scaled by -rate_scale. A resumed test carries on from
+// the point of the shape its run had reached.
+func (r *Runner) shapeRate(elapsed time.Duration) float64 {
+	s := r.args.RateShape
+	duration := r.args.Duration
+	if prev := r.args.Resume; prev != nil {
+		elapsed += prev.Elapsed
+		duration += prev.Elapsed
+	}
+	t := time.Duration(float64(elapsed) * float64(s.Length()) / float64(duration))
+	return max(s.rateAt(t)*r.args.RateScale, minShapeRate)
+}
+
+// followRateShape changes the rate to follow -rate_shape until the test stops.
+func (r *Runner) followRateShape(lt *loadTest) {
+	ticker := time.NewTicker(shapeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopch:
+			return
+		case <-ticker.C:
+			r.SetQps(r.shapeRate(r.activeTime(lt)))
+		}
+	}
+}
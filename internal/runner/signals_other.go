@@ -0,0 +1,12 @@
+//go:build !unix
+
+package runner
+
+import "os"
+
+// Pausing, resuming and reloading via signals are only supported on unix platforms.
+var (
+	pauseSignal  os.Signal
+	resumeSignal os.Signal
+	reloadSignal os.Signal
+)
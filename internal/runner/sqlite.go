@@ -0,0 +1,175 @@
+package runner
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// IsSQLiteOutput returns whether an -output_file is a SQLite database rather than a file of the
+// -output_format, by its extension.
+func IsSQLiteOutput(name string) bool {
+	if strings.Contains(name, "://") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".db", ".sqlite", ".sqlite3":
+		return true
+	}
+	return false
+}
+
+// sqliteSchema creates the tables of a SQLite output, if it doesn't have them yet. Times are in
+// nanoseconds since the Unix epoch, and durations in nanoseconds.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	run_id TEXT PRIMARY KEY,
+	schema_version INTEGER NOT NULL,
+	target TEXT NOT NULL,
+	started_at INTEGER NOT NULL,
+	ended_at INTEGER,
+	stop_reason TEXT,
+	requests INTEGER,
+	failed INTEGER,
+	error_rate REAL,
+	throughput REAL,
+	p50_ns INTEGER,
+	p99_ns INTEGER,
+	config TEXT NOT NULL,
+	summary TEXT
+);
+CREATE INDEX IF NOT EXISTS runs_started_at ON runs (started_at);
+
+CREATE TABLE IF NOT EXISTS results (
+	run_id TEXT NOT NULL REFERENCES runs (run_id),
+	timestamp INTEGER NOT NULL,
+	code INTEGER NOT NULL,
+	latency_ns INTEGER NOT NULL,
+	error TEXT NOT NULL,
+	seq INTEGER NOT NULL,
+	tag TEXT NOT NULL,
+	queue_delay_ns INTEGER NOT NULL,
+	failure_kind TEXT NOT NULL,
+	step TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS results_run_timestamp ON results (run_id, timestamp);
+CREATE INDEX IF NOT EXISTS results_run_code ON results (run_id, code);
+`
+
+const (
+	// Results inserted in a transaction, since committing each one would be far too slow.
+	sqliteBatchSize = 10000
+	// Age at which a batch is committed with the next result, so a test that's killed loses little.
+	sqliteBatchInterval = time.Second
+)
+
+// sqliteOutput writes the results to a SQLite database, with a row of each test in the runs table,
+// so the results of many tests can be compared with SQL. Tests add to the database rather than
+// replacing it, and a resumed test, which keeps its run ID, adds to the results of its run.
+type sqliteOutput struct {
+	db     *sql.DB
+	runID  string
+	tx     *sql.Tx
+	insert *sql.Stmt
+	batch  int       // Results inserted in tx
+	since  time.Time // When tx began
+}
+
+func openSQLiteOutput(name, runID string) (*sqliteOutput, error) {
+	db, err := sql.Open("sqlite", name)
+	if err != nil {
+		return nil, err
+	}
+	// A single connection, so the pragmas apply to every statement.
+	db.SetMaxOpenConns(1)
+	// Wait for other tests writing to the same database rather than fail.
+	if _, err := db.Exec("PRAGMA busy_timeout = 10000"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteOutput{db: db, runID: runID}, nil
+}
+
+// start records the start of the test in the runs table. A resumed test keeps when it first
+// started.
+func (o *sqliteOutput) start(target string, config *LoadTestArgs, start time.Time) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = o.db.Exec(`INSERT INTO runs (run_id, schema_version, target, started_at, config) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (run_id) DO UPDATE SET schema_version = excluded.schema_version, target = excluded.target, config = excluded.config, ended_at = NULL`,
+		o.runID, SchemaVersion, target, start.UnixNano(), string(data))
+	return err
+}
+
+// write inserts a result, committing the results so far when the batch is full or old enough.
+func (o *sqliteOutput) write(result *Result) error {
+	if o.tx == nil {
+		var err error
+		if o.tx, err = o.db.Begin(); err != nil {
+			return err
+		}
+		o.insert, err = o.tx.Prepare(`INSERT INTO results (run_id, timestamp, code, latency_ns, error, seq, tag, queue_delay_ns, failure_kind, step)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		if err != nil {
+			o.tx.Rollback()
+			o.tx = nil
+			return err
+		}
+		o.batch, o.since = 0, time.Now()
+	}
+	_, err := o.insert.Exec(o.runID, result.Timestamp.UnixNano(), result.Code, int64(result.Latency), result.Error,
+		int64(result.Seq), result.Tag, int64(result.QueueDelay), result.FailureKind, result.Step)
+	if err != nil {
+		return err
+	}
+	o.batch++
+	if o.batch >= sqliteBatchSize || time.Since(o.since) >= sqliteBatchInterval {
+		return o.commit()
+	}
+	return nil
+}
+
+func (o *sqliteOutput) commit() error {
+	if o.tx == nil {
+		return nil
+	}
+	o.insert.Close()
+	err := o.tx.Commit()
+	o.tx, o.insert = nil, nil
+	return err
+}
+
+// finish commits the remaining results and records the summary of the test in the runs table.
+func (o *sqliteOutput) finish(s *Summary) error {
+	if err := o.commit(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = o.db.Exec(`UPDATE runs SET ended_at = ?, stop_reason = ?, requests = ?, failed = ?, error_rate = ?, throughput = ?,
+		p50_ns = ?, p99_ns = ?, summary = ? WHERE run_id = ?`,
+		time.Now().UnixNano(), s.StopReason, s.Requests, s.Failed, s.ErrorRate, s.Throughput,
+		int64(s.Latency.P50), int64(s.Latency.P99), string(data), o.runID)
+	return err
+}
+
+// close commits the remaining results, if the test didn't finish, and closes the database.
+func (o *sqliteOutput) close() error {
+	err := o.commit()
+	if cerr := o.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package runner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxSSELine is the longest line of an event stream that can be read.
+const maxSSELine = 1 << 20
+
+// stream opens a Server-Sent Events connection to the target and holds it until the test ends or
+// the server closes it, counting the events received. Its latency is how long it was held.
+func (r *Runner) stream(lt *loadTest, l *lane, client *http.Client) *Result {
+	result := r.newResult(lt, l)
+	defer func() {
+		result.Latency = time.Since(result.Timestamp)
+	}()
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+	if r.args.Duration > 0 {
+		var deadlineCancel context.CancelFunc
+		ctx, deadlineCancel = context.WithTimeout(ctx, r.args.Duration-r.activeTime(lt))
+		defer deadlineCancel()
+	}
+	// Started once ctx is final, so the goroutine doesn't read it while it's reassigned.
+	go func() {
+		select {
+		case <-r.stopch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var vars map[string]string
+	if r.args.Feeder != nil {
+		vars = r.args.Feeder.Next()
+	}
+
+	req, err := r.newTargetRequest(ctx, l, vars, result, nil)
+	if err != nil {
+		result.fail(err)
+		return result
+	}
+	for name, value := range map[string]string{"Accept": "text/event-stream", "Cache-Control": "no-cache"} {
+		if req.Header.Get(name) == "" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	// The connection is held for the rest of the test, so the timeout doesn't apply.
+	c := *client
+	c.Timeout = 0
+
+	if !r.clientDelay() {
+		result.fail(r.ctx.Err())
+		return result
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			result.fail(err)
+		}
+		return result
+	}
+	defer res.Body.Close()
+
+	if result.Code = uint16(res.StatusCode); result.Code != http.StatusOK {
+		result.failStatus(res.Status)
+		return result
+	}
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		result.Error = fmt.Sprintf("unexpected content type %q", ct)
+		result.FailureKind = FailureOther
+		return result
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(nil, maxSSELine)
+	hasData := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// A blank line dispatches the event, unless it only had comments or other fields.
+			if hasData {
+				if result.Events == 0 {
+					result.FirstEvent = time.Since(result.Timestamp)
+				}
+				result.Events++
+			}
+			hasData = false
+		case line == "data" || strings.HasPrefix(line, "data:"):
+			hasData = true
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		result.fail(err)
+	}
+
+	return result
+}
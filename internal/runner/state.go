@@ -0,0 +1,137 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How often the run's state is saved to the state file.
+const stateInterval = 10 * time.Second
+
+// RunState is how far a test got, saved to -state_file while it runs so a test that crashed or
+// was killed can be resumed with -resume instead of restarted from zero.
+type RunState struct {
+	SchemaVersion int           `json:"schema_version"`
+	RunID         string        `json:"run_id"`
+	Seed          int64         `json:"seed"` // Of the random values, reused by the resumed test
+	Target        string        `json:"target"`
+	Started       time.Time     `json:"started"`
+	Elapsed       time.Duration `json:"elapsed"`  // Of the test so far, not counting time paused
+	Seq           uint64        `json:"seq"`      // Sequence number of the next request
+	Requests      int           `json:"requests"` // Results received so far
+	Failed        int           `json:"failed"`
+	Finished      bool          `json:"finished"` // Whether the test ran to its end
+	Saved         time.Time     `json:"saved"`
+}
+
+// LoadRunState reads a state file to resume the test of.
+func LoadRunState(name string) (*RunState, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var s RunState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("error reading state %s: %s", name, err)
+	}
+	if s.Finished {
+		return nil, fmt.Errorf("the test of %s already finished", name)
+	}
+	return &s, nil
+}
+
+// save writes the state to a file, replacing it at once so a crash while saving never leaves it
+// half written.
+func (s *RunState) save(name string) error {
+	s.SchemaVersion, s.Saved = SchemaVersion, time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// Remaining returns whether the state leaves some of a test's duration or requests to run.
+func (s *RunState) Remaining(duration time.Duration, maxRequests uint64) bool {
+	return (duration == 0 || s.Elapsed < duration) && (maxRequests == 0 || s.Seq < maxRequests)
+}
+
+// resumeArgs continues the test of a resumed state: the same run ID and seed, and what's left of
+// the duration and the requests.
+func resumeArgs(args *LoadTestArgs) {
+	s := args.Resume
+	args.RunID = s.RunID
+	if args.Seed == 0 {
+		args.Seed = s.Seed
+	}
+	if args.Duration > 0 {
+		args.Duration -= s.Elapsed
+	}
+	if args.MaxRequests > 0 {
+		args.MaxRequests -= s.Seq
+	}
+}
+
+// runProgress counts the results of the test for its state.
+type runProgress struct {
+	requests, failed int
+	seq              uint64 // Of the next request
+}
+
+func (p *runProgress) add(results []*Result) {
+	for _, result := range results {
+		p.seq = max(p.seq, result.Seq+1)
+		if !isSuccess(result) {
+			p.failed++
+		}
+	}
+	p.requests += len(results)
+}
+
+// runState returns the state of the test, with its progress and that of the run it resumed.
+func (r *Runner) runState(start time.Time, p *runProgress, finished bool) *RunState {
+	s := &RunState{
+		RunID:    r.args.RunID,
+		Seed:     r.args.Seed,
+		Target:   r.target,
+		Started:  start,
+		Seq:      p.seq,
+		Requests: p.requests,
+		Failed:   p.failed,
+		Finished: finished,
+	}
+	r.pausemu.Lock()
+	s.Elapsed = time.Since(start) - r.pausedTotal
+	r.pausemu.Unlock()
+
+	if prev := r.args.Resume; prev != nil {
+		s.Started = prev.Started
+		s.Elapsed += prev.Elapsed
+		s.Seq = max(s.Seq, prev.Seq)
+		s.Requests += prev.Requests
+		s.Failed += prev.Failed
+	}
+	return s
+}
+
+// saveState saves the state of the test to -state_file. Failing to isn't fatal, the test goes on.
+func (r *Runner) saveState(start time.Time, p *runProgress, finished bool) {
+	if err := r.runState(start, p, finished).save(r.args.StateFile); err != nil {
+		fmt.Fprintf(r.console, "Warning: error saving state to %s: %s\n", r.args.StateFile, err)
+	}
+}
@@ -0,0 +1,121 @@
+package runner
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// IntervalStats aggregates the results of each interval of the test, a small and directly
+// plottable alternative to the results output.
+type IntervalStats struct {
+	SchemaVersion int `json:"schema_version"`
+
+	Interval time.Duration `json:"interval"`
+	Rows     []StatsRow    `json:"rows"`
+}
+
+// StatsRow aggregates the results sent during an interval. Intervals without results have a row of
+// zeros, so the rows are evenly spaced.
+type StatsRow struct {
+	Start     time.Duration `json:"start"` // Offset of the interval from the start of the test
+	Requests  int           `json:"requests"`
+	Qps       float64       `json:"qps"`
+	Failed    int           `json:"failed"`
+	ErrorRate float64       `json:"error_rate"`
+	P50       time.Duration `json:"p50"`
+	P95       time.Duration `json:"p95"`
+	P99       time.Duration `json:"p99"`
+	Bytes     int64         `json:"bytes"` // Response bytes received
+}
+
+// statsColumns are the columns of a CSV stats file, in order.
+var statsColumns = []SchemaField{
+	{"start", durationField, "Start of the interval since the start of the test"},
+	{"requests", "integer", "Requests sent during the interval"},
+	{"qps", "number", "Requests sent per second"},
+	{"failed", "integer", "Requests that failed"},
+	{"error_rate", "number", "Fraction of the requests that failed"},
+	{"p50", durationField, "Median latency"},
+	{"p95", durationField, "95th percentile latency"},
+	{"p99", durationField, "99th percentile latency"},
+	{"bytes", "integer", "Response bytes received"},
+}
+
+func buildStats(results []*Result, began time.Time, interval time.Duration) *IntervalStats {
+	var rows []StatsRow
+	var latencies [][]time.Duration
+	for _, r := range results {
+		i := int(r.Timestamp.Sub(began) / interval)
+		for len(rows) <= i {
+			rows = append(rows, StatsRow{Start: time.Duration(len(rows)) * interval})
+			latencies = append(latencies, nil)
+		}
+		rows[i].Requests++
+		if !isSuccess(r) {
+			rows[i].Failed++
+		}
+		rows[i].Bytes += r.Bytes
+		latencies[i] = append(latencies[i], r.Latency)
+	}
+
+	for i := range rows {
+		row := &rows[i]
+		if row.Requests == 0 {
+			continue
+		}
+		row.Qps = float64(row.Requests) / interval.Seconds()
+		row.ErrorRate = float64(row.Failed) / float64(row.Requests)
+		stats := computeLatencyStats(latencies[i])
+		row.P50, row.P95, row.P99 = stats.P50, stats.P95, stats.P99
+	}
+
+	return &IntervalStats{SchemaVersion: SchemaVersion, Interval: interval, Rows: rows}
+}
+
+// writeStatsFile writes the stats as JSON if name ends in ".json", and otherwise as CSV with one
+// line per interval after the preamble.
+func writeStatsFile(name string, s *IntervalStats, unit string) error {
+	if filepath.Ext(name) == ".json" {
+		data, err := json.Marshal(inLatencyUnit(s, unit))
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(name, append(data, '\n'), 0o644)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := writeCSVPreamble(f, statsColumns, unit); err != nil {
+		return err
+	}
+	enc := csv.NewWriter(f)
+	for _, row := range s.Rows {
+		if err := enc.Write([]string{
+			formatDuration(row.Start, unit),
+			strconv.Itoa(row.Requests),
+			strconv.FormatFloat(row.Qps, 'f', -1, 64),
+			strconv.Itoa(row.Failed),
+			strconv.FormatFloat(row.ErrorRate, 'f', -1, 64),
+			formatDuration(row.P50, unit),
+			formatDuration(row.P95, unit),
+			formatDuration(row.P99, unit),
+			strconv.FormatInt(row.Bytes, 10),
+		}); err != nil {
+			return err
+		}
+	}
+	enc.Flush()
+	if err := enc.Error(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,40 @@
+package runner
+
+import "time"
+
+// OnResult registers a function for Run to call with every result as it arrives, so a program
+// embedding the runner can attach metrics, logging or assertions without reading the results
+// itself. Subscribers are called in the order they were registered from Run's goroutine, so they
+// shouldn't block, and mustn't modify the result. They must be registered before Run is called.
+func (r *Runner) OnResult(f func(*Result)) {
+	r.resultSubscribers = append(r.resultSubscribers, f)
+}
+
+// OnInterval registers a function for Run to call with the summary of the results of each
+// Interval of the test, like the interval-summary events. It's called like OnResult's.
+func (r *Runner) OnInterval(f func(*Summary)) {
+	r.intervalSubscribers = append(r.intervalSubscribers, f)
+}
+
+// OnEvent registers a function for Run to call with each event of the test's lifecycle, e.g.
+// run-start, scale-up, interval-summary or run-end, as they'd be written with the "events" output
+// format but whatever the format, so a program embedding the runner can react to them, e.g. start
+// profiling when the workers scale up. Results aren't events, OnResult has them. Calls aren't
+// concurrent, but some come from the scheduler, so subscribers shouldn't block either. They must
+// be registered before Run is called.
+func (r *Runner) OnEvent(f func(Event)) {
+	r.eventSubscribers = append(r.eventSubscribers, f)
+}
+
+// publish calls the event subscribers with an event.
+func (r *Runner) publish(event Event) {
+	if len(r.eventSubscribers) == 0 {
+		return
+	}
+	event.Time = time.Now()
+	r.eventmu.Lock()
+	defer r.eventmu.Unlock()
+	for _, f := range r.eventSubscribers {
+		f(event)
+	}
+}
@@ -0,0 +1,735 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LatencyStats are the latency aggregates of a set of results. Durations are encoded as
+// nanoseconds in JSON, unless the output files use another LatencyUnit.
+type LatencyStats struct {
+	Count int           `json:"count"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P95   time.Duration `json:"p95"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// Summary is the final aggregate of all the results of a test.
+type Summary struct {
+	SchemaVersion int `json:"schema_version"`
+
+	Target      string        `json:"target,omitempty"`
+	Config      *LoadTestArgs `json:"config,omitempty"` // Only set for the final summary
+	Elapsed     time.Duration `json:"elapsed"`
+	StopReason  string        `json:"stop_reason,omitempty"` // Why the test stopped early, if it did
+	Requests    int           `json:"requests"`
+	Dropped     int           `json:"dropped,omitempty"` // Results dropped with the drop results overflow, left out of all the other stats
+	Successful  int           `json:"successful"`
+	Failed      int           `json:"failed"`
+	NotModified int           `json:"not_modified"`
+
+	// Number of failed requests of each kind, e.g. "timeout" or "refused".
+	Failures map[string]int `json:"failures,omitempty"`
+
+	// How much retrying hid failures, when retries are enabled.
+	Retries *RetrySummary `json:"retries,omitempty"`
+
+	ErrorRate  float64 `json:"error_rate"`
+	Throughput float64 `json:"throughput"` // Completed requests per second
+
+	Latency        LatencyStats `json:"latency"`
+	SuccessLatency LatencyStats `json:"success_latency"`
+	FailureLatency LatencyStats `json:"failure_latency"`
+
+	// Time to the first byte of the responses, of the requests that got one.
+	TTFB *LatencyStats `json:"ttfb,omitempty"`
+
+	// Time requests waited between when they were due and when they were sent, when pacing by QPS.
+	QueueDelay *LatencyStats `json:"queue_delay,omitempty"`
+
+	// How far from when requests were due the pacer woke up to send them. Only set for the final
+	// summary.
+	SchedulingError *LatencyStats `json:"scheduling_error,omitempty"`
+
+	// Latency for each status code, keyed by the code. Requests that got no response are
+	// under code "0".
+	Codes map[string]LatencyStats `json:"codes"`
+
+	// Requests sent on new and reused connections, and the fraction reused. Keep-alive silently
+	// broken, e.g. by the target closing connections, shows as a low reuse rate.
+	NewConnections    int     `json:"new_connections,omitempty"`
+	ReusedConnections int     `json:"reused_connections,omitempty"`
+	ReuseRate         float64 `json:"reuse_rate,omitempty"`
+
+	// Setup latencies of new connections and the fraction of TLS sessions resumed.
+	ConnectLatency      *LatencyStats `json:"connect_latency,omitempty"`
+	TLSHandshakeLatency *LatencyStats `json:"tls_handshake_latency,omitempty"`
+	ResumedRate         float64       `json:"resumed_rate,omitempty"`
+
+	// The kernel's TCP statistics of the connections, with -tcp_info. Only set for the final
+	// summary.
+	TCP *TCPSummary `json:"tcp,omitempty"`
+
+	// Number of new TLS connections that negotiated each version, keyed by e.g. "TLS 1.3".
+	TLSVersions map[string]int `json:"tls_versions,omitempty"`
+
+	// Events received on Server-Sent Events connections, in sse mode.
+	SSE *SSESummary `json:"sse,omitempty"`
+
+	// Polls held by the target, in longpoll mode.
+	LongPoll *LongPollSummary `json:"long_poll,omitempty"`
+
+	// Delays of connections that fell back to another address, keyed by kind, e.g. "ipv6->ipv4".
+	Fallbacks map[string]LatencyStats `json:"fallbacks,omitempty"`
+
+	// Aggregates for each target group, keyed by the group's name.
+	Groups map[string]GroupSummary `json:"groups,omitempty"`
+	Steps  map[string]GroupSummary `json:"steps,omitempty"` // Of each step of the scenario, by name
+
+	// Aggregates of the valid requests and each kind of deliberately invalid ones, e.g.
+	// "bad_auth", when some are sent invalid.
+	Classes map[string]GroupSummary `json:"classes,omitempty"`
+
+	// Aggregates of the responses with each cache status, e.g. "hit", and the fraction that were
+	// hits, when any response had cache status headers. Responses without are under "none".
+	Cache        map[string]GroupSummary `json:"cache,omitempty"`
+	CacheHitRate float64                 `json:"cache_hit_rate,omitempty"`
+
+	// Aggregates of the requests cut short on purpose of each kind, e.g. "abort", and of the
+	// others under "none", with -abort_rate or -drop_connection_rate.
+	Chaos map[string]GroupSummary `json:"chaos,omitempty"`
+
+	// Aggregates for each address requests were sent to, with -per_host_qps or -dns_strategy.
+	Backends map[string]GroupSummary `json:"backends,omitempty"`
+
+	// Aggregates for each scheme, "http" and "https", when the targets mix them.
+	Schemes map[string]GroupSummary `json:"schemes,omitempty"`
+
+	// Results that found the results channel full. Only set for the final summary, if any did.
+	Backpressure *Backpressure `json:"backpressure,omitempty"`
+
+	// The state of the test this one resumed, whose results aren't in this summary. Only set for
+	// the final summary.
+	Resumed *RunState `json:"resumed,omitempty"`
+
+	// Virtual users that failed to log in, and so didn't send requests. Only set for the final
+	// summary.
+	LoginFailures uint64 `json:"login_failures,omitempty"`
+
+	// Requests slower than the outlier threshold, written to the outliers file. Only set for the
+	// final summary.
+	Outliers uint64 `json:"outliers,omitempty"`
+
+	// Alerts sent to the alert webhook. Only set for the final summary.
+	Alerts uint64 `json:"alerts,omitempty"`
+
+	// Times each weighted target was ejected for its error rate. Only set for the final summary.
+	Ejections map[string]int `json:"ejections,omitempty"`
+
+	// Requests mirrored to the shadow target. Only set for the final summary.
+	Shadow *ShadowSummary `json:"shadow,omitempty"`
+
+	// The target's own metrics scraped during the test. Only set for the final summary.
+	TargetMetrics *TargetMetricsSummary `json:"target_metrics,omitempty"`
+
+	// The fraction of all requests within each of the latency buckets.
+	LatencyBuckets []LatencyBucket `json:"latency_buckets,omitempty"`
+
+	// The expected latency thresholds, checked against the latency of all results.
+	Thresholds []ThresholdResult `json:"thresholds,omitempty"`
+}
+
+type SSESummary struct {
+	Events     uint64       `json:"events"`
+	EventRate  float64      `json:"event_rate"`  // Events per second across all connections
+	FirstEvent LatencyStats `json:"first_event"` // Time to the first event of connections that got any
+}
+
+type LongPollSummary struct {
+	WithData    int          `json:"with_data"`    // Successful polls that returned a body
+	Empty       int          `json:"empty"`        // Successful polls that returned a 204 or no body, e.g. held until the server's timeout
+	MessageRate float64      `json:"message_rate"` // Polls with data per second across all connections
+	Held        LatencyStats `json:"held"`         // How long successful polls were held
+	Reconnect   LatencyStats `json:"reconnect"`    // Time from each poll returning to the next being sent
+}
+
+type GroupSummary struct {
+	Requests   int          `json:"requests"`
+	Failed     int          `json:"failed"`
+	ErrorRate  float64      `json:"error_rate"`
+	Throughput float64      `json:"throughput"`
+	Latency    LatencyStats `json:"latency"`
+}
+
+func computeLatencyStats(latencies []time.Duration) LatencyStats {
+	stats := LatencyStats{Count: len(latencies)}
+	if len(latencies) == 0 {
+		return stats
+	}
+
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, l := range sorted {
+		total += l
+	}
+
+	stats.Mean = total / time.Duration(len(sorted))
+	stats.P50 = percentile(sorted, 50)
+	stats.P90 = percentile(sorted, 90)
+	stats.P95 = percentile(sorted, 95)
+	stats.P99 = percentile(sorted, 99)
+	stats.Max = sorted[len(sorted)-1]
+
+	return stats
+}
+
+// percentile returns the nearest-rank percentile p of the already sorted latencies: the smallest
+// one that at least p percent of them are less than or equal to.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	// The epsilon keeps floating point error, e.g. in 99.9*1000/100, from rounding up a whole rank.
+	rank := int(math.Ceil(p*float64(len(sorted))/100-1e-9)) - 1
+	rank = max(0, min(rank, len(sorted)-1))
+	return sorted[rank]
+}
+
+func (s LatencyStats) String() string {
+	return fmt.Sprintf("count=%d p50=%s p90=%s p95=%s p99=%s max=%s", s.Count, s.P50, s.P90, s.P95, s.P99, s.Max)
+}
+
+// The fewest requests to warn about keep-alive after, since every connection is new at first.
+const minKeepAliveRequests = 100
+
+// isSuccess returns whether a result is counted as successful: no error was recorded for it. Error
+// status codes are always recorded as errors, unless expected, e.g. by a scenario step's status or
+// an invalid request, and so are failed checks of a 2xx or 3xx response, e.g. a body checksum.
+// Connect mode results have no status code, and succeed when the connection is established.
+func isSuccess(r *Result) bool {
+	return r.Error == ""
+}
+
+func (r *Runner) summarize(results []*Result, elapsed time.Duration) *Summary {
+	s := &Summary{
+		SchemaVersion: SchemaVersion,
+		Elapsed:       elapsed,
+		Requests:      len(results),
+		Dropped:       int(r.backpressure.dropped.Load()),
+		Codes:         map[string]LatencyStats{},
+	}
+
+	var all, successLatencies, failureLatencies []time.Duration
+	codeLatencies := map[uint16][]time.Duration{}
+	fallbacks := map[string][]time.Duration{}
+	var connects, handshakes, queueDelays, ttfbs []time.Duration
+	resumed := 0
+	for _, r := range results {
+		queueDelays = append(queueDelays, r.QueueDelay)
+		if r.TTFB > 0 {
+			ttfbs = append(ttfbs, r.TTFB)
+		}
+		if r.Connect > 0 {
+			connects = append(connects, r.Connect)
+		}
+		if r.TLSHandshake > 0 {
+			handshakes = append(handshakes, r.TLSHandshake)
+		}
+		if r.Resumed {
+			resumed++
+		}
+		switch r.Connection {
+		case ConnectionNew:
+			s.NewConnections++
+		case ConnectionReused:
+			s.ReusedConnections++
+		}
+		if r.TLSVersion != "" {
+			if s.TLSVersions == nil {
+				s.TLSVersions = map[string]int{}
+			}
+			s.TLSVersions[r.TLSVersion]++
+		}
+		if r.Fallback != "" {
+			fallbacks[r.Fallback] = append(fallbacks[r.Fallback], r.FallbackDelay)
+		}
+		if isSuccess(r) {
+			s.Successful++
+			successLatencies = append(successLatencies, r.Latency)
+		} else {
+			s.Failed++
+			failureLatencies = append(failureLatencies, r.Latency)
+			kind := r.FailureKind
+			if kind == "" {
+				kind = FailureOther
+			}
+			if s.Failures == nil {
+				s.Failures = map[string]int{}
+			}
+			s.Failures[kind]++
+		}
+		if r.Code == http.StatusNotModified {
+			s.NotModified++
+		}
+		all = append(all, r.Latency)
+		codeLatencies[r.Code] = append(codeLatencies[r.Code], r.Latency)
+	}
+
+	if len(results) > 0 {
+		s.ErrorRate = float64(s.Failed) / float64(len(results))
+	}
+	if elapsed > 0 {
+		s.Throughput = float64(len(results)) / elapsed.Seconds()
+	}
+
+	if r.args.Retries > 0 {
+		s.Retries = summarizeRetries(results)
+	}
+
+	s.Latency = computeLatencyStats(all)
+	s.SuccessLatency = computeLatencyStats(successLatencies)
+	s.FailureLatency = computeLatencyStats(failureLatencies)
+	for code, latencies := range codeLatencies {
+		s.Codes[strconv.Itoa(int(code))] = computeLatencyStats(latencies)
+	}
+
+	// Virtual users only wait for -per_host_qps and the max_concurrency of scenario steps.
+	if (r.args.VUs == 0 || r.backends != nil || r.args.Scenario.limitsConcurrency()) && len(results) > 0 {
+		stats := computeLatencyStats(queueDelays)
+		s.QueueDelay = &stats
+	}
+
+	if conns := s.NewConnections + s.ReusedConnections; conns > 0 {
+		s.ReuseRate = float64(s.ReusedConnections) / float64(conns)
+	}
+
+	if len(ttfbs) > 0 {
+		stats := computeLatencyStats(ttfbs)
+		s.TTFB = &stats
+	}
+
+	if len(connects) > 0 {
+		stats := computeLatencyStats(connects)
+		s.ConnectLatency = &stats
+	}
+	if len(handshakes) > 0 {
+		stats := computeLatencyStats(handshakes)
+		s.TLSHandshakeLatency = &stats
+		s.ResumedRate = float64(resumed) / float64(len(handshakes))
+	}
+
+	if len(fallbacks) > 0 {
+		s.Fallbacks = map[string]LatencyStats{}
+		for kind, delays := range fallbacks {
+			s.Fallbacks[kind] = computeLatencyStats(delays)
+		}
+	}
+
+	if r.args.Mode == ModeSSE {
+		s.SSE = summarizeSSE(results, elapsed)
+	}
+	if r.args.Mode == ModeLongPoll {
+		s.LongPoll = summarizeLongPoll(results, elapsed)
+	}
+
+	if len(r.args.Groups) > 0 {
+		s.Groups = summarizeGroups(results, elapsed)
+	}
+	if r.args.Scenario != nil {
+		s.Steps = summarizeBy(results, elapsed, func(r *Result) string { return r.Step })
+	}
+	if r.backends != nil {
+		s.Backends = summarizeBy(results, elapsed, func(r *Result) string {
+			if r.Backend == "" {
+				// Failed before an address was picked, e.g. to resolve the host.
+				return "none"
+			}
+			return r.Backend
+		})
+	}
+	if r.mixedSchemes {
+		s.Schemes = summarizeBy(results, elapsed, func(r *Result) string {
+			if r.Scheme == "" {
+				// Failed before the request was created, e.g. to render the target.
+				return "none"
+			}
+			return r.Scheme
+		})
+	}
+	if slices.ContainsFunc(results, func(r *Result) bool { return r.CacheStatus != "" }) {
+		s.Cache = summarizeBy(results, elapsed, func(r *Result) string {
+			if r.CacheStatus == "" {
+				return "none"
+			}
+			return r.CacheStatus
+		})
+		s.CacheHitRate = float64(s.Cache[CacheHit].Requests) / float64(len(results))
+	}
+	if r.args.Chaos != nil {
+		s.Chaos = summarizeBy(results, elapsed, func(r *Result) string {
+			if r.Chaos == "" {
+				return "none"
+			}
+			return r.Chaos
+		})
+	}
+	if r.args.Invalid != nil {
+		s.Classes = summarizeBy(results, elapsed, func(r *Result) string {
+			if r.Invalid == "" {
+				return "valid"
+			}
+			return r.Invalid
+		})
+	}
+
+	if len(r.args.LatencyBuckets) > 0 && len(results) > 0 {
+		s.LatencyBuckets = computeLatencyBuckets(r.args.LatencyBuckets, all)
+	}
+
+	if len(r.args.Thresholds) > 0 && len(results) > 0 {
+		s.Thresholds = checkThresholds(r.args.Thresholds, s.Latency, s.TTFB)
+	}
+
+	return s
+}
+
+func summarizeSSE(results []*Result, elapsed time.Duration) *SSESummary {
+	s := &SSESummary{}
+	var firstEvents []time.Duration
+	for _, r := range results {
+		s.Events += r.Events
+		if r.Events > 0 {
+			firstEvents = append(firstEvents, r.FirstEvent)
+		}
+	}
+	if elapsed > 0 {
+		s.EventRate = float64(s.Events) / elapsed.Seconds()
+	}
+	s.FirstEvent = computeLatencyStats(firstEvents)
+	return s
+}
+
+func summarizeLongPoll(results []*Result, elapsed time.Duration) *LongPollSummary {
+	s := &LongPollSummary{}
+	var held, reconnects []time.Duration
+	for _, r := range results {
+		if r.Reconnect > 0 {
+			reconnects = append(reconnects, r.Reconnect)
+		}
+		if !isSuccess(r) {
+			continue
+		}
+		held = append(held, r.Latency)
+		if r.Code == http.StatusNoContent || r.Bytes == 0 {
+			s.Empty++
+		} else {
+			s.WithData++
+		}
+	}
+	if elapsed > 0 {
+		s.MessageRate = float64(s.WithData) / elapsed.Seconds()
+	}
+	s.Held = computeLatencyStats(held)
+	s.Reconnect = computeLatencyStats(reconnects)
+	return s
+}
+
+func summarizeGroups(results []*Result, elapsed time.Duration) map[string]GroupSummary {
+	return summarizeBy(results, elapsed, func(r *Result) string { return r.Tag })
+}
+
+// summarizeBy aggregates the results by the key of each.
+func summarizeBy(results []*Result, elapsed time.Duration, key func(*Result) string) map[string]GroupSummary {
+	groups := map[string]GroupSummary{}
+	latencies := map[string][]time.Duration{}
+	for _, r := range results {
+		k := key(r)
+		g := groups[k]
+		g.Requests++
+		if !isSuccess(r) {
+			g.Failed++
+		}
+		groups[k] = g
+		latencies[k] = append(latencies[k], r.Latency)
+	}
+
+	for name, g := range groups {
+		g.ErrorRate = float64(g.Failed) / float64(g.Requests)
+		if elapsed > 0 {
+			g.Throughput = float64(g.Requests) / elapsed.Seconds()
+		}
+		g.Latency = computeLatencyStats(latencies[name])
+		groups[name] = g
+	}
+
+	return groups
+}
+
+func printResultSummary(w io.Writer, s *Summary, byCode bool) {
+	if s.Requests == 0 {
+		if s.StopReason != "" {
+			fmt.Fprintf(w, "No requests completed (%s)\n", s.StopReason)
+		} else {
+			fmt.Fprintln(w, "No requests completed")
+		}
+		return
+	}
+	if s.StopReason != "" {
+		fmt.Fprintf(w, "Stopped early: %s\n", s.StopReason)
+	}
+
+	if s.Config != nil && s.Config.RunID != "" {
+		fmt.Fprintf(w, "Run ID: %s\n", s.Config.RunID)
+	}
+	if s.Config != nil && s.Config.MaxRequests > 0 {
+		fmt.Fprintf(w, "Completed Requests: %d of max %d\n", s.Requests, s.Config.MaxRequests)
+	}
+	fmt.Fprintf(w, "Successful Requests: %d, Failed Requests: %d\n", s.Successful, s.Failed)
+	if s.Dropped > 0 {
+		fmt.Fprintf(w, "Dropped Results: %d, sent but left out of the stats below as the results buffer was full\n", s.Dropped)
+	}
+	fmt.Fprintf(w, "Average latency: %s\n", s.Latency.Mean)
+	fmt.Fprintf(w, "Error rate: %.2f%%\n", s.ErrorRate*100)
+	if len(s.Failures) > 0 {
+		var kinds []string
+		for _, kind := range FailureKinds {
+			if n := s.Failures[kind]; n > 0 {
+				kinds = append(kinds, fmt.Sprintf("%s=%d", kind, n))
+			}
+		}
+		fmt.Fprintf(w, "Failures: %s\n", strings.Join(kinds, " "))
+	}
+	fmt.Fprintf(w, "Throughput: %.2f requests/s\n", s.Throughput)
+	if rs := s.Retries; rs != nil {
+		fmt.Fprintf(w, "Retries: %d requests retried %d times, amplification %.2fx, %.2f%% succeeded after retrying",
+			rs.Retried, rs.Retries, rs.Amplification, rs.SuccessAfterRetry*100)
+		if s.Config != nil && s.Config.RetryBudget > 0 {
+			fmt.Fprintf(w, ", retry budget %.2f%% consumed, %d retries denied", rs.BudgetConsumed*100, rs.Denied)
+		}
+		fmt.Fprintln(w)
+	}
+	if s.NotModified > 0 {
+		fmt.Fprintf(w, "Not Modified (304) responses: %d (%.2f%%)\n", s.NotModified, float64(s.NotModified)/float64(s.Requests)*100)
+	}
+
+	// Fast failures (e.g. 503s from a circuit breaker) drag the aggregate down, so report them
+	// separately from successful requests.
+	fmt.Fprintln(w, "Latency percentiles:")
+	fmt.Fprintf(w, "  all:     %s\n", s.Latency)
+	fmt.Fprintf(w, "  success: %s\n", s.SuccessLatency)
+	fmt.Fprintf(w, "  failure: %s\n", s.FailureLatency)
+	if s.TTFB != nil {
+		fmt.Fprintf(w, "  time to first byte: %s\n", s.TTFB)
+	}
+	if s.QueueDelay != nil && s.QueueDelay.Max > 0 {
+		fmt.Fprintf(w, "  queue delay: %s\n", s.QueueDelay)
+	}
+	if s.SchedulingError != nil {
+		fmt.Fprintf(w, "  scheduling error: %s\n", s.SchedulingError)
+	}
+
+	if s.ConnectLatency != nil {
+		fmt.Fprintf(w, "  connect: %s\n", s.ConnectLatency)
+	}
+	if conns := s.NewConnections + s.ReusedConnections; conns > 0 {
+		fmt.Fprintf(w, "Connections: %d requests on new connections, %d on reused ones (%.2f%% reused)\n", s.NewConnections, s.ReusedConnections, s.ReuseRate*100)
+		if s.Config != nil && !s.Config.NewConnections && conns >= minKeepAliveRequests && s.ReuseRate < 0.5 {
+			fmt.Fprintln(w, "Warning: most requests needed a new connection, keep-alive may be broken, e.g. by the target closing connections")
+		}
+	}
+	if s.TLSHandshakeLatency != nil {
+		fmt.Fprintf(w, "  TLS handshake: %s\n", s.TLSHandshakeLatency)
+		fmt.Fprintf(w, "TLS sessions resumed: %.2f%%\n", s.ResumedRate*100)
+	}
+	if len(s.TLSVersions) > 0 {
+		versions := make([]string, 0, len(s.TLSVersions))
+		for v := range s.TLSVersions {
+			versions = append(versions, v)
+		}
+		sort.Strings(versions)
+
+		fmt.Fprint(w, "TLS versions:")
+		for _, v := range versions {
+			fmt.Fprintf(w, " %s=%d", v, s.TLSVersions[v])
+		}
+		fmt.Fprintln(w)
+	}
+
+	if s.TCP != nil && s.TCP.Connections > 0 {
+		fmt.Fprintf(w, "TCP connections: %d, retransmits: %d (in %d connections), mean congestion window: %.1f segments\n", s.TCP.Connections, s.TCP.Retransmits, s.TCP.RetransmittedConns, s.TCP.MeanCongestionWindow)
+		fmt.Fprintf(w, "  RTT: %s\n", s.TCP.RTT)
+	}
+
+	if s.SSE != nil {
+		fmt.Fprintf(w, "Events: %d (%.2f events/s)\n", s.SSE.Events, s.SSE.EventRate)
+		fmt.Fprintf(w, "  time to first event: %s\n", s.SSE.FirstEvent)
+	}
+	if s.LongPoll != nil {
+		fmt.Fprintf(w, "Long polls: %d with data, %d empty (%.2f with data/s)\n", s.LongPoll.WithData, s.LongPoll.Empty, s.LongPoll.MessageRate)
+		fmt.Fprintf(w, "  hold duration: %s\n", s.LongPoll.Held)
+		fmt.Fprintf(w, "  reconnect: %s\n", s.LongPoll.Reconnect)
+	}
+
+	if len(s.Fallbacks) > 0 {
+		kinds := make([]string, 0, len(s.Fallbacks))
+		for kind := range s.Fallbacks {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+
+		fmt.Fprintln(w, "Connection fallbacks (delay before the successful attempt):")
+		for _, kind := range kinds {
+			fmt.Fprintf(w, "  %s: %s\n", kind, s.Fallbacks[kind])
+		}
+	}
+
+	printGroups(w, "Groups", s.Groups)
+	printGroups(w, "Steps", s.Steps)
+	printGroups(w, "Valid and invalid requests", s.Classes)
+	printGroups(w, "Requests cut short", s.Chaos)
+	printBackends(w, s.Backends)
+	printGroups(w, "Schemes", s.Schemes)
+	if len(s.Cache) > 0 {
+		fmt.Fprintf(w, "Cache hit rate: %.2f%%\n", s.CacheHitRate*100)
+		printGroups(w, "Cache statuses", s.Cache)
+	}
+
+	if b := s.Backpressure; b != nil {
+		fmt.Fprintf(w, "Results backpressure: %d results blocked for %s in total, %d dropped. Reading the results couldn't keep up, which may have distorted the test\n", b.Blocked, b.BlockedTime.Round(time.Millisecond), b.Dropped)
+	}
+
+	if s.LoginFailures > 0 {
+		fmt.Fprintf(w, "Login failures: %d virtual users couldn't log in and sent no requests\n", s.LoginFailures)
+	}
+
+	if s.Resumed != nil {
+		fmt.Fprintf(w, "Resumed run %s: %d requests, %d failed, over %s before this one\n", s.Resumed.RunID, s.Resumed.Requests, s.Resumed.Failed, s.Resumed.Elapsed.Round(time.Second))
+	}
+
+	if s.Alerts > 0 {
+		fmt.Fprintf(w, "Alerts: %d sent to the alert webhook\n", s.Alerts)
+	}
+
+	if s.Outliers > 0 {
+		fmt.Fprintf(w, "Latency outliers: %d requests over the threshold, written to the outliers file with their traces\n", s.Outliers)
+	}
+
+	if len(s.Ejections) > 0 {
+		urls := make([]string, 0, len(s.Ejections))
+		for u := range s.Ejections {
+			urls = append(urls, u)
+		}
+		sort.Strings(urls)
+
+		fmt.Fprintln(w, "Target ejections:")
+		for _, u := range urls {
+			fmt.Fprintf(w, "  %s: %d\n", u, s.Ejections[u])
+		}
+	}
+
+	if s.Shadow != nil {
+		fmt.Fprintf(w, "Shadow target %s (not included above):\n", s.Shadow.Target)
+		fmt.Fprintf(w, "  requests=%d error rate=%.2f%% status mismatches=%d %s\n", s.Shadow.Requests, s.Shadow.ErrorRate*100, s.Shadow.Mismatched, s.Shadow.Latency)
+		if s.Shadow.Dropped > 0 {
+			fmt.Fprintf(w, "  dropped=%d (too many mirrored requests in flight)\n", s.Shadow.Dropped)
+		}
+	}
+
+	if s.TargetMetrics != nil {
+		printTargetMetrics(w, s.TargetMetrics)
+	}
+
+	if len(s.LatencyBuckets) > 0 {
+		fmt.Fprintln(w, "Requests within latency:")
+		for _, b := range s.LatencyBuckets {
+			fmt.Fprintf(w, "  <= %s: %.2f%%\n", b.Le, b.Fraction*100)
+		}
+	}
+
+	if len(s.Thresholds) > 0 {
+		fmt.Fprintln(w, "Thresholds:")
+		for _, t := range s.Thresholds {
+			status := "PASS"
+			if !t.Passed {
+				status = "FAIL"
+			}
+			fmt.Fprintf(w, "  %s %s <= %s: %s\n", status, t.Name(), t.Limit, t.Actual)
+		}
+	}
+
+	if byCode {
+		codes := make([]int, 0, len(s.Codes))
+		for code := range s.Codes {
+			c, _ := strconv.Atoi(code)
+			codes = append(codes, c)
+		}
+		sort.Ints(codes)
+
+		for _, code := range codes {
+			label := strconv.Itoa(code)
+			if code == 0 {
+				label = "no response"
+			}
+			fmt.Fprintf(w, "  %s: %s\n", label, s.Codes[strconv.Itoa(code)])
+		}
+	}
+}
+
+func writeSummaryFile(name string, s *Summary, unit string) error {
+	data, err := json.MarshalIndent(inLatencyUnit(s, unit), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(name, append(data, '\n'), 0o644)
+}
+
+// printBackends prints the groups of each address like printGroups, with each address's share of
+// the requests, so an imbalance between the backends stands out.
+func printBackends(w io.Writer, backends map[string]GroupSummary) {
+	if len(backends) == 0 {
+		return
+	}
+	addrs := make([]string, 0, len(backends))
+	total := 0
+	for addr, g := range backends {
+		addrs = append(addrs, addr)
+		total += g.Requests
+	}
+	sort.Strings(addrs)
+
+	fmt.Fprintln(w, "Backends:")
+	for _, addr := range addrs {
+		g := backends[addr]
+		fmt.Fprintf(w, "  %s: requests=%d (%.1f%%) error rate=%.2f%% throughput=%.2f requests/s %s\n", addr, g.Requests, float64(g.Requests)/float64(total)*100, g.ErrorRate*100, g.Throughput, g.Latency)
+	}
+}
+
+func printGroups(w io.Writer, title string, groups map[string]GroupSummary) {
+	if len(groups) == 0 {
+		return
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "%s:\n", title)
+	for _, name := range names {
+		g := groups[name]
+		fmt.Fprintf(w, "  %s: error rate=%.2f%% throughput=%.2f requests/s %s\n", name, g.ErrorRate*100, g.Throughput, g.Latency)
+	}
+}
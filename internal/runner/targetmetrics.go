@@ -0,0 +1,288 @@
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const EventTargetMetrics = "target-metrics"
+
+// DefaultTargetMetricsInterval is how often the target's metrics are scraped by default.
+const DefaultTargetMetricsInterval = 10 * time.Second
+
+// TargetMetrics scrapes values the target reports about itself during the test, e.g. its memory
+// use, so they can be correlated with the load in the summary. A soak test that leaks memory
+// shows as steady growth.
+type TargetMetrics struct {
+	URL      string        `json:"url"`
+	Metrics  []string      `json:"metrics"`
+	Interval time.Duration `json:"interval"`
+}
+
+// MetricSample is the values of a scrape of the target's metrics, with the load before it.
+type MetricSample struct {
+	Time     time.Time          `json:"time"`
+	Requests int                `json:"requests"` // Sent since the start of the test
+	Rps      float64            `json:"rps"`      // Sent per second since the previous sample
+	Values   map[string]float64 `json:"values"`   // Metrics missing from the scrape aren't set
+}
+
+// MetricTrend is how a metric of the target changed over the test.
+type MetricTrend struct {
+	Name    string  `json:"name"`
+	Samples int     `json:"samples"`
+	First   float64 `json:"first"`
+	Last    float64 `json:"last"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+
+	// The least squares slope of the samples, steadier than the difference of the first and last.
+	GrowthPerHour float64 `json:"growth_per_hour"`
+}
+
+// TargetMetricsSummary is the target's metrics scraped during the test, with -target_metrics_url.
+type TargetMetricsSummary struct {
+	URL     string         `json:"url"`
+	Trends  []MetricTrend  `json:"trends"`
+	Samples []MetricSample `json:"samples"`
+	Errors  int            `json:"errors,omitempty"` // Scrapes that failed
+}
+
+// ParseMetricNames parses a comma-separated list of the metrics to scrape. Each is the name of a
+// Prometheus metric, summed across its series, a single series, e.g.
+// `http_requests{code="500"}`, or a JSON path, e.g. "$.memory.heap_bytes", for JSON payloads.
+func ParseMetricNames(s string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no metrics given")
+	}
+	return names, nil
+}
+
+// metricsScraper scrapes the target's metrics until it's stopped.
+type metricsScraper struct {
+	args   *TargetMetrics
+	client http.Client
+	stopch chan struct{}
+	once   sync.Once
+	done   chan struct{}
+
+	mu      sync.Mutex
+	scrapes []metricScrape
+	errors  int
+}
+
+type metricScrape struct {
+	time   time.Time
+	values map[string]float64
+}
+
+func newMetricsScraper(args *TargetMetrics) *metricsScraper {
+	return &metricsScraper{
+		args:   args,
+		client: http.Client{Timeout: min(args.Interval, 10*time.Second)},
+		stopch: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// run scrapes the metrics once when the test starts, then every interval, and once more when
+// it's stopped, so the samples span the whole test.
+func (s *metricsScraper) run(emit func(Event)) {
+	defer close(s.done)
+	ticker := time.NewTicker(s.args.Interval)
+	defer ticker.Stop()
+	for {
+		s.scrape(emit)
+		select {
+		case <-s.stopch:
+			s.scrape(emit)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stop stops scraping once the last scrape is done. It can be called more than once.
+func (s *metricsScraper) stop() {
+	s.once.Do(func() { close(s.stopch) })
+	<-s.done
+}
+
+func (s *metricsScraper) scrape(emit func(Event)) {
+	now := time.Now()
+	values, err := s.fetch()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.scrapes = append(s.scrapes, metricScrape{time: now, values: values})
+	emit(Event{Type: EventTargetMetrics, Metrics: values})
+}
+
+func (s *metricsScraper) fetch() (map[string]float64, error) {
+	res, err := s.client.Get(s.args.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if b := bytes.TrimSpace(body); len(b) > 0 && (b[0] == '{' || b[0] == '[') {
+		return jsonMetrics(b, s.args.Metrics)
+	}
+	return prometheusMetrics(body, s.args.Metrics), nil
+}
+
+// jsonMetrics reads the metrics at the given JSON paths of a payload. Numbers in strings are
+// read too.
+func jsonMetrics(body []byte, paths []string) (map[string]float64, error) {
+	data, err := decodeJSON(body)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]float64{}
+	for _, p := range paths {
+		s, ok := jsonValue(jsonPath(data, p))
+		if !ok {
+			continue
+		}
+		if v, err := strconv.ParseFloat(s, 64); err == nil {
+			values[p] = v
+		}
+	}
+	return values, nil
+}
+
+// prometheusMetrics reads the given metrics of a Prometheus text exposition. A name without
+// labels sums all the series of the metric.
+func prometheusMetrics(body []byte, names []string) map[string]float64 {
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[name] = true
+	}
+	values := map[string]float64{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		// Label values can contain spaces, so the series ends at the closing brace.
+		series, rest := line, ""
+		if i := strings.LastIndexByte(line, '}'); i >= 0 {
+			series, rest = line[:i+1], line[i+1:]
+		} else {
+			series, rest, _ = strings.Cut(line, " ")
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		if wanted[series] {
+			values[series] += v
+		}
+		if name, _, ok := strings.Cut(series, "{"); ok && wanted[name] {
+			values[name] += v
+		}
+	}
+	return values
+}
+
+// summarize reports the trend of each metric, and the load before each sample from the results.
+func (s *metricsScraper) summarize(results []*Result, start time.Time) *TargetMetricsSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := &TargetMetricsSummary{URL: s.args.URL, Samples: []MetricSample{}, Errors: s.errors}
+	// Count the requests sent before each sample.
+	sent := make([]int, len(s.scrapes))
+	for _, r := range results {
+		i := sort.Search(len(s.scrapes), func(i int) bool { return !s.scrapes[i].time.Before(r.Timestamp) })
+		if i < len(sent) {
+			sent[i]++
+		}
+	}
+	requests, prev := 0, start
+	for i, sc := range s.scrapes {
+		requests += sent[i]
+		sample := MetricSample{Time: sc.time, Requests: requests, Values: sc.values}
+		if d := sc.time.Sub(prev).Seconds(); d > 0 {
+			sample.Rps = float64(sent[i]) / d
+		}
+		summary.Samples = append(summary.Samples, sample)
+		prev = sc.time
+	}
+
+	for _, name := range s.args.Metrics {
+		summary.Trends = append(summary.Trends, metricTrend(name, s.scrapes))
+	}
+	return summary
+}
+
+func metricTrend(name string, scrapes []metricScrape) MetricTrend {
+	t := MetricTrend{Name: name}
+	var sumX, sumY, sumXY, sumXX float64
+	for _, sc := range scrapes {
+		v, ok := sc.values[name]
+		if !ok {
+			continue
+		}
+		if t.Samples == 0 {
+			t.First, t.Min, t.Max = v, v, v
+		}
+		t.Samples++
+		t.Last, t.Min, t.Max = v, min(t.Min, v), max(t.Max, v)
+
+		x := sc.time.Sub(scrapes[0].time).Hours()
+		sumX, sumY, sumXY, sumXX = sumX+x, sumY+v, sumXY+x*v, sumXX+x*x
+	}
+	n := float64(t.Samples)
+	if d := n*sumXX - sumX*sumX; t.Samples > 1 && d > 0 {
+		t.GrowthPerHour = (n*sumXY - sumX*sumY) / d
+	}
+	return t
+}
+
+func printTargetMetrics(w io.Writer, s *TargetMetricsSummary) {
+	fmt.Fprintf(w, "Target metrics from %s (%d samples", s.URL, len(s.Samples))
+	if s.Errors > 0 {
+		fmt.Fprintf(w, ", %d failed scrapes", s.Errors)
+	}
+	fmt.Fprintln(w, "):")
+	for _, t := range s.Trends {
+		if t.Samples == 0 {
+			fmt.Fprintf(w, "  %s: not found\n", t.Name)
+			continue
+		}
+		growth := ""
+		if t.First != 0 {
+			growth = fmt.Sprintf(" (%+.1f%%)", (t.Last-t.First)/t.First*100)
+		}
+		fmt.Fprintf(w, "  %s: first=%.6g last=%.6g%s min=%.6g max=%.6g growth=%+.6g/h\n", t.Name, t.First, t.Last, growth, t.Min, t.Max, t.GrowthPerHour)
+	}
+}
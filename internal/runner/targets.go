@@ -0,0 +1,307 @@
+package runner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How often the targets file is checked for changes.
+const targetsPollInterval = time.Second
+
+// Target is a target of a targets file, sent a share of the requests in proportion to its weight.
+// Targets in the vegeta format have their own method, headers and body.
+type Target struct {
+	URL      string   `json:"url"`
+	Weight   float64  `json:"weight"`
+	Method   string   `json:"method,omitempty"` // [empty = the test's method]
+	Headers  []Header `json:"-"`
+	BodyFile string   `json:"body_file,omitempty"`
+	Body     []byte   `json:"-"`
+}
+
+// ParseTargets parses a targets file. Each line is a target URL, optionally followed by its
+// weight, which defaults to 1. Blank lines and lines starting with "#" are skipped. URLs must be
+// http or https, unless they start with a placeholder.
+//
+// Targets can also be in the vegeta format, with a method before the URL, followed by lines of
+// headers in "Name: value" form and a line with "@" and the path of a file to send as the body:
+//
+//	POST https://api.com/items 2
+//	Content-Type: application/json
+//	@item.json
+func ParseTargets(r io.Reader) ([]Target, error) {
+	var targets []Target
+	total := 0.0
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		var last *Target
+		if len(targets) > 0 {
+			last = &targets[len(targets)-1]
+		}
+		switch {
+		case isTargetURL(fields[0]):
+		case len(fields) > 1 && isTargetURL(fields[1]) && strings.IndexFunc(fields[0], isNotTokenChar) < 0:
+			method := fields[0]
+			if err := ValidateMethod(method, true); err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+			t, err := parseTarget(fields[1:], n)
+			if err != nil {
+				return nil, err
+			}
+			t.Method = method
+			targets = append(targets, t)
+			total += t.Weight
+			continue
+		case strings.HasPrefix(line, "@") && last != nil && last.Method != "":
+			if last.Body != nil {
+				return nil, fmt.Errorf("line %d: the target already has a body", n)
+			}
+			if err := ValidateMethodBody(last.Method); err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+			body, err := os.ReadFile(line[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+			last.BodyFile, last.Body = line[1:], body
+			continue
+		case last != nil && last.Method != "":
+			h, err := ParseHeader(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+			last.Headers = append(last.Headers, h)
+			continue
+		default:
+			return nil, fmt.Errorf("line %d: expected a target URL", n)
+		}
+
+		t, err := parseTarget(fields, n)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+		total += t.Weight
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("no targets with a weight above 0")
+	}
+
+	return targets, nil
+}
+
+// parseTarget parses a target URL and its optional weight.
+func parseTarget(fields []string, n int) (Target, error) {
+	t := Target{URL: fields[0], Weight: 1}
+	if err := ValidateTemplate(t.URL); err != nil {
+		return t, fmt.Errorf("line %d: %s", n, err)
+	}
+	switch len(fields) {
+	case 1:
+	case 2:
+		w, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || w < 0 {
+			return t, fmt.Errorf("line %d: invalid weight %q", n, fields[1])
+		}
+		t.Weight = w
+	default:
+		return t, fmt.Errorf("line %d: expected a URL and an optional weight", n)
+	}
+	return t, nil
+}
+
+// isTargetURL returns whether s is an http or https URL, or a template starting with a
+// placeholder, e.g. "{{base}}/items", which only has its scheme once it's rendered.
+func isTargetURL(s string) bool {
+	if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+		return true
+	}
+	t, err := parseTemplate(s)
+	if err != nil {
+		// Only a URL starts with a placeholder, parseTarget reports what's wrong with it.
+		return true
+	}
+	return len(t.parts) > 0 && t.parts[0].kind != partLiteral
+}
+
+func LoadTargets(name string) ([]Target, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	targets, err := ParseTargets(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading targets %s: %s", name, err)
+	}
+	return targets, nil
+}
+
+// weightedTarget is a target of a targetSet.
+type weightedTarget struct {
+	url     *template
+	raw     string
+	weight  float64
+	method  string // [empty = the test's method]
+	headers []headerTemplate
+	body    []byte
+	health  targetHealth
+}
+
+// targetSet picks targets at random in proportion to their weights.
+type targetSet struct {
+	targets    []*weightedTarget
+	cumulative []float64 // Running total of the weights
+
+	ejected atomic.Int32 // Number of targets currently ejected
+}
+
+func newTargetSet(targets []Target) *targetSet {
+	s := &targetSet{}
+	total := 0.0
+	for _, t := range targets {
+		if t.Weight == 0 {
+			continue
+		}
+		total += t.Weight
+		wt := &weightedTarget{url: parseValidTemplate(t.URL), raw: t.URL, weight: t.Weight, method: t.Method, body: t.Body}
+		for _, h := range t.Headers {
+			wt.headers = append(wt.headers, headerTemplate{name: h.Name, value: parseValidTemplate(h.Value)})
+		}
+		s.targets = append(s.targets, wt)
+		s.cumulative = append(s.cumulative, total)
+	}
+	return s
+}
+
+func (s *targetSet) pick(rng *rand.Rand) *weightedTarget {
+	if s.ejected.Load() > 0 {
+		return s.pickHealthy(rng)
+	}
+	x := rng.Float64() * s.cumulative[len(s.cumulative)-1]
+	i := sort.SearchFloat64s(s.cumulative, x)
+	return s.targets[min(i, len(s.targets)-1)]
+}
+
+// nextTarget returns the target of the lane's next request, and the weighted target it's one of
+// if the lane has weighted targets.
+func (l *lane) nextTarget(rng *rand.Rand) (*template, *weightedTarget) {
+	if s := l.targets.Load(); s != nil {
+		t := s.pick(rng)
+		return t.url, t
+	}
+	return l.target, nil
+}
+
+// allTargets returns every target the lane currently sends requests to.
+func (l *lane) allTargets() []*template {
+	s := l.targets.Load()
+	if s == nil {
+		return []*template{l.target}
+	}
+	targets := make([]*template, 0, len(s.targets))
+	for _, t := range s.targets {
+		targets = append(targets, t.url)
+	}
+	return targets
+}
+
+// newTargetRequest creates a request to the lane's next target, with the headers given with
+// -header. Targets in the vegeta format are sent with their own method and body, and their
+// headers replace those of the same name.
+func (r *Runner) newTargetRequest(ctx context.Context, l *lane, vars map[string]string, result *Result, body io.Reader) (*http.Request, error) {
+	target, wt := r.renderTarget(l, vars, result)
+	method := r.args.Method
+	if wt != nil && wt.method != "" {
+		method = wt.method
+		if r.args.Verbose {
+			result.Method = method
+		}
+	}
+	var req *http.Request
+	var err error
+	if wt != nil && wt.body != nil {
+		req, err = newBodyRequest(ctx, method, target, wt.body)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, target, body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.setHeaders(req, vars)
+	if wt != nil {
+		for _, h := range wt.headers {
+			req.Header.Del(h.name)
+		}
+		for _, h := range wt.headers {
+			setHeader(req, h.name, h.value.render(r.rand, vars))
+		}
+	}
+	return req, nil
+}
+
+// watchTargets reloads the targets file whenever it changes, until the test stops. Requests are
+// sent to the new targets as soon as they're loaded, and a file that fails to load is skipped.
+// When Reload switches to another file, that file is watched instead.
+func (r *Runner) watchTargets(l *lane) {
+	name := *r.targetsFile.Load()
+	last, err := os.Stat(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: not watching targets: %s\n", err)
+		return
+	}
+
+	ticker := time.NewTicker(targetsPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopch:
+			return
+		case <-ticker.C:
+		}
+
+		if current := *r.targetsFile.Load(); current != name {
+			// Reload already loaded the new file.
+			name = current
+			if last, err = os.Stat(name); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: not watching targets: %s\n", err)
+				return
+			}
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil || (info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size()) {
+			continue
+		}
+		last = info
+
+		targets, err := LoadTargets(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: keeping the previous targets: %s\n", err)
+			continue
+		}
+		l.targets.Store(newTargetSet(targets))
+		fmt.Fprintf(r.console, "%s: reloaded %d targets from %s\n", time.Now().Format(time.RFC3339), len(targets), name)
+	}
+}
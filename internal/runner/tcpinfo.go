@@ -0,0 +1,93 @@
+package runner
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// TCPSummary aggregates the kernel's TCP statistics of the test's connections, read just before
+// each connection is closed. It separates network-layer degradation, such as packet loss, from the
+// server being slow.
+type TCPSummary struct {
+	Connections          int          `json:"connections"`
+	RTT                  LatencyStats `json:"rtt"`                    // Smoothed round trip time of each connection
+	Retransmits          uint64       `json:"retransmits"`            // Segments retransmitted across all connections
+	RetransmittedConns   int          `json:"retransmitted_conns"`    // Connections that retransmitted any segments
+	MeanCongestionWindow float64      `json:"mean_congestion_window"` // In segments
+}
+
+type tcpConnStats struct {
+	rtt         time.Duration
+	retransmits uint64
+	cwnd        uint64
+}
+
+// tcpStats collects the TCP statistics of connections as they're closed.
+type tcpStats struct {
+	mu    sync.Mutex
+	conns []tcpConnStats
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// wrap returns a dial function whose connections record their statistics when closed.
+func (s *tcpStats) wrap(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &tcpInfoConn{Conn: conn, stats: s}, nil
+	}
+}
+
+func (s *tcpStats) summary() *TCPSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := &TCPSummary{Connections: len(s.conns)}
+	rtts := make([]time.Duration, 0, len(s.conns))
+	var cwnd uint64
+	for _, c := range s.conns {
+		rtts = append(rtts, c.rtt)
+		summary.Retransmits += c.retransmits
+		if c.retransmits > 0 {
+			summary.RetransmittedConns++
+		}
+		cwnd += c.cwnd
+	}
+	summary.RTT = computeLatencyStats(rtts)
+	if len(s.conns) > 0 {
+		summary.MeanCongestionWindow = float64(cwnd) / float64(len(s.conns))
+	}
+	return summary
+}
+
+type tcpInfoConn struct {
+	net.Conn
+	stats *tcpStats
+	once  sync.Once
+}
+
+func (c *tcpInfoConn) Close() error {
+	c.once.Do(func() {
+		// Connections that can't be read, e.g. already closed by the kernel, are left out.
+		if info, err := readTCPInfo(c.Conn); err == nil {
+			c.stats.mu.Lock()
+			c.stats.conns = append(c.stats.conns, info)
+			c.stats.mu.Unlock()
+		}
+	})
+	return c.Conn.Close()
+}
+
+// dialContext returns the function to dial the targets' connections with.
+func (r *Runner) dialContext() dialFunc {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if r.tcpStats == nil {
+		return dialer.DialContext
+	}
+	return r.tcpStats.wrap(dialer.DialContext)
+}
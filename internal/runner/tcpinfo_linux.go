@@ -0,0 +1,49 @@
+//go:build linux && (amd64 || arm64)
+
+package runner
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// TCPInfoSupported is whether -tcp_info can collect TCP_INFO on this platform.
+const TCPInfoSupported = true
+
+// readTCPInfo reads the kernel's TCP_INFO statistics of a connection.
+func readTCPInfo(conn net.Conn) (tcpConnStats, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return tcpConnStats{}, errors.New("not a TCP connection")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return tcpConnStats{}, err
+	}
+
+	var info syscall.TCPInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(info))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return tcpConnStats{}, err
+	}
+
+	return tcpConnStats{
+		rtt:         time.Duration(info.Rtt) * time.Microsecond,
+		retransmits: uint64(info.Total_retrans),
+		cwnd:        uint64(info.Snd_cwnd),
+	}, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux || !(amd64 || arm64)
+
+package runner
+
+import (
+	"errors"
+	"net"
+)
+
+// TCP_INFO is only collected on Linux.
+const TCPInfoSupported = false
+
+func readTCPInfo(conn net.Conn) (tcpConnStats, error) {
+	return tcpConnStats{}, errors.New("TCP_INFO is not supported on this platform")
+}
@@ -0,0 +1,185 @@
+package runner
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// template is a string with placeholders that are filled in each time it's rendered:
+//
+//	{{name}}             the variable name, e.g. a column of the current feeder row
+//	{{randint:MIN:MAX}}  a random integer between MIN and MAX inclusive, at most 2^63-1 of them
+//	{{randip:CIDR,...}}  a random address of one of the CIDR pools
+//	{{randpick:A|B|...}} one of the values at random
+//	{{randlang}}         a realistic Accept-Language header
+//	{{randdevice}}       a device type: mobile, desktop or tablet, in proportion to web traffic
+//	{MIN..MAX}           the integers from MIN to MAX in turn, wrapping around at the end
+type template struct {
+	literal string // Set if the template has no placeholders
+	parts   []templatePart
+}
+
+type templatePartKind int
+
+const (
+	partLiteral templatePartKind = iota
+	partVariable
+	partRandInt
+	partRandIP
+	partChoice
+	partRange
+)
+
+type templatePart struct {
+	kind     templatePartKind
+	text     string
+	min, max int64
+	next     *atomic.Uint64 // Position of a range
+	pools    []netip.Prefix // Of a random address
+	choices  *choices
+}
+
+var rangePattern = regexp.MustCompile(`^\{(-?\d+)\.\.(-?\d+)\}`)
+
+// ValidateTemplate checks that the placeholders of a template are well formed, e.g. that a
+// randint range is a valid one.
+func ValidateTemplate(s string) error {
+	_, err := parseTemplate(s)
+	return err
+}
+
+func parseTemplate(s string) (*template, error) {
+	t := &template{}
+	var literal strings.Builder
+	flush := func() {
+		if literal.Len() > 0 {
+			t.parts = append(t.parts, templatePart{kind: partLiteral, text: literal.String()})
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); {
+		if strings.HasPrefix(s[i:], "{{") {
+			if end := strings.Index(s[i+2:], "}}"); end >= 0 {
+				part, err := parsePlaceholder(strings.TrimSpace(s[i+2 : i+2+end]))
+				if err != nil {
+					return nil, err
+				}
+				flush()
+				t.parts = append(t.parts, part)
+				i += end + 4
+				continue
+			}
+		} else if m := rangePattern.FindStringSubmatch(s[i:]); m != nil {
+			lo, err1 := strconv.ParseInt(m[1], 10, 64)
+			hi, err2 := strconv.ParseInt(m[2], 10, 64)
+			if err1 == nil && err2 == nil && lo <= hi {
+				flush()
+				t.parts = append(t.parts, templatePart{kind: partRange, min: lo, max: hi, next: &atomic.Uint64{}})
+				i += len(m[0])
+				continue
+			}
+		}
+		literal.WriteByte(s[i])
+		i++
+	}
+
+	if len(t.parts) == 0 {
+		t.literal = s
+		return t, nil
+	}
+	flush()
+
+	return t, nil
+}
+
+// parseValidTemplate parses a template its argument's parser already checked with
+// ValidateTemplate. One that's malformed anyway is sent as it is.
+func parseValidTemplate(s string) *template {
+	t, err := parseTemplate(s)
+	if err != nil {
+		return &template{literal: s}
+	}
+	return t
+}
+
+func parsePlaceholder(p string) (templatePart, error) {
+	if args, ok := strings.CutPrefix(p, "randint:"); ok {
+		first, last, _ := strings.Cut(args, ":")
+		lo, err1 := strconv.ParseInt(first, 10, 64)
+		hi, err2 := strconv.ParseInt(last, 10, 64)
+		// The number of integers between them has to fit in an int64 for rand.Int63n.
+		if err1 != nil || err2 != nil || lo > hi || uint64(hi)-uint64(lo) >= math.MaxInt64 {
+			return templatePart{}, fmt.Errorf("invalid placeholder {{%s}}, expected {{randint:MIN:MAX}} with MIN <= MAX and at most 2^63-1 integers", p)
+		}
+		return templatePart{kind: partRandInt, min: lo, max: hi}, nil
+	}
+	if args, ok := strings.CutPrefix(p, "randip:"); ok {
+		pools, ok := parseAddrPools(args)
+		if !ok {
+			return templatePart{}, fmt.Errorf("invalid placeholder {{%s}}, expected {{randip:CIDR,...}}", p)
+		}
+		return templatePart{kind: partRandIP, pools: pools}, nil
+	}
+	if args, ok := strings.CutPrefix(p, "randpick:"); ok {
+		return templatePart{kind: partChoice, choices: equalChoices(strings.Split(args, "|"))}, nil
+	}
+	switch p {
+	case "randlang":
+		return templatePart{kind: partChoice, choices: acceptLanguages}, nil
+	case "randdevice":
+		return templatePart{kind: partChoice, choices: deviceTypes}, nil
+	}
+
+	return templatePart{kind: partVariable, text: p}, nil
+}
+
+// prefix returns the text before the first placeholder, without rendering the template.
+func (t *template) prefix() string {
+	if t.parts == nil {
+		return t.literal
+	}
+	if t.parts[0].kind == partLiteral {
+		return t.parts[0].text
+	}
+	return ""
+}
+
+// render fills in the placeholders. Variable placeholders without a matching variable are left
+// as they are.
+func (t *template) render(rng *rand.Rand, vars map[string]string) string {
+	if t.parts == nil {
+		return t.literal
+	}
+
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch p.kind {
+		case partLiteral:
+			b.WriteString(p.text)
+		case partVariable:
+			if v, ok := vars[p.text]; ok {
+				b.WriteString(v)
+			} else {
+				b.WriteString("{{" + p.text + "}}")
+			}
+		case partRandInt:
+			b.WriteString(strconv.FormatInt(p.min+rng.Int63n(p.max-p.min+1), 10))
+		case partRandIP:
+			b.WriteString(randomAddr(rng, p.pools))
+		case partChoice:
+			b.WriteString(p.choices.pick(rng))
+		case partRange:
+			n := uint64(p.max-p.min) + 1
+			b.WriteString(strconv.FormatInt(p.min+int64((p.next.Add(1)-1)%n), 10))
+		}
+	}
+
+	return b.String()
+}
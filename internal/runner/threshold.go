@@ -0,0 +1,90 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Threshold is an expected bound on a latency statistic, e.g. p99=250ms, or on a statistic of the
+// time to first byte, e.g. ttfb_p99=100ms.
+type Threshold struct {
+	Stat  string        `json:"stat"`
+	TTFB  bool          `json:"ttfb,omitempty"` // Of the time to first byte instead of the latency
+	Limit time.Duration `json:"limit"`
+}
+
+// ThresholdResult is a threshold checked against the latency, or time to first byte, of all
+// results.
+type ThresholdResult struct {
+	Threshold
+	Actual time.Duration `json:"actual"`
+	Passed bool          `json:"passed"`
+}
+
+// ParseThreshold parses a threshold in "stat=duration" form, where stat is one of mean, p50, p90,
+// p95, p99 or max, prefixed with "ttfb_" for the time to first byte.
+func ParseThreshold(s string) (Threshold, error) {
+	stat, limit, ok := strings.Cut(s, "=")
+	if !ok {
+		return Threshold{}, fmt.Errorf("invalid threshold %q, expected \"stat=duration\"", s)
+	}
+
+	stat = strings.ToLower(strings.TrimSpace(stat))
+	stat, ttfb := strings.CutPrefix(stat, "ttfb_")
+	if _, ok := (LatencyStats{}).stat(stat); !ok {
+		return Threshold{}, fmt.Errorf("invalid threshold %q, stat must be one of mean, p50, p90, p95, p99 or max, optionally prefixed with ttfb_", s)
+	}
+
+	d, err := time.ParseDuration(strings.TrimSpace(limit))
+	if err != nil || d <= 0 {
+		return Threshold{}, fmt.Errorf("invalid threshold %q, expected a positive duration", s)
+	}
+
+	return Threshold{Stat: stat, TTFB: ttfb, Limit: d}, nil
+}
+
+// Name returns the statistic the threshold bounds as it's given, e.g. "p99" or "ttfb_p99".
+func (t Threshold) Name() string {
+	if t.TTFB {
+		return "ttfb_" + t.Stat
+	}
+	return t.Stat
+}
+
+func (s LatencyStats) stat(name string) (time.Duration, bool) {
+	switch name {
+	case "mean":
+		return s.Mean, true
+	case "p50":
+		return s.P50, true
+	case "p90":
+		return s.P90, true
+	case "p95":
+		return s.P95, true
+	case "p99":
+		return s.P99, true
+	case "max":
+		return s.Max, true
+	default:
+		return 0, false
+	}
+}
+
+func checkThresholds(thresholds []Threshold, latency LatencyStats, ttfb *LatencyStats) []ThresholdResult {
+	results := make([]ThresholdResult, 0, len(thresholds))
+	for _, t := range thresholds {
+		stats := latency
+		if t.TTFB {
+			// No response means no time to first byte to pass with.
+			if ttfb == nil {
+				results = append(results, ThresholdResult{Threshold: t})
+				continue
+			}
+			stats = *ttfb
+		}
+		actual, _ := stats.stat(t.Stat)
+		results = append(results, ThresholdResult{Threshold: t, Actual: actual, Passed: actual <= t.Limit})
+	}
+	return results
+}
@@ -0,0 +1,92 @@
+package runner
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a TLS version such as "1.2".
+func ParseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", s)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites parses a comma separated list of cipher suite names, e.g.
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". Insecure suites are accepted, to benchmark legacy
+// configurations.
+func ParseCipherSuites(s string) ([]uint16, error) {
+	byName := map[string]uint16{}
+	for _, c := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		byName[c.Name] = c.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		id, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// LoadCertPool loads a file of PEM encoded CA certificates.
+func LoadCertPool(name string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", name)
+	}
+	return pool, nil
+}
+
+// tlsConfig returns the TLS configuration for connections to the targets, or nil to use the
+// defaults.
+func (r *Runner) tlsConfig() *tls.Config {
+	a := r.args
+	if a.TLSMinVersion == 0 && a.TLSMaxVersion == 0 && len(a.TLSCiphers) == 0 && len(a.TLSCertificates) == 0 && a.TLSRootCAs == nil && r.sessionCache == nil && a.TLSKeyLog == nil {
+		return nil
+	}
+	return &tls.Config{
+		MinVersion:         a.TLSMinVersion,
+		MaxVersion:         a.TLSMaxVersion,
+		CipherSuites:       a.TLSCiphers,
+		Certificates:       a.TLSCertificates,
+		RootCAs:            a.TLSRootCAs,
+		ClientSessionCache: r.sessionCache,
+		KeyLogWriter:       a.TLSKeyLog,
+	}
+}
+
+// newTransport returns a transport with the test's TLS configuration, connection reuse and warm
+// connections.
+func (r *Runner) newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = r.tlsConfig()
+	transport.DisableKeepAlives = r.args.NewConnections
+	if r.tcpStats != nil {
+		transport.DialContext = r.dialContext()
+	}
+	if r.preconnected != nil {
+		r.preconnected.install(transport)
+	}
+	return transport
+}
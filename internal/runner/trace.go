@@ -0,0 +1,289 @@
+package runner
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Whether a request was sent on a new connection or one kept alive from an earlier request.
+const (
+	ConnectionNew    = "new"
+	ConnectionReused = "reused"
+)
+
+type requestPhase int32
+
+const (
+	phaseGettingConn requestPhase = iota
+	phaseResolving
+	phaseDialing
+	phaseTLSHandshake
+	phaseWritingRequest
+	phaseWaitingForHeaders
+	phaseReadingBody
+)
+
+var phaseNames = [...]string{
+	phaseGettingConn:       "waiting for a connection",
+	phaseResolving:         "resolving DNS",
+	phaseDialing:           "dialing",
+	phaseTLSHandshake:      "TLS handshake",
+	phaseWritingRequest:    "writing request",
+	phaseWaitingForHeaders: "waiting for headers",
+	phaseReadingBody:       "reading body",
+}
+
+func (p requestPhase) String() string {
+	return phaseNames[p]
+}
+
+// requestTrace follows a request through its phases using httptrace. The hooks can be called
+// from other goroutines than the one sending the request.
+type requestTrace struct {
+	phase atomic.Int32
+
+	mu            sync.Mutex
+	connectStarts map[string]time.Time // Start of each connection attempt, by address
+	firstAttempt  string
+	connectedAddr string
+	connectedAt   time.Time
+	conn          string // "new" or "reused", once the request got a connection
+	gotConnAt     time.Time
+	remoteAddr    string
+	wroteAt       time.Time
+	firstByte     time.Time
+
+	dnsStart time.Time
+	dnsDone  time.Time
+
+	tlsStart time.Time
+	tlsDone  time.Time
+	tlsState tls.ConnectionState
+}
+
+func (t *requestTrace) setPhase(p requestPhase) {
+	t.phase.Store(int32(p))
+}
+
+func (t *requestTrace) currentPhase() requestPhase {
+	return requestPhase(t.phase.Load())
+}
+
+func (t *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             t.dnsStarted,
+		DNSDone:              t.dnsFinished,
+		ConnectStart:         t.connectStart,
+		ConnectDone:          t.connectDone,
+		TLSHandshakeStart:    t.tlsHandshakeStart,
+		TLSHandshakeDone:     t.tlsHandshakeDone,
+		GotConn:              t.gotConn,
+		WroteRequest:         t.wroteRequest,
+		GotFirstResponseByte: t.gotFirstByte,
+	}
+}
+
+func (t *requestTrace) dnsStarted(httptrace.DNSStartInfo) {
+	t.setPhase(phaseResolving)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dnsStart = time.Now()
+}
+
+func (t *requestTrace) dnsFinished(httptrace.DNSDoneInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dnsDone = time.Now()
+}
+
+func (t *requestTrace) wroteRequest(httptrace.WroteRequestInfo) {
+	t.setPhase(phaseWaitingForHeaders)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.wroteAt = time.Now()
+}
+
+func (t *requestTrace) gotFirstByte() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.firstByte = time.Now()
+}
+
+// timeToFirstByte reports how long after start the first byte of the response arrived, if it did.
+func (t *requestTrace) timeToFirstByte(start time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.firstByte.IsZero() {
+		return 0
+	}
+	return t.firstByte.Sub(start)
+}
+
+func (t *requestTrace) gotConn(info httptrace.GotConnInfo) {
+	t.setPhase(phaseWritingRequest)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conn = ConnectionNew
+	if info.Reused {
+		t.conn = ConnectionReused
+	}
+	t.gotConnAt = time.Now()
+	if info.Conn != nil {
+		t.remoteAddr = info.Conn.RemoteAddr().String()
+	}
+}
+
+// connection reports whether the request was sent on a "new" or "reused" connection, or "" if it
+// never got one.
+func (t *requestTrace) connection() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conn
+}
+
+func (t *requestTrace) tlsHandshakeStart() {
+	t.setPhase(phaseTLSHandshake)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tlsStart = time.Now()
+}
+
+func (t *requestTrace) tlsHandshakeDone(state tls.ConnectionState, err error) {
+	t.setPhase(phaseDialing)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tlsDone, t.tlsState = time.Now(), state
+}
+
+// tlsHandshake reports the latency and outcome of the TLS handshake of a new connection, if the
+// request established one.
+func (t *requestTrace) tlsHandshake() (time.Duration, string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.tlsDone.IsZero() {
+		return 0, "", false
+	}
+	return t.tlsDone.Sub(t.tlsStart), tls.VersionName(t.tlsState.Version), t.tlsState.DidResume
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func (t *requestTrace) connectStart(network, addr string) {
+	t.setPhase(phaseDialing)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.connectStarts == nil {
+		t.connectStarts = map[string]time.Time{}
+		t.firstAttempt = addr
+	}
+	t.connectStarts[addr] = time.Now()
+}
+
+func (t *requestTrace) connectDone(network, addr string, err error) {
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.connectedAddr, t.connectedAt = addr, time.Now()
+}
+
+// connectLatency reports how long the TCP connection took to establish, if the request
+// established a new one.
+func (t *requestTrace) connectLatency() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.connectedAddr == "" {
+		return 0
+	}
+	return t.connectedAt.Sub(t.connectStarts[t.connectedAddr])
+}
+
+// fallback reports whether a new connection had to fall back from the first address it tried
+// to another one, e.g. from IPv6 to IPv4 with happy eyeballs, as "ipv6->ipv4". The delay is how
+// long after the first attempt the successful one started.
+func (t *requestTrace) fallback() (string, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.connectedAddr == "" || t.connectedAddr == t.firstAttempt {
+		return "", 0
+	}
+
+	kind := addrFamily(t.firstAttempt) + "->" + addrFamily(t.connectedAddr)
+	return kind, t.connectStarts[t.connectedAddr].Sub(t.connectStarts[t.firstAttempt])
+}
+
+func addrFamily(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// TraceBreakdown is where the time of a request went, by phase. Phases the request didn't reach,
+// or that didn't happen, e.g. DNS on a reused connection, are zero.
+type TraceBreakdown struct {
+	Connection string `json:"connection,omitempty"` // "new" or "reused"
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// Until the request got a connection, including establishing a new one, of which the DNS
+	// lookup, TCP connection and TLS handshake are part.
+	GetConn      time.Duration `json:"get_conn"`
+	DNS          time.Duration `json:"dns"`
+	Connect      time.Duration `json:"connect"`
+	TLSHandshake time.Duration `json:"tls_handshake"`
+
+	WriteRequest   time.Duration `json:"write_request"`
+	WaitForHeaders time.Duration `json:"wait_for_headers"` // Until the first byte of the response
+	ReadBody       time.Duration `json:"read_body"`
+}
+
+// breakdown splits the time of a request that started at start and ended at end into its phases.
+func (t *requestTrace) breakdown(start, end time.Time) TraceBreakdown {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := TraceBreakdown{Connection: t.conn, RemoteAddr: t.remoteAddr}
+	since := func(from, to time.Time) time.Duration {
+		if from.IsZero() || to.IsZero() {
+			return 0
+		}
+		return max(0, to.Sub(from))
+	}
+	b.GetConn = since(start, t.gotConnAt)
+	b.DNS = since(t.dnsStart, t.dnsDone)
+	if t.connectedAddr != "" {
+		b.Connect = since(t.connectStarts[t.connectedAddr], t.connectedAt)
+	}
+	b.TLSHandshake = since(t.tlsStart, t.tlsDone)
+	b.WriteRequest = since(t.gotConnAt, t.wroteAt)
+	b.WaitForHeaders = since(t.wroteAt, t.firstByte)
+	b.ReadBody = since(t.firstByte, end)
+	return b
+}
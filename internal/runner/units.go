@@ -0,0 +1,193 @@
+package runner
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Units durations can be written to the output files in.
+const (
+	LatencyUnitNs    = "ns"
+	LatencyUnitUs    = "us"
+	LatencyUnitMs    = "ms"
+	LatencyUnitS     = "s"
+	LatencyUnitHuman = "human" // e.g. "1.5ms"
+)
+
+var latencyUnits = map[string]time.Duration{
+	LatencyUnitNs: time.Nanosecond,
+	LatencyUnitUs: time.Microsecond,
+	LatencyUnitMs: time.Millisecond,
+	LatencyUnitS:  time.Second,
+}
+
+// ParseLatencyUnit parses a unit to write durations in: "ns", "us" (or "µs"), "ms", "s" or
+// "human".
+func ParseLatencyUnit(s string) (string, error) {
+	if s == "µs" {
+		return LatencyUnitUs, nil
+	}
+	if _, ok := latencyUnits[s]; ok || s == LatencyUnitHuman {
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid latency unit %q, expected ns, us, ms, s or human", s)
+}
+
+// formatDuration formats a duration in a unit for a CSV output. Units other than nanoseconds
+// have a fraction, e.g. 1.5 ms.
+func formatDuration(d time.Duration, unit string) string {
+	switch unit {
+	case "", LatencyUnitNs:
+		return strconv.FormatInt(d.Nanoseconds(), 10)
+	case LatencyUnitHuman:
+		return d.String()
+	}
+	return strconv.FormatFloat(float64(d)/float64(latencyUnits[unit]), 'f', -1, 64)
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// inLatencyUnit returns a value that encodes to the same JSON as v, except with every duration
+// in unit rather than in nanoseconds.
+func inLatencyUnit(v any, unit string) any {
+	if unit == "" || unit == LatencyUnitNs {
+		return v
+	}
+	return convertDurations(reflect.ValueOf(v), unit)
+}
+
+func convertDurations(v reflect.Value, unit string) any {
+	if !v.IsValid() {
+		return nil
+	}
+	t := v.Type()
+	switch {
+	case t == durationType:
+		d := time.Duration(v.Int())
+		if unit == LatencyUnitHuman {
+			return d.String()
+		}
+		return float64(d) / float64(latencyUnits[unit])
+	case t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType):
+		return v.Interface()
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return convertDurations(v.Elem(), unit)
+	case reflect.Struct:
+		return convertStruct(v, unit)
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		m := make(map[string]any, v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			key := iter.Key()
+			name := fmt.Sprint(key.Interface())
+			if key.Kind() == reflect.String {
+				name = key.String()
+			}
+			m[name] = convertDurations(iter.Value(), unit)
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 || (t.Kind() == reflect.Slice && v.IsNil()) {
+			// Byte slices are encoded as base64.
+			return v.Interface()
+		}
+		s := make([]any, v.Len())
+		for i := range s {
+			s[i] = convertDurations(v.Index(i), unit)
+		}
+		return s
+	}
+	return v.Interface()
+}
+
+// jsonObject is a JSON object that keeps the order of its members, as a struct's fields are.
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	name  string
+	value any
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(m.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// convertStruct converts a struct's fields the way encoding/json names and omits them.
+func convertStruct(v reflect.Value, unit string) jsonObject {
+	var o jsonObject
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		fv := v.Field(i)
+		if f.Anonymous && name == "" {
+			for fv.Kind() == reflect.Pointer && !fv.IsNil() {
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				o = append(o, convertStruct(fv, unit)...)
+				continue
+			}
+		}
+		if slices.Contains(strings.Split(opts, ","), "omitempty") && isEmptyJSONValue(fv) {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		o = append(o, jsonMember{name, convertDurations(fv, unit)})
+	}
+	return o
+}
+
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
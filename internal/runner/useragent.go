@@ -0,0 +1,66 @@
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// UserAgents is a list of User-Agent strings to pick from at random. A string can be repeated in
+// the file to make it more likely, to match a realistic distribution.
+type UserAgents struct {
+	agents []string
+}
+
+// LoadUserAgents reads User-Agent strings from a file, one per line, skipping blank lines and
+// lines starting with "#".
+func LoadUserAgents(name string) (*UserAgents, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	uas := &UserAgents{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		uas.agents = append(uas.agents, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading user agents %s: %s", name, err)
+	}
+	if len(uas.agents) == 0 {
+		return nil, fmt.Errorf("user agents %s has no user agents", name)
+	}
+
+	return uas, nil
+}
+
+// pick returns a random User-Agent. It's safe to call from multiple goroutines.
+func (u *UserAgents) pick(rng *rand.Rand) string {
+	return u.agents[rng.Intn(len(u.agents))]
+}
+
+// userAgentTransport sends a fixed User-Agent, for a virtual user that keeps the same one for all
+// its requests. A User-Agent set on the request, e.g. with -header, takes precedence.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(req)
+}
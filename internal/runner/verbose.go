@@ -0,0 +1,56 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// MaxVerboseQps is the highest total rate -verbose can be used at. A line for each request is
+// only readable at low rates, and printing them would slow down the test at higher ones.
+const MaxVerboseQps = 20
+
+// capVerboseQps caps a new total rate at MaxVerboseQps with -verbose, as it's only checked
+// against the initial rate before the test starts. It warns the first time it does.
+func (r *Runner) capVerboseQps(total float64) float64 {
+	if !r.args.Verbose || total <= MaxVerboseQps {
+		return total
+	}
+	r.verboseCapOnce.Do(func() {
+		fmt.Fprintf(r.console, "Warning: -verbose is for debugging at up to %d qps, capping the rate at %d qps\n", MaxVerboseQps, MaxVerboseQps)
+	})
+	return MaxVerboseQps
+}
+
+// renderTarget renders the URL of the lane's next request, recording it on the result if the
+// requests are printed. It also returns the weighted target the URL is for, if the lane has
+// weighted targets.
+func (r *Runner) renderTarget(l *lane, vars map[string]string, result *Result) (string, *weightedTarget) {
+	target, wt := l.nextTarget(r.rand)
+	if wt != nil {
+		result.health = &wt.health
+	}
+	u := target.render(r.rand, vars)
+	if r.args.Verbose {
+		result.URL = u
+	}
+	return u, wt
+}
+
+// printVerbose prints a line for a result, e.g.
+//
+//	12:00:00.000 GET https://api.com/items 200 12.5ms
+func (r *Runner) printVerbose(w io.Writer, result *Result) {
+	method := r.args.Method
+	if r.args.Mode == ModeConnect {
+		method = "CONNECT"
+	} else if result.Method != "" {
+		method = result.Method
+	}
+
+	line := fmt.Sprintf("%s %s %s %d %s", result.Timestamp.Format("15:04:05.000"), method, result.URL, result.Code, result.Latency.Round(time.Microsecond))
+	if result.Error != "" {
+		line += " error: " + result.Error
+	}
+	fmt.Fprintln(w, line)
+}
@@ -0,0 +1,118 @@
+package runner
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"sync"
+	"time"
+)
+
+// startVirtualUsers runs the test as a closed model: each virtual user sends its requests one
+// after the other as fast as the target responds, with its own cookie jar and connections,
+// instead of the pacer sending requests at a fixed rate.
+func (r *Runner) startVirtualUsers() chan *Result {
+	var wg sync.WaitGroup
+	lt := r.newLoadTest()
+	results := r.newResultsChannel()
+
+	for i := uint64(0); i < r.args.VUs; i++ {
+		wg.Add(1)
+		go r.runVirtualUser(lt, &wg, r.rampDelay(i, r.args.VUs), results)
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+		r.Stop()
+	}()
+
+	return results
+}
+
+func (r *Runner) runVirtualUser(lt *loadTest, wg *sync.WaitGroup, delay time.Duration, results chan<- *Result) {
+	defer wg.Done()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.stopch:
+			return
+		}
+	}
+
+	// cookiejar.New only fails if given invalid options.
+	jar, _ := cookiejar.New(nil)
+	transport := r.withBackends(r.newTransport())
+	client := &http.Client{
+		Timeout:       r.client.Timeout,
+		Transport:     transport,
+		Jar:           jar,
+		CheckRedirect: checkRedirect,
+	}
+	defer transport.CloseIdleConnections()
+
+	if r.args.UserAgents != nil && r.args.UserAgentPerVU {
+		client.Transport = &userAgentTransport{base: transport, userAgent: r.args.UserAgents.pick(r.rand)}
+	}
+	client.Transport = r.guardHosts(client.Transport)
+
+	if r.args.Login != nil {
+		if err := r.login(client); err != nil {
+			if r.ctx.Err() == nil {
+				r.loginFailures.Add(1)
+				r.loginWarning.Do(func() {
+					fmt.Fprintf(os.Stderr, "Warning: a virtual user couldn't log in, and won't send requests: %s\n", err)
+				})
+			}
+			return
+		}
+	}
+
+	var hooks *scriptHooks
+	if s := r.args.Scenario; s != nil && s.script != nil {
+		var err error
+		if hooks, err = newScriptHooks(s.script); err != nil {
+			r.scriptWarning.Do(func() {
+				fmt.Fprintf(os.Stderr, "Warning: a virtual user couldn't run the scenario's script, and won't send requests: %s\n", err)
+			})
+			return
+		}
+		defer hooks.close()
+		// Killing the test interrupts a hook that doesn't return.
+		hooks.L.SetContext(r.ctx)
+	}
+
+	var lastPoll time.Time // When the previous poll returned, in longpoll mode
+	for i := uint64(0); r.args.Iterations == 0 || i < r.args.Iterations; i++ {
+		if !r.waitWhilePaused() {
+			return
+		}
+		if r.args.Duration > 0 && r.activeTime(lt) > r.args.Duration {
+			return
+		}
+		if r.args.MaxRequests > 0 && lt.sent.Add(1) > r.args.MaxRequests {
+			return
+		}
+
+		if r.args.Scenario != nil {
+			if !r.runScenario(lt, client, hooks, results) {
+				return
+			}
+			continue
+		}
+
+		result := r.execute(lt, r.lanes[0], client)
+		if r.cancelled(result) {
+			return
+		}
+		if r.args.Mode == ModeLongPoll {
+			if !lastPoll.IsZero() {
+				result.Reconnect = result.Timestamp.Sub(lastPoll) + result.Connect + result.TLSHandshake
+			}
+			lastPoll = result.Timestamp.Add(result.Latency)
+		}
+		r.deliver(results, result)
+	}
+}
@@ -0,0 +1,58 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// waitPollInterval is how often the target is polled until it's ready, with -wait_for_target.
+const waitPollInterval = time.Second
+
+// waitForTarget polls the first target of each lane until it's ready, with -wait_for_target, so
+// a target still starting up isn't counted as failing. A target is ready once it responds with
+// a status below 500, so e.g. a 401 without credentials counts as ready.
+func (r *Runner) waitForTarget() error {
+	if r.args.WaitForTarget <= 0 {
+		return nil
+	}
+
+	began := time.Now()
+	deadline := began.Add(r.args.WaitForTarget)
+	fmt.Fprintf(r.console, "Waiting up to %s for the target to be ready...\n", r.args.WaitForTarget)
+	for _, l := range r.lanes {
+		target := l.allTargets()[0].render(r.rand, nil)
+		for {
+			err := r.pollTarget(target, deadline)
+			if err == nil {
+				break
+			}
+			if time.Until(deadline) < waitPollInterval {
+				return fmt.Errorf("target not ready after %s: %s", r.args.WaitForTarget, err)
+			}
+			time.Sleep(waitPollInterval)
+		}
+	}
+	fmt.Fprintf(r.console, "Target ready after %s\n", time.Since(began).Round(time.Millisecond))
+	return nil
+}
+
+func (r *Runner) pollTarget(target string, deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(r.ctx, deadline)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	r.setHeaders(req, nil)
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 500 {
+		return fmt.Errorf("status %s", res.Status)
+	}
+	return nil
+}
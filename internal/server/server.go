@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	DistributionFixed       = "fixed"
+	DistributionUniform     = "uniform"
+	DistributionNormal      = "normal"
+	DistributionExponential = "exponential"
+)
+
+type Config struct {
+	Port          int
+	Latency       time.Duration // Mean latency added to each response
+	LatencyJitter time.Duration // Spread of the latency for the uniform and normal distributions
+	Distribution  string        // One of fixed, uniform, normal or exponential
+	ErrorRate     float64       // Fraction of requests to fail, between 0 and 1
+	ErrorCode     int
+	ResponseSize  int // Size of successful response bodies in bytes
+}
+
+// Server is a dummy HTTP server with configurable latency, errors and response size, for
+// validating and demoing the load tester without any external infrastructure.
+type Server struct {
+	cfg  Config
+	body []byte
+}
+
+func New(cfg Config) (*Server, error) {
+	switch cfg.Distribution {
+	case DistributionFixed, DistributionUniform, DistributionNormal, DistributionExponential:
+	default:
+		return nil, fmt.Errorf("unknown latency distribution %q", cfg.Distribution)
+	}
+	if cfg.ErrorCode < 100 || cfg.ErrorCode > 999 {
+		return nil, fmt.Errorf("invalid error code %d", cfg.ErrorCode)
+	}
+
+	return &Server{
+		cfg:  cfg,
+		body: bytes.Repeat([]byte("x"), cfg.ResponseSize),
+	}, nil
+}
+
+func (s *Server) ListenAndServe() error {
+	fmt.Printf("Listening on :%d\n", s.cfg.Port)
+	return http.ListenAndServe(":"+strconv.Itoa(s.cfg.Port), s)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-time.After(s.latency()):
+	case <-r.Context().Done():
+		return
+	}
+
+	if s.cfg.ErrorRate > 0 && rand.Float64() < s.cfg.ErrorRate {
+		w.WriteHeader(s.cfg.ErrorCode)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(s.body)))
+	w.Write(s.body)
+}
+
+func (s *Server) latency() time.Duration {
+	var d time.Duration
+	switch s.cfg.Distribution {
+	case DistributionFixed:
+		d = s.cfg.Latency
+	case DistributionUniform:
+		d = s.cfg.Latency - s.cfg.LatencyJitter + time.Duration(rand.Int63n(int64(2*s.cfg.LatencyJitter)+1))
+	case DistributionNormal:
+		d = s.cfg.Latency + time.Duration(rand.NormFloat64()*float64(s.cfg.LatencyJitter))
+	case DistributionExponential:
+		d = time.Duration(rand.ExpFloat64() * float64(s.cfg.Latency))
+	}
+
+	return max(d, 0)
+}
@@ -0,0 +1,62 @@
+package server_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nfiacco/loadtester/internal/server"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	s, err := server.New(server.Config{
+		Latency:      20 * time.Millisecond,
+		Distribution: server.DistributionFixed,
+		ErrorCode:    http.StatusServiceUnavailable,
+		ResponseSize: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	start := time.Now()
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("got: %v, want at least 20ms", elapsed)
+	}
+	if got, want := len(body), 100; got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
+
+func TestServerErrorRate(t *testing.T) {
+	t.Parallel()
+	s, err := server.New(server.Config{
+		Distribution: server.DistributionFixed,
+		ErrorRate:    1,
+		ErrorCode:    http.StatusServiceUnavailable,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got, want := w.Code, http.StatusServiceUnavailable; got != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
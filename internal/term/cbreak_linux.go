@@ -0,0 +1,34 @@
+package term
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// EnableCbreak puts the terminal in cbreak mode, so keypresses can be read as they happen without
+// waiting for a newline and aren't echoed. Output processing is left alone. The returned function
+// restores the previous mode.
+func EnableCbreak(fd int) (func() error, error) {
+	var old syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, &old); err != nil {
+		return nil, err
+	}
+
+	t := old
+	t.Lflag &^= syscall.ICANON | syscall.ECHO
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, syscall.TCSETS, &t); err != nil {
+		return nil, err
+	}
+
+	return func() error { return ioctl(fd, syscall.TCSETS, &old) }, nil
+}
+
+func ioctl(fd int, req uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package term
+
+// EnableCbreak is a no-op on this platform, so keypresses are only read once enter is pressed.
+func EnableCbreak(fd int) (func() error, error) {
+	return func() error { return nil }, nil
+}
@@ -0,0 +1,13 @@
+package term
+
+import (
+	"os"
+	"syscall"
+)
+
+// IsTerminal reports whether f is attached to a terminal: it has terminal attributes, unlike
+// other character devices such as /dev/null.
+func IsTerminal(f *os.File) bool {
+	var t syscall.Termios
+	return ioctl(int(f.Fd()), syscall.TCGETS, &t) == nil
+}
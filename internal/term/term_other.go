@@ -0,0 +1,16 @@
+//go:build !linux
+
+package term
+
+import "os"
+
+// IsTerminal reports whether f is attached to a terminal. Without the terminal ioctls, it's any
+// character device, which includes e.g. /dev/null.
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode()&os.ModeCharDevice != 0
+}
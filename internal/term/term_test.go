@@ -0,0 +1,41 @@
+package term_test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"nfiacco/loadtester/internal/term"
+)
+
+func TestIsTerminal(t *testing.T) {
+	t.Parallel()
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	file, err := os.Create(filepath.Join(t.TempDir(), "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+
+	files := map[string]*os.File{"a file": file, "a pipe": pr}
+	// Elsewhere, any character device counts as a terminal.
+	if runtime.GOOS == "linux" {
+		files[os.DevNull] = devNull
+	}
+	for name, f := range files {
+		if term.IsTerminal(f) {
+			t.Errorf("got: %s is a terminal, want: not", name)
+		}
+	}
+}